@@ -18,6 +18,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/linkedin/goavro"
 	"github.com/pkg/errors"
 )
@@ -36,7 +37,9 @@ import (
 //
 // We map a SQL table schema to an Avro record with 1:1 mapping between table
 // columns and Avro fields. The type of the column is mapped to a native Avro
-// type as faithfully as possible. This is then used to make an "optional" Avro
+// type as faithfully as possible, using an Avro logical type (timestamp-micros,
+// decimal, date, uuid) where there is one, so that schema-aware consumers don't
+// have to parse strings. This is then used to make an "optional" Avro
 // field for that column by unioning with null and explicitly specifying null as
 // default, regardless of whether the sql column allows NULLs. This may seem an
 // odd choice, but it allows for all adjacent Avro schemas for a given SQL table
@@ -58,6 +61,7 @@ const (
 	avroSchemaBoolean = `boolean`
 	avroSchemaBytes   = `bytes`
 	avroSchemaDouble  = `double`
+	avroSchemaInt     = `int`
 	avroSchemaLong    = `long`
 	avroSchemaNull    = `null`
 	avroSchemaString  = `string`
@@ -68,6 +72,11 @@ type avroLogicalType struct {
 	LogicalType string         `json:"logicalType"`
 	Precision   int            `json:"precision,omitempty"`
 	Scale       int            `json:"scale,omitempty"`
+
+	// annotationOnly is set for logical types that our avro library doesn't
+	// implement. It encodes them as their underlying type, so the logical type
+	// is only an annotation in the schema for consumers that understand it.
+	annotationOnly bool
 }
 
 func avroUnionKey(t avroSchemaType) string {
@@ -75,6 +84,9 @@ func avroUnionKey(t avroSchemaType) string {
 	case string:
 		return s
 	case avroLogicalType:
+		if s.annotationOnly {
+			return avroUnionKey(s.SchemaType)
+		}
 		return avroUnionKey(s.SchemaType) + `.` + s.LogicalType
 	case *avroRecord:
 		return s.Name
@@ -122,7 +134,7 @@ type avroMetadata map[string]interface{}
 // avroEnvelopeOpts controls which fields in avroEnvelopeRecord are set.
 type avroEnvelopeOpts struct {
 	updatedField, resolvedField bool
-	afterField                  bool
+	beforeField, afterField     bool
 }
 
 // avroEnvelopeRecord is an `avroRecord` that wraps a changed SQL row and some
@@ -208,6 +220,29 @@ func columnDescToAvroSchema(colDesc *sqlbase.ColumnDescriptor) (*avroSchemaField
 		schema.decodeFn = func(x interface{}) (tree.Datum, error) {
 			return tree.MakeDTimestampTZ(x.(time.Time), time.Microsecond), nil
 		}
+	case sqlbase.ColumnType_DATE:
+		avroType = avroLogicalType{
+			SchemaType:  avroSchemaInt,
+			LogicalType: `date`,
+		}
+		schema.encodeFn = func(d tree.Datum) (interface{}, error) {
+			return timeutil.Unix(int64(*d.(*tree.DDate))*tree.SecondsInDay, 0), nil
+		}
+		schema.decodeFn = func(x interface{}) (tree.Datum, error) {
+			return tree.NewDDateFromTime(x.(time.Time), time.UTC), nil
+		}
+	case sqlbase.ColumnType_UUID:
+		avroType = avroLogicalType{
+			SchemaType:     avroSchemaString,
+			LogicalType:    `uuid`,
+			annotationOnly: true,
+		}
+		schema.encodeFn = func(d tree.Datum) (interface{}, error) {
+			return d.(*tree.DUuid).UUID.String(), nil
+		}
+		schema.decodeFn = func(x interface{}) (tree.Datum, error) {
+			return tree.ParseDUuidFromString(x.(string))
+		}
 	case sqlbase.ColumnType_DECIMAL:
 		if colDesc.Type.Precision == 0 {
 			return nil, errors.Errorf(
@@ -464,6 +499,21 @@ func envelopeToAvroSchema(
 		}
 		schema.Fields = append(schema.Fields, afterField)
 	}
+	if opts.beforeField {
+		if after == nil {
+			return nil, errors.New(`before field requires an after schema`)
+		}
+		// The previous version of the row has the same schema, which was
+		// already defined by the after field. Avro only allows a named type to
+		// be defined once, so reference it by name.
+		schema.after = after
+		beforeField := &avroSchemaField{
+			Name:       `before`,
+			SchemaType: []avroSchemaType{avroSchemaNull, after.Name},
+			Default:    nil,
+		}
+		schema.Fields = append(schema.Fields, beforeField)
+	}
 
 	schemaJSON, err := json.Marshal(schema)
 	if err != nil {
@@ -477,13 +527,24 @@ func envelopeToAvroSchema(
 }
 
 // BinaryFromRow encodes the given metadata and row data into avro's defined
-// binary format.
+// binary format. The previous version of the row is ignored unless the
+// envelope has a before field.
 func (r *avroEnvelopeRecord) BinaryFromRow(
-	buf []byte, meta avroMetadata, row sqlbase.EncDatumRow,
+	buf []byte, meta avroMetadata, prevRow, row sqlbase.EncDatumRow,
 ) ([]byte, error) {
 	native := map[string]interface{}{
 		`after`: nil,
 	}
+	if r.opts.beforeField {
+		native[`before`] = nil
+		if prevRow != nil {
+			beforeNative, err := r.after.nativeFromRow(prevRow)
+			if err != nil {
+				return nil, err
+			}
+			native[`before`] = goavro.Union(avroUnionKey(&r.after.avroRecord), beforeNative)
+		}
+	}
 	if r.opts.updatedField {
 		native[`updated`] = nil
 		if u, ok := meta[`updated`]; ok {
@@ -150,6 +150,10 @@ func avroSchemaToColDesc(
 		switch t[`logicalType`] {
 		case `timestamp-micros`:
 			colDesc.Type = sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_TIMESTAMP}
+		case `date`:
+			colDesc.Type = sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_DATE}
+		case `uuid`:
+			colDesc.Type = sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_UUID}
 		case `decimal`:
 			colDesc.Type = sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_DECIMAL}
 			if p, ok := t[`precision`]; ok {
@@ -197,9 +201,9 @@ func TestAvroSchema(t *testing.T) {
 	for semTypeID, semTypeName := range sqlbase.ColumnType_SemanticType_name {
 		typ := sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_SemanticType(semTypeID)}
 		switch typ.SemanticType {
-		case sqlbase.ColumnType_DATE, sqlbase.ColumnType_INTERVAL, sqlbase.ColumnType_TIMESTAMPTZ,
+		case sqlbase.ColumnType_INTERVAL, sqlbase.ColumnType_TIMESTAMPTZ,
 			sqlbase.ColumnType_COLLATEDSTRING, sqlbase.ColumnType_NAME, sqlbase.ColumnType_OID,
-			sqlbase.ColumnType_UUID, sqlbase.ColumnType_ARRAY, sqlbase.ColumnType_INET,
+			sqlbase.ColumnType_ARRAY, sqlbase.ColumnType_INET,
 			sqlbase.ColumnType_TIME, sqlbase.ColumnType_JSONB, sqlbase.ColumnType_BIT,
 			sqlbase.ColumnType_TUPLE:
 			continue
@@ -12,8 +12,10 @@ import (
 	"context"
 	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/internal/client"
 	"github.com/cockroachdb/cockroach/pkg/jobs"
 	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
@@ -24,6 +26,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/pkg/errors"
 )
 
 var changefeedPollInterval = settings.RegisterNonNegativeDurationSetting(
@@ -43,6 +46,10 @@ const (
 type emitRow struct {
 	// datums is the new value of a changed table row.
 	datums sqlbase.EncDatumRow
+	// prevDatums, if non-nil, is the value of the row before this change. It's
+	// only filled in for `envelope=diff` and the `diff_only` option, and never
+	// for rows from a full table scan. See kvsToRows.
+	prevDatums sqlbase.EncDatumRow
 	// timestamp is the mvcc timestamp corresponding to the latest update in
 	// `row`.
 	timestamp hlc.Timestamp
@@ -52,6 +59,9 @@ type emitRow struct {
 	// tableDesc is a TableDescriptor for the table containing `datums`.
 	// It's valid for interpreting the row at `timestamp`.
 	tableDesc *sqlbase.TableDescriptor
+	// backfill is true if the row came from a full scan of its table, either
+	// the initial scan or one after a schema change.
+	backfill bool
 }
 
 type emitEntry struct {
@@ -70,17 +80,24 @@ type emitEntry struct {
 // kvsToRows gets changed kvs from a closure and converts them into sql rows. It
 // returns a closure that may be repeatedly called to advance the changefeed.
 // The returned closure is not threadsafe.
+//
+// With `envelope=diff` or the `diff_only` option, the previous version of each
+// changed row is read from db as of just before the change. Neither the poller
+// nor rangefeeds return it, so this costs a read per changed row.
 func kvsToRows(
+	db *client.DB,
 	leaseMgr *sql.LeaseManager,
 	details jobspb.ChangefeedDetails,
 	inputFn func(context.Context) (bufferEntry, error),
 ) func(context.Context) ([]emitEntry, error) {
 	rfCache := newRowFetcherCache(leaseMgr)
+	_, diffOnly := details.Opts[optDiffOnly]
+	withDiff := envelopeType(details.Opts[optEnvelope]) == optEnvelopeDiff || diffOnly
 
 	var kvs row.SpanKVFetcher
 	appendEmitEntryForKV := func(
 		ctx context.Context, output []emitEntry, kv roachpb.KeyValue, schemaTimestamp hlc.Timestamp,
-		bufferGetTimestamp time.Time,
+		backfill bool, bufferGetTimestamp time.Time,
 	) ([]emitEntry, error) {
 		// Reuse kvs to save allocations.
 		kvs.KVs = kvs.KVs[:0]
@@ -101,6 +118,31 @@ func kvsToRows(
 		if err != nil {
 			return nil, err
 		}
+
+		// The previous version is decoded with the descriptor of the change,
+		// which is what the encoder is given for both of them.
+		var prevDatums sqlbase.EncDatumRow
+		if withDiff && !backfill {
+			prevKV, err := prevValue(ctx, db, kv.Key, kv.Value.Timestamp)
+			if err != nil {
+				return nil, err
+			}
+			if prevKV.Value.IsPresent() {
+				kvs.KVs = append(kvs.KVs, prevKV)
+				if err := rf.StartScanFrom(ctx, &kvs); err != nil {
+					return nil, err
+				}
+				datums, _, _, err := rf.NextRow(ctx)
+				if err != nil {
+					return nil, err
+				}
+				if datums != nil && !rf.RowIsDeleted() {
+					prevDatums = append(sqlbase.EncDatumRow(nil), datums...)
+				}
+				kvs.KVs = kvs.KVs[:0]
+			}
+		}
+
 		// TODO(dan): Handle tables with multiple column families.
 		kvs.KVs = append(kvs.KVs, kv)
 		if err := rf.StartScanFrom(ctx, &kvs); err != nil {
@@ -118,7 +160,9 @@ func kvsToRows(
 				break
 			}
 			r.row.datums = append(sqlbase.EncDatumRow(nil), r.row.datums...)
+			r.row.prevDatums = prevDatums
 			r.row.deleted = rf.RowIsDeleted()
+			r.row.backfill = backfill
 			// TODO(mrtracy): This should likely be set to schemaTimestamp instead of
 			// the value timestamp, if schema timestamp is set. However, doing so
 			// seems to break some of the assumptions of our existing tests in subtle
@@ -142,12 +186,14 @@ func kvsToRows(
 				if log.V(3) {
 					log.Infof(ctx, "changed key %s %s", input.kv.Key, input.kv.Value.Timestamp)
 				}
+				// Only full scans set the schema timestamp.
 				schemaTimestamp := input.kv.Value.Timestamp
-				if input.schemaTimestamp != (hlc.Timestamp{}) {
+				backfill := input.schemaTimestamp != (hlc.Timestamp{})
+				if backfill {
 					schemaTimestamp = input.schemaTimestamp
 				}
 				output, err = appendEmitEntryForKV(
-					ctx, output, input.kv, schemaTimestamp, input.bufferGetTimestamp)
+					ctx, output, input.kv, schemaTimestamp, backfill, input.bufferGetTimestamp)
 				if err != nil {
 					return nil, err
 				}
@@ -165,10 +211,35 @@ func kvsToRows(
 	}
 }
 
+// prevValue returns the version of the key just before ts, which has no value
+// if the key didn't exist then.
+func prevValue(
+	ctx context.Context, db *client.DB, key roachpb.Key, ts hlc.Timestamp,
+) (roachpb.KeyValue, error) {
+	var prev roachpb.KeyValue
+	err := db.Txn(ctx, func(ctx context.Context, txn *client.Txn) error {
+		txn.SetFixedTimestamp(ctx, ts.Prev())
+		kv, err := txn.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		prev = roachpb.KeyValue{Key: kv.Key}
+		if kv.Value != nil {
+			prev.Value = *kv.Value
+		}
+		return nil
+	})
+	return prev, err
+}
+
 // emitEntries connects to a sink, receives rows from a closure, and repeatedly
 // emits them to the sink. It returns a closure that may be repeatedly called to
 // advance the changefeed and which returns span-level resolved timestamp
 // updates. The returned closure is not threadsafe.
+//
+// Schema changes aren't emitted to the sink, since every changeAggregator sees
+// them. If schemaChangeFn is non-nil, it's called with the table descriptor of
+// the first row of each new version of a table and the previous version.
 func emitEntries(
 	settings *cluster.Settings,
 	details jobspb.ChangefeedDetails,
@@ -178,11 +249,40 @@ func emitEntries(
 	inputFn func(context.Context) ([]emitEntry, error),
 	knobs TestingKnobs,
 	metrics *Metrics,
+	schemaChangeFn func(*sqlbase.TableDescriptor, sqlbase.DescriptorVersion) error,
 ) func(context.Context) ([]jobspb.ResolvedSpan, error) {
 	var scratch bufalloc.ByteAllocator
+	// partitionHintEncoder is nil unless the `partition_key` or
+	// `partition_by_column` option is set.
+	partitionHintEncoder := makePartitionHintEncoder(details.Opts)
+	// columnExcluder is nil unless the `exclude_columns` option is set.
+	columnExcluder := makeColumnExcluder(details.Opts)
+	// columnDiffer is nil unless the `diff_only` option is set.
+	columnDiffer := makeColumnDiffer(details.Opts)
+	// keyedEncoder is nil unless the format's values depend on the key.
+	keyedEncoder := keyedValueEncoder(encoder)
+	// schemaVersions tracks the latest schema version emitted for each table,
+	// so schemaChangeFn can be told when it changes.
+	schemaVersions := make(map[sqlbase.ID]sqlbase.DescriptorVersion)
+	// priorityTables is empty unless the `priority_tables` option is set.
+	priorityTables := makePriorityTables(details)
 	emitRowFn := func(ctx context.Context, row emitRow) error {
 		var keyCopy, valueCopy []byte
 
+		if _, ok := priorityTables[row.tableDesc.ID]; ok {
+			// The sink knows the table by its current name.
+			priorityTables[row.tableDesc.ID] = row.tableDesc.Name
+		}
+
+		if prev, ok := schemaVersions[row.tableDesc.ID]; !ok || prev < row.tableDesc.Version {
+			if ok && schemaChangeFn != nil {
+				if err := schemaChangeFn(row.tableDesc, prev); err != nil {
+					return err
+				}
+			}
+			schemaVersions[row.tableDesc.ID] = row.tableDesc.Version
+		}
+
 		if envelopeType(details.Opts[optEnvelope]) != optEnvelopeValueOnly {
 			encodedKey, err := encoder.EncodeKey(row.tableDesc, row.datums)
 			if err != nil {
@@ -190,9 +290,58 @@ func emitEntries(
 			}
 			scratch, keyCopy = scratch.Copy(encodedKey, 0 /* extraCap */)
 		}
+		var hint partitionHint
+		if partitionHintEncoder != nil {
+			var err error
+			hint, err = partitionHintEncoder.EncodePartitionHint(row.tableDesc, row.datums)
+			if err != nil {
+				return err
+			}
+			if hint.key != nil {
+				scratch, hint.key = scratch.Copy(hint.key, 0 /* extraCap */)
+			}
+		}
 
-		if !row.deleted && envelopeType(details.Opts[optEnvelope]) != optEnvelopeKeyOnly {
-			encodedValue, err := encoder.EncodeValue(row.tableDesc, row.datums, row.timestamp)
+		// A deletion has no value, unless the diff envelope has a previous
+		// version of the row to put in it or the format makes a deletion an
+		// event of its own.
+		envelope := envelopeType(details.Opts[optEnvelope])
+		hasPrev := envelope == optEnvelopeDiff && row.prevDatums != nil
+		isEvent := formatType(details.Opts[optFormat]) == optFormatCloudEvents
+		if (!row.deleted || hasPrev || isEvent) && envelope != optEnvelopeKeyOnly {
+			tableDesc, datums, prevDatums := row.tableDesc, row.datums, row.prevDatums
+			if row.deleted {
+				datums = nil
+			}
+			if columnExcluder != nil {
+				tableDesc, datums, prevDatums = columnExcluder.Project(tableDesc, datums, prevDatums)
+			}
+			if columnDiffer != nil {
+				var err error
+				tableDesc, datums, prevDatums, err = columnDiffer.Project(tableDesc, datums, prevDatums)
+				if err != nil {
+					return err
+				}
+			}
+			var encodedValue []byte
+			var err error
+			if keyedEncoder != nil {
+				key := keyCopy
+				if key == nil {
+					// The envelope leaves the key out of the message, but the
+					// value still needs it.
+					encodedKey, err := encoder.EncodeKey(row.tableDesc, row.datums)
+					if err != nil {
+						return err
+					}
+					scratch, key = scratch.Copy(encodedKey, 0 /* extraCap */)
+				}
+				encodedValue, err = keyedEncoder.EncodeKeyedValue(
+					tableDesc, key, datums, prevDatums, row.timestamp,
+				)
+			} else {
+				encodedValue, err = encoder.EncodeValue(tableDesc, datums, prevDatums, row.timestamp)
+			}
 			if err != nil {
 				return err
 			}
@@ -204,7 +353,13 @@ func emitEntries(
 				return err
 			}
 		}
-		if err := sink.EmitRow(
+		if partitionHintEncoder != nil {
+			if err := emitRowWithPartitionHint(
+				ctx, sink, row.tableDesc, keyCopy, valueCopy, hint, row.timestamp,
+			); err != nil {
+				return err
+			}
+		} else if err := sink.EmitRow(
 			ctx, row.tableDesc, keyCopy, valueCopy, row.timestamp,
 		); err != nil {
 			return err
@@ -219,9 +374,21 @@ func emitEntries(
 	// (There is a different SpanFrontier elsewhere for the entire changefeed.)
 	watchedSF := makeSpanFrontier(watchedSpans...)
 
+	// With the `high_water` option, the sink is told the frontier of the
+	// watched spans as it moves, starting from the statement time, to put in
+	// the metadata of the rows that follow. See HighWaterSetter.
+	_, highWater := details.Opts[optHighWater]
+	if highWater {
+		setSinkHighWater(sink, details.StatementTime)
+	}
+
 	var lastFlush time.Time
 	// TODO(dan): We could keep these in `watchedSF` to eliminate dups.
 	var resolvedSpans []jobspb.ResolvedSpan
+	// backfillTs, if non-zero, is the timestamp of the latest full scan that
+	// rows were emitted from. The sink is kept in backfill mode until
+	// everything up to it has been flushed.
+	var backfillTs hlc.Timestamp
 
 	return func(ctx context.Context) ([]jobspb.ResolvedSpan, error) {
 		inputs, err := inputFn(ctx)
@@ -241,12 +408,21 @@ func emitEntries(
 			metrics.ProcessingNanos.Inc(processingNanos)
 
 			if input.row.datums != nil {
+				if input.row.backfill {
+					if backfillTs == (hlc.Timestamp{}) {
+						setSinkBackfillMode(ctx, sink, true)
+					}
+					backfillTs.Forward(input.row.timestamp)
+				}
 				if err := emitRowFn(ctx, input.row); err != nil {
 					return nil, err
 				}
 			}
 			if input.resolved != nil {
-				_ = watchedSF.Forward(input.resolved.Span, input.resolved.Timestamp)
+				frontierChanged := watchedSF.Forward(input.resolved.Span, input.resolved.Timestamp)
+				if highWater && frontierChanged {
+					setSinkHighWater(sink, watchedSF.Frontier())
+				}
 				resolvedSpans = append(resolvedSpans, *input.resolved)
 			}
 		}
@@ -265,9 +441,15 @@ func emitEntries(
 		// is not changing), then this is sufficient and we don't have to do
 		// anything fancy with timers.
 		timeBetweenFlushes := changefeedPollInterval.Get(&settings.SV) / 5
-		if len(resolvedSpans) == 0 || timeutil.Since(lastFlush) < timeBetweenFlushes {
+		if len(resolvedSpans) == 0 {
 			return nil, nil
 		}
+		if timeutil.Since(lastFlush) < timeBetweenFlushes {
+			if len(priorityTables) == 0 {
+				return nil, nil
+			}
+			return flushPriorityTables(ctx, sink, priorityTables, watchedSF, &resolvedSpans)
+		}
 
 		// Make sure to flush the sink before forwarding resolved spans,
 		// otherwise, we could lose buffered messages and violate the
@@ -277,6 +459,10 @@ func emitEntries(
 			return nil, err
 		}
 		lastFlush = timeutil.Now()
+		if backfillTs != (hlc.Timestamp{}) && !watchedSF.Frontier().Less(backfillTs) {
+			setSinkBackfillMode(ctx, sink, false)
+			backfillTs = hlc.Timestamp{}
+		}
 		if knobs.AfterSinkFlush != nil {
 			if err := knobs.AfterSinkFlush(); err != nil {
 				return nil, err
@@ -288,6 +474,84 @@ func emitEntries(
 	}
 }
 
+// makePriorityTables returns the names of the tables named by the
+// `priority_tables` option, by ID.
+func makePriorityTables(details jobspb.ChangefeedDetails) map[sqlbase.ID]string {
+	priorityTables := make(map[sqlbase.ID]string)
+	opt, ok := details.Opts[optPriorityTables]
+	if !ok {
+		return priorityTables
+	}
+	for _, name := range parsePartitionKeyOpt(opt) {
+		for id, target := range details.Targets {
+			if target.StatementTimeName == name {
+				priorityTables[id] = name
+			}
+		}
+	}
+	return priorityTables
+}
+
+// validatePriorityTables checks that every table named by the
+// `priority_tables` option is watched by the changefeed.
+func validatePriorityTables(targets jobspb.ChangefeedTargets, opt string) error {
+	for _, name := range parsePartitionKeyOpt(opt) {
+		found := false
+		for _, target := range targets {
+			found = found || target.StatementTimeName == name
+		}
+		if !found {
+			return errors.Errorf(`%s table %q is not watched by the changefeed`,
+				optPriorityTables, name)
+		}
+	}
+	return nil
+}
+
+// flushPriorityTables is what emitEntries does with the resolved spans it has
+// accumulated when it isn't time for a full flush yet. The rows of the
+// priority tables are flushed by themselves, which lets their resolved spans
+// be forwarded right away, instead of waiting for the next full flush with the
+// rest. A resolved span only covers the rows of the table it's in, so
+// forwarding it after flushing that table keeps the at-least-once guarantee.
+// The resolved spans of the other tables are left in resolvedSpans.
+func flushPriorityTables(
+	ctx context.Context,
+	sink Sink,
+	priorityTables map[sqlbase.ID]string,
+	watchedSF *spanFrontier,
+	resolvedSpans *[]jobspb.ResolvedSpan,
+) ([]jobspb.ResolvedSpan, error) {
+	var ret, rest []jobspb.ResolvedSpan
+	flush := make(map[sqlbase.ID]struct{})
+	for _, resolved := range *resolvedSpans {
+		_, tableID, err := keys.DecodeTablePrefix(resolved.Span.Key)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := priorityTables[sqlbase.ID(tableID)]; !ok {
+			rest = append(rest, resolved)
+			continue
+		}
+		flush[sqlbase.ID(tableID)] = struct{}{}
+		ret = append(ret, resolved)
+	}
+	if len(ret) == 0 {
+		return nil, nil
+	}
+	frontiers, err := tableFrontiers(watchedSF)
+	if err != nil {
+		return nil, err
+	}
+	for id := range flush {
+		if err := flushTable(ctx, sink, priorityTables[id], frontiers[id]); err != nil {
+			return nil, err
+		}
+	}
+	*resolvedSpans = rest
+	return ret, nil
+}
+
 // checkpointResolvedTimestamp checkpoints a changefeed-level resolved timestamp
 // to the jobs record.
 func checkpointResolvedTimestamp(
@@ -325,6 +589,26 @@ func checkpointResolvedTimestamp(
 	return nil
 }
 
+// tableFrontiers returns the frontier of the spans of each table in sf, which
+// is the latest timestamp that every one of them is resolved to.
+func tableFrontiers(sf *spanFrontier) (map[sqlbase.ID]hlc.Timestamp, error) {
+	frontiers := make(map[sqlbase.ID]hlc.Timestamp)
+	var err error
+	sf.Entries(func(span roachpb.Span, ts hlc.Timestamp) {
+		if err != nil {
+			return
+		}
+		var tableID uint64
+		if _, tableID, err = keys.DecodeTablePrefix(span.Key); err != nil {
+			return
+		}
+		if frontier, ok := frontiers[sqlbase.ID(tableID)]; !ok || ts.Less(frontier) {
+			frontiers[sqlbase.ID(tableID)] = ts
+		}
+	})
+	return frontiers, err
+}
+
 // emitResolvedTimestamp emits a changefeed-level resolved timestamp to the
 // sink.
 func emitResolvedTimestamp(
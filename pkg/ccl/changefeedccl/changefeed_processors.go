@@ -10,6 +10,7 @@ package changefeedccl
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/jobs"
@@ -23,6 +24,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/storage"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/log/logtags"
 	"github.com/cockroachdb/cockroach/pkg/util/mon"
 	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
@@ -51,6 +53,14 @@ type changeAggregator struct {
 	// sink is the Sink to write rows to. Resolved timestamps are never written
 	// by changeAggregator.
 	sink Sink
+	// sinkBreaker, if non-nil, is the circuit breaker guarding the sink,
+	// which is released when the processor is closed.
+	sinkBreaker *sinkBreaker
+	// schemaChanges are the schema change markers of the tables whose schema
+	// changed since the last resolved span. They're forwarded to the
+	// changeFrontier along with resolved spans, which emits them, so that every
+	// change is only emitted once, not by every changeAggregator.
+	schemaChanges [][]byte
 	// tickFn is the workhorse behind Next(). It pulls kv changes from the
 	// buffer that poller fills, handles table leasing, converts them to rows,
 	// and writes them to the sink.
@@ -99,7 +109,9 @@ func newChangeAggregatorProcessor(
 	}
 
 	var err error
-	if ca.encoder, err = getEncoder(ca.spec.Feed.Opts); err != nil {
+	if ca.encoder, err = getEncoder(
+		ca.spec.Feed.Opts, ca.spec.Feed.Targets, flowCtx.EvalCtx.ClusterID, ca.spec.JobID,
+	); err != nil {
 		return nil, err
 	}
 
@@ -113,14 +125,28 @@ func (ca *changeAggregator) OutputTypes() []sqlbase.ColumnType {
 // Start is part of the RowSource interface.
 func (ca *changeAggregator) Start(ctx context.Context) context.Context {
 	ctx, ca.cancel = context.WithCancel(ctx)
+	ctx = withJobLogTag(ctx, ca.spec.JobID)
 	// StartInternal called at the beginning of the function because there are
 	// early returns if errors are detected.
 	ctx = ca.StartInternal(ctx, changeAggregatorProcName)
 
+	distSQLKnobs := ca.flowCtx.TestingKnobs()
+	knobs := changefeedTestingKnobs(&distSQLKnobs)
+
 	var err error
-	if ca.sink, err = getSink(
-		ca.spec.Feed.SinkURI, ca.spec.Feed.Opts, ca.spec.Feed.Targets, ca.flowCtx.Settings,
-	); err != nil {
+	if ca.sinkBreaker, err = acquireSinkBreaker(ca.spec.Feed.SinkURI, ca.spec.JobID); err != nil {
+		ca.MoveToDraining(err)
+		ca.cancel()
+		return ctx
+	}
+	if err = ca.sinkBreaker.call(ctx, func() error {
+		var err error
+		ca.sink, err = getSink(
+			ctx, ca.spec.Feed.SinkURI, ca.spec.Feed.Opts, ca.encoder, ca.spec.Feed.Targets,
+			ca.spec.JobID, ca.flowCtx.Settings, knobs,
+		)
+		return err
+	}); err != nil {
 		// Early abort in the case that there is an error creating the sink.
 		ca.MoveToDraining(err)
 		ca.cancel()
@@ -142,11 +168,28 @@ func (ca *changeAggregator) Start(ctx context.Context) context.Context {
 		}
 	}
 
+	if err := resumeSinkFromState(ctx, ca.sink, spans); err != nil {
+		ca.MoveToDraining(err)
+		ca.cancel()
+		return ctx
+	}
+
 	// The job registry has a set of metrics used to monitor the various jobs it
 	// runs. They're all stored as the `metric.Struct` interface because of
 	// dependency cycles.
 	metrics := ca.flowCtx.JobRegistry.MetricsStruct().Changefeed.(*Metrics)
+	setSinkMetrics(ca.sink, metrics, ca.flowCtx.EvalCtx.NodeID)
+	ca.sink = makeBreakerSink(ca.sink, ca.sinkBreaker)
 	ca.sink = makeMetricsSink(metrics, ca.sink)
+	// Only the change aggregators flush the sink, so this is where the flush
+	// lag is measured.
+	flushSLA, err := sinkFlushSLA(ca.spec.Feed.SinkURI)
+	if err != nil {
+		ca.MoveToDraining(err)
+		ca.cancel()
+		return ctx
+	}
+	ca.sink = makeSLASink(ca.sink, metrics, flushSLA)
 
 	buf := makeBuffer()
 	leaseMgr := ca.flowCtx.LeaseManager.(*sql.LeaseManager)
@@ -154,14 +197,11 @@ func (ca *changeAggregator) Start(ctx context.Context) context.Context {
 		ca.flowCtx.Settings, ca.flowCtx.ClientDB, ca.flowCtx.ClientDB.Clock(), ca.flowCtx.Gossip,
 		spans, ca.spec.Feed, initialHighWater, buf, leaseMgr, metrics,
 	)
-	rowsFn := kvsToRows(leaseMgr, ca.spec.Feed, buf.Get)
+	rowsFn := kvsToRows(ca.flowCtx.ClientDB, leaseMgr, ca.spec.Feed, buf.Get)
 
-	var knobs TestingKnobs
-	if cfKnobs, ok := ca.flowCtx.TestingKnobs().Changefeed.(*TestingKnobs); ok {
-		knobs = *cfKnobs
-	}
 	ca.tickFn = emitEntries(
-		ca.flowCtx.Settings, ca.spec.Feed, spans, ca.encoder, ca.sink, rowsFn, knobs, metrics)
+		ca.flowCtx.Settings, ca.spec.Feed, spans, ca.encoder, ca.sink, rowsFn, knobs, metrics,
+		ca.noteSchemaChange)
 
 	// Give errCh enough buffer both possible errors from supporting goroutines,
 	// but only the first one is ever used.
@@ -205,10 +245,9 @@ func (ca *changeAggregator) close() {
 			<-ca.pollerDoneCh
 		}
 		if ca.sink != nil {
-			if err := ca.sink.Close(); err != nil {
-				log.Warningf(ca.Ctx, `error closing sink. goroutines may have leaked: %v`, err)
-			}
+			closeSink(ca.Ctx, ca.sink)
 		}
+		ca.sinkBreaker.release()
 		ca.memAcc.Close(ca.Ctx)
 		ca.MemMonitor.Stop(ca.Ctx)
 	}
@@ -240,17 +279,80 @@ func (ca *changeAggregator) Next() (sqlbase.EncDatumRow, *distsqlrun.ProducerMet
 	return nil, ca.DrainHelper()
 }
 
+// noteSchemaChange records that the schema of a table changed from oldVersion
+// to the version of the given descriptor, to be forwarded to the
+// changeFrontier.
+func (ca *changeAggregator) noteSchemaChange(
+	table *sqlbase.TableDescriptor, oldVersion sqlbase.DescriptorVersion,
+) error {
+	marker, err := encodeSchemaChangeMarker(table, oldVersion, table.Version)
+	if err != nil {
+		return err
+	}
+	ca.schemaChanges = append(ca.schemaChanges, marker)
+	return nil
+}
+
 func (ca *changeAggregator) tick() error {
 	resolvedSpans, err := ca.tickFn(ca.Ctx)
 	if err != nil {
 		return err
 	}
 
-	for _, resolvedSpan := range resolvedSpans {
+	// The topics that the sink emitted to are forwarded to the changeFrontier
+	// along with resolved spans, if it restricts resolved timestamps to them.
+	var changedTopics []string
+	if len(resolvedSpans) > 0 {
+		changedTopics = takeSinkChangedTopics(ca.sink)
+	}
+	// Likewise with the data files that it completed, if it lists them in
+	// resolved timestamp files.
+	var completedFiles []string
+	if len(resolvedSpans) > 0 {
+		completedFiles = takeSinkCompletedFiles(ca.sink)
+	}
+	var schemaChanges [][]byte
+	if len(resolvedSpans) > 0 {
+		schemaChanges, ca.schemaChanges = ca.schemaChanges, nil
+	}
+
+	for i, resolvedSpan := range resolvedSpans {
 		resolvedBytes, err := protoutil.Marshal(&resolvedSpan)
 		if err != nil {
 			return err
 		}
+		if i == 0 {
+			// Tell the changeFrontier which topics were emitted to before it
+			// sees the resolved spans that cover them. This is piggybacked on
+			// the topic column of otherwise normal resolved span rows.
+			for _, topic := range changedTopics {
+				ca.resolvedSpanBuf.Push(sqlbase.EncDatumRow{
+					sqlbase.EncDatum{Datum: tree.NewDBytes(tree.DBytes(resolvedBytes))},
+					sqlbase.EncDatum{Datum: tree.NewDString(topic)}, // topic
+					sqlbase.EncDatum{Datum: tree.DNull},             // key
+					sqlbase.EncDatum{Datum: tree.DNull},             // value
+				})
+			}
+			// Likewise with the data files that were completed, on the key
+			// column.
+			for _, filename := range completedFiles {
+				ca.resolvedSpanBuf.Push(sqlbase.EncDatumRow{
+					sqlbase.EncDatum{Datum: tree.NewDBytes(tree.DBytes(resolvedBytes))},
+					sqlbase.EncDatum{Datum: tree.DNull},                            // topic
+					sqlbase.EncDatum{Datum: tree.NewDBytes(tree.DBytes(filename))}, // key
+					sqlbase.EncDatum{Datum: tree.DNull},                            // value
+				})
+			}
+			// And the schema changes, on the value column.
+			for _, marker := range schemaChanges {
+				ca.resolvedSpanBuf.Push(sqlbase.EncDatumRow{
+					sqlbase.EncDatum{Datum: tree.NewDBytes(tree.DBytes(resolvedBytes))},
+					sqlbase.EncDatum{Datum: tree.DNull},                          // topic
+					sqlbase.EncDatum{Datum: tree.DNull},                          // key
+					sqlbase.EncDatum{Datum: tree.NewDBytes(tree.DBytes(marker))}, // value
+				})
+			}
+		}
 		// Enqueue a row to be returned that indicates some span-level resolved
 		// timestamp has advanced. If any rows were queued in `sink`, they must
 		// be emitted first.
@@ -299,6 +401,20 @@ type changeFrontier struct {
 	// sink is the Sink to write resolved timestamps to. Rows are never written
 	// by changeFrontier.
 	sink Sink
+	// topicResolved, if non-nil, is the last resolved timestamp emitted to
+	// `sink` for the topic of each table, when it emits a resolved timestamp
+	// message for each topic.
+	topicResolved map[sqlbase.ID]hlc.Timestamp
+	// combineTopicResolved is whether `sink` puts the resolved timestamp of
+	// each topic in the changefeed's resolved timestamp messages.
+	combineTopicResolved bool
+	// sinkBreaker, if non-nil, is the circuit breaker guarding the sink,
+	// which is released when the processor is closed.
+	sinkBreaker *sinkBreaker
+	// schemaVersions is the latest version of each table, by name, whose
+	// schema change was emitted, so that the changes forwarded by every
+	// changeAggregator are only emitted once.
+	schemaVersions map[string]sqlbase.DescriptorVersion
 	// freqEmitResolved, if >= 0, is a lower bound on the duration between
 	// resolved timestamp emits.
 	freqEmitResolved time.Duration
@@ -306,10 +422,20 @@ type changeFrontier struct {
 	lastEmitResolved time.Time
 	// lastSlowSpanLog is the last time a slow span from `sf` was logged.
 	lastSlowSpanLog time.Time
+	// lifecycleMarkers is whether the `lifecycle_markers` option is set, and
+	// feedStarted whether the start marker has been emitted, possibly by an
+	// earlier run of the changefeed.
+	lifecycleMarkers bool
+	feedStarted      bool
 
 	// jobProgressedFn, if non-nil, is called to checkpoint the changefeed's
 	// progress in the corresponding system job entry.
 	jobProgressedFn func(context.Context, jobs.HighWaterProgressedFn) error
+	// sinkUnreachableJob, if non-nil, is the job when its running status says
+	// that the sink is unreachable. Rows are flushed to the sink before their
+	// spans are resolved, so the first checkpoint shows that it's reachable
+	// again and clears the running status.
+	sinkUnreachableJob *jobs.Job
 	// passthroughBuf, in some but not all flows, contains changed row data to
 	// pass through unchanged to the gateway node.
 	passthroughBuf encDatumRowBuffer
@@ -361,6 +487,7 @@ func newChangeFrontierProcessor(
 		return nil, err
 	}
 
+	_, cf.lifecycleMarkers = cf.spec.Feed.Opts[optLifecycleMarkers]
 	if r, ok := cf.spec.Feed.Opts[optResolvedTimestamps]; ok {
 		var err error
 		if r == `` {
@@ -374,7 +501,9 @@ func newChangeFrontierProcessor(
 	}
 
 	var err error
-	if cf.encoder, err = getEncoder(spec.Feed.Opts); err != nil {
+	if cf.encoder, err = getEncoder(
+		spec.Feed.Opts, spec.Feed.Targets, flowCtx.EvalCtx.ClusterID, spec.JobID,
+	); err != nil {
 		return nil, err
 	}
 
@@ -388,15 +517,28 @@ func (cf *changeFrontier) OutputTypes() []sqlbase.ColumnType {
 // Start is part of the RowSource interface.
 func (cf *changeFrontier) Start(ctx context.Context) context.Context {
 	cf.input.Start(ctx)
+	ctx = withJobLogTag(ctx, cf.spec.JobID)
 
 	// StartInternal called at the beginning of the function because there are
 	// early returns if errors are detected.
 	ctx = cf.StartInternal(ctx, changeFrontierProcName)
 
+	distSQLKnobs := cf.flowCtx.TestingKnobs()
+	knobs := changefeedTestingKnobs(&distSQLKnobs)
+
 	var err error
-	if cf.sink, err = getSink(
-		cf.spec.Feed.SinkURI, cf.spec.Feed.Opts, cf.spec.Feed.Targets, cf.flowCtx.Settings,
-	); err != nil {
+	if cf.sinkBreaker, err = acquireSinkBreaker(cf.spec.Feed.SinkURI, cf.spec.JobID); err != nil {
+		cf.MoveToDraining(err)
+		return ctx
+	}
+	if err = cf.sinkBreaker.call(ctx, func() error {
+		var err error
+		cf.sink, err = getSink(
+			ctx, cf.spec.Feed.SinkURI, cf.spec.Feed.Opts, cf.encoder, cf.spec.Feed.Targets,
+			cf.spec.JobID, cf.flowCtx.Settings, knobs,
+		)
+		return err
+	}); err != nil {
 		cf.MoveToDraining(err)
 		return ctx
 	}
@@ -409,6 +551,12 @@ func (cf *changeFrontier) Start(ctx context.Context) context.Context {
 	// runs. They're all stored as the `metric.Struct` interface because of
 	// dependency cycles.
 	cf.metrics = cf.flowCtx.JobRegistry.MetricsStruct().Changefeed.(*Metrics)
+	setSinkMetrics(cf.sink, cf.metrics, cf.flowCtx.EvalCtx.NodeID)
+	if sinkEmitsTopicResolved(cf.sink) {
+		cf.topicResolved = make(map[sqlbase.ID]hlc.Timestamp)
+	}
+	cf.combineTopicResolved = sinkCombinesTopicResolved(cf.sink)
+	cf.sink = makeBreakerSink(cf.sink, cf.sinkBreaker)
 	cf.sink = makeMetricsSink(cf.metrics, cf.sink)
 
 	if cf.spec.JobID != 0 {
@@ -418,6 +566,14 @@ func (cf *changeFrontier) Start(ctx context.Context) context.Context {
 			return ctx
 		}
 		cf.jobProgressedFn = job.HighWaterProgressed
+		if strings.HasPrefix(job.Progress().RunningStatus, sinkUnreachableStatusPrefix) {
+			cf.sinkUnreachableJob = job
+		}
+		// The start marker is emitted before the high water that it's for is
+		// checkpointed, so a checkpointed one means it was.
+		if h := job.Progress().GetHighWater(); h != nil {
+			cf.feedStarted = !h.Less(cf.spec.Feed.StatementTime)
+		}
 	}
 
 	cf.metrics.mu.Lock()
@@ -444,10 +600,9 @@ func (cf *changeFrontier) Start(ctx context.Context) context.Context {
 func (cf *changeFrontier) close() {
 	if cf.InternalClose() {
 		if cf.sink != nil {
-			if err := cf.sink.Close(); err != nil {
-				log.Warningf(cf.Ctx, `error closing sink. goroutines may have leaked: %v`, err)
-			}
+			closeSink(cf.Ctx, cf.sink)
 		}
+		cf.sinkBreaker.release()
 		cf.memAcc.Close(cf.Ctx)
 		cf.MemMonitor.Stop(cf.Ctx)
 	}
@@ -483,6 +638,24 @@ func (cf *changeFrontier) Next() (sqlbase.EncDatumRow, *distsqlrun.ProducerMetad
 			continue
 		}
 
+		if !row[1].IsNull() {
+			if err := cf.noteChangedTopic(row[1]); err != nil {
+				cf.MoveToDraining(err)
+				break
+			}
+		}
+		if !row[2].IsNull() {
+			if err := cf.noteCompletedFile(row[2]); err != nil {
+				cf.MoveToDraining(err)
+				break
+			}
+		}
+		if !row[3].IsNull() {
+			if err := cf.noteSchemaChange(cf.Ctx, row[3]); err != nil {
+				cf.MoveToDraining(err)
+				break
+			}
+		}
 		if err := cf.noteResolvedSpan(row[0]); err != nil {
 			cf.MoveToDraining(err)
 			break
@@ -491,6 +664,65 @@ func (cf *changeFrontier) Next() (sqlbase.EncDatumRow, *distsqlrun.ProducerMetad
 	return nil, cf.DrainHelper()
 }
 
+// noteChangedTopic records that a changeAggregator has emitted rows to the
+// given topic since its last resolved span.
+func (cf *changeFrontier) noteChangedTopic(d sqlbase.EncDatum) error {
+	if err := d.EnsureDecoded(&changefeedResultTypes[1], &cf.a); err != nil {
+		return err
+	}
+	topic, ok := d.Datum.(*tree.DString)
+	if !ok {
+		return errors.Errorf(`unexpected datum type %T: %s`, d.Datum, d.Datum)
+	}
+	noteSinkChangedTopic(cf.sink, string(*topic))
+	return nil
+}
+
+// noteCompletedFile records that a changeAggregator has completed the given
+// data file since its last resolved span.
+func (cf *changeFrontier) noteCompletedFile(d sqlbase.EncDatum) error {
+	if err := d.EnsureDecoded(&changefeedResultTypes[2], &cf.a); err != nil {
+		return err
+	}
+	filename, ok := d.Datum.(*tree.DBytes)
+	if !ok {
+		return errors.Errorf(`unexpected datum type %T: %s`, d.Datum, d.Datum)
+	}
+	noteSinkCompletedFile(cf.sink, string(*filename))
+	return nil
+}
+
+// noteSchemaChange emits a schema change forwarded by a changeAggregator,
+// unless it already was. It's flushed right away, because nothing else
+// flushes the changeFrontier's sink.
+func (cf *changeFrontier) noteSchemaChange(ctx context.Context, d sqlbase.EncDatum) error {
+	if err := d.EnsureDecoded(&changefeedResultTypes[3], &cf.a); err != nil {
+		return err
+	}
+	marker, ok := d.Datum.(*tree.DBytes)
+	if !ok {
+		return errors.Errorf(`unexpected datum type %T: %s`, d.Datum, d.Datum)
+	}
+	table, oldVersion, err := decodeSchemaChangeMarker([]byte(*marker))
+	if err != nil {
+		return err
+	}
+	if cf.schemaVersions == nil {
+		cf.schemaVersions = make(map[string]sqlbase.DescriptorVersion)
+	}
+	if emitted, ok := cf.schemaVersions[table.Name]; ok && emitted >= table.Version {
+		return nil
+	}
+	if err := cf.sink.EmitSchemaChange(ctx, table, oldVersion, table.Version); err != nil {
+		return err
+	}
+	if err := cf.sink.Flush(ctx, hlc.Timestamp{}); err != nil {
+		return err
+	}
+	cf.schemaVersions[table.Name] = table.Version
+	return nil
+}
+
 func (cf *changeFrontier) noteResolvedSpan(d sqlbase.EncDatum) error {
 	if err := d.EnsureDecoded(&changefeedResultTypes[0], &cf.a); err != nil {
 		return err
@@ -512,19 +744,40 @@ func (cf *changeFrontier) noteResolvedSpan(d sqlbase.EncDatum) error {
 			cf.metrics.mu.resolved[cf.metricsID] = newResolved
 		}
 		cf.metrics.mu.Unlock()
+		if err := cf.maybeEmitFeedStart(newResolved); err != nil {
+			return err
+		}
 		if err := checkpointResolvedTimestamp(cf.Ctx, cf.jobProgressedFn, cf.sf); err != nil {
 			return err
 		}
+		if cf.sinkUnreachableJob != nil {
+			err := updateSinkRunningStatus(cf.Ctx, cf.sinkUnreachableJob, nil /* pingErr */)
+			if err != nil {
+				return err
+			}
+			cf.sinkUnreachableJob = nil
+		}
 		sinceEmitted := newResolved.GoTime().Sub(cf.lastEmitResolved)
 		if cf.freqEmitResolved != emitNoResolved && sinceEmitted >= cf.freqEmitResolved {
 			// Keeping this after the checkpointResolvedTimestamp call will avoid
 			// some duplicates if a restart happens.
+			if cf.combineTopicResolved {
+				if err := cf.setCombinedTopicResolved(); err != nil {
+					return err
+				}
+			}
 			if err := emitResolvedTimestamp(cf.Ctx, cf.encoder, cf.sink, newResolved); err != nil {
 				return err
 			}
 			cf.lastEmitResolved = newResolved.GoTime()
 		}
 	}
+	// A table's frontier can move without the changefeed's moving.
+	if cf.topicResolved != nil && cf.freqEmitResolved != emitNoResolved {
+		if err := cf.maybeEmitTopicResolved(cf.Ctx); err != nil {
+			return err
+		}
+	}
 
 	// Potentially log the most behind span in the frontier for debugging.
 	slownessThreshold := 10 * changefeedPollInterval.Get(&cf.flowCtx.Settings.SV)
@@ -557,6 +810,65 @@ func (cf *changeFrontier) noteResolvedSpan(d sqlbase.EncDatum) error {
 	return nil
 }
 
+// maybeEmitFeedStart emits the start marker, for the `lifecycle_markers` option,
+// once the frontier reaches the statement time, which means that the initial
+// scan is complete. It's emitted before the frontier is checkpointed, so that a
+// restart can duplicate it but not lose it.
+func (cf *changeFrontier) maybeEmitFeedStart(resolved hlc.Timestamp) error {
+	if !cf.lifecycleMarkers || cf.feedStarted || resolved.Less(cf.spec.Feed.StatementTime) {
+		return nil
+	}
+	err := emitFeedLifecycle(cf.Ctx, cf.sink, feedPhaseStart, cf.spec.Feed.StatementTime)
+	if err != nil {
+		return err
+	}
+	cf.feedStarted = true
+	return nil
+}
+
+// maybeEmitTopicResolved writes the resolved timestamp file of each topic whose
+// table's frontier is at least freqEmitResolved past the last one written.
+func (cf *changeFrontier) maybeEmitTopicResolved(ctx context.Context) error {
+	resolvedByTable, err := tableFrontiers(cf.sf)
+	if err != nil {
+		return err
+	}
+	for tableID, resolved := range resolvedByTable {
+		target, ok := cf.spec.Feed.Targets[tableID]
+		if !ok {
+			continue
+		}
+		last := cf.topicResolved[tableID]
+		if !last.Less(resolved) || resolved.GoTime().Sub(last.GoTime()) < cf.freqEmitResolved {
+			continue
+		}
+		if err := emitSinkTopicResolvedTimestamp(
+			ctx, cf.sink, cf.encoder, target.StatementTimeName, resolved,
+		); err != nil {
+			return err
+		}
+		cf.topicResolved[tableID] = resolved
+	}
+	return nil
+}
+
+// setCombinedTopicResolved hands the frontier of each topic's table to the sink
+// for the resolved timestamp message about to be emitted.
+func (cf *changeFrontier) setCombinedTopicResolved() error {
+	resolvedByTable, err := tableFrontiers(cf.sf)
+	if err != nil {
+		return err
+	}
+	topicResolved := make(map[string]hlc.Timestamp, len(resolvedByTable))
+	for tableID, resolved := range resolvedByTable {
+		if target, ok := cf.spec.Feed.Targets[tableID]; ok {
+			topicResolved[target.StatementTimeName] = resolved
+		}
+	}
+	setSinkCombinedTopicResolved(cf.sink, topicResolved)
+	return nil
+}
+
 // ConsumerDone is part of the RowSource interface.
 func (cf *changeFrontier) ConsumerDone() {
 	cf.MoveToDraining(nil /* err */)
@@ -567,3 +879,42 @@ func (cf *changeFrontier) ConsumerClosed() {
 	// The consumer is done, Next() will not be called again.
 	cf.InternalClose()
 }
+
+// sinkDrainTimeout bounds how long closing a processor waits for its sink to
+// deliver what it was given.
+const sinkDrainTimeout = 5 * time.Second
+
+// closeSink closes the sink of a processor that's shutting down. It gives the
+// sink up to sinkDrainTimeout to deliver what it was given and logs what it
+// couldn't, which is emitted again if the changefeed is resumed, unless it was
+// already covered by a resolved timestamp. The processor's context is usually
+// canceled by then, so draining uses one of its own with the same log tags.
+func closeSink(procCtx context.Context, s Sink) {
+	ctx := logtags.WithTags(context.Background(), logtags.FromContext(procCtx))
+	ctx, cancel := context.WithTimeout(ctx, sinkDrainTimeout)
+	defer cancel()
+	undelivered, err := closeAndDrainSink(ctx, s)
+	if err != nil {
+		log.Warningf(ctx, `error closing sink. goroutines may have leaked: %v`, err)
+	}
+	if len(undelivered) > 0 {
+		log.Warningf(ctx, `closed sink with %d messages that may not have been delivered`,
+			len(undelivered))
+		if log.V(2) {
+			for _, ref := range undelivered {
+				log.Infof(ctx, `undelivered: topic %s key %s bucket %s`, ref.Topic, ref.Key, ref.Bucket)
+			}
+		}
+	}
+}
+
+// withJobLogTag adds the changefeed's job ID as a log tag to ctx. The sinks log
+// with the contexts they're given, so this lets their log lines be attributed
+// to a changefeed when several are running. Sinkless changefeeds don't have a
+// job ID and are left untagged.
+func withJobLogTag(ctx context.Context, jobID int64) context.Context {
+	if jobID == 0 {
+		return ctx
+	}
+	return logtags.AddTag(ctx, "job", jobID)
+}
@@ -10,8 +10,11 @@ package changefeedccl
 
 import (
 	"context"
+	"net/url"
 	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/ccl/backupccl"
@@ -39,13 +42,27 @@ func init() {
 
 type envelopeType string
 type formatType string
+type resolvedFormatType string
 
 const (
 	optConfluentSchemaRegistry = `confluent_schema_registry`
 	optCursor                  = `cursor`
+	optDeadLetterSink          = `dead_letter_sink`
+	optDiffOnly                = `diff_only`
 	optEnvelope                = `envelope`
+	optExcludeColumns          = `exclude_columns`
+	optFlatten                 = `flatten`
 	optFormat                  = `format`
+	optHighWater               = `high_water`
+	optKeyFormat               = `key_format`
+	optLifecycleMarkers        = `lifecycle_markers`
+	optNumAsString             = `num_as_string`
+	optPartitionByColumn       = `partition_by_column`
+	optPartitionKey            = `partition_key`
+	optPriorityTables          = `priority_tables`
+	optResolvedFormat          = `resolved_format`
 	optResolvedTimestamps      = `resolved`
+	optSource                  = `source`
 	optUpdatedTimestamps       = `updated`
 
 	optEnvelopeDiff      envelopeType = `diff`
@@ -53,23 +70,120 @@ const (
 	optEnvelopeRow       envelopeType = `row`
 	optEnvelopeValueOnly envelopeType = `value_only`
 
-	optFormatJSON formatType = `json`
-	optFormatAvro formatType = `experimental_avro`
-
-	sinkParamBucketSize       = `bucket_size`
-	sinkParamSchemaTopic      = `schema_topic`
-	sinkParamTopicPrefix      = `topic_prefix`
-	sinkSchemeBuffer          = ``
-	sinkSchemeExperimentalSQL = `experimental-sql`
-	sinkSchemeKafka           = `kafka`
+	optFormatJSON        formatType = `json`
+	optFormatAvro        formatType = `experimental_avro`
+	optFormatCloudEvents formatType = `experimental_cloudevents`
+	optFormatRaw         formatType = `raw`
+	optFormatProtobuf    formatType = `protobuf`
+
+	optResolvedFormatWrapped resolvedFormatType = `wrapped`
+	optResolvedFormatDecimal resolvedFormatType = `decimal`
+	optResolvedFormatNanos   resolvedFormatType = `nanos`
+	optResolvedFormatISO8601 resolvedFormatType = `iso8601`
+
+	sinkParamAcksTimeout               = `acks_timeout`
+	sinkParamAtomicWrites              = `atomic_writes`
+	sinkParamBackfillWriteConcurrency  = `backfill_write_concurrency`
+	sinkParamBackpressureTimeout       = `backpressure_timeout`
+	sinkParamBreakerCooldown           = `breaker_cooldown`
+	sinkParamBreakerFailures           = `breaker_failures`
+	sinkParamBucketSize                = `bucket_size`
+	sinkParamBufferPoolMaxBytes        = `buffer_pool_max_bytes`
+	sinkParamCompression               = `compression`
+	sinkParamControlTopic              = `control_topic`
+	sinkParamDebugDir                  = `debug_dir`
+	sinkParamDebugMaxFileSize          = `debug_max_file_size`
+	sinkParamDebugSampleRate           = `debug_sample_rate`
+	sinkParamDiagnoseErrors            = `diagnose_errors`
+	sinkParamDialTimeout               = `dial_timeout`
+	sinkParamExtraBootstrapServers     = `extra_bootstrap_servers`
+	sinkParamExtraClusterFailurePolicy = `extra_cluster_failure_policy`
+	sinkParamFlushBytes                = `flush_bytes`
+	sinkParamFlushSLA                  = `flush_sla`
+	sinkParamHeaderPrefix              = `header.`
+	sinkParamHMACHeader                = `hmac_header`
+	sinkParamHMACSecret                = `hmac_secret`
+	sinkParamIdempotentFlush           = `idempotent_flush`
+	sinkParamIdleFlushInterval         = `idle_flush_interval`
+	sinkParamJobPrefix                 = `job_prefix`
+	sinkParamManifest                  = `manifest`
+	sinkParamMaxBytesPerSec            = `max_bytes_per_sec`
+	sinkParamMaxFileAge                = `max_file_age`
+	sinkParamMaxInflightRequests       = `max_inflight_requests`
+	sinkParamMaxLen                    = `max_len`
+	sinkParamMaxRowsPerSec             = `max_rows_per_sec`
+	sinkParamMaxStatementBytes         = `max_statement_bytes`
+	sinkParamMaxValueBytes             = `max_value_bytes`
+	sinkParamMaxValuePolicy            = `max_value_policy`
+	sinkParamMetadata                  = `metadata`
+	sinkParamMinResolvedInterval       = `min_resolved_interval`
+	sinkParamOAuthClientID             = `oauth_client_id`
+	sinkParamOAuthClientSecret         = `oauth_client_secret`
+	sinkParamOAuthScope                = `oauth_scope`
+	sinkParamOAuthTokenURL             = `oauth_token_url`
+	sinkParamPartitionBy               = `partition_by`
+	sinkParamPartitionColumn           = `partition_column`
+	sinkParamPartitionKeyBuckets       = `partition_key_buckets`
+	sinkParamPartitionKeySalt          = `partition_key_salt`
+	sinkParamPartitioner               = `partitioner`
+	sinkParamReadTimeout               = `read_timeout`
+	sinkParamRecordSeparator           = `record_separator`
+	sinkParamRelaxedOrderingTopics     = `relaxed_ordering_topics`
+	sinkParamResolvedBucketStart       = `resolved_bucket_start`
+	sinkParamResolvedChangedTopicsOnly = `resolved_changed_topics_only`
+	sinkParamResolvedFileListing       = `resolved_file_listing`
+	sinkParamResolvedGranularity       = `resolved_granularity`
+	sinkParamResolvedSuffix            = `resolved_suffix`
+	sinkParamResolvedTopic             = `resolved_topic`
+	sinkParamRetryBudget               = `retry_budget`
+	sinkParamSASLEnabled               = `sasl_enabled`
+	sinkParamSASLHandshake             = `sasl_handshake`
+	sinkParamSASLMechanism             = `sasl_mechanism`
+	sinkParamSASLPassword              = `sasl_password`
+	sinkParamSASLUser                  = `sasl_user`
+	sinkParamSchemaTopic               = `schema_topic`
+	sinkParamSchemaVersionHeader       = `schema_version_header`
+	sinkParamSinkID                    = `sink_id`
+	sinkParamSkipCreate                = `skip_create`
+	sinkParamSpillDir                  = `spill_dir`
+	sinkParamSpillThreshold            = `spill_threshold`
+	sinkParamStreamPrefix              = `stream_prefix`
+	sinkParamTopicGranularity          = `topic_granularity`
+	sinkParamTopicPrefix               = `topic_prefix`
+	sinkParamTrimTrailingSeparator     = `trim_trailing_separator`
+	sinkParamUploadMaxRetries          = `upload_max_retries`
+	sinkParamUploadTimeout             = `upload_timeout`
+	sinkParamWriteConcurrency          = `write_concurrency`
+	sinkParamWriteTimeout              = `write_timeout`
+	sinkSchemeBuffer                   = ``
+	sinkSchemeExperimentalSQL          = `experimental-sql`
+	sinkSchemeKafka                    = `kafka`
+	sinkSchemeMetrics                  = `experimental-metrics`
+	sinkSchemeRedis                    = `redis`
+	sinkSchemeUnix                     = `unix`
+	sinkSchemeWebhookHTTP              = `webhook-http`
+	sinkSchemeWebhookHTTPS             = `webhook-https`
 )
 
 var changefeedOptionExpectValues = map[string]sql.KVStringOptValidate{
 	optConfluentSchemaRegistry: sql.KVStringOptRequireValue,
 	optCursor:                  sql.KVStringOptRequireValue,
+	optDeadLetterSink:          sql.KVStringOptRequireValue,
+	optDiffOnly:                sql.KVStringOptRequireNoValue,
 	optEnvelope:                sql.KVStringOptRequireValue,
+	optExcludeColumns:          sql.KVStringOptRequireValue,
+	optFlatten:                 sql.KVStringOptAny,
 	optFormat:                  sql.KVStringOptRequireValue,
+	optHighWater:               sql.KVStringOptRequireNoValue,
+	optKeyFormat:               sql.KVStringOptRequireValue,
+	optLifecycleMarkers:        sql.KVStringOptRequireNoValue,
+	optNumAsString:             sql.KVStringOptRequireNoValue,
+	optPartitionByColumn:       sql.KVStringOptRequireValue,
+	optPartitionKey:            sql.KVStringOptRequireValue,
+	optPriorityTables:          sql.KVStringOptRequireValue,
+	optResolvedFormat:          sql.KVStringOptRequireValue,
 	optResolvedTimestamps:      sql.KVStringOptAny,
+	optSource:                  sql.KVStringOptRequireNoValue,
 	optUpdatedTimestamps:       sql.KVStringOptRequireNoValue,
 }
 
@@ -144,7 +258,10 @@ func changefeedPlanHook(
 			return err
 		}
 
-		jobDescription := changefeedJobDescription(changefeedStmt, sinkURI, opts)
+		jobDescription, err := changefeedJobDescription(changefeedStmt, sinkURI, opts)
+		if err != nil {
+			return err
+		}
 
 		statementTime := p.ExecCfg().Clock.Now()
 		var initialHighWater hlc.Timestamp
@@ -180,15 +297,57 @@ func changefeedPlanHook(
 		if err != nil {
 			return err
 		}
+		// The database of each table is resolved along with it.
+		databaseNames := make(map[sqlbase.ID]string)
+		for _, desc := range targetDescs {
+			if dbDesc := desc.GetDatabase(); dbDesc != nil {
+				databaseNames[dbDesc.ID] = dbDesc.Name
+			}
+		}
 		targets := make(jobspb.ChangefeedTargets, len(targetDescs))
+		var tableDescs []*sqlbase.TableDescriptor
 		for _, desc := range targetDescs {
 			if tableDesc := desc.GetTable(); tableDesc != nil {
+				tableDescs = append(tableDescs, tableDesc)
 				targets[tableDesc.ID] = jobspb.ChangefeedTarget{
-					StatementTimeName: tableDesc.Name,
+					StatementTimeName:         tableDesc.Name,
+					StatementTimeDatabaseName: databaseNames[tableDesc.ParentID],
 				}
 				if err := validateChangefeedTable(targets, tableDesc); err != nil {
 					return err
 				}
+				if formatType(opts[optFormat]) == optFormatRaw {
+					if _, err := rawValueColumn(tableDesc); err != nil {
+						return err
+					}
+				}
+				if formatType(opts[optKeyFormat]) == optFormatRaw {
+					if _, err := rawKeyColumn(tableDesc); err != nil {
+						return err
+					}
+				}
+				if partitionKey, ok := opts[optPartitionKey]; ok {
+					if _, err := partitionKeyColumns(
+						tableDesc, optPartitionKey, parsePartitionKeyOpt(partitionKey),
+					); err != nil {
+						return err
+					}
+				}
+				if column, ok := opts[optPartitionByColumn]; ok {
+					if _, err := partitionByColumn(tableDesc, column); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if columns, ok := opts[optExcludeColumns]; ok {
+			if err := validateExcludeColumns(tableDescs, columns); err != nil {
+				return err
+			}
+		}
+		if tables, ok := opts[optPriorityTables]; ok {
+			if err := validatePriorityTables(targets, tables); err != nil {
+				return err
 			}
 		}
 
@@ -226,7 +385,14 @@ func changefeedPlanHook(
 		// the CREATE CHANGEFEED statement. To do this, we create a "canary" sink,
 		// which will be immediately closed, only to check for errors.
 		{
-			canarySink, err := getSink(details.SinkURI, details.Opts, details.Targets, settings)
+			encoder, err := getEncoder(
+				details.Opts, details.Targets, p.ExecCfg().ClusterID(), 0 /* jobID */)
+			if err != nil {
+				return err
+			}
+			canarySink, err := getSink(
+				ctx, details.SinkURI, details.Opts, encoder, details.Targets, 0 /* jobID */, settings,
+				changefeedTestingKnobs(p.ExecCfg().DistSQLRunTestingKnobs))
 			if err != nil {
 				// In this context, we don't want to retry even retryable errors from the
 				// sync. Unwrap any retryable errors encountered.
@@ -278,22 +444,71 @@ func changefeedPlanHook(
 
 func changefeedJobDescription(
 	changefeed *tree.CreateChangefeed, sinkURI string, opts map[string]string,
-) string {
+) (string, error) {
+	// If/when we start accepting export storage uris (or ones with other
+	// secrets), we'll need to sanitize those too.
+	cleanedSinkURI, err := redactSinkURI(sinkURI)
+	if err != nil {
+		return ``, err
+	}
 	c := &tree.CreateChangefeed{
 		Targets: changefeed.Targets,
-		// If/when we start accepting export storage uris (or ones with
-		// secrets), we'll need to sanitize sinkURI.
-		SinkURI: tree.NewDString(sinkURI),
+		SinkURI: tree.NewDString(cleanedSinkURI),
 	}
 	for k, v := range opts {
 		opt := tree.KVOption{Key: tree.Name(k)}
+		// The dead letter sink is a sink URI too, with the same secrets.
+		if k == optDeadLetterSink {
+			if v, err = redactSinkURI(v); err != nil {
+				return ``, err
+			}
+		}
 		if len(v) > 0 {
 			opt.Value = tree.NewDString(v)
 		}
 		c.Options = append(c.Options, opt)
 	}
 	sort.Slice(c.Options, func(i, j int) bool { return c.Options[i].Key < c.Options[j].Key })
-	return tree.AsStringWithFlags(c, tree.FmtAlwaysQualifyTableNames)
+	return tree.AsStringWithFlags(c, tree.FmtAlwaysQualifyTableNames), nil
+}
+
+// redactedSinkParams are the sink params that hold secrets and so must not be
+// shown in the job description. The values of `header.` params are redacted as
+// well, because headers often hold credentials.
+var redactedSinkParams = []string{
+	sinkParamHMACSecret, sinkParamOAuthClientSecret, sinkParamSASLPassword,
+}
+
+// redactSinkURI replaces the password and the values of any secret sink params
+// in sinkURI.
+func redactSinkURI(sinkURI string) (string, error) {
+	u, err := url.Parse(sinkURI)
+	if err != nil {
+		return ``, err
+	}
+	q := u.Query()
+	var redacted bool
+	for _, param := range redactedSinkParams {
+		if q.Get(param) != `` {
+			q.Set(param, `redacted`)
+			redacted = true
+		}
+	}
+	for param := range q {
+		if strings.HasPrefix(param, sinkParamHeaderPrefix) {
+			q.Set(param, `redacted`)
+			redacted = true
+		}
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), `redacted`)
+		redacted = true
+	}
+	if !redacted {
+		return sinkURI, nil
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
 }
 
 func validateDetails(details jobspb.ChangefeedDetails) (jobspb.ChangefeedDetails, error) {
@@ -322,8 +537,15 @@ func validateDetails(details jobspb.ChangefeedDetails) (jobspb.ChangefeedDetails
 	case optEnvelopeValueOnly:
 		details.Opts[optEnvelope] = string(optEnvelopeValueOnly)
 	case optEnvelopeDiff:
-		return jobspb.ChangefeedDetails{}, errors.Errorf(
-			`%s=%s is not yet supported`, optEnvelope, optEnvelopeDiff)
+		// Only JSON and Avro values have somewhere to put the previous version
+		// of the row.
+		switch f := formatType(details.Opts[optFormat]); f {
+		case ``, optFormatJSON, optFormatAvro:
+		default:
+			return jobspb.ChangefeedDetails{}, errors.Errorf(`%s=%s is not supported with %s=%s`,
+				optEnvelope, optEnvelopeDiff, optFormat, f)
+		}
+		details.Opts[optEnvelope] = string(optEnvelopeDiff)
 	default:
 		return jobspb.ChangefeedDetails{}, errors.Errorf(
 			`unknown %s: %s`, optEnvelope, details.Opts[optEnvelope])
@@ -333,12 +555,116 @@ func validateDetails(details jobspb.ChangefeedDetails) (jobspb.ChangefeedDetails
 	case ``, optFormatJSON:
 		details.Opts[optFormat] = string(optFormatJSON)
 	case optFormatAvro:
-		// No-op.
+		// Avro numbers are typed, so they don't need num_as_string.
+		if _, ok := details.Opts[optNumAsString]; ok {
+			return jobspb.ChangefeedDetails{}, errors.Errorf(
+				`%s is only supported with %s=%s`, optNumAsString, optFormat, optFormatJSON)
+		}
+	case optFormatCloudEvents:
+		// Every event has a value, a key alone can't be one.
+		if envelopeType(details.Opts[optEnvelope]) == optEnvelopeKeyOnly {
+			return jobspb.ChangefeedDetails{}, errors.Errorf(
+				`%s=%s is not supported with %s=%s`,
+				optEnvelope, optEnvelopeKeyOnly, optFormat, optFormatCloudEvents)
+		}
+	case optFormatRaw:
+		// The value is passed through verbatim, so there's nowhere to put the
+		// updated timestamp.
+		if _, ok := details.Opts[optUpdatedTimestamps]; ok {
+			return jobspb.ChangefeedDetails{}, errors.Errorf(
+				`%s is not supported with %s=%s`, optUpdatedTimestamps, optFormat, optFormatRaw)
+		}
+		// The value is a single column, which can't be left out.
+		if _, ok := details.Opts[optExcludeColumns]; ok {
+			return jobspb.ChangefeedDetails{}, errors.Errorf(
+				`%s is not supported with %s=%s`, optExcludeColumns, optFormat, optFormatRaw)
+		}
+	case optFormatProtobuf:
+		// Every field number is a column's, so there's nowhere to put the
+		// updated timestamp, and the fields are typed.
+		for _, opt := range []string{optUpdatedTimestamps, optNumAsString} {
+			if _, ok := details.Opts[opt]; ok {
+				return jobspb.ChangefeedDetails{}, errors.Errorf(
+					`%s is not supported with %s=%s`, opt, optFormat, optFormatProtobuf)
+			}
+		}
 	default:
 		return jobspb.ChangefeedDetails{}, errors.Errorf(
 			`unknown %s: %s`, optFormat, details.Opts[optFormat])
 	}
 
+	switch resolvedFormatType(details.Opts[optResolvedFormat]) {
+	case ``:
+	case optResolvedFormatWrapped, optResolvedFormatDecimal, optResolvedFormatNanos,
+		optResolvedFormatISO8601:
+		// Avro, CloudEvents and protobuf resolved timestamps have a fixed shape
+		// that their consumers rely on.
+		switch f := formatType(details.Opts[optFormat]); f {
+		case optFormatAvro, optFormatCloudEvents, optFormatProtobuf:
+			return jobspb.ChangefeedDetails{}, errors.Errorf(
+				`%s is not supported with %s=%s`, optResolvedFormat, optFormat, f)
+		}
+	default:
+		return jobspb.ChangefeedDetails{}, errors.Errorf(
+			`unknown %s: %s`, optResolvedFormat, details.Opts[optResolvedFormat])
+	}
+
+	switch formatType(details.Opts[optKeyFormat]) {
+	case ``, optFormatJSON, optFormatAvro, optFormatRaw:
+	default:
+		return jobspb.ChangefeedDetails{}, errors.Errorf(
+			`unknown %s: %s`, optKeyFormat, details.Opts[optKeyFormat])
+	}
+
+	if _, ok := details.Opts[optDiffOnly]; ok {
+		// Avro schemas are registered per table version, not per set of
+		// changed columns.
+		if f := formatType(details.Opts[optFormat]); f != optFormatJSON {
+			return jobspb.ChangefeedDetails{}, errors.Errorf(
+				`%s is only supported with %s=%s`, optDiffOnly, optFormat, optFormatJSON)
+		}
+	}
+
+	if depth, ok := details.Opts[optFlatten]; ok {
+		// The other formats are typed, nested values and all.
+		if f := formatType(details.Opts[optFormat]); f != optFormatJSON {
+			return jobspb.ChangefeedDetails{}, errors.Errorf(
+				`%s is only supported with %s=%s`, optFlatten, optFormat, optFormatJSON)
+		}
+		if depth != `` {
+			if n, err := strconv.Atoi(depth); err != nil || n <= 0 {
+				return jobspb.ChangefeedDetails{}, errors.Errorf(
+					`%s must be a positive maximum depth: %s`, optFlatten, depth)
+			}
+		}
+	}
+
+	if _, ok := details.Opts[optSource]; ok {
+		if f := formatType(details.Opts[optFormat]); f != `` && f != optFormatJSON {
+			return jobspb.ChangefeedDetails{}, errors.Errorf(
+				`%s is only supported with %s=%s`, optSource, optFormat, optFormatJSON)
+		}
+	}
+
+	// A row can only be partitioned one way.
+	_, hasPartitionKey := details.Opts[optPartitionKey]
+	if _, ok := details.Opts[optPartitionByColumn]; ok && hasPartitionKey {
+		return jobspb.ChangefeedDetails{}, errors.Errorf(
+			`%s is not supported with %s`, optPartitionByColumn, optPartitionKey)
+	}
+
+	// The partition column's value is read out of the encoded key or value.
+	// A bad sink URI is left for getSink to report.
+	if u, err := url.Parse(details.SinkURI); err == nil &&
+		u.Query().Get(sinkParamPartitionColumn) != `` {
+		for _, opt := range []string{optFormat, optKeyFormat} {
+			if f := formatType(details.Opts[opt]); f != `` && f != optFormatJSON {
+				return jobspb.ChangefeedDetails{}, errors.Errorf(
+					`%s is only supported with %s=%s`, sinkParamPartitionColumn, opt, optFormatJSON)
+			}
+		}
+	}
+
 	return details, nil
 }
 
@@ -388,12 +714,16 @@ func validateChangefeedTable(
 	return nil
 }
 
-type changefeedResumer struct{}
+type changefeedResumer struct {
+	// execCfg is set by Resume, for OnTerminal.
+	execCfg *sql.ExecutorConfig
+}
 
 func (b *changefeedResumer) Resume(
 	ctx context.Context, job *jobs.Job, planHookState interface{}, startedCh chan<- tree.Datums,
 ) error {
 	phs := planHookState.(sql.PlanHookState)
+	b.execCfg = phs.ExecCfg()
 	details := job.Details().(jobspb.ChangefeedDetails)
 	progress := job.Progress()
 
@@ -405,7 +735,21 @@ func (b *changefeedResumer) Resume(
 		Multiplier:     2,
 		MaxBackoff:     10 * time.Second,
 	}
-	var err error
+	var highWater hlc.Timestamp
+	if h := progress.GetHighWater(); h != nil {
+		highWater = *h
+	}
+	budget, err := makeSinkRetryBudget(details.SinkURI, highWater)
+	if err != nil {
+		return err
+	}
+	// The processors on this node release the sink's circuit breaker when a
+	// restart closes them, so hold on to it here to keep it across restarts.
+	breaker, err := acquireSinkBreaker(details.SinkURI, *job.ID())
+	if err != nil {
+		return err
+	}
+	defer breaker.release()
 	for r := retry.StartWithCtx(ctx, opts); r.Next(); {
 		// TODO(dan): This is a workaround for not being able to set an initial
 		// progress high-water when creating a job (currently only the progress
@@ -430,6 +774,23 @@ func (b *changefeedResumer) Resume(
 			break
 		}
 		progress = reloadedJob.Progress()
+		pingErr := pingChangefeedSink(ctx, phs.ExecCfg(), details)
+		if statusErr := updateSinkRunningStatus(ctx, reloadedJob, pingErr); statusErr != nil {
+			log.Warningf(ctx, `CHANGEFEED job %d failed to update running status: %v`,
+				*job.ID(), statusErr)
+		}
+		highWater = hlc.Timestamp{}
+		if h := progress.GetHighWater(); h != nil {
+			highWater = *h
+		}
+		// A restart because the sink's circuit breaker is open didn't reach the
+		// sink, so it's not another failure of it.
+		if !isSinkBreakerOpenError(err) {
+			if budgetErr := budget.onRetryableError(err, highWater); budgetErr != nil {
+				err = pauseChangefeedJob(ctx, phs.ExecCfg().JobRegistry, reloadedJob, budgetErr)
+				break
+			}
+		}
 		// startedCh is normally used to signal back to the creator of the job that
 		// the job has started; however, in this case nothing will ever receive
 		// on the channel, causing the changefeed flow to block. Replace it with
@@ -446,11 +807,130 @@ func (b *changefeedResumer) Resume(
 	return err
 }
 
+// sinkUnreachableStatusPrefix starts the running status of a changefeed job
+// whose sink failed a ping after a retryable error, which is shown by SHOW JOBS.
+const sinkUnreachableStatusPrefix = `sink unreachable: `
+
+// pingChangefeedSink makes the sink of a changefeed and pings it. Like the
+// canary sink of CREATE CHANGEFEED, it's made without the job ID, so that
+// nothing specific to the job, like its resumable state, is touched.
+func pingChangefeedSink(
+	ctx context.Context, execCfg *sql.ExecutorConfig, details jobspb.ChangefeedDetails,
+) error {
+	encoder, err := getEncoder(details.Opts, details.Targets, execCfg.ClusterID(), 0 /* jobID */)
+	if err != nil {
+		return err
+	}
+	sink, err := getSink(ctx, details.SinkURI, details.Opts, encoder, details.Targets,
+		0 /* jobID */, execCfg.Settings, changefeedTestingKnobs(execCfg.DistSQLRunTestingKnobs))
+	if err != nil {
+		if rErr, ok := err.(*retryableSinkError); ok {
+			return rErr.cause
+		}
+		return err
+	}
+	defer func() {
+		if err := sink.Close(); err != nil {
+			log.Warningf(ctx, `error closing sink. goroutines may have leaked: %v`, err)
+		}
+	}()
+	return pingSink(ctx, sink)
+}
+
+// updateSinkRunningStatus sets the running status of a changefeed job to say
+// that its sink is unreachable if pingErr is non-nil, and otherwise clears it
+// if it said so. Any other running status is left alone.
+func updateSinkRunningStatus(ctx context.Context, job *jobs.Job, pingErr error) error {
+	current := job.Progress().RunningStatus
+	var status jobs.RunningStatus
+	if pingErr != nil {
+		status = jobs.RunningStatus(sinkUnreachableStatusPrefix + pingErr.Error())
+	} else if !strings.HasPrefix(current, sinkUnreachableStatusPrefix) {
+		return nil
+	}
+	if string(status) == current {
+		return nil
+	}
+	return job.RunningStatus(ctx, func(context.Context, jobspb.Details) (jobs.RunningStatus, error) {
+		return status, nil
+	})
+}
+
+// pauseChangefeedJob pauses a changefeed job, with a running status that says
+// why, and returns the error that tells the job registry it was paused, so
+// that it's left paused instead of marked failed.
+func pauseChangefeedJob(
+	ctx context.Context, registry *jobs.Registry, job *jobs.Job, reason error,
+) error {
+	status := func(context.Context, jobspb.Details) (jobs.RunningStatus, error) {
+		return jobs.RunningStatus(`paused: ` + reason.Error()), nil
+	}
+	if err := job.RunningStatus(ctx, status); err != nil {
+		return err
+	}
+	log.Warningf(ctx, `CHANGEFEED job %d pausing: %v`, *job.ID(), reason)
+	if err := registry.Pause(ctx, nil /* txn */, *job.ID()); err != nil {
+		return err
+	}
+	// A paused job can't be updated, and the error saying so is what the
+	// registry looks for.
+	if err := job.RunningStatus(ctx, status); err != nil {
+		return err
+	}
+	return errors.Errorf(`CHANGEFEED job %d could not be paused`, *job.ID())
+}
+
 func (b *changefeedResumer) OnFailOrCancel(context.Context, *client.Txn, *jobs.Job) error { return nil }
 func (b *changefeedResumer) OnSuccess(context.Context, *client.Txn, *jobs.Job) error      { return nil }
+
+// OnTerminal implements the jobs.Resumer interface. With the `lifecycle_markers`
+// option, it emits the end marker of the changefeed as of its high water. The
+// job is already done, so that's best effort and an error is only logged.
 func (b *changefeedResumer) OnTerminal(
-	context.Context, *jobs.Job, jobs.Status, chan<- tree.Datums,
+	ctx context.Context, job *jobs.Job, status jobs.Status, _ chan<- tree.Datums,
 ) {
+	details := job.Details().(jobspb.ChangefeedDetails)
+	if _, ok := details.Opts[optLifecycleMarkers]; !ok || b.execCfg == nil {
+		return
+	}
+	if err := emitChangefeedEndMarker(ctx, b.execCfg, *job.ID(), details); err != nil {
+		log.Warningf(ctx, `CHANGEFEED job %d failed to emit its end marker after it %s: %v`,
+			*job.ID(), status, err)
+	}
+}
+
+// emitChangefeedEndMarker makes the sink of a changefeed and emits its end
+// marker as of its last checkpointed high water. Unlike pingChangefeedSink, the
+// sink is made with the job ID, so that the marker goes wherever the rows of the
+// job went.
+func emitChangefeedEndMarker(
+	ctx context.Context, execCfg *sql.ExecutorConfig, jobID int64, details jobspb.ChangefeedDetails,
+) error {
+	// The job's progress in memory doesn't have the change frontier's
+	// checkpoints.
+	job, err := execCfg.JobRegistry.LoadJob(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	var highWater hlc.Timestamp
+	if h := job.Progress().GetHighWater(); h != nil {
+		highWater = *h
+	}
+	encoder, err := getEncoder(details.Opts, details.Targets, execCfg.ClusterID(), jobID)
+	if err != nil {
+		return err
+	}
+	sink, err := getSink(ctx, details.SinkURI, details.Opts, encoder, details.Targets,
+		jobID, execCfg.Settings, changefeedTestingKnobs(execCfg.DistSQLRunTestingKnobs))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := sink.Close(); err != nil {
+			log.Warningf(ctx, `error closing sink. goroutines may have leaked: %v`, err)
+		}
+	}()
+	return emitFeedLifecycle(ctx, sink, feedPhaseEnd, highWater)
 }
 
 func changefeedResumeHook(typ jobspb.Type, _ *cluster.Settings) jobs.Resumer {
@@ -16,6 +16,7 @@ import (
 	"net/url"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -113,6 +114,96 @@ func TestChangefeedEnvelope(t *testing.T) {
 	t.Run(`rangefeed`, rangefeedTest(sinklessTest, testFn))
 }
 
+func TestChangefeedEnvelopeDiff(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testFn := func(t *testing.T, db *gosql.DB, f testfeedFactory) {
+		sqlDB := sqlutils.MakeSQLRunner(db)
+		sqlDB.Exec(t, `CREATE TABLE foo (a INT PRIMARY KEY, b STRING)`)
+		sqlDB.Exec(t, `INSERT INTO foo VALUES (0, 'initial')`)
+
+		foo := f.Feed(t, `CREATE CHANGEFEED FOR foo WITH envelope=diff`)
+		defer foo.Close(t)
+
+		// The rows of the initial scan have no previous version.
+		assertPayloads(t, foo, []string{
+			`foo: [0]->{"__crdb__": {"before": null}, "a": 0, "b": "initial"}`,
+		})
+
+		sqlDB.Exec(t, `INSERT INTO foo VALUES (1, 'a')`)
+		assertPayloads(t, foo, []string{
+			`foo: [1]->{"__crdb__": {"before": null}, "a": 1, "b": "a"}`,
+		})
+
+		sqlDB.Exec(t, `UPSERT INTO foo VALUES (0, 'updated'), (1, 'b')`)
+		assertPayloads(t, foo, []string{
+			`foo: [0]->{"__crdb__": {"before": {"a": 0, "b": "initial"}}, "a": 0, "b": "updated"}`,
+			`foo: [1]->{"__crdb__": {"before": {"a": 1, "b": "a"}}, "a": 1, "b": "b"}`,
+		})
+
+		// A deletion has only the previous version.
+		sqlDB.Exec(t, `DELETE FROM foo WHERE a = 1`)
+		assertPayloads(t, foo, []string{
+			`foo: [1]->{"__crdb__": {"before": {"a": 1, "b": "b"}}}`,
+		})
+
+		// A row that's deleted and written again has no previous version.
+		sqlDB.Exec(t, `INSERT INTO foo VALUES (1, 'c')`)
+		assertPayloads(t, foo, []string{
+			`foo: [1]->{"__crdb__": {"before": null}, "a": 1, "b": "c"}`,
+		})
+	}
+
+	t.Run(`sinkless`, sinklessTest(testFn))
+	t.Run(`enterprise`, enterpriseTest(testFn))
+	t.Run(`rangefeed`, rangefeedTest(sinklessTest, testFn))
+}
+
+func TestChangefeedDiffOnly(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	testFn := func(t *testing.T, db *gosql.DB, f testfeedFactory) {
+		sqlDB := sqlutils.MakeSQLRunner(db)
+		sqlDB.Exec(t, `CREATE TABLE foo (a INT PRIMARY KEY, b STRING, c INT)`)
+		sqlDB.Exec(t, `INSERT INTO foo VALUES (0, 'initial', 0)`)
+
+		foo := f.Feed(t, `CREATE CHANGEFEED FOR foo WITH diff_only`)
+		defer foo.Close(t)
+
+		// Rows without a previous version are whole.
+		assertPayloads(t, foo, []string{
+			`foo: [0]->{"a": 0, "b": "initial", "c": 0}`,
+		})
+		sqlDB.Exec(t, `INSERT INTO foo VALUES (1, 'a', 1)`)
+		assertPayloads(t, foo, []string{
+			`foo: [1]->{"a": 1, "b": "a", "c": 1}`,
+		})
+
+		// An update only has the primary key and the columns it changed.
+		sqlDB.Exec(t, `UPDATE foo SET b = 'updated' WHERE a = 0`)
+		assertPayloads(t, foo, []string{
+			`foo: [0]->{"a": 0, "b": "updated"}`,
+		})
+		sqlDB.Exec(t, `UPDATE foo SET b = 'b', c = 2 WHERE a = 1`)
+		assertPayloads(t, foo, []string{
+			`foo: [1]->{"a": 1, "b": "b", "c": 2}`,
+		})
+		sqlDB.Exec(t, `UPDATE foo SET c = 3 WHERE a = 1`)
+		assertPayloads(t, foo, []string{
+			`foo: [1]->{"a": 1, "c": 3}`,
+		})
+
+		sqlDB.Exec(t, `DELETE FROM foo WHERE a = 1`)
+		assertPayloads(t, foo, []string{
+			`foo: [1]->`,
+		})
+	}
+
+	t.Run(`sinkless`, sinklessTest(testFn))
+	t.Run(`enterprise`, enterpriseTest(testFn))
+	t.Run(`rangefeed`, rangefeedTest(sinklessTest, testFn))
+}
+
 func TestChangefeedMultiTable(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
@@ -1124,6 +1215,71 @@ func TestChangefeedRetryableSinkError(t *testing.T) {
 	sqlDB.Exec(t, `CANCEL JOB $1`, jobID)
 }
 
+func TestChangefeedRetryBudgetPausesJob(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer utilccl.TestingEnableEnterprise()()
+
+	var failSink int64 = 1
+	s, sqlDBRaw, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Insecure: true,
+		Knobs: base.TestingKnobs{
+			DistSQL: &distsqlrun.TestingKnobs{
+				Changefeed: &TestingKnobs{
+					AfterSinkFlush: func() error {
+						if atomic.LoadInt64(&failSink) != 0 {
+							return &retryableSinkError{cause: fmt.Errorf("synthetic retryable error")}
+						}
+						return nil
+					},
+				},
+			},
+		},
+		UseDatabase: "d",
+	})
+	defer s.Stopper().Stop(context.Background())
+	sqlDB := sqlutils.MakeSQLRunner(sqlDBRaw)
+
+	sqlDB.Exec(t, `CREATE DATABASE d`)
+	sqlDB.Exec(t, `CREATE TABLE foo (a INT PRIMARY KEY, b STRING)`)
+	sqlDB.Exec(t, `CREATE USER sinkuser`)
+	sqlDB.Exec(t, `GRANT ALL ON DATABASE d TO sinkuser`)
+	sqlDB.Exec(t, `INSERT INTO foo VALUES (1, 'a')`)
+
+	var jobID int64
+	sqlDB.QueryRow(t, fmt.Sprintf(`CREATE CHANGEFEED FOR foo INTO `+
+		`'experimental-sql://sinkuser@%s/d?sslmode=disable&retry_budget=2'`, s.ServingAddr()),
+	).Scan(&jobID)
+
+	// Once the budget is used up, the job is paused instead of failed, with a
+	// running status that says why.
+	testutils.SucceedsSoon(t, func() error {
+		var status, runningStatus string
+		sqlDB.QueryRow(t, `SELECT status, running_status FROM [SHOW JOBS] WHERE job_id = $1`,
+			jobID).Scan(&status, &runningStatus)
+		if status != string(jobs.StatusPaused) {
+			return errors.Errorf(`expected paused got %s`, status)
+		}
+		if !strings.Contains(runningStatus, `giving up after 3 consecutive sink failures`) {
+			return errors.Errorf(`unexpected running status: %s`, runningStatus)
+		}
+		return nil
+	})
+
+	// Once the sink is fixed, the job can be resumed.
+	atomic.StoreInt64(&failSink, 0)
+	sqlDB.Exec(t, `RESUME JOB $1`, jobID)
+	sqlDB.Exec(t, `INSERT INTO foo VALUES (2, 'b')`)
+	testutils.SucceedsSoon(t, func() error {
+		var count int
+		sqlDB.QueryRow(t, `SELECT count(*) FROM d.sqlsink WHERE key = '[2]'`).Scan(&count)
+		if count == 0 {
+			return errors.New(`expected the row inserted after resuming`)
+		}
+		return nil
+	})
+	sqlDB.Exec(t, `CANCEL JOB $1`, jobID)
+}
+
 // TestChangefeedDataTTL ensures that changefeeds fail with an error in the case
 // where the feed has fallen behind the GC TTL of the table data.
 func TestChangefeedDataTTL(t *testing.T) {
@@ -1294,8 +1450,12 @@ func TestChangefeedErrors(t *testing.T) {
 	)
 
 	sqlDB.ExpectErr(
-		t, `envelope=diff is not yet supported`,
-		`CREATE CHANGEFEED FOR foo WITH envelope=diff`,
+		t, `envelope=diff is not supported with format=raw`,
+		`CREATE CHANGEFEED FOR foo WITH envelope=diff, format=raw`,
+	)
+	sqlDB.ExpectErr(
+		t, `diff_only is only supported with format=json`,
+		`CREATE CHANGEFEED FOR foo WITH diff_only, format=experimental_avro`,
 	)
 	sqlDB.ExpectErr(
 		t, `unknown envelope: nope`,
@@ -1305,6 +1465,94 @@ func TestChangefeedErrors(t *testing.T) {
 		t, `negative durations are not accepted: resolved='-1s'`,
 		`CREATE CHANGEFEED FOR foo WITH resolved='-1s'`,
 	)
+	sqlDB.ExpectErr(
+		t, `num_as_string is only supported with format=json`,
+		`CREATE CHANGEFEED FOR foo WITH format=$1, num_as_string`, optFormatAvro,
+	)
+	sqlDB.ExpectErr(
+		t, `envelope=key_only is not supported with format=experimental_cloudevents`,
+		`CREATE CHANGEFEED FOR foo WITH format=$1, envelope=key_only`, optFormatCloudEvents,
+	)
+	sqlDB.ExpectErr(
+		t, `updated is not supported with format=raw`,
+		`CREATE CHANGEFEED FOR foo WITH format=$1, updated`, optFormatRaw,
+	)
+	sqlDB.ExpectErr(
+		t, `updated is not supported with format=protobuf`,
+		`CREATE CHANGEFEED FOR foo WITH format=$1, updated`, optFormatProtobuf,
+	)
+	sqlDB.ExpectErr(
+		t, `num_as_string is not supported with format=protobuf`,
+		`CREATE CHANGEFEED FOR foo WITH format=$1, num_as_string`, optFormatProtobuf,
+	)
+	sqlDB.ExpectErr(
+		t, `unknown resolved_format: nope`,
+		`CREATE CHANGEFEED FOR foo WITH resolved_format=nope`,
+	)
+	sqlDB.ExpectErr(
+		t, `resolved_format is not supported with format=experimental_avro`,
+		`CREATE CHANGEFEED FOR foo WITH format=$1, resolved_format=nanos`, optFormatAvro,
+	)
+	sqlDB.Exec(t, `CREATE TABLE raw_wide (a INT PRIMARY KEY, b BYTES, c BYTES)`)
+	sqlDB.ExpectErr(
+		t, `format=raw requires exactly 1 column outside the primary key: raw_wide has 2`,
+		`CREATE CHANGEFEED FOR raw_wide WITH format=$1`, optFormatRaw,
+	)
+	sqlDB.Exec(t, `CREATE TABLE raw_int (a INT PRIMARY KEY, b INT)`)
+	sqlDB.ExpectErr(
+		t, `format=raw requires a BYTES or STRING value column: raw_int.b is INT`,
+		`CREATE CHANGEFEED FOR raw_int WITH format=$1`, optFormatRaw,
+	)
+	sqlDB.ExpectErr(
+		t, `unknown key_format: nope`,
+		`CREATE CHANGEFEED FOR foo INTO $1 WITH key_format=nope`, `kafka://nope`,
+	)
+	sqlDB.ExpectErr(
+		t, `key_format=raw requires a BYTES or STRING key column: foo.a is INT`,
+		`CREATE CHANGEFEED FOR foo WITH key_format=$1`, optFormatRaw,
+	)
+	sqlDB.Exec(t, `CREATE TABLE raw_key_wide (a STRING, b STRING, PRIMARY KEY (a, b))`)
+	sqlDB.ExpectErr(
+		t, `key_format=raw requires exactly 1 primary key column: raw_key_wide has 2`,
+		`CREATE CHANGEFEED FOR raw_key_wide WITH key_format=$1`, optFormatRaw,
+	)
+	sqlDB.ExpectErr(
+		t, `partition_key column "b" is not in the primary key of foo`,
+		`CREATE CHANGEFEED FOR foo WITH partition_key='a, b'`,
+	)
+	sqlDB.ExpectErr(
+		t, `partition_key column "nope" does not exist in foo`,
+		`CREATE CHANGEFEED FOR foo WITH partition_key=nope`,
+	)
+	sqlDB.ExpectErr(
+		t, `partition_by_column column "b" is not in the primary key of foo`,
+		`CREATE CHANGEFEED FOR foo WITH partition_by_column=b`,
+	)
+	sqlDB.Exec(t, `CREATE TABLE partition_str (a STRING PRIMARY KEY)`)
+	sqlDB.ExpectErr(
+		t, `partition_by_column column "a" must be an INT: partition_str.a is STRING`,
+		`CREATE CHANGEFEED FOR partition_str WITH partition_by_column=a`,
+	)
+	sqlDB.ExpectErr(
+		t, `partition_by_column is not supported with partition_key`,
+		`CREATE CHANGEFEED FOR foo WITH partition_by_column=a, partition_key=a`,
+	)
+	sqlDB.ExpectErr(
+		t, `exclude_columns column "nope" does not exist in any watched table`,
+		`CREATE CHANGEFEED FOR foo WITH exclude_columns=nope`,
+	)
+	sqlDB.ExpectErr(
+		t, `exclude_columns column "a" is in the primary key of foo`,
+		`CREATE CHANGEFEED FOR foo WITH exclude_columns='b, a'`,
+	)
+	sqlDB.ExpectErr(
+		t, `exclude_columns is not supported with format=raw`,
+		`CREATE CHANGEFEED FOR foo WITH exclude_columns=b, format=$1`, optFormatRaw,
+	)
+	sqlDB.ExpectErr(
+		t, `priority_tables table "nope" is not watched by the changefeed`,
+		`CREATE CHANGEFEED FOR foo WITH priority_tables=nope`,
+	)
 	sqlDB.ExpectErr(
 		t, `cannot specify timestamp in the future`,
 		`CREATE CHANGEFEED FOR foo WITH cursor=$1`, timeutil.Now().Add(time.Hour),
@@ -1361,14 +1609,26 @@ func TestChangefeedErrors(t *testing.T) {
 		`CREATE CHANGEFEED FOR dec WITH format=$1, confluent_schema_registry=$2`,
 		optFormatAvro, `bar`,
 	)
-	sqlDB.Exec(t, `CREATE TABLE "uuid" (a UUID PRIMARY KEY)`)
-	sqlDB.Exec(t, `INSERT INTO "uuid" VALUES (gen_random_uuid())`)
+	sqlDB.Exec(t, `CREATE TABLE "inet" (a INET PRIMARY KEY)`)
+	sqlDB.Exec(t, `INSERT INTO "inet" VALUES ('127.0.0.1')`)
 	sqlDB.ExpectErr(
-		t, `pq: column a: type UUID not yet supported with avro`,
-		`CREATE CHANGEFEED FOR "uuid" WITH format=$1, confluent_schema_registry=$2`,
+		t, `pq: column a: type INET not yet supported with avro`,
+		`CREATE CHANGEFEED FOR "inet" WITH format=$1, confluent_schema_registry=$2`,
 		optFormatAvro, `bar`,
 	)
 
+	// The partition column is read out of the JSON key or value.
+	sqlDB.ExpectErr(
+		t, `partition_column is only supported with format=json`,
+		`CREATE CHANGEFEED FOR foo INTO $1 WITH format=$2`,
+		`experimental-nodelocal:///partition?bucket_size=1h&partition_column=b`, optFormatRaw,
+	)
+	sqlDB.ExpectErr(
+		t, `partition_column is only supported with key_format=json`,
+		`CREATE CHANGEFEED FOR foo INTO $1 WITH key_format=$2`,
+		`experimental-nodelocal:///partition?bucket_size=1h&partition_column=a`, optFormatAvro,
+	)
+
 	// Check that confluent_schema_registry is only accepted if format is avro.
 	sqlDB.ExpectErr(
 		t, `unknown sink query parameter: confluent_schema_registry`,
@@ -1393,6 +1653,11 @@ func TestChangefeedErrors(t *testing.T) {
 		t, `schema_topic is not yet supported`,
 		`CREATE CHANGEFEED FOR foo INTO $1`, `kafka://nope/?schema_topic=foo`,
 	)
+	sqlDB.ExpectErr(
+		t, `relaxed_ordering_topics requires resolved_topic to emit resolved timestamps`,
+		`CREATE CHANGEFEED FOR foo INTO $1 WITH resolved`,
+		`kafka://nope/?relaxed_ordering_topics=foo`,
+	)
 
 	// The cloudStorageSink is particular about the options it will work with.
 	sqlDB.ExpectErr(
@@ -1401,10 +1666,30 @@ func TestChangefeedErrors(t *testing.T) {
 		`experimental-nodelocal:///bar?bucket_size=0ns`,
 	)
 	sqlDB.ExpectErr(
-		t, `this sink is incompatible with envelope=key_only`,
-		`CREATE CHANGEFEED FOR foo INTO $1 WITH envelope='key_only'`,
+		t, `this sink is incompatible with envelope=row`,
+		`CREATE CHANGEFEED FOR foo INTO $1 WITH envelope='row'`,
+		`experimental-nodelocal:///bar?bucket_size=0ns`,
+	)
+	sqlDB.ExpectErr(
+		t, `this sink is incompatible with partition_key`,
+		`CREATE CHANGEFEED FOR foo INTO $1 WITH partition_key=a`,
+		`experimental-nodelocal:///bar?bucket_size=0ns`,
+	)
+	sqlDB.ExpectErr(
+		t, `this sink is incompatible with key_format`,
+		`CREATE CHANGEFEED FOR foo INTO $1 WITH envelope=value_only, key_format=json`,
 		`experimental-nodelocal:///bar?bucket_size=0ns`,
 	)
+	sqlDB.ExpectErr(
+		t, `this sink is incompatible with high_water`,
+		`CREATE CHANGEFEED FOR foo INTO $1 WITH envelope=value_only, high_water`,
+		`experimental-nodelocal:///bar?bucket_size=0ns`,
+	)
+	sqlDB.ExpectErr(
+		t, `lifecycle_markers requires control_topic`,
+		`CREATE CHANGEFEED FOR foo INTO $1 WITH lifecycle_markers`,
+		`kafka://nope`,
+	)
 }
 
 func TestChangefeedPermissions(t *testing.T) {
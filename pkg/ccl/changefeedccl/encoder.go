@@ -13,16 +13,24 @@ import (
 	"context"
 	"encoding/binary"
 	gojson "encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/cache"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/json"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 	"github.com/pkg/errors"
 )
 
@@ -41,33 +49,129 @@ type Encoder interface {
 	// `TableDescriptor`, but only the primary key fields will be used. The
 	// returned bytes are only valid until the next call to Encode*.
 	EncodeKey(*sqlbase.TableDescriptor, sqlbase.EncDatumRow) ([]byte, error)
-	// EncodeValue encodes the primary key of the given row. The columns of the
-	// row are expected to match 1:1 with the `Columns` field of the
-	// `TableDescriptor`. The returned bytes are only valid until the next call
-	// to Encode*.
-	EncodeValue(*sqlbase.TableDescriptor, sqlbase.EncDatumRow, hlc.Timestamp) ([]byte, error)
+	// EncodeValue encodes the given row and, if known, the previous version of
+	// it (its "before image"). The columns of both rows are expected to match
+	// 1:1 with the `Columns` field of the `TableDescriptor`. The row is nil if
+	// it was deleted and the previous version is nil if it's not known. The
+	// previous version is only included with `envelope=diff`. The returned
+	// bytes are only valid until the next call to Encode*.
+	EncodeValue(
+		tableDesc *sqlbase.TableDescriptor, row, prevRow sqlbase.EncDatumRow, updated hlc.Timestamp,
+	) ([]byte, error)
 	// EncodeResolvedTimestamp encodes a resolved timestamp payload. The
 	// returned bytes are only valid until the next call to Encode*.
 	EncodeResolvedTimestamp(string, hlc.Timestamp) ([]byte, error)
 }
 
-func getEncoder(opts map[string]string) (Encoder, error) {
+// FileEncoder is implemented by Encoders whose values can be written one after
+// another to files, as the cloud storage sink does. Adding a format to the
+// cloud storage sink only takes implementing it.
+type FileEncoder interface {
+	// FileFormat returns the extension of the files and the function that
+	// writes each value to one, as a record separated as the
+	// `record_separator` sink param says.
+	FileFormat(
+		recordSeparator string,
+	) (ext string, writeRecordFn func(io.Writer, []byte) error, _ error)
+}
+
+// getEncoder returns the Encoder for the `format=` option in opts, with keys in
+// the `key_format=` format if that's set. The targets are those of the
+// changefeed, for the names of their databases. The cluster and job IDs
+// identify the changefeed to formats that include its identity in every
+// message, the job ID is 0 if it's not known yet.
+func getEncoder(
+	opts map[string]string, targets jobspb.ChangefeedTargets, clusterID uuid.UUID, jobID int64,
+) (Encoder, error) {
+	e, err := getFormatEncoder(opts, targets, clusterID, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := opts[optKeyFormat]; !ok {
+		return e, nil
+	}
+	keys, err := getKeyEncoder(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &keyFormatEncoder{Encoder: e, keys: keys}, nil
+}
+
+func getFormatEncoder(
+	opts map[string]string, targets jobspb.ChangefeedTargets, clusterID uuid.UUID, jobID int64,
+) (Encoder, error) {
 	switch formatType(opts[optFormat]) {
 	case ``, optFormatJSON:
-		return makeJSONEncoder(opts), nil
+		e := makeJSONEncoder(opts)
+		e.targets = targets
+		return e, nil
 	case optFormatAvro:
 		return newConfluentAvroEncoder(opts)
+	case optFormatCloudEvents:
+		return makeCloudEventsEncoder(opts, clusterID, jobID), nil
+	case optFormatRaw:
+		return makeRawEncoder(opts), nil
+	case optFormatProtobuf:
+		return makeProtobufEncoder(opts), nil
 	default:
 		return nil, errors.Errorf(`unknown %s: %s`, optFormat, opts[optFormat])
 	}
 }
 
+// encoderFormat returns the `format=` changefeed option that the given Encoder
+// implements.
+func encoderFormat(e Encoder) (formatType, error) {
+	switch e.(type) {
+	case *jsonEncoder:
+		return optFormatJSON, nil
+	case *confluentAvroEncoder:
+		return optFormatAvro, nil
+	case *cloudEventsEncoder:
+		return optFormatCloudEvents, nil
+	case *rawEncoder:
+		return optFormatRaw, nil
+	case *protobufEncoder:
+		return optFormatProtobuf, nil
+	case *keyFormatEncoder:
+		return encoderFormat(e.Encoder)
+	default:
+		return ``, errors.Errorf(`unknown encoder: %T`, e)
+	}
+}
+
 // jsonEncoder encodes changefeed entries as JSON. Keys are the primary key
 // columns in a JSON array. Values are a JSON object mapping every column name
-// to its value. Updated timestamps in rows and resolved timestamp payloads are
-// stored in a sub-object under the `__crdb__` key in the top-level JSON object.
+// to its value. Updated timestamps in rows, the previous versions of rows with
+// `envelope=diff`, and resolved timestamp payloads are stored in a sub-object
+// under the `__crdb__` key in the top-level JSON object.
+//
+// INT and DECIMAL values are JSON numbers, unless the `num_as_string` option is
+// set, in which case they're JSON strings. Many JSON parsers decode every
+// number as a 64-bit float, which silently loses the precision of large
+// integers and decimals.
+//
+// With the `flatten` option, the JSON objects among the columns of a row, as
+// with JSONB columns, are flattened into the row with dotted names, so
+// `{"a": {"b": 1}}` becomes `{"a.b": 1}`, for stores that can't ingest nested
+// values. `flatten=<n>` stops at n levels and keeps the objects nested any
+// deeper as they are. Arrays and empty objects are kept as they are too.
+//
+// With the `source` option, every row also has a `source` object under
+// `__crdb__`, with the IDs of its table and database, see sourceJSON, so that
+// consumers can route rows on something that doesn't change when the table is
+// renamed, unlike the table name and the topic derived from it.
 type jsonEncoder struct {
-	opts map[string]string
+	opts           map[string]string
+	numAsString    bool
+	resolvedFormat resolvedFormatType
+	// flatten is whether the `flatten` option is set, and flattenMaxDepth is
+	// its maximum depth, or zero for no limit.
+	flatten         bool
+	flattenMaxDepth int
+	// source is whether the `source` option is set. targets are those of the
+	// changefeed, for the names of the databases of its tables, if known.
+	source  bool
+	targets jobspb.ChangefeedTargets
 
 	alloc sqlbase.DatumAlloc
 	buf   bytes.Buffer
@@ -76,7 +180,37 @@ type jsonEncoder struct {
 var _ Encoder = &jsonEncoder{}
 
 func makeJSONEncoder(opts map[string]string) *jsonEncoder {
-	return &jsonEncoder{opts: opts}
+	_, numAsString := opts[optNumAsString]
+	flattenDepth, flatten := opts[optFlatten]
+	// The depth was validated by CREATE CHANGEFEED and is empty for no limit.
+	flattenMaxDepth, _ := strconv.Atoi(flattenDepth)
+	_, source := opts[optSource]
+	return &jsonEncoder{
+		opts:            opts,
+		numAsString:     numAsString,
+		resolvedFormat:  resolvedFormatType(opts[optResolvedFormat]),
+		flatten:         flatten,
+		flattenMaxDepth: flattenMaxDepth,
+		source:          source,
+	}
+}
+
+// FileFormat implements the FileEncoder interface.
+func (e *jsonEncoder) FileFormat(
+	recordSeparator string,
+) (string, func(io.Writer, []byte) error, error) {
+	return delimitedFileFormat(`json`, recordSeparator)
+}
+
+// datumAsJSON converts a datum to JSON, honoring `num_as_string`.
+func (e *jsonEncoder) datumAsJSON(d tree.Datum) (json.JSON, error) {
+	if e.numAsString {
+		switch d.(type) {
+		case *tree.DInt, *tree.DDecimal:
+			return json.FromString(d.String()), nil
+		}
+	}
+	return tree.AsJSON(d)
 }
 
 // EncodeKey implements the Encoder interface.
@@ -95,7 +229,7 @@ func (e *jsonEncoder) EncodeKey(
 			return nil, err
 		}
 		var err error
-		jsonEntries[i], err = tree.AsJSON(datum.Datum)
+		jsonEntries[i], err = e.datumAsJSON(datum.Datum)
 		if err != nil {
 			return nil, err
 		}
@@ -111,23 +245,696 @@ func (e *jsonEncoder) EncodeKey(
 
 // EncodeValue implements the Encoder interface.
 func (e *jsonEncoder) EncodeValue(
-	tableDesc *sqlbase.TableDescriptor, row sqlbase.EncDatumRow, updated hlc.Timestamp,
+	tableDesc *sqlbase.TableDescriptor, row, prevRow sqlbase.EncDatumRow, updated hlc.Timestamp,
 ) ([]byte, error) {
-	columns := tableDesc.Columns
-	jsonEntries := make(map[string]interface{}, len(columns))
+	jsonEntries, err := e.rowAsJSONEntries(tableDesc, row)
+	if err != nil {
+		return nil, err
+	}
+	if jsonEntries == nil {
+		jsonEntries = make(map[string]interface{})
+	}
+	meta := make(map[string]interface{})
 	if _, ok := e.opts[optUpdatedTimestamps]; ok {
-		jsonEntries[jsonMetaSentinel] = map[string]interface{}{
-			`updated`: tree.TimestampToDecimal(updated).Decimal.String(),
+		meta[`updated`] = tree.TimestampToDecimal(updated).Decimal.String()
+	}
+	if envelopeType(e.opts[optEnvelope]) == optEnvelopeDiff {
+		// An unknown previous version is JSON null.
+		var before interface{}
+		if prevRow != nil {
+			beforeEntries, err := e.rowAsJSONEntries(tableDesc, prevRow)
+			if err != nil {
+				return nil, err
+			}
+			before = beforeEntries
 		}
+		meta[`before`] = before
+	}
+	if e.source {
+		meta[`source`] = e.sourceJSON(tableDesc)
+	}
+	if len(meta) > 0 {
+		jsonEntries[jsonMetaSentinel] = meta
+	}
+	j, err := json.MakeJSON(jsonEntries)
+	if err != nil {
+		return nil, err
 	}
+	e.buf.Reset()
+	j.Format(&e.buf)
+	return e.buf.Bytes(), nil
+}
+
+// sourceJSON returns the `source` of a row of the given table: the IDs of the
+// table and its database, which stay the same when they're renamed, with their
+// names and the schema's. The database's name is the one it had when the
+// changefeed was created and is left out if that isn't known.
+func (e *jsonEncoder) sourceJSON(tableDesc *sqlbase.TableDescriptor) map[string]interface{} {
+	source := map[string]interface{}{
+		`table_id`:    int64(tableDesc.ID),
+		`database_id`: int64(tableDesc.ParentID),
+		`schema`:      tree.PublicSchema,
+		`table`:       tableDesc.Name,
+	}
+	if database := e.targets[tableDesc.ID].StatementTimeDatabaseName; database != `` {
+		source[`database`] = database
+	}
+	return source
+}
+
+// rowAsJSONEntries returns a map of every column name in row to its value, or
+// nil for a nil row.
+func (e *jsonEncoder) rowAsJSONEntries(
+	tableDesc *sqlbase.TableDescriptor, row sqlbase.EncDatumRow,
+) (map[string]interface{}, error) {
+	if row == nil {
+		return nil, nil
+	}
+	columns := tableDesc.Columns
+	jsonEntries := make(map[string]interface{}, len(columns))
 	for i, col := range columns {
 		datum := row[i]
 		if err := datum.EnsureDecoded(&col.Type, &e.alloc); err != nil {
 			return nil, err
 		}
+		j, err := e.datumAsJSON(datum.Datum)
+		if err != nil {
+			return nil, err
+		}
+		if !e.flatten {
+			jsonEntries[col.Name] = j
+		} else if err := e.flattenInto(jsonEntries, col.Name, j, 0 /* depth */); err != nil {
+			return nil, err
+		}
+	}
+	return jsonEntries, nil
+}
+
+// flattenInto adds j to entries under name, or, if it's a non-empty object and
+// the maximum depth for `flatten` isn't reached, adds each of its fields under
+// the name and a dot, recursively. The depth is the number of objects that
+// have been flattened into name.
+func (e *jsonEncoder) flattenInto(
+	entries map[string]interface{}, name string, j json.JSON, depth int,
+) error {
+	it, err := j.ObjectIter()
+	if err != nil {
+		return err
+	}
+	if it != nil && (e.flattenMaxDepth == 0 || depth < e.flattenMaxDepth) && j.Len() > 0 {
+		for it.Next() {
+			if err := e.flattenInto(entries, name+`.`+it.Key(), it.Value(), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// A column named `a.b` and a field b of a column a can't both be kept.
+	if _, ok := entries[name]; ok {
+		return errors.Errorf(`%s: more than one field is named %s`, optFlatten, name)
+	}
+	entries[name] = j
+	return nil
+}
+
+// EncodeResolvedTimestamp implements the Encoder interface. By default the
+// payload is a JSON object with the decimal timestamp under `__crdb__`, but
+// `resolved_format` can make it the bare decimal, the wall time in nanoseconds
+// since the epoch, or an ISO-8601 string. The last two drop the logical part,
+// which only makes the marker more conservative.
+func (e *jsonEncoder) EncodeResolvedTimestamp(_ string, resolved hlc.Timestamp) ([]byte, error) {
+	switch e.resolvedFormat {
+	case ``, optResolvedFormatWrapped:
+		resolvedMetaRaw := map[string]interface{}{
+			jsonMetaSentinel: map[string]interface{}{
+				`resolved`: tree.TimestampToDecimal(resolved).Decimal.String(),
+			},
+		}
+		return gojson.Marshal(resolvedMetaRaw)
+	case optResolvedFormatDecimal:
+		return []byte(tree.TimestampToDecimal(resolved).Decimal.String()), nil
+	case optResolvedFormatNanos:
+		return []byte(strconv.FormatInt(resolved.WallTime, 10)), nil
+	case optResolvedFormatISO8601:
+		return []byte(resolved.GoTime().UTC().Format(time.RFC3339Nano)), nil
+	default:
+		return nil, errors.Errorf(`unknown %s: %s`, optResolvedFormat, e.resolvedFormat)
+	}
+}
+
+const (
+	cloudEventsSpecVersion = `1.0`
+	cloudEventsContentType = `application/cloudevents+json`
+	cloudEventsTypeUpsert  = `com.cockroachlabs.changefeed.upsert`
+	cloudEventsTypeDelete  = `com.cockroachlabs.changefeed.delete`
+	cloudEventsTypeResolve = `com.cockroachlabs.changefeed.resolved`
+)
+
+// cloudEventsEncoder encodes changefeed entries as CloudEvents in the JSON
+// event format (https://github.com/cloudevents/spec). Keys are the same as with
+// jsonEncoder. Values are events whose `data` is the row as jsonEncoder would
+// encode it, without the `__crdb__` sub-object: the updated timestamp is the
+// event's `time` and `envelope=diff` isn't supported. A deletion is an event
+// with null `data`. The `source` identifies the cluster and changefeed and the
+// `subject` is the table name, or the topic for resolved timestamps.
+//
+// An event's `id` is derived from its subject, the message's key and the
+// updated timestamp, so a message that's delivered more than once has the same
+// one each time and consumers can use it to deduplicate.
+type cloudEventsEncoder struct {
+	*jsonEncoder
+	source string
+}
+
+var _ Encoder = &cloudEventsEncoder{}
+var _ KeyedValueEncoder = &cloudEventsEncoder{}
+
+func makeCloudEventsEncoder(
+	opts map[string]string, clusterID uuid.UUID, jobID int64,
+) *cloudEventsEncoder {
+	return &cloudEventsEncoder{
+		jsonEncoder: makeJSONEncoder(opts),
+		source:      fmt.Sprintf(`/cockroachdb/%s/changefeed/%d`, clusterID, jobID),
+	}
+}
+
+// EncodeValue implements the Encoder interface. Without the key, the `id` is
+// derived from the row, which a deletion doesn't have, so emitEntries uses
+// EncodeKeyedValue instead.
+func (e *cloudEventsEncoder) EncodeValue(
+	tableDesc *sqlbase.TableDescriptor, row, prevRow sqlbase.EncDatumRow, updated hlc.Timestamp,
+) ([]byte, error) {
+	var key []byte
+	if row != nil {
 		var err error
-		jsonEntries[col.Name], err = tree.AsJSON(datum.Datum)
+		if key, err = e.jsonEncoder.EncodeKey(tableDesc, row); err != nil {
+			return nil, err
+		}
+		key = append([]byte(nil), key...)
+	}
+	return e.EncodeKeyedValue(tableDesc, key, row, prevRow, updated)
+}
+
+// EncodeKeyedValue implements the KeyedValueEncoder interface.
+func (e *cloudEventsEncoder) EncodeKeyedValue(
+	tableDesc *sqlbase.TableDescriptor, key []byte, row, _ sqlbase.EncDatumRow, updated hlc.Timestamp,
+) ([]byte, error) {
+	if row == nil {
+		return e.encodeEvent(cloudEventsTypeDelete, tableDesc.Name, key, updated, nil)
+	}
+	data, err := e.rowAsJSONEntries(tableDesc, row)
+	if err != nil {
+		return nil, err
+	}
+	return e.encodeEvent(cloudEventsTypeUpsert, tableDesc.Name, key, updated, data)
+}
+
+// EncodeResolvedTimestamp implements the Encoder interface.
+func (e *cloudEventsEncoder) EncodeResolvedTimestamp(
+	topic string, resolved hlc.Timestamp,
+) ([]byte, error) {
+	data := map[string]interface{}{
+		`resolved`: tree.TimestampToDecimal(resolved).Decimal.String(),
+	}
+	return e.encodeEvent(cloudEventsTypeResolve, topic, nil /* key */, resolved, data)
+}
+
+// cloudEventsID returns the `id` of the event with the given subject, key and
+// timestamp: a name-based UUID, so it's the same every time they are.
+func cloudEventsID(subject string, key []byte, ts hlc.Timestamp) string {
+	name := subject + "\x00" + string(key) + "\x00" + ts.String()
+	return uuid.NewV5(uuid.NamespaceURL, name).String()
+}
+
+func (e *cloudEventsEncoder) encodeEvent(
+	eventType, subject string, key []byte, ts hlc.Timestamp, data map[string]interface{},
+) ([]byte, error) {
+	event := map[string]interface{}{
+		`specversion`:     cloudEventsSpecVersion,
+		`id`:              cloudEventsID(subject, key, ts),
+		`source`:          e.source,
+		`type`:            eventType,
+		`time`:            ts.GoTime().UTC().Format(time.RFC3339Nano),
+		`datacontenttype`: `application/json`,
+		`data`:            nil,
+	}
+	if subject != `` {
+		event[`subject`] = subject
+	}
+	if data != nil {
+		event[`data`] = data
+	}
+	j, err := json.MakeJSON(event)
+	if err != nil {
+		return nil, err
+	}
+	e.buf.Reset()
+	j.Format(&e.buf)
+	return e.buf.Bytes(), nil
+}
+
+// rawEncoder passes through payloads that were encoded before they were written
+// to the table. Values are the bytes of the table's only column that isn't in
+// the primary key, which must be BYTES or STRING, copied verbatim; a NULL is an
+// empty value and a deletion has no value. Keys and resolved timestamp payloads
+// are the same as with jsonEncoder.
+type rawEncoder struct {
+	*jsonEncoder
+}
+
+var _ Encoder = &rawEncoder{}
+
+func makeRawEncoder(opts map[string]string) *rawEncoder {
+	return &rawEncoder{jsonEncoder: makeJSONEncoder(opts)}
+}
+
+// FileFormat implements the FileEncoder interface. Raw values are opaque, so
+// nothing stops them from containing the record separator, which is why the
+// cloud storage sink defaults to a length_prefixed one for them.
+func (e *rawEncoder) FileFormat(
+	recordSeparator string,
+) (string, func(io.Writer, []byte) error, error) {
+	return delimitedFileFormat(`raw`, recordSeparator)
+}
+
+// EncodeValue implements the Encoder interface.
+func (e *rawEncoder) EncodeValue(
+	tableDesc *sqlbase.TableDescriptor, row, _ sqlbase.EncDatumRow, _ hlc.Timestamp,
+) ([]byte, error) {
+	if row == nil {
+		return nil, nil
+	}
+	// The table may have been altered since the changefeed was created, so
+	// check its shape again.
+	idx, err := rawValueColumn(tableDesc)
+	if err != nil {
+		return nil, err
+	}
+	datum := row[idx]
+	if err := datum.EnsureDecoded(&tableDesc.Columns[idx].Type, &e.alloc); err != nil {
+		return nil, err
+	}
+	switch d := datum.Datum.(type) {
+	case *tree.DBytes:
+		return []byte(*d), nil
+	case *tree.DString:
+		return []byte(*d), nil
+	default:
+		if datum.Datum == tree.DNull {
+			return []byte{}, nil
+		}
+		return nil, errors.Errorf(`unexpected %T in %s=%s value`, d, optFormat, optFormatRaw)
+	}
+}
+
+// rawValueColumn returns the index of the column whose bytes are the value of
+// a row with `format=raw`: the table's only column that isn't in the primary
+// key, which must be BYTES or STRING.
+func rawValueColumn(tableDesc *sqlbase.TableDescriptor) (int, error) {
+	pkCols := make(map[sqlbase.ColumnID]struct{}, len(tableDesc.PrimaryIndex.ColumnIDs))
+	for _, colID := range tableDesc.PrimaryIndex.ColumnIDs {
+		pkCols[colID] = struct{}{}
+	}
+	idx, numValueCols := -1, 0
+	for i, col := range tableDesc.Columns {
+		if _, ok := pkCols[col.ID]; !ok {
+			idx = i
+			numValueCols++
+		}
+	}
+	if numValueCols != 1 {
+		return 0, errors.Errorf(
+			`%s=%s requires exactly 1 column outside the primary key: %s has %d`,
+			optFormat, optFormatRaw, tableDesc.Name, numValueCols)
+	}
+	col := tableDesc.Columns[idx]
+	switch col.Type.SemanticType {
+	case sqlbase.ColumnType_BYTES, sqlbase.ColumnType_STRING:
+		return idx, nil
+	default:
+		return 0, errors.Errorf(`%s=%s requires a BYTES or STRING value column: %s.%s is %s`,
+			optFormat, optFormatRaw, tableDesc.Name, col.Name, col.Type.SQLString())
+	}
+}
+
+// DescriptorEncoder is implemented by Encoders whose messages can't be decoded
+// without a schema that's published separately. Sinks that have somewhere to
+// publish it, like the cloud storage sink, do.
+type DescriptorEncoder interface {
+	// EncodeDescriptor encodes the schema of the messages of the given table
+	// version. The returned bytes are only valid until the next call to
+	// Encode*.
+	EncodeDescriptor(*sqlbase.TableDescriptor) ([]byte, error)
+}
+
+// KeyedValueEncoder is implemented by Encoders whose values depend on the
+// message's key, like cloudEventsEncoder, which derives each event's `id` from
+// it. A deletion's row is nil, so the key can't be recomputed from it.
+type KeyedValueEncoder interface {
+	// EncodeKeyedValue is EncodeValue with the message's encoded key, as
+	// returned by EncodeKey.
+	EncodeKeyedValue(
+		tableDesc *sqlbase.TableDescriptor, key []byte, row, prevRow sqlbase.EncDatumRow,
+		updated hlc.Timestamp,
+	) ([]byte, error)
+}
+
+// keyedValueEncoder returns the KeyedValueEncoder that encodes the values of
+// the given Encoder, or nil if there isn't one.
+func keyedValueEncoder(e Encoder) KeyedValueEncoder {
+	switch e := e.(type) {
+	case KeyedValueEncoder:
+		return e
+	case *keyFormatEncoder:
+		return keyedValueEncoder(e.Encoder)
+	default:
+		return nil
+	}
+}
+
+// protobufContentType is the content type of `format=protobuf` messages.
+const protobufContentType = `application/x-protobuf`
+
+// protobufEncoder encodes changefeed entries as protobuf messages, mapped from
+// the table as described in protobuf.go. Values have every column, keys only
+// the primary key columns, and a deletion has no value. The updated timestamp
+// can't be included, since every field number is a column's. Resolved
+// timestamp payloads are a message with the decimal timestamp as string field
+// 1.
+type protobufEncoder struct {
+	alloc sqlbase.DatumAlloc
+	buf   []byte
+}
+
+var _ Encoder = &protobufEncoder{}
+var _ DescriptorEncoder = &protobufEncoder{}
+
+func makeProtobufEncoder(_ map[string]string) *protobufEncoder {
+	return &protobufEncoder{}
+}
+
+// FileFormat implements the FileEncoder interface. Each record is preceded by
+// its length as a varint, which is how protobuf libraries delimit messages, so
+// the `record_separator` sink param isn't supported.
+func (e *protobufEncoder) FileFormat(
+	recordSeparator string,
+) (string, func(io.Writer, []byte) error, error) {
+	if recordSeparator != `` {
+		return ``, nil, errors.Errorf(`%s is not supported with %s=%s`,
+			sinkParamRecordSeparator, optFormat, optFormatProtobuf)
+	}
+	return `.protodelim`, writeProtobufDelimitedRecord, nil
+}
+
+// encodeColumns encodes the columns of row with the given indexes.
+func (e *protobufEncoder) encodeColumns(
+	tableDesc *sqlbase.TableDescriptor, row sqlbase.EncDatumRow, idxs []int,
+) ([]byte, error) {
+	e.buf = e.buf[:0]
+	for _, idx := range idxs {
+		datum, col := row[idx], &tableDesc.Columns[idx]
+		if err := datum.EnsureDecoded(&col.Type, &e.alloc); err != nil {
+			return nil, err
+		}
+		var err error
+		if e.buf, err = appendProtobufField(e.buf, col, datum.Datum); err != nil {
+			return nil, err
+		}
+	}
+	return e.buf, nil
+}
+
+// EncodeKey implements the Encoder interface.
+func (e *protobufEncoder) EncodeKey(
+	tableDesc *sqlbase.TableDescriptor, row sqlbase.EncDatumRow,
+) ([]byte, error) {
+	colIdxByID := tableDesc.ColumnIdxMap()
+	idxs := make([]int, len(tableDesc.PrimaryIndex.ColumnIDs))
+	for i, colID := range tableDesc.PrimaryIndex.ColumnIDs {
+		idx, ok := colIdxByID[colID]
+		if !ok {
+			return nil, errors.Errorf(`unknown column id: %d`, colID)
+		}
+		idxs[i] = idx
+	}
+	return e.encodeColumns(tableDesc, row, idxs)
+}
+
+// EncodeValue implements the Encoder interface.
+func (e *protobufEncoder) EncodeValue(
+	tableDesc *sqlbase.TableDescriptor, row, _ sqlbase.EncDatumRow, _ hlc.Timestamp,
+) ([]byte, error) {
+	if row == nil {
+		return nil, nil
+	}
+	idxs := make([]int, len(tableDesc.Columns))
+	for i := range idxs {
+		idxs[i] = i
+	}
+	return e.encodeColumns(tableDesc, row, idxs)
+}
+
+// EncodeResolvedTimestamp implements the Encoder interface.
+func (e *protobufEncoder) EncodeResolvedTimestamp(
+	_ string, resolved hlc.Timestamp,
+) ([]byte, error) {
+	resolvedStr := tree.TimestampToDecimal(resolved).Decimal.String()
+	e.buf = appendProtobufVarint(e.buf[:0], 1<<3|protobufWireBytes)
+	e.buf = appendProtobufVarint(e.buf, uint64(len(resolvedStr)))
+	return append(e.buf, resolvedStr...), nil
+}
+
+// EncodeDescriptor implements the DescriptorEncoder interface. The descriptor
+// is a serialized FileDescriptorSet with the table's message.
+func (e *protobufEncoder) EncodeDescriptor(tableDesc *sqlbase.TableDescriptor) ([]byte, error) {
+	return protobufDescriptorSet(tableDesc)
+}
+
+// keyEncoder is the part of an Encoder that encodes keys.
+type keyEncoder interface {
+	EncodeKey(*sqlbase.TableDescriptor, sqlbase.EncDatumRow) ([]byte, error)
+}
+
+// getKeyEncoder returns the keyEncoder for the `key_format=` option in opts.
+func getKeyEncoder(opts map[string]string) (keyEncoder, error) {
+	switch formatType(opts[optKeyFormat]) {
+	case optFormatJSON:
+		return makeJSONEncoder(opts), nil
+	case optFormatAvro:
+		if opts[optConfluentSchemaRegistry] == `` {
+			return nil, errors.Errorf(`WITH option %s is required for %s=%s`,
+				optConfluentSchemaRegistry, optKeyFormat, optFormatAvro)
+		}
+		return newConfluentAvroEncoder(opts)
+	case optFormatRaw:
+		return &rawKeyEncoder{}, nil
+	default:
+		return nil, errors.Errorf(`unknown %s: %s`, optKeyFormat, opts[optKeyFormat])
+	}
+}
+
+// keyFormatEncoder is an Encoder whose keys are in the `key_format=` format
+// instead of the one that goes with its values, for consumers that need keys
+// in a particular serialization, such as Avro with a registered key schema,
+// to join on them. Values and resolved timestamps are unchanged.
+type keyFormatEncoder struct {
+	Encoder
+	keys keyEncoder
+}
+
+var _ Encoder = &keyFormatEncoder{}
+
+// EncodeKey implements the Encoder interface.
+func (e *keyFormatEncoder) EncodeKey(
+	tableDesc *sqlbase.TableDescriptor, row sqlbase.EncDatumRow,
+) ([]byte, error) {
+	return e.keys.EncodeKey(tableDesc, row)
+}
+
+// rawKeyEncoder encodes keys with `key_format=raw`: the bytes of the table's
+// only primary key column, which must be BYTES or STRING, copied verbatim.
+type rawKeyEncoder struct {
+	alloc sqlbase.DatumAlloc
+}
+
+// EncodeKey implements the keyEncoder interface.
+func (e *rawKeyEncoder) EncodeKey(
+	tableDesc *sqlbase.TableDescriptor, row sqlbase.EncDatumRow,
+) ([]byte, error) {
+	// The table may have been altered since the changefeed was created, so
+	// check its shape again.
+	idx, err := rawKeyColumn(tableDesc)
+	if err != nil {
+		return nil, err
+	}
+	datum := row[idx]
+	if err := datum.EnsureDecoded(&tableDesc.Columns[idx].Type, &e.alloc); err != nil {
+		return nil, err
+	}
+	switch d := datum.Datum.(type) {
+	case *tree.DBytes:
+		return []byte(*d), nil
+	case *tree.DString:
+		return []byte(*d), nil
+	default:
+		return nil, errors.Errorf(`unexpected %T in %s=%s key`, d, optKeyFormat, optFormatRaw)
+	}
+}
+
+// rawKeyColumn returns the index of the column whose bytes are the key of a
+// row with `key_format=raw`: the table's only primary key column, which must
+// be BYTES or STRING.
+func rawKeyColumn(tableDesc *sqlbase.TableDescriptor) (int, error) {
+	if n := len(tableDesc.PrimaryIndex.ColumnIDs); n != 1 {
+		return 0, errors.Errorf(
+			`%s=%s requires exactly 1 primary key column: %s has %d`,
+			optKeyFormat, optFormatRaw, tableDesc.Name, n)
+	}
+	idx, ok := tableDesc.ColumnIdxMap()[tableDesc.PrimaryIndex.ColumnIDs[0]]
+	if !ok {
+		return 0, errors.Errorf(`unknown column id: %d`, tableDesc.PrimaryIndex.ColumnIDs[0])
+	}
+	col := tableDesc.Columns[idx]
+	switch col.Type.SemanticType {
+	case sqlbase.ColumnType_BYTES, sqlbase.ColumnType_STRING:
+		return idx, nil
+	default:
+		return 0, errors.Errorf(`%s=%s requires a BYTES or STRING key column: %s.%s is %s`,
+			optKeyFormat, optFormatRaw, tableDesc.Name, col.Name, col.Type.SQLString())
+	}
+}
+
+// parsePartitionKeyOpt splits the value of the `partition_key` option into
+// column names.
+func parsePartitionKeyOpt(opt string) []string {
+	names := strings.Split(opt, `,`)
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+	}
+	return names
+}
+
+// partitionKeyColumns returns the indexes of the columns named by the given
+// option, which must all be in the table's primary key. Only primary key
+// columns can be used, because the partition of a row would otherwise change
+// when it's updated and the updates of a row could be delivered out of order.
+func partitionKeyColumns(
+	tableDesc *sqlbase.TableDescriptor, opt string, names []string,
+) ([]int, error) {
+	pkCols := make(map[sqlbase.ColumnID]struct{}, len(tableDesc.PrimaryIndex.ColumnIDs))
+	for _, colID := range tableDesc.PrimaryIndex.ColumnIDs {
+		pkCols[colID] = struct{}{}
+	}
+	idxs := make([]int, len(names))
+	for i, name := range names {
+		idx := -1
+		for j, col := range tableDesc.Columns {
+			if col.Name == name {
+				idx = j
+				break
+			}
+		}
+		if idx == -1 {
+			return nil, errors.Errorf(`%s column %q does not exist in %s`,
+				opt, name, tableDesc.Name)
+		}
+		if _, ok := pkCols[tableDesc.Columns[idx].ID]; !ok {
+			return nil, errors.Errorf(`%s column %q is not in the primary key of %s`,
+				opt, name, tableDesc.Name)
+		}
+		idxs[i] = idx
+	}
+	return idxs, nil
+}
+
+// partitionByColumn returns the index of the column named by the
+// `partition_by_column` option, which must be an INT column in the table's
+// primary key.
+func partitionByColumn(tableDesc *sqlbase.TableDescriptor, name string) (int, error) {
+	idxs, err := partitionKeyColumns(tableDesc, optPartitionByColumn, []string{name})
+	if err != nil {
+		return 0, err
+	}
+	col := tableDesc.Columns[idxs[0]]
+	if col.Type.SemanticType != sqlbase.ColumnType_INT {
+		return 0, errors.Errorf(`%s column %q must be an INT: %s.%s is %s`,
+			optPartitionByColumn, name, tableDesc.Name, col.Name, col.Type.SQLString())
+	}
+	return idxs[0], nil
+}
+
+// partitionHintEncoder computes the partitionHint of a row with the
+// `partition_key` or `partition_by_column` option.
+//
+// With `partition_key`, the hint is a key: a JSON array of the named columns,
+// like the key of the json format is of the primary key columns. With
+// `partition_by_column`, it's the value of the named column.
+type partitionHintEncoder struct {
+	// keyNames are the `partition_key` columns, if it's set.
+	keyNames []string
+	// columnName is the `partition_by_column` column, if it's set.
+	columnName string
+
+	alloc sqlbase.DatumAlloc
+	buf   bytes.Buffer
+}
+
+// makePartitionHintEncoder returns a partitionHintEncoder, or nil if neither
+// option is set.
+func makePartitionHintEncoder(opts map[string]string) *partitionHintEncoder {
+	if opt, ok := opts[optPartitionKey]; ok {
+		return &partitionHintEncoder{keyNames: parsePartitionKeyOpt(opt)}
+	}
+	if opt, ok := opts[optPartitionByColumn]; ok {
+		return &partitionHintEncoder{columnName: opt}
+	}
+	return nil
+}
+
+// EncodePartitionHint returns the partitionHint of a row. The key of the
+// returned hint is only valid until the next call.
+func (e *partitionHintEncoder) EncodePartitionHint(
+	tableDesc *sqlbase.TableDescriptor, row sqlbase.EncDatumRow,
+) (partitionHint, error) {
+	// The table may have been altered since the changefeed was created, so
+	// look the columns up again.
+	if e.keyNames == nil {
+		idx, err := partitionByColumn(tableDesc, e.columnName)
 		if err != nil {
+			return partitionHint{}, err
+		}
+		datum := row[idx]
+		if err := datum.EnsureDecoded(&tableDesc.Columns[idx].Type, &e.alloc); err != nil {
+			return partitionHint{}, err
+		}
+		d, ok := datum.Datum.(*tree.DInt)
+		if !ok {
+			return partitionHint{}, errors.Errorf(`unexpected %T in %s column %q`,
+				datum.Datum, optPartitionByColumn, e.columnName)
+		}
+		return partitionHint{value: int64(*d), hasValue: true}, nil
+	}
+	key, err := e.encodeKey(tableDesc, row)
+	if err != nil {
+		return partitionHint{}, err
+	}
+	return partitionHint{key: key}, nil
+}
+
+func (e *partitionHintEncoder) encodeKey(
+	tableDesc *sqlbase.TableDescriptor, row sqlbase.EncDatumRow,
+) ([]byte, error) {
+	idxs, err := partitionKeyColumns(tableDesc, optPartitionKey, e.keyNames)
+	if err != nil {
+		return nil, err
+	}
+	jsonEntries := make([]interface{}, len(idxs))
+	for i, idx := range idxs {
+		datum, col := row[idx], tableDesc.Columns[idx]
+		if err := datum.EnsureDecoded(&col.Type, &e.alloc); err != nil {
+			return nil, err
+		}
+		if jsonEntries[i], err = tree.AsJSON(datum.Datum); err != nil {
 			return nil, err
 		}
 	}
@@ -140,14 +947,162 @@ func (e *jsonEncoder) EncodeValue(
 	return e.buf.Bytes(), nil
 }
 
-// EncodeResolvedTimestamp implements the Encoder interface.
-func (e *jsonEncoder) EncodeResolvedTimestamp(_ string, resolved hlc.Timestamp) ([]byte, error) {
-	resolvedMetaRaw := map[string]interface{}{
-		jsonMetaSentinel: map[string]interface{}{
-			`resolved`: tree.TimestampToDecimal(resolved).Decimal.String(),
-		},
+// validateExcludeColumns checks that every column named by the
+// `exclude_columns` option is in at least one of the watched tables and isn't
+// in the primary key of any of them. Keys are always emitted in full, so a
+// primary key column can't be kept from leaving the cluster.
+func validateExcludeColumns(tableDescs []*sqlbase.TableDescriptor, opt string) error {
+	for _, name := range parsePartitionKeyOpt(opt) {
+		found := false
+		for _, tableDesc := range tableDescs {
+			for _, col := range tableDesc.Columns {
+				if col.Name != name {
+					continue
+				}
+				found = true
+				for _, colID := range tableDesc.PrimaryIndex.ColumnIDs {
+					if colID == col.ID {
+						return errors.Errorf(`%s column %q is in the primary key of %s`,
+							optExcludeColumns, name, tableDesc.Name)
+					}
+				}
+			}
+		}
+		if !found {
+			return errors.Errorf(`%s column %q does not exist in any watched table`,
+				optExcludeColumns, name)
+		}
+	}
+	return nil
+}
+
+// columnExcluder strips the columns named by the `exclude_columns` option out
+// of rows before their values are encoded, so the excluded columns are never
+// given to the Encoder, whatever the format. Keys are encoded from the full
+// row.
+type columnExcluder struct {
+	names map[string]struct{}
+	// projections caches the projections of the most recently used versions
+	// of tables, keyed by tableIDAndVersion, up to columnExcluderCacheSize.
+	projections *cache.UnorderedCache
+}
+
+// columnExcluderCacheSize is how many table versions a columnExcluder keeps
+// the projection of. Rows of more than a couple of versions of a table are
+// only interleaved around a schema change, so this only has to cover the
+// tables of the changefeed.
+const columnExcluderCacheSize = 128
+
+// columnProjection is a table descriptor with only the columns that aren't
+// excluded, and the indexes of those columns in the full row.
+type columnProjection struct {
+	tableDesc *sqlbase.TableDescriptor
+	idxs      []int
+}
+
+// makeColumnExcluder returns a columnExcluder, or nil if the option isn't set.
+func makeColumnExcluder(opts map[string]string) *columnExcluder {
+	opt, ok := opts[optExcludeColumns]
+	if !ok {
+		return nil
+	}
+	e := &columnExcluder{
+		names: make(map[string]struct{}),
+		projections: cache.NewUnorderedCache(cache.Config{
+			Policy: cache.CacheLRU,
+			ShouldEvict: func(size int, _, _ interface{}) bool {
+				return size > columnExcluderCacheSize
+			},
+		}),
+	}
+	for _, name := range parsePartitionKeyOpt(opt) {
+		e.names[name] = struct{}{}
+	}
+	return e
+}
+
+// Project returns the table descriptor and rows without the excluded columns.
+// A nil row stays nil.
+func (e *columnExcluder) Project(
+	tableDesc *sqlbase.TableDescriptor, row, prevRow sqlbase.EncDatumRow,
+) (*sqlbase.TableDescriptor, sqlbase.EncDatumRow, sqlbase.EncDatumRow) {
+	// The table may have been altered since the changefeed was created, so
+	// the columns are looked up by name for each version.
+	cacheKey := makeTableIDAndVersion(tableDesc.ID, tableDesc.Version)
+	var p columnProjection
+	if cached, ok := e.projections.Get(cacheKey); ok {
+		p = cached.(columnProjection)
+	} else {
+		projected := *tableDesc
+		projected.Columns = nil
+		for i, col := range tableDesc.Columns {
+			if _, ok := e.names[col.Name]; !ok {
+				projected.Columns = append(projected.Columns, col)
+				p.idxs = append(p.idxs, i)
+			}
+		}
+		p.tableDesc = &projected
+		e.projections.Add(cacheKey, p)
+	}
+	project := func(row sqlbase.EncDatumRow) sqlbase.EncDatumRow {
+		if row == nil {
+			return nil
+		}
+		projected := make(sqlbase.EncDatumRow, len(p.idxs))
+		for i, idx := range p.idxs {
+			projected[i] = row[idx]
+		}
+		return projected
+	}
+	return p.tableDesc, project(row), project(prevRow)
+}
+
+// columnDiffer strips the columns that an update didn't change out of rows
+// before their values are encoded, for the `diff_only` option, so that the
+// value of an update to a couple of columns of a wide row is only those
+// columns and the primary key. Consumers apply it onto their copy of the row.
+// Rows without a previous version, which includes inserts, and deletions are
+// left whole.
+type columnDiffer struct {
+	alloc   sqlbase.DatumAlloc
+	evalCtx tree.EvalContext
+}
+
+// makeColumnDiffer returns a columnDiffer, or nil if the option isn't set.
+func makeColumnDiffer(opts map[string]string) *columnDiffer {
+	if _, ok := opts[optDiffOnly]; !ok {
+		return nil
+	}
+	return &columnDiffer{}
+}
+
+// Project returns the table descriptor and rows with only the primary key
+// columns and the columns whose value differs between row and prevRow. Unlike
+// columnExcluder, the columns depend on the row, so nothing is cached.
+func (d *columnDiffer) Project(
+	tableDesc *sqlbase.TableDescriptor, row, prevRow sqlbase.EncDatumRow,
+) (*sqlbase.TableDescriptor, sqlbase.EncDatumRow, sqlbase.EncDatumRow, error) {
+	if row == nil || prevRow == nil {
+		return tableDesc, row, prevRow, nil
+	}
+	projected := *tableDesc
+	projected.Columns = nil
+	var projectedRow, projectedPrevRow sqlbase.EncDatumRow
+	for i, col := range tableDesc.Columns {
+		if !tableDesc.PrimaryIndex.ContainsColumnID(col.ID) {
+			cmp, err := row[i].Compare(&col.Type, &d.alloc, &d.evalCtx, &prevRow[i])
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if cmp == 0 {
+				continue
+			}
+		}
+		projected.Columns = append(projected.Columns, col)
+		projectedRow = append(projectedRow, row[i])
+		projectedPrevRow = append(projectedPrevRow, prevRow[i])
 	}
-	return gojson.Marshal(resolvedMetaRaw)
+	return &projected, projectedRow, projectedPrevRow, nil
 }
 
 // confluentAvroEncoder encodes changefeed entries as Avro's binary or textual
@@ -232,7 +1187,7 @@ func (e *confluentAvroEncoder) EncodeKey(
 
 // EncodeValue implements the Encoder interface.
 func (e *confluentAvroEncoder) EncodeValue(
-	tableDesc *sqlbase.TableDescriptor, row sqlbase.EncDatumRow, updated hlc.Timestamp,
+	tableDesc *sqlbase.TableDescriptor, row, prevRow sqlbase.EncDatumRow, updated hlc.Timestamp,
 ) ([]byte, error) {
 	cacheKey := makeTableIDAndVersion(tableDesc.ID, tableDesc.Version)
 	registered, ok := e.valueCache[cacheKey]
@@ -244,6 +1199,7 @@ func (e *confluentAvroEncoder) EncodeValue(
 
 		opts := avroEnvelopeOpts{afterField: true}
 		_, opts.updatedField = e.opts[optUpdatedTimestamps]
+		opts.beforeField = envelopeType(e.opts[optEnvelope]) == optEnvelopeDiff
 		registered.schema, err = envelopeToAvroSchema(tableDesc.Name, opts, afterDataSchema)
 		if err != nil {
 			return nil, err
@@ -271,7 +1227,7 @@ func (e *confluentAvroEncoder) EncodeValue(
 		0, 0, 0, 0, // Placeholder for the ID.
 	}
 	binary.BigEndian.PutUint32(header[1:5], uint32(registered.registryID))
-	return registered.schema.BinaryFromRow(header, meta, row)
+	return registered.schema.BinaryFromRow(header, meta, prevRow, row)
 }
 
 // EncodeResolvedTimestamp implements the Encoder interface.
@@ -310,7 +1266,7 @@ func (e *confluentAvroEncoder) EncodeResolvedTimestamp(
 		0, 0, 0, 0, // Placeholder for the ID.
 	}
 	binary.BigEndian.PutUint32(header[1:5], uint32(registered.registryID))
-	return registered.schema.BinaryFromRow(header, meta, nil /* row */)
+	return registered.schema.BinaryFromRow(header, meta, nil /* prevRow */, nil /* row */)
 }
 
 func (e *confluentAvroEncoder) register(schema *avroRecord, subject string) (int32, error) {
@@ -11,10 +11,12 @@ package changefeedccl
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	gosql "database/sql"
 	gojson "encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -78,8 +80,14 @@ func (s *benchSink) EmitResolvedTimestamp(_ context.Context, e Encoder, ts hlc.T
 	}
 	return s.emit(int64(len(p)))
 }
+func (s *benchSink) EmitSchemaChange(
+	context.Context, *sqlbase.TableDescriptor, sqlbase.DescriptorVersion, sqlbase.DescriptorVersion,
+) error {
+	return nil
+}
 func (s *benchSink) Flush(_ context.Context, _ hlc.Timestamp) error { return nil }
 func (s *benchSink) Close() error                                   { return nil }
+func (s *benchSink) Capabilities() SinkCapabilities                 { return bufferSinkCapabilities }
 func (s *benchSink) emit(bytes int64) error {
 	s.Lock()
 	defer s.Unlock()
@@ -149,9 +157,10 @@ func createBenchmarkChangefeed(
 		targets:  details.Targets,
 		m:        th,
 	}
-	rowsFn := kvsToRows(s.LeaseManager().(*sql.LeaseManager), details, buf.Get)
+	rowsFn := kvsToRows(s.DB(), s.LeaseManager().(*sql.LeaseManager), details, buf.Get)
 	tickFn := emitEntries(
-		s.ClusterSettings(), details, spans, encoder, sink, rowsFn, TestingKnobs{}, metrics)
+		s.ClusterSettings(), details, spans, encoder, sink, rowsFn, TestingKnobs{}, metrics,
+		nil /* schemaChangeFn */)
 
 	ctx, cancel := context.WithCancel(ctx)
 	go func() { _ = poller.Run(ctx) }()
@@ -496,7 +505,17 @@ func (c *tableFeed) Next(
 	for {
 		if c.rows != nil && c.rows.Next() {
 			var msgID int64
-			if err := c.rows.Scan(&topic, &partition, &msgID, &key, &value, &payload); err != nil {
+			var codec string
+			if err := c.rows.Scan(
+				&topic, &partition, &msgID, &key, &value, &payload, &codec,
+			); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			if value, err = decodeSQLSinkPayload(codec, value); err != nil {
+				t.Fatal(err)
+			}
+			if payload, err = decodeSQLSinkPayload(codec, payload); err != nil {
 				t.Fatal(err)
 			}
 
@@ -700,6 +719,9 @@ func (c *cloudFeed) Next(
 					// TODO(dan): Implement this when a test needs it.
 					continue
 				}
+				if strings.HasSuffix(file, `SCHEMACHANGE`) || strings.HasSuffix(file, `MANIFEST`) {
+					continue
+				}
 
 				var topic string
 				if subs := cloudFeedFileRE.FindStringSubmatch(file); subs == nil {
@@ -994,3 +1016,17 @@ func forceTableGC(
 		t.Fatal(err)
 	}
 }
+
+// decodeSQLSinkPayload decodes a value or resolved timestamp written by a
+// sqlSink with the given codec.
+func decodeSQLSinkPayload(codec string, payload []byte) ([]byte, error) {
+	if len(payload) == 0 || codec != sqlSinkCodecGzip {
+		return payload, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
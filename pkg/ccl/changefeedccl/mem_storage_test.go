@@ -0,0 +1,279 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/ccl/storageccl"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// memFiles are the files written to memExportStorages, by path.
+type memFiles struct {
+	syncutil.Mutex
+	m map[string][]byte
+}
+
+// names returns the paths of the files, sorted.
+func (f *memFiles) names() []string {
+	f.Lock()
+	defer f.Unlock()
+	var names []string
+	for name := range f.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// get returns the contents of the file at the given path.
+func (f *memFiles) get(name string) string {
+	f.Lock()
+	defer f.Unlock()
+	return string(f.m[name])
+}
+
+// memExportStorage is a storageccl.ExportStorage that keeps what's written to
+// it in memory, so a test can drive a cloud storage sink end to end and look at
+// everything it wrote without a real or emulated cloud backend. Its URIs are
+// `mem://<path>` and, like the buckets of a cloud, the files outlive the
+// storage that wrote them.
+type memExportStorage struct {
+	prefix string
+	files  *memFiles
+}
+
+var _ storageccl.ExportStorage = &memExportStorage{}
+var _ storageccl.ExportStorageRenamer = &memExportStorage{}
+
+// useMemExportStorage makes `mem://` URIs open memExportStorages that share the
+// returned memFiles, until the returned function is called. Every other URI
+// is opened as usual.
+func useMemExportStorage() (*memFiles, func()) {
+	files := &memFiles{m: make(map[string][]byte)}
+	orig := exportStorageFromURI
+	exportStorageFromURI = func(
+		ctx context.Context, uri string, settings *cluster.Settings,
+	) (storageccl.ExportStorage, error) {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != `mem` {
+			return orig(ctx, uri, settings)
+		}
+		return &memExportStorage{prefix: path.Join(u.Host, u.Path), files: files}, nil
+	}
+	return files, func() { exportStorageFromURI = orig }
+}
+
+func (s *memExportStorage) Conf() roachpb.ExportStorage {
+	return roachpb.ExportStorage{}
+}
+
+func (s *memExportStorage) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	s.files.Lock()
+	defer s.files.Unlock()
+	name := path.Join(s.prefix, basename)
+	contents, ok := s.files.m[name]
+	if !ok {
+		return nil, errors.Errorf(`%s does not exist`, name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(contents)), nil
+}
+
+func (s *memExportStorage) WriteFile(
+	ctx context.Context, basename string, content io.ReadSeeker,
+) error {
+	// Like the real ones, a write can't outlive its context.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	contents, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	s.files.Lock()
+	defer s.files.Unlock()
+	s.files.m[path.Join(s.prefix, basename)] = contents
+	return nil
+}
+
+func (s *memExportStorage) Delete(ctx context.Context, basename string) error {
+	s.files.Lock()
+	defer s.files.Unlock()
+	delete(s.files.m, path.Join(s.prefix, basename))
+	return nil
+}
+
+func (s *memExportStorage) Size(ctx context.Context, basename string) (int64, error) {
+	s.files.Lock()
+	defer s.files.Unlock()
+	name := path.Join(s.prefix, basename)
+	contents, ok := s.files.m[name]
+	if !ok {
+		return 0, errors.Errorf(`%s does not exist`, name)
+	}
+	return int64(len(contents)), nil
+}
+
+func (s *memExportStorage) Rename(ctx context.Context, oldBasename, newBasename string) error {
+	s.files.Lock()
+	defer s.files.Unlock()
+	oldName := path.Join(s.prefix, oldBasename)
+	contents, ok := s.files.m[oldName]
+	if !ok {
+		return errors.Errorf(`%s does not exist`, oldName)
+	}
+	delete(s.files.m, oldName)
+	s.files.m[path.Join(s.prefix, newBasename)] = contents
+	return nil
+}
+
+func (s *memExportStorage) Close() error {
+	return nil
+}
+
+func TestCloudStorageSinkMemStorage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	files, cleanup := useMemExportStorage()
+	defer cleanup()
+
+	cfg := cloudStorageSinkConfig{
+		bucketSize: time.Second, atomicWrites: true, resolvedBucketStart: true,
+	}
+	sink, err := makeCloudStorageSink(
+		ctx, `mem://bucket/feed`, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	s := sink.(*cloudStorageSink)
+	defer func() { require.NoError(t, s.Close()) }()
+
+	ts := func(d time.Duration) hlc.Timestamp { return hlc.Timestamp{WallTime: int64(d)} }
+	// contents returns the contents of the data files, by bucket.
+	contents := func() map[string]string {
+		m := make(map[string]string)
+		for _, name := range files.names() {
+			require.True(t, strings.HasPrefix(name, `bucket/feed/`), name)
+			name = strings.TrimPrefix(name, `bucket/feed/`)
+			if strings.HasSuffix(name, s.ext) {
+				m[name[:strings.IndexByte(name, '-')]] += files.get(`bucket/feed/` + name)
+			}
+		}
+		return m
+	}
+	bucket := func(d time.Duration) string {
+		return cloudStorageFormatBucket(ts(d).GoTime())
+	}
+
+	// The sanity check when the sink was made left nothing behind.
+	require.Empty(t, files.names())
+
+	table := &sqlbase.TableDescriptor{Name: `foo`}
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 1}`), ts(1500*time.Millisecond)))
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 2}`), ts(2500*time.Millisecond)))
+
+	// A flush only writes the buckets that begin before it, but keeps them
+	// around until they end before it too, since they can still get rows.
+	require.NoError(t, s.Flush(ctx, ts(2*time.Second)))
+	require.Equal(t, map[string]string{bucket(time.Second): "{\"a\": 1}\n"}, contents())
+	require.Len(t, s.files, 2)
+
+	// Rows at or below a flushed timestamp are dropped as duplicates.
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 1}`), ts(1500*time.Millisecond)))
+	require.NoError(t, s.Flush(ctx, ts(3*time.Second)))
+	require.Equal(t, map[string]string{
+		bucket(time.Second):     "{\"a\": 1}\n",
+		bucket(2 * time.Second): "{\"a\": 2}\n",
+	}, contents())
+	require.Len(t, s.files, 1)
+
+	// The resolved timestamp file is named after the start of the last
+	// complete bucket.
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, makeJSONEncoder(nil), ts(3*time.Second)))
+	resolvedName := `bucket/feed/` + bucket(2*time.Second) + `.RESOLVED`
+	require.Contains(t, files.names(), resolvedName)
+	require.Equal(t, `{"__crdb__":{"resolved":"3000000000.0000000000"}}`, files.get(resolvedName))
+
+	// Nothing is left under a temporary name.
+	for _, name := range files.names() {
+		require.False(t, strings.HasSuffix(name, cloudStorageTempSuffix), name)
+	}
+}
+
+func TestCloudStorageSinkResumeFromState(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	files, cleanup := useMemExportStorage()
+	defer cleanup()
+
+	ts := func(d time.Duration) hlc.Timestamp { return hlc.Timestamp{WallTime: int64(d)} }
+	cfg := cloudStorageSinkConfig{bucketSize: time.Second, stateID: `feed`}
+	makeSink := func() *cloudStorageSink {
+		s, err := makeCloudStorageSink(
+			ctx, `mem://bucket/feed`, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+		require.NoError(t, err)
+		return s.(*cloudStorageSink)
+	}
+	spans := []roachpb.Span{{Key: roachpb.Key(`a`), EndKey: roachpb.Key(`b`)}}
+	table := &sqlbase.TableDescriptor{Name: `foo`}
+
+	// Nothing has been persisted yet, so there's nothing to resume from.
+	s1 := makeSink()
+	require.NoError(t, resumeSinkFromState(ctx, s1, spans))
+	require.Equal(t, hlc.Timestamp{}, s1.persistedResolvedTs)
+	require.NoError(t, s1.EmitRow(ctx, table, nil, []byte(`{"a": 1}`), ts(1500*time.Millisecond)))
+	require.NoError(t, s1.Flush(ctx, ts(2*time.Second)))
+	require.NoError(t, s1.Close())
+	var stateFiles int
+	for _, name := range files.names() {
+		if strings.HasSuffix(name, `.STATE`) {
+			stateFiles++
+		}
+	}
+	require.Equal(t, 1, stateFiles)
+
+	// A restarted sink resumes even when the processor sees it through the
+	// wrappers added by sink params, and drops the rows it already wrote.
+	s2 := makeSink()
+	defer func() { require.NoError(t, s2.Close()) }()
+	wrapped := makeRateLimitedSink(makeValueLimitSink(s2, sinkValueLimit{}), sinkRateLimits{})
+	require.NoError(t, resumeSinkFromState(ctx, wrapped, spans))
+	require.Equal(t, ts(2*time.Second), s2.persistedResolvedTs)
+	require.Equal(t, ts(2*time.Second), s2.localResolvedTs)
+
+	// The state is per set of spans, so other spans start from scratch.
+	s3 := makeSink()
+	defer func() { require.NoError(t, s3.Close()) }()
+	otherSpans := []roachpb.Span{{Key: roachpb.Key(`b`), EndKey: roachpb.Key(`c`)}}
+	require.NoError(t, resumeSinkFromState(ctx, s3, otherSpans))
+	require.Equal(t, hlc.Timestamp{}, s3.persistedResolvedTs)
+
+	// Sinks that don't persist any state are left alone.
+	require.NoError(t, resumeSinkFromState(ctx, &bufferSink{}, spans))
+}
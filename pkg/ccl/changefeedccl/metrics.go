@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/jobs"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
@@ -24,6 +25,9 @@ import (
 type metricsSink struct {
 	metrics *Metrics
 	wrapped Sink
+	// id is the key of the sink in metrics.mu.sinks, where it's counted by
+	// the SinkInflightMessages gauge until it's closed.
+	id int
 }
 
 func makeMetricsSink(metrics *Metrics, s Sink) *metricsSink {
@@ -31,6 +35,11 @@ func makeMetricsSink(metrics *Metrics, s Sink) *metricsSink {
 		metrics: metrics,
 		wrapped: s,
 	}
+	metrics.mu.Lock()
+	m.id = metrics.mu.id
+	metrics.mu.id++
+	metrics.mu.sinks[m.id] = m
+	metrics.mu.Unlock()
 	return m
 }
 
@@ -39,12 +48,29 @@ func (s *metricsSink) EmitRow(
 ) error {
 	start := timeutil.Now()
 	err := s.wrapped.EmitRow(ctx, table, key, value, updated)
+	s.recordEmitRow(start, key, value, err)
+	return err
+}
+
+func (s *metricsSink) EmitRowWithPartitionHint(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	key, value []byte,
+	hint partitionHint,
+	updated hlc.Timestamp,
+) error {
+	start := timeutil.Now()
+	err := emitRowWithPartitionHint(ctx, s.wrapped, table, key, value, hint, updated)
+	s.recordEmitRow(start, key, value, err)
+	return err
+}
+
+func (s *metricsSink) recordEmitRow(start time.Time, key, value []byte, err error) {
 	if err == nil {
 		s.metrics.EmittedMessages.Inc(1)
 		s.metrics.EmittedBytes.Inc(int64(len(key) + len(value)))
 		s.metrics.EmitNanos.Inc(timeutil.Since(start).Nanoseconds())
 	}
-	return err
 }
 
 func (s *metricsSink) EmitResolvedTimestamp(
@@ -62,6 +88,14 @@ func (s *metricsSink) EmitResolvedTimestamp(
 	return err
 }
 
+func (s *metricsSink) EmitSchemaChange(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	oldVersion, newVersion sqlbase.DescriptorVersion,
+) error {
+	return s.wrapped.EmitSchemaChange(ctx, table, oldVersion, newVersion)
+}
+
 func (s *metricsSink) Flush(ctx context.Context, gc hlc.Timestamp) error {
 	start := timeutil.Now()
 	err := s.wrapped.Flush(ctx, gc)
@@ -72,10 +106,97 @@ func (s *metricsSink) Flush(ctx context.Context, gc hlc.Timestamp) error {
 	return err
 }
 
+func (s *metricsSink) FlushTable(ctx context.Context, tableName string, ts hlc.Timestamp) error {
+	start := timeutil.Now()
+	err := flushTable(ctx, s.wrapped, tableName, ts)
+	if err == nil {
+		s.metrics.Flushes.Inc(1)
+		s.metrics.FlushNanos.Inc(timeutil.Since(start).Nanoseconds())
+	}
+	return err
+}
+
+func (s *metricsSink) Ping(ctx context.Context) error {
+	return pingSink(ctx, s.wrapped)
+}
+
+func (s *metricsSink) SetHighWater(highWater hlc.Timestamp) {
+	setSinkHighWater(s.wrapped, highWater)
+}
+
+func (s *metricsSink) EmitFeedLifecycle(
+	ctx context.Context, phase feedPhase, ts hlc.Timestamp,
+) error {
+	return emitFeedLifecycle(ctx, s.wrapped, phase, ts)
+}
+
+func (s *metricsSink) InflightCount() int64 {
+	return sinkInflightCount(s.wrapped)
+}
+
+func (s *metricsSink) SetBackfillMode(backfill bool) {
+	if b, ok := s.wrapped.(BackfillModeSetter); ok {
+		b.SetBackfillMode(backfill)
+	}
+}
+
+func (s *metricsSink) SetMetrics(metrics *Metrics, nodeID roachpb.NodeID) {
+	setSinkMetrics(s.wrapped, metrics, nodeID)
+}
+
+func (s *metricsSink) ResumeFromState(ctx context.Context, spans []roachpb.Span) error {
+	return resumeSinkFromState(ctx, s.wrapped, spans)
+}
+
+func (s *metricsSink) TakeChangedTopics() []string {
+	return takeSinkChangedTopics(s.wrapped)
+}
+
+func (s *metricsSink) NoteChangedTopic(topic string) {
+	noteSinkChangedTopic(s.wrapped, topic)
+}
+
+func (s *metricsSink) TakeCompletedFiles() []string {
+	return takeSinkCompletedFiles(s.wrapped)
+}
+
+func (s *metricsSink) NoteCompletedFile(filename string) {
+	noteSinkCompletedFile(s.wrapped, filename)
+}
+
+func (s *metricsSink) CombinesTopicResolved() bool {
+	return sinkCombinesTopicResolved(s.wrapped)
+}
+
+func (s *metricsSink) SetCombinedTopicResolved(topicResolved map[string]hlc.Timestamp) {
+	setSinkCombinedTopicResolved(s.wrapped, topicResolved)
+}
+
+func (s *metricsSink) EmitsTopicResolved() bool {
+	return sinkEmitsTopicResolved(s.wrapped)
+}
+
+func (s *metricsSink) EmitTopicResolvedTimestamp(
+	ctx context.Context, encoder Encoder, topic string, resolved hlc.Timestamp,
+) error {
+	return emitSinkTopicResolvedTimestamp(ctx, s.wrapped, encoder, topic, resolved)
+}
+
+func (s *metricsSink) Capabilities() SinkCapabilities {
+	return s.wrapped.Capabilities()
+}
+
 func (s *metricsSink) Close() error {
+	s.metrics.mu.Lock()
+	delete(s.metrics.mu.sinks, s.id)
+	s.metrics.mu.Unlock()
 	return s.wrapped.Close()
 }
 
+func (s *metricsSink) CloseAndDrain(ctx context.Context) ([]MessageRef, error) {
+	return closeAndDrainSink(ctx, s.wrapped)
+}
+
 var (
 	metaChangefeedEmittedMessages = metric.Metadata{
 		Name:        "changefeed.emitted_messages",
@@ -101,6 +222,12 @@ var (
 		Measurement: "Errors",
 		Unit:        metric.Unit_COUNT,
 	}
+	metaChangefeedSinkBackpressureNanos = metric.Metadata{
+		Name:        "changefeed.sink_backpressure_nanos",
+		Help:        "Total time emits spent blocked on a full sink queue",
+		Measurement: "Nanoseconds",
+		Unit:        metric.Unit_NANOSECONDS,
+	}
 
 	metaChangefeedPollRequestNanos = metric.Metadata{
 		Name:        "changefeed.poll_request_nanos",
@@ -126,17 +253,71 @@ var (
 		Measurement: "Nanoseconds",
 		Unit:        metric.Unit_NANOSECONDS,
 	}
+	metaChangefeedCloudStorageFileBytes = metric.Metadata{
+		Name:        "changefeed.cloudstorage_file_bytes",
+		Help:        "Size of the data files written by cloud storage sinks",
+		Measurement: "Bytes",
+		Unit:        metric.Unit_BYTES,
+	}
+	metaChangefeedCloudStorageFileWriteNanos = metric.Metadata{
+		Name:        "changefeed.cloudstorage_file_write_nanos",
+		Help:        "Time spent writing each data file by cloud storage sinks",
+		Measurement: "Nanoseconds",
+		Unit:        metric.Unit_NANOSECONDS,
+	}
+	metaChangefeedCounterSinkInserts = metric.Metadata{
+		Name:        "changefeed.counter_sink.inserts",
+		Help:        "Inserted rows counted by metrics sinks",
+		Measurement: "Rows",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaChangefeedCounterSinkUpdates = metric.Metadata{
+		Name:        "changefeed.counter_sink.updates",
+		Help:        "Updated rows counted by metrics sinks",
+		Measurement: "Rows",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaChangefeedCounterSinkDeletes = metric.Metadata{
+		Name:        "changefeed.counter_sink.deletes",
+		Help:        "Deleted rows counted by metrics sinks",
+		Measurement: "Rows",
+		Unit:        metric.Unit_COUNT,
+	}
+	metaChangefeedCounterSinkBytes = metric.Metadata{
+		Name:        "changefeed.counter_sink.bytes",
+		Help:        "Bytes of the keys and values of rows counted by metrics sinks",
+		Measurement: "Bytes",
+		Unit:        metric.Unit_BYTES,
+	}
 	metaChangefeedFlushNanos = metric.Metadata{
 		Name:        "changefeed.flush_nanos",
 		Help:        "Total time spent flushing all feeds",
 		Measurement: "Nanoseconds",
 		Unit:        metric.Unit_NANOSECONDS,
 	}
+	metaChangefeedFlushLag = metric.Metadata{
+		Name:        "changefeed.flush_lag",
+		Help:        "Time between the timestamp flushed to a sink and when the flush completed",
+		Measurement: "Nanoseconds",
+		Unit:        metric.Unit_NANOSECONDS,
+	}
+	metaChangefeedFlushSLABreaches = metric.Metadata{
+		Name:        "changefeed.flush_sla_breaches",
+		Help:        "Flushes whose lag was over the flush_sla sink param",
+		Measurement: "Flushes",
+		Unit:        metric.Unit_COUNT,
+	}
 
 	// TODO(dan): This was intended to be a measure of the minimum distance of
 	// any changefeed ahead of its gc ttl threshold, but keeping that correct in
 	// the face of changing zone configs is much harder, so this will have to do
 	// for now.
+	metaChangefeedSinkInflightMessages = metric.Metadata{
+		Name:        "changefeed.sink_inflight_messages",
+		Help:        "Messages emitted to sinks that are waiting to be acknowledged",
+		Measurement: "Messages",
+		Unit:        metric.Unit_COUNT,
+	}
 	metaChangefeedMinHighWater = metric.Metadata{
 		Name:        "changefeed.min_high_water",
 		Help:        "Latest high_water timestamp of most behind feed",
@@ -149,12 +330,23 @@ const noMinHighWaterSentinel = int64(math.MaxInt64)
 
 const pollRequestNanosHistMaxLatency = time.Hour
 
+// flushLagHistMaxLatency is the largest flush lag that's distinguished. Feeds
+// that are further behind, such as ones started with an old cursor, are
+// recorded at the max.
+const flushLagHistMaxLatency = 24 * time.Hour
+
+const (
+	cloudStorageFileBytesHistMax             = 1 << 30 // 1 GiB
+	cloudStorageFileWriteNanosHistMaxLatency = time.Hour
+)
+
 // Metrics are for production monitoring of changefeeds.
 type Metrics struct {
-	EmittedMessages  *metric.Counter
-	EmittedBytes     *metric.Counter
-	Flushes          *metric.Counter
-	SinkErrorRetries *metric.Counter
+	EmittedMessages       *metric.Counter
+	EmittedBytes          *metric.Counter
+	Flushes               *metric.Counter
+	SinkErrorRetries      *metric.Counter
+	SinkBackpressureNanos *metric.Counter
 
 	PollRequestNanosHist *metric.Histogram
 	ProcessingNanos      *metric.Counter
@@ -162,12 +354,26 @@ type Metrics struct {
 	EmitNanos            *metric.Counter
 	FlushNanos           *metric.Counter
 
+	FlushLagNanosHist *metric.Histogram
+	FlushSLABreaches  *metric.Counter
+
+	CloudStorageFileBytesHist      *metric.Histogram
+	CloudStorageFileWriteNanosHist *metric.Histogram
+
+	CounterSinkInserts *metric.CounterVec
+	CounterSinkUpdates *metric.CounterVec
+	CounterSinkDeletes *metric.CounterVec
+	CounterSinkBytes   *metric.CounterVec
+
 	mu struct {
 		syncutil.Mutex
 		id       int
 		resolved map[int]hlc.Timestamp
+		// sinks are the open sinks, see metricsSink.
+		sinks map[int]*metricsSink
 	}
-	MinHighWater *metric.Gauge
+	MinHighWater         *metric.Gauge
+	SinkInflightMessages *metric.Gauge
 }
 
 // MetricStruct implements the metric.Struct interface.
@@ -176,10 +382,11 @@ func (*Metrics) MetricStruct() {}
 // MakeMetrics makes the metrics for changefeed monitoring.
 func MakeMetrics(histogramWindow time.Duration) metric.Struct {
 	m := &Metrics{
-		EmittedMessages:  metric.NewCounter(metaChangefeedEmittedMessages),
-		EmittedBytes:     metric.NewCounter(metaChangefeedEmittedBytes),
-		Flushes:          metric.NewCounter(metaChangefeedFlushes),
-		SinkErrorRetries: metric.NewCounter(metaChangefeedSinkErrorRetries),
+		EmittedMessages:       metric.NewCounter(metaChangefeedEmittedMessages),
+		EmittedBytes:          metric.NewCounter(metaChangefeedEmittedBytes),
+		Flushes:               metric.NewCounter(metaChangefeedFlushes),
+		SinkErrorRetries:      metric.NewCounter(metaChangefeedSinkErrorRetries),
+		SinkBackpressureNanos: metric.NewCounter(metaChangefeedSinkBackpressureNanos),
 
 		// Metrics for changefeed performance debugging: - PollRequestNanos and
 		// PollRequestNanosHist, things are first
@@ -201,8 +408,32 @@ func MakeMetrics(histogramWindow time.Duration) metric.Struct {
 		TableMetadataNanos: metric.NewCounter(metaChangefeedTableMetadataNanos),
 		EmitNanos:          metric.NewCounter(metaChangefeedEmitNanos),
 		FlushNanos:         metric.NewCounter(metaChangefeedFlushNanos),
+
+		// How far behind the sinks are when they're flushed, see slaSink.
+		FlushLagNanosHist: metric.NewHistogram(
+			metaChangefeedFlushLag, histogramWindow,
+			flushLagHistMaxLatency.Nanoseconds(), 1),
+		FlushSLABreaches: metric.NewCounter(metaChangefeedFlushSLABreaches),
+
+		// The size of each data file written by cloud storage sinks and how
+		// long it took, which tell apart slow flushes of many small files
+		// from ones of a few huge files.
+		CloudStorageFileBytesHist: metric.NewHistogram(
+			metaChangefeedCloudStorageFileBytes, histogramWindow,
+			cloudStorageFileBytesHistMax, 1),
+		CloudStorageFileWriteNanosHist: metric.NewHistogram(
+			metaChangefeedCloudStorageFileWriteNanos, histogramWindow,
+			cloudStorageFileWriteNanosHistMaxLatency.Nanoseconds(), 1),
+
+		// The changes counted by `experimental-metrics` sinks, which don't
+		// emit them anywhere else, by table.
+		CounterSinkInserts: metric.NewCounterVec(metaChangefeedCounterSinkInserts, `table`),
+		CounterSinkUpdates: metric.NewCounterVec(metaChangefeedCounterSinkUpdates, `table`),
+		CounterSinkDeletes: metric.NewCounterVec(metaChangefeedCounterSinkDeletes, `table`),
+		CounterSinkBytes:   metric.NewCounterVec(metaChangefeedCounterSinkBytes, `table`),
 	}
 	m.mu.resolved = make(map[int]hlc.Timestamp)
+	m.mu.sinks = make(map[int]*metricsSink)
 	m.MinHighWater = metric.NewFunctionalGauge(metaChangefeedMinHighWater, func() int64 {
 		minHighWater := noMinHighWaterSentinel
 		m.mu.Lock()
@@ -214,6 +445,18 @@ func MakeMetrics(histogramWindow time.Duration) metric.Struct {
 		m.mu.Unlock()
 		return minHighWater
 	})
+	// How backed up the sinks that deliver asynchronously are, which is the
+	// signal to look at before blaming a slow changefeed on its scans.
+	m.SinkInflightMessages = metric.NewFunctionalGauge(
+		metaChangefeedSinkInflightMessages, func() int64 {
+			var inflight int64
+			m.mu.Lock()
+			for _, s := range m.mu.sinks {
+				inflight += sinkInflightCount(s.wrapped)
+			}
+			m.mu.Unlock()
+			return inflight
+		})
 	return m
 }
 
@@ -19,6 +19,7 @@ import (
 var escapeRE = regexp.MustCompile(`_u[0-9a-fA-F]{2,8}_`)
 var kafkaDisallowedRE = regexp.MustCompile(`[^a-zA-Z0-9\._\-]`)
 var avroDisallowedRE = regexp.MustCompile(`[^A-Za-z0-9_]`)
+var filenameDisallowedRE = regexp.MustCompile(`[^A-Za-z0-9_]`)
 
 func escapeRune(r rune) string {
 	if r <= 1<<16 {
@@ -75,6 +76,15 @@ func SQLNameToAvroName(s string) string {
 	return escapeSQLName(s, avroDisallowedRE)
 }
 
+// escapeFilenamePart escapes s into something that can be used as one of the
+// `-` separated parts of a filename. This is reversible by unescapeSQLName.
+//
+// Only `[A-Za-z0-9_]` is left as is, which keeps s from being confused with
+// the separators or being interpreted as a path.
+func escapeFilenamePart(s string) string {
+	return escapeSQLName(s, filenameDisallowedRE)
+}
+
 // AvroNameToSQLName is the inverse of SQLNameToAvroName.
 func AvroNameToSQLName(s string) string {
 	return unescapeSQLName(s)
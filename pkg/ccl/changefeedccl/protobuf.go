@@ -0,0 +1,183 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/pkg/errors"
+)
+
+// The file contains the mapping between our SQL schemas and protobuf messages
+// used by `format=protobuf`. Like avro.go, it's not a general purpose protobuf
+// utility.
+//
+// A SQL table maps to a proto2 message with one optional field per column. The
+// field number is the column ID, which never changes and is never reused, so
+// the messages of every version of a table are compatible with each other,
+// and the field name is the column name escaped as for avro. A NULL is a field
+// that isn't set, which proto2 can tell apart from a zero value. INT, FLOAT,
+// BOOL and BYTES columns map to int64, double, bool and bytes fields, and every
+// other column to a string field with the value formatted as in `EXPORT`.
+//
+// Keys are the same message with only the primary key columns set.
+
+// protobufDescriptorPackage is the package of the messages in the descriptors
+// written for `format=protobuf`.
+const protobufDescriptorPackage = `cockroach.changefeed`
+
+// protobufFieldNumber returns the field number of a column. Protobuf reserves
+// 19000 through 19999, and a field number can't be larger than 2^29-1. Column
+// IDs are allocated sequentially, so neither should ever happen.
+func protobufFieldNumber(col *sqlbase.ColumnDescriptor) (int32, error) {
+	const maxFieldNumber = 1<<29 - 1
+	if col.ID < 1 || col.ID > maxFieldNumber || (col.ID >= 19000 && col.ID <= 19999) {
+		return 0, errors.Errorf(`column %s has ID %d, which is not a valid protobuf field number`,
+			col.Name, col.ID)
+	}
+	return int32(col.ID), nil
+}
+
+// protobufFieldType returns the type of the field of a column.
+func protobufFieldType(typ sqlbase.ColumnType) descriptor.FieldDescriptorProto_Type {
+	switch typ.SemanticType {
+	case sqlbase.ColumnType_INT:
+		return descriptor.FieldDescriptorProto_TYPE_INT64
+	case sqlbase.ColumnType_FLOAT:
+		return descriptor.FieldDescriptorProto_TYPE_DOUBLE
+	case sqlbase.ColumnType_BOOL:
+		return descriptor.FieldDescriptorProto_TYPE_BOOL
+	case sqlbase.ColumnType_BYTES:
+		return descriptor.FieldDescriptorProto_TYPE_BYTES
+	default:
+		return descriptor.FieldDescriptorProto_TYPE_STRING
+	}
+}
+
+// protobufMessageDescriptor returns the descriptor of the message of a table.
+func protobufMessageDescriptor(
+	tableDesc *sqlbase.TableDescriptor,
+) (*descriptor.DescriptorProto, error) {
+	msg := &descriptor.DescriptorProto{Name: proto.String(SQLNameToAvroName(tableDesc.Name))}
+	for i := range tableDesc.Columns {
+		col := &tableDesc.Columns[i]
+		number, err := protobufFieldNumber(col)
+		if err != nil {
+			return nil, err
+		}
+		msg.Field = append(msg.Field, &descriptor.FieldDescriptorProto{
+			Name:   proto.String(SQLNameToAvroName(col.Name)),
+			Number: proto.Int32(number),
+			Label:  descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   protobufFieldType(col.Type).Enum(),
+		})
+	}
+	return msg, nil
+}
+
+// protobufDescriptorSet returns a serialized FileDescriptorSet, as written by
+// `protoc --descriptor_set_out`, with the message of a table. It's what a
+// consumer needs to decode the messages without generated code.
+func protobufDescriptorSet(tableDesc *sqlbase.TableDescriptor) ([]byte, error) {
+	msg, err := protobufMessageDescriptor(tableDesc)
+	if err != nil {
+		return nil, err
+	}
+	set := &descriptor.FileDescriptorSet{File: []*descriptor.FileDescriptorProto{{
+		Name:        proto.String(msg.GetName() + `.proto`),
+		Package:     proto.String(protobufDescriptorPackage),
+		MessageType: []*descriptor.DescriptorProto{msg},
+		Syntax:      proto.String(`proto2`),
+	}}}
+	return proto.Marshal(set)
+}
+
+const (
+	protobufWireVarint  = 0
+	protobufWireFixed64 = 1
+	protobufWireBytes   = 2
+)
+
+// appendProtobufVarint appends the base 128 varint encoding of x.
+func appendProtobufVarint(buf []byte, x uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(buf, scratch[:binary.PutUvarint(scratch[:], x)]...)
+}
+
+// appendProtobufField appends the field of a column with the given value, or
+// nothing for a NULL.
+func appendProtobufField(
+	buf []byte, col *sqlbase.ColumnDescriptor, d tree.Datum,
+) ([]byte, error) {
+	if d == tree.DNull {
+		return buf, nil
+	}
+	number, err := protobufFieldNumber(col)
+	if err != nil {
+		return nil, err
+	}
+	tag := func(wireType uint64) []byte {
+		return appendProtobufVarint(buf, uint64(number)<<3|wireType)
+	}
+	appendBytes := func(b []byte) []byte {
+		buf = appendProtobufVarint(tag(protobufWireBytes), uint64(len(b)))
+		return append(buf, b...)
+	}
+	switch protobufFieldType(col.Type) {
+	case descriptor.FieldDescriptorProto_TYPE_INT64:
+		i, ok := d.(*tree.DInt)
+		if !ok {
+			return nil, errors.Errorf(`unexpected %T for INT column %s`, d, col.Name)
+		}
+		return appendProtobufVarint(tag(protobufWireVarint), uint64(int64(*i))), nil
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		f, ok := d.(*tree.DFloat)
+		if !ok {
+			return nil, errors.Errorf(`unexpected %T for FLOAT column %s`, d, col.Name)
+		}
+		var scratch [8]byte
+		binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(float64(*f)))
+		return append(tag(protobufWireFixed64), scratch[:]...), nil
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		b, ok := d.(*tree.DBool)
+		if !ok {
+			return nil, errors.Errorf(`unexpected %T for BOOL column %s`, d, col.Name)
+		}
+		var v uint64
+		if *b {
+			v = 1
+		}
+		return appendProtobufVarint(tag(protobufWireVarint), v), nil
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		b, ok := d.(*tree.DBytes)
+		if !ok {
+			return nil, errors.Errorf(`unexpected %T for BYTES column %s`, d, col.Name)
+		}
+		return appendBytes([]byte(*b)), nil
+	default:
+		return appendBytes([]byte(tree.AsStringWithFlags(d, tree.FmtExport))), nil
+	}
+}
+
+// writeProtobufDelimitedRecord writes a record preceded by its length as a
+// varint, which is how protobuf libraries delimit a stream of messages, as in
+// Java's `writeDelimitedTo`.
+func writeProtobufDelimitedRecord(w io.Writer, record []byte) error {
+	if _, err := w.Write(appendProtobufVarint(nil, uint64(len(record)))); err != nil {
+		return err
+	}
+	_, err := w.Write(record)
+	return err
+}
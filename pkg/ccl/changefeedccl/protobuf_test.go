@@ -0,0 +1,94 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/protoc-gen-gogo/descriptor"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtobufEncoder(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	tableDesc, err := parseTableDesc(`CREATE TABLE "foo bar" (
+		a INT PRIMARY KEY, b STRING, c FLOAT, d BOOL, e BYTES, f DECIMAL
+	)`)
+	require.NoError(t, err)
+	rows, err := parseValues(tableDesc, `VALUES
+		(1, 'x', 1.5, true, b'\x00', 1.25),
+		(-1, NULL, NULL, NULL, NULL, NULL)`)
+	require.NoError(t, err)
+
+	e := makeProtobufEncoder(nil /* opts */)
+	// Each field is tagged with the column ID and wire type.
+	key, err := e.EncodeKey(tableDesc, rows[0])
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x08, 0x01}, key)
+	value, err := e.EncodeValue(tableDesc, rows[0], nil /* prevRow */, zeroTS)
+	require.NoError(t, err)
+	require.Equal(t, []byte{
+		0x08, 0x01,
+		0x12, 0x01, 'x',
+		0x19, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf8, 0x3f,
+		0x20, 0x01,
+		0x2a, 0x01, 0x00,
+		0x32, 0x04, '1', '.', '2', '5',
+	}, value)
+	// NULLs are left out.
+	value, err = e.EncodeValue(tableDesc, rows[1], nil /* prevRow */, zeroTS)
+	require.NoError(t, err)
+	require.Equal(t, []byte{
+		0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01,
+	}, value)
+	// Deletes have no value.
+	value, err = e.EncodeValue(tableDesc, nil /* row */, nil /* prevRow */, zeroTS)
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	resolved, err := e.EncodeResolvedTimestamp(`foo bar`, hlc.Timestamp{WallTime: 1})
+	require.NoError(t, err)
+	require.Equal(t, append([]byte{0x0a, 0x0c}, `1.0000000000`...), resolved)
+
+	// The descriptor can be read by protobuf libraries.
+	payload, err := e.EncodeDescriptor(tableDesc)
+	require.NoError(t, err)
+	var set descriptor.FileDescriptorSet
+	require.NoError(t, proto.Unmarshal(payload, &set))
+	require.Len(t, set.File, 1)
+	require.Equal(t, `cockroach.changefeed`, set.File[0].GetPackage())
+	require.Len(t, set.File[0].MessageType, 1)
+	msg := set.File[0].MessageType[0]
+	require.Equal(t, `foo_u0020_bar`, msg.GetName())
+	var fields []string
+	for _, field := range msg.Field {
+		require.Equal(t, descriptor.FieldDescriptorProto_LABEL_OPTIONAL, field.GetLabel())
+		fields = append(fields, field.GetName()+` `+field.GetType().String())
+	}
+	require.Equal(t, []string{
+		`a TYPE_INT64`, `b TYPE_STRING`, `c TYPE_DOUBLE`, `d TYPE_BOOL`, `e TYPE_BYTES`,
+		`f TYPE_STRING`,
+	}, fields)
+
+	_, _, err = e.FileFormat(`lf`)
+	require.EqualError(t, err, `record_separator is not supported with format=protobuf`)
+	ext, writeRecordFn, err := e.FileFormat(``)
+	require.NoError(t, err)
+	require.Equal(t, `.protodelim`, ext)
+	var buf bytes.Buffer
+	require.NoError(t, writeRecordFn(&buf, []byte(`ab`)))
+	require.NoError(t, writeRecordFn(&buf, bytes.Repeat([]byte{'c'}, 200)))
+	require.Equal(t, []byte{0x02, 'a', 'b', 0xc8, 0x01}, buf.Bytes()[:5])
+	require.Equal(t, 205, buf.Len())
+}
@@ -10,14 +10,22 @@ package changefeedccl
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	gosql "database/sql"
+	"encoding/binary"
+	gojson "encoding/json"
 	"fmt"
 	"hash"
+	"hash/crc32"
 	"hash/fnv"
 	"io"
+	"net"
 	"net/url"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -32,11 +40,16 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/bufalloc"
+	"github.com/cockroachdb/cockroach/pkg/util/ctxgroup"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/log/logtags"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
@@ -55,6 +68,16 @@ type Sink interface {
 	// seen by EmitRow. The list of partitions used may be stale. An error may
 	// be returned if a previously enqueued message has failed.
 	EmitResolvedTimestamp(ctx context.Context, encoder Encoder, resolved hlc.Timestamp) error
+	// EmitSchemaChange notifies the sink that the schema of a watched table has
+	// changed from oldVersion to newVersion. It's only called by the
+	// changeFrontier, once for each change, after the changeAggregators have
+	// emitted rows with the new version and before the resolved timestamp that
+	// covers them. Sinks that have no way to represent this may ignore it.
+	EmitSchemaChange(
+		ctx context.Context,
+		table *sqlbase.TableDescriptor,
+		oldVersion, newVersion sqlbase.DescriptorVersion,
+	) error
 	// Flush blocks until every message enqueued by EmitRow and
 	// EmitResolvedTimestamp with a timestamp >= ts has been acknowledged by the
 	// sink. This is also a guarantee that rows that come in after will have an
@@ -64,13 +87,478 @@ type Sink interface {
 	Flush(ctx context.Context, ts hlc.Timestamp) error
 	// Close does not guarantee delivery of outstanding messages.
 	Close() error
+	// Capabilities returns the changefeed options that the sink can handle.
+	Capabilities() SinkCapabilities
+}
+
+// TableFlusher is implemented by sinks that can flush the messages of a single
+// table without flushing everything else, which lets a latency-sensitive table
+// be prioritized in a changefeed watching many tables.
+type TableFlusher interface {
+	// FlushTable is like Flush, but the guarantee only covers the messages
+	// enqueued by EmitRow for the table with the given name. A sink may flush
+	// more than was asked for.
+	FlushTable(ctx context.Context, tableName string, ts hlc.Timestamp) error
+}
+
+// flushTable flushes the messages of the given table if the sink is a
+// TableFlusher and otherwise falls back to flushing everything.
+func flushTable(ctx context.Context, s Sink, tableName string, ts hlc.Timestamp) error {
+	if f, ok := s.(TableFlusher); ok {
+		return f.FlushTable(ctx, tableName, ts)
+	}
+	return s.Flush(ctx, ts)
+}
+
+// InflightCounter is implemented by sinks that deliver messages asynchronously
+// and can report how many are waiting to be acknowledged, which is a signal
+// that row production should slow down.
+type InflightCounter interface {
+	// InflightCount returns the number of messages that have been enqueued
+	// but not yet acknowledged or failed. It's safe for concurrent use.
+	InflightCount() int64
+}
+
+// sinkInflightCount returns the inflight count of the sink if it's an
+// InflightCounter and otherwise 0.
+func sinkInflightCount(s Sink) int64 {
+	if c, ok := s.(InflightCounter); ok {
+		return c.InflightCount()
+	}
+	return 0
+}
+
+// Pinger is implemented by sinks that can cheaply check that their downstream
+// is reachable and writable, without emitting anything to it.
+type Pinger interface {
+	// Ping returns an error if the downstream can't be reached or written to.
+	Ping(ctx context.Context) error
+}
+
+// pingSink pings the sink if it's a Pinger and otherwise assumes it's
+// reachable, since making it already connected to the downstream.
+func pingSink(ctx context.Context, s Sink) error {
+	if p, ok := s.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// MessageRef identifies something that a sink was given but may not have
+// delivered. See Drainer.
+type MessageRef struct {
+	// Topic is the topic that the message was for.
+	Topic string
+	// Key is the key of a row. It's nil for keyless rows, for messages that
+	// aren't rows and for unwritten data files.
+	Key []byte
+	// Bucket, if non-zero, is the bucket of an unwritten data file of a cloud
+	// storage sink, which stands for every row in the file.
+	Bucket time.Time
+}
+
+// Drainer is implemented by sinks that can report what wasn't delivered when
+// they're closed, instead of silently dropping it, which gives tests and
+// migration tooling a precise picture of what has to be reconciled.
+type Drainer interface {
+	// CloseAndDrain tries to deliver everything that the sink has been given
+	// until ctx is done and then closes the sink, like Close. It returns, in no
+	// particular order, references to whatever may not have been delivered,
+	// which can include something delivered while the sink was closing but
+	// never leaves out anything that wasn't. The error is from closing the
+	// sink.
+	CloseAndDrain(ctx context.Context) (undelivered []MessageRef, _ error)
+}
+
+// closeAndDrainSink closes the sink with CloseAndDrain if it's a Drainer and
+// otherwise closes it with Close and reports nothing.
+func closeAndDrainSink(ctx context.Context, s Sink) ([]MessageRef, error) {
+	if d, ok := s.(Drainer); ok {
+		return d.CloseAndDrain(ctx)
+	}
+	return nil, s.Close()
+}
+
+// BackfillModeSetter is implemented by sinks that can trade resources for
+// throughput while a changefeed emits the rows of a full table scan, which are
+// much more numerous than the changes that follow.
+type BackfillModeSetter interface {
+	// SetBackfillMode tells the sink whether the rows it's being sent are
+	// mostly from a backfill.
+	SetBackfillMode(backfill bool)
+}
+
+// setSinkBackfillMode tells the sink whether it's in backfill mode, if it's a
+// BackfillModeSetter.
+func setSinkBackfillMode(ctx context.Context, s Sink, backfill bool) {
+	if b, ok := s.(BackfillModeSetter); ok {
+		if log.V(1) {
+			log.Infof(ctx, `setting sink backfill mode to %t`, backfill)
+		}
+		b.SetBackfillMode(backfill)
+	}
+}
+
+// HighWaterSetter is implemented by sinks that can put the high water of the
+// changefeed in the metadata of each row, for the `high_water` option. It
+// gives consumers an "as of" anchor for reconciliation. It's the resolved
+// timestamp of the spans watched by the processor emitting the row, so every
+// change to them at or below it has been emitted before the row, or the
+// statement time until those spans are first resolved.
+type HighWaterSetter interface {
+	// SetHighWater tells the sink the high water for the rows that follow.
+	// It only moves forward.
+	SetHighWater(highWater hlc.Timestamp)
+}
+
+// setSinkHighWater tells the sink the high water, if it's a HighWaterSetter.
+func setSinkHighWater(s Sink, highWater hlc.Timestamp) {
+	if h, ok := s.(HighWaterSetter); ok {
+		h.SetHighWater(highWater)
+	}
+}
+
+// MetricsSetter is implemented by sinks that record metrics of their own, such
+// as how long their writes take, on top of the ones that metricsSink records
+// for every sink.
+type MetricsSetter interface {
+	// SetMetrics tells the sink where to record its metrics and which node it
+	// emits rows from. It's called before anything is emitted.
+	SetMetrics(metrics *Metrics, nodeID roachpb.NodeID)
+}
+
+// setSinkMetrics tells the sink where to record its metrics, if it's a
+// MetricsSetter.
+func setSinkMetrics(s Sink, metrics *Metrics, nodeID roachpb.NodeID) {
+	if m, ok := s.(MetricsSetter); ok {
+		m.SetMetrics(metrics, nodeID)
+	}
+}
+
+// StateResumer is implemented by sinks that can persist what they've written
+// and pick up where a previous incarnation of them left off, which lets a
+// restarted changefeed skip re-emitting rows that were already written.
+type StateResumer interface {
+	// ResumeFromState loads the state persisted for the given watched spans,
+	// if any. It's called before anything is emitted.
+	ResumeFromState(ctx context.Context, spans []roachpb.Span) error
+}
+
+// resumeSinkFromState resumes the sink from its persisted state if it's a
+// StateResumer and otherwise does nothing.
+func resumeSinkFromState(ctx context.Context, s Sink, spans []roachpb.Span) error {
+	if r, ok := s.(StateResumer); ok {
+		return r.ResumeFromState(ctx, spans)
+	}
+	return nil
+}
+
+// ChangedTopicsTracker is implemented by sinks that can restrict resolved
+// timestamps to the topics that rows were emitted to since the last one. The
+// rows are emitted by the changeAggregators' sinks and the resolved timestamps
+// by the changeFrontier's, so the topics are taken from the former along with
+// each resolved span and noted on the latter.
+type ChangedTopicsTracker interface {
+	// TakeChangedTopics returns the topics that rows have been emitted to
+	// since the last call, in sorted order. It's empty if the sink doesn't
+	// restrict resolved timestamps.
+	TakeChangedTopics() []string
+	// NoteChangedTopic records that rows have been emitted to the given topic
+	// by the sink of another processor.
+	NoteChangedTopic(topic string)
+}
+
+// takeSinkChangedTopics returns the changed topics of the sink if it's a
+// ChangedTopicsTracker and otherwise nothing.
+func takeSinkChangedTopics(s Sink) []string {
+	if c, ok := s.(ChangedTopicsTracker); ok {
+		return c.TakeChangedTopics()
+	}
+	return nil
+}
+
+// noteSinkChangedTopic notes a changed topic on the sink if it's a
+// ChangedTopicsTracker and otherwise does nothing.
+func noteSinkChangedTopic(s Sink, topic string) {
+	if c, ok := s.(ChangedTopicsTracker); ok {
+		c.NoteChangedTopic(topic)
+	}
+}
+
+// CompletedFilesTracker is implemented by sinks that can list the data files
+// that are complete in their resolved timestamp files. Like with
+// ChangedTopicsTracker, the files are taken from the changeAggregators' sinks,
+// which write them, along with each resolved span and noted on the
+// changeFrontier's, which writes the resolved timestamp files.
+type CompletedFilesTracker interface {
+	// TakeCompletedFiles returns the names of the data files that have been
+	// completed since the last call, in sorted order. It's empty if the sink
+	// doesn't list them.
+	TakeCompletedFiles() []string
+	// NoteCompletedFile records that a data file has been completed by the
+	// sink of another processor.
+	NoteCompletedFile(filename string)
+}
+
+// takeSinkCompletedFiles returns the completed files of the sink if it's a
+// CompletedFilesTracker and otherwise nothing.
+func takeSinkCompletedFiles(s Sink) []string {
+	if c, ok := s.(CompletedFilesTracker); ok {
+		return c.TakeCompletedFiles()
+	}
+	return nil
+}
+
+// noteSinkCompletedFile notes a completed file on the sink if it's a
+// CompletedFilesTracker and otherwise does nothing.
+func noteSinkCompletedFile(s Sink, filename string) {
+	if c, ok := s.(CompletedFilesTracker); ok {
+		c.NoteCompletedFile(filename)
+	}
+}
+
+// TopicResolvedCombiner is implemented by sinks that can put the resolved
+// timestamp of each topic in the changefeed's resolved timestamp messages.
+// Only the changeFrontier knows them, from the frontier of each topic's
+// table, and the Sink interface only passes on the changefeed's.
+type TopicResolvedCombiner interface {
+	// CombinesTopicResolved returns whether the sink is configured to put the
+	// resolved timestamp of each topic in its resolved timestamp messages.
+	CombinesTopicResolved() bool
+	// SetCombinedTopicResolved sets the resolved timestamp of each topic for
+	// the next EmitResolvedTimestamp, which it's called right before.
+	SetCombinedTopicResolved(topicResolved map[string]hlc.Timestamp)
+}
+
+// sinkCombinesTopicResolved returns whether the sink is a TopicResolvedCombiner
+// that puts the resolved timestamp of each topic in its resolved timestamp
+// messages.
+func sinkCombinesTopicResolved(s Sink) bool {
+	c, ok := s.(TopicResolvedCombiner)
+	return ok && c.CombinesTopicResolved()
+}
+
+// setSinkCombinedTopicResolved sets the resolved timestamp of each topic on the
+// sink if it's a TopicResolvedCombiner and otherwise does nothing.
+func setSinkCombinedTopicResolved(s Sink, topicResolved map[string]hlc.Timestamp) {
+	if c, ok := s.(TopicResolvedCombiner); ok {
+		c.SetCombinedTopicResolved(topicResolved)
+	}
+}
+
+// TopicResolvedEmitter is implemented by sinks that can emit a resolved
+// timestamp message for each topic. Only the changeFrontier knows the resolved
+// timestamp of each topic, from the frontier of the topic's table, and the Sink
+// interface only passes on the changefeed's.
+type TopicResolvedEmitter interface {
+	// EmitsTopicResolved returns whether the sink is configured to emit a
+	// resolved timestamp message for each topic.
+	EmitsTopicResolved() bool
+	// EmitTopicResolvedTimestamp emits the resolved timestamp of one topic.
+	EmitTopicResolvedTimestamp(
+		ctx context.Context, encoder Encoder, topic string, resolved hlc.Timestamp,
+	) error
+}
+
+// sinkEmitsTopicResolved returns whether the sink is a TopicResolvedEmitter
+// that emits a resolved timestamp message for each topic.
+func sinkEmitsTopicResolved(s Sink) bool {
+	e, ok := s.(TopicResolvedEmitter)
+	return ok && e.EmitsTopicResolved()
+}
+
+// emitSinkTopicResolvedTimestamp emits the resolved timestamp of one topic to
+// the sink if it's a TopicResolvedEmitter and otherwise does nothing.
+func emitSinkTopicResolvedTimestamp(
+	ctx context.Context, s Sink, encoder Encoder, topic string, resolved hlc.Timestamp,
+) error {
+	if e, ok := s.(TopicResolvedEmitter); ok {
+		return e.EmitTopicResolvedTimestamp(ctx, encoder, topic, resolved)
+	}
+	return nil
+}
+
+// feedPhase is a transition in the life of a changefeed that's marked in its
+// sink with the `lifecycle_markers` option.
+type feedPhase string
+
+const (
+	// feedPhaseStart is when every row as of the changefeed's statement time
+	// has been emitted, which is when its initial scan is complete.
+	feedPhaseStart feedPhase = `start`
+	// feedPhaseEnd is when the changefeed's job is done, whether it
+	// succeeded, failed or was canceled.
+	feedPhaseEnd feedPhase = `end`
+)
+
+// LifecycleEmitter is implemented by sinks that can mark the start and end of
+// a changefeed, for the `lifecycle_markers` option. This lets the consumer of
+// a one-shot export know that it has everything, instead of guessing from
+// resolved timestamps.
+type LifecycleEmitter interface {
+	// EmitFeedLifecycle emits the marker of the given phase. Every row at or
+	// below ts has already been emitted and flushed, possibly by another
+	// sink. Unlike EmitRow, the marker is flushed before it returns. A
+	// changefeed that restarts may emit a marker more than once.
+	EmitFeedLifecycle(ctx context.Context, phase feedPhase, ts hlc.Timestamp) error
+}
+
+// emitFeedLifecycle emits the marker of the given phase if the sink is a
+// LifecycleEmitter and otherwise does nothing.
+func emitFeedLifecycle(ctx context.Context, s Sink, phase feedPhase, ts hlc.Timestamp) error {
+	if l, ok := s.(LifecycleEmitter); ok {
+		return l.EmitFeedLifecycle(ctx, phase, ts)
+	}
+	return nil
+}
+
+// partitionHint overrides how a sink that partitions rows by their key picks
+// the partition of a row. At most one of its fields is set.
+type partitionHint struct {
+	// key, if non-nil, is hashed instead of the row's key. This lets related
+	// rows be co-located by a coarse partition key while the message key,
+	// which log compaction is based on, stays the full primary key. See the
+	// `partition_key` option.
+	key []byte
+	// value, if hasValue, pins the row to partition value mod the number of
+	// partitions, bypassing the hash. See the `partition_by_column` option.
+	value    int64
+	hasValue bool
+}
+
+// partition returns the partition picked by an explicit value, which must be
+// set, out of numPartitions. It's never negative.
+func (h partitionHint) partition(numPartitions int32) int32 {
+	p := h.value % int64(numPartitions)
+	if p < 0 {
+		p += int64(numPartitions)
+	}
+	return int32(p)
+}
+
+// PartitionHintEmitter is implemented by sinks that partition rows by their
+// key and can partition them by a partitionHint instead.
+type PartitionHintEmitter interface {
+	// EmitRowWithPartitionHint is like EmitRow, but the row's partition is
+	// picked with hint instead of key.
+	EmitRowWithPartitionHint(
+		ctx context.Context,
+		table *sqlbase.TableDescriptor,
+		key, value []byte,
+		hint partitionHint,
+		updated hlc.Timestamp,
+	) error
+}
+
+// emitRowWithPartitionHint emits a row with the given partition hint if the
+// sink is a PartitionHintEmitter and otherwise ignores it.
+func emitRowWithPartitionHint(
+	ctx context.Context,
+	s Sink,
+	table *sqlbase.TableDescriptor,
+	key, value []byte,
+	hint partitionHint,
+	updated hlc.Timestamp,
+) error {
+	if e, ok := s.(PartitionHintEmitter); ok {
+		return e.EmitRowWithPartitionHint(ctx, table, key, value, hint, updated)
+	}
+	return s.EmitRow(ctx, table, key, value, updated)
+}
+
+// SinkCapabilities describes which changefeed options a Sink can handle. Each
+// kind of sink has a fixed set, which getSink checks before the sink is
+// created, so that an incompatible changefeed is rejected up front with a
+// precise error instead of failing midway.
+type SinkCapabilities struct {
+	// Formats are the encoder formats that the sink knows how to handle.
+	Formats []formatType
+	// Envelopes are the envelopes that the sink knows how to handle. A sink
+	// that doesn't write keys, for example, only supports envelopes that put
+	// everything in the value.
+	Envelopes []envelopeType
+	// Resolved is whether the sink can emit resolved timestamps.
+	Resolved bool
+	// PartitionHint is whether the sink is a PartitionHintEmitter, which the
+	// `partition_key` and `partition_by_column` options need.
+	PartitionHint bool
+	// KeyFormat is whether the sink passes keys through as opaque bytes, which
+	// the `key_format` option needs. A sink that embeds keys in a larger
+	// payload or decodes them can only handle those of its format.
+	KeyFormat bool
+	// HighWater is whether the sink is a HighWaterSetter that puts the high
+	// water in the metadata of each row, which the `high_water` option needs.
+	HighWater bool
+	// Lifecycle is whether the sink is a LifecycleEmitter, which the
+	// `lifecycle_markers` option needs.
+	Lifecycle bool
+}
+
+// allEnvelopes are the envelopes for sinks that write both keys and values.
+var allEnvelopes = []envelopeType{
+	optEnvelopeRow, optEnvelopeKeyOnly, optEnvelopeValueOnly, optEnvelopeDiff,
+}
+
+// validate returns an error if format or any of opts isn't supported.
+func (c SinkCapabilities) validate(format formatType, opts map[string]string) error {
+	if err := validateSinkFormat(format, c.Formats); err != nil {
+		return err
+	}
+	envelope := envelopeType(opts[optEnvelope])
+	if envelope == `` {
+		envelope = optEnvelopeRow
+	}
+	var envelopeSupported bool
+	for _, supported := range c.Envelopes {
+		envelopeSupported = envelopeSupported || envelope == supported
+	}
+	if !envelopeSupported {
+		return errors.Errorf(`this sink is incompatible with %s=%s`, optEnvelope, envelope)
+	}
+	if _, ok := opts[optResolvedTimestamps]; ok && !c.Resolved {
+		return errors.Errorf(`this sink is incompatible with %s`, optResolvedTimestamps)
+	}
+	for _, opt := range []string{optPartitionKey, optPartitionByColumn} {
+		if _, ok := opts[opt]; ok && !c.PartitionHint {
+			return errors.Errorf(`this sink is incompatible with %s`, opt)
+		}
+	}
+	if _, ok := opts[optKeyFormat]; ok && !c.KeyFormat {
+		return errors.Errorf(`this sink is incompatible with %s`, optKeyFormat)
+	}
+	if _, ok := opts[optHighWater]; ok && !c.HighWater {
+		return errors.Errorf(`this sink is incompatible with %s`, optHighWater)
+	}
+	if _, ok := opts[optLifecycleMarkers]; ok && !c.Lifecycle {
+		return errors.Errorf(`this sink is incompatible with %s`, optLifecycleMarkers)
+	}
+	return nil
 }
 
+// sinkLogCtx returns a context with the log tags of ctx, but not its deadline or
+// cancellation, for a sink to keep and log with from its own goroutines and
+// from methods that aren't passed a context.
+func sinkLogCtx(ctx context.Context) context.Context {
+	return logtags.WithTags(context.Background(), logtags.FromContext(ctx))
+}
+
+// getSink returns the Sink described by sinkURI. The encoder is the one that
+// will be used for everything emitted to the sink and is checked for
+// compatibility here, so that a changefeed fails up front instead of midway.
+//
+// The log tags of ctx, which should identify the changefeed, are used for
+// anything logged while the sink is created. The sinks log with the contexts
+// passed to their methods, so those should carry the same tags. Anything that a
+// sink logs without one has the tags of ctx too, see sinkLogCtx.
 func getSink(
+	ctx context.Context,
 	sinkURI string,
 	opts map[string]string,
+	encoder Encoder,
 	targets jobspb.ChangefeedTargets,
+	jobID int64,
 	settings *cluster.Settings,
+	knobs TestingKnobs,
 ) (Sink, error) {
 	u, err := url.Parse(sinkURI)
 	if err != nil {
@@ -78,47 +566,364 @@ func getSink(
 	}
 	q := u.Query()
 
+	format, err := encoderFormat(encoder)
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimits, err := consumeSinkRateLimits(q)
+	if err != nil {
+		return nil, err
+	}
+	debugSampleRate, err := consumeSinkDebugSampleRate(q)
+	if err != nil {
+		return nil, err
+	}
+	debugMirror, err := consumeSinkDebugMirrorConfig(q)
+	if err != nil {
+		return nil, err
+	}
+	if debugMirror.dir != `` {
+		if debugMirror.dir, err = localSinkPath(debugMirror.dir, settings); err != nil {
+			return nil, errors.Wrap(err, sinkParamDebugDir)
+		}
+	}
+	valueLimit, err := consumeSinkValueLimit(q)
+	if err != nil {
+		return nil, err
+	}
+	if valueLimit.truncate && format != optFormatJSON {
+		return nil, errors.Errorf(`%s=%s is only supported with %s=%s`, sinkParamMaxValuePolicy,
+			sinkValueLimitPolicyTruncate, optFormat, optFormatJSON)
+	}
+	// The retry budget is enforced by the job, not the sink, but it's checked
+	// here so that a bad one is rejected by CREATE CHANGEFEED.
+	if _, err := consumeSinkRetryBudget(q); err != nil {
+		return nil, err
+	}
+	// Likewise, the flush SLA is enforced by an slaSink that the change
+	// aggregator wraps around the sink, because that's where the metrics are.
+	if _, err := consumeSinkFlushSLA(q); err != nil {
+		return nil, err
+	}
+	// The circuit breaker is also kept by the processors, because it has to
+	// outlive the sink.
+	if _, err := consumeSinkBreakerConfig(q); err != nil {
+		return nil, err
+	}
+
 	// Use a function here to delay creation of the sink until after we've done
 	// all the parameter verification.
 	var makeSink func() (Sink, error)
+	// capabilities are those of the sink that makeSink returns.
+	var capabilities SinkCapabilities
 	switch u.Scheme {
 	case sinkSchemeBuffer:
+		capabilities = bufferSinkCapabilities
 		makeSink = func() (Sink, error) { return &bufferSink{}, nil }
 	case sinkSchemeKafka:
-		kafkaTopicPrefix := q.Get(sinkParamTopicPrefix)
-		q.Del(sinkParamTopicPrefix)
-		schemaTopic := q.Get(sinkParamSchemaTopic)
-		q.Del(sinkParamSchemaTopic)
-		if schemaTopic != `` {
-			return nil, errors.Errorf(`%s is not yet supported`, sinkParamSchemaTopic)
+		capabilities = kafkaSinkCapabilities
+		cfg, err := consumeKafkaSinkConfig(q)
+		if err != nil {
+			return nil, err
+		}
+		switch format {
+		case optFormatCloudEvents:
+			cfg.contentType = cloudEventsContentType
+		case optFormatProtobuf:
+			cfg.contentType = protobufContentType
+		}
+		_, cfg.highWaterHeader = opts[optHighWater]
+		_, cfg.sourceHeaders = opts[optSource]
+		cfg.configHook = knobs.KafkaConfigHook
+		// Resolved timestamps are sent to each partition of a data topic by
+		// its index, which a topic with relaxed ordering maps to the
+		// partitions that have a leader instead.
+		_, resolved := opts[optResolvedTimestamps]
+		if len(cfg.relaxedOrderingTopics) > 0 && resolved && cfg.resolvedTopic == `` {
+			return nil, errors.Errorf(`%s requires %s to emit resolved timestamps`,
+				sinkParamRelaxedOrderingTopics, sinkParamResolvedTopic)
+		}
+		// Lifecycle markers are control messages, like schema change markers.
+		if _, ok := opts[optLifecycleMarkers]; ok && cfg.controlTopic == `` {
+			return nil, errors.Errorf(`%s requires %s`, optLifecycleMarkers, sinkParamControlTopic)
 		}
 		makeSink = func() (Sink, error) {
-			return makeKafkaSink(kafkaTopicPrefix, u.Host, targets)
+			if len(cfg.extraBootstrapServers) > 0 {
+				return makeKafkaMultiClusterSink(ctx, cfg, u.Host, targets, newSaramaKafkaClient)
+			}
+			return makeKafkaSink(ctx, cfg, u.Host, targets, newSaramaKafkaClient)
 		}
 	case `experimental-s3`, `experimental-gs`, `experimental-nodelocal`, `experimental-http`,
 		`experimental-https`, `experimental-azure`:
+		capabilities = cloudStorageSinkCapabilities
 		sinkURI = strings.TrimPrefix(sinkURI, `experimental-`)
 		bucketSizeStr := q.Get(sinkParamBucketSize)
 		q.Del(sinkParamBucketSize)
 		if bucketSizeStr == `` {
 			return nil, errors.Errorf(`sink param %s is required`, sinkParamBucketSize)
 		}
-		bucketSize, err := time.ParseDuration(bucketSizeStr)
+		var cfg cloudStorageSinkConfig
+		var err error
+		cfg.bucketSize, err = time.ParseDuration(bucketSizeStr)
+		if err != nil {
+			return nil, err
+		}
+		cfg.recordSeparator = q.Get(sinkParamRecordSeparator)
+		q.Del(sinkParamRecordSeparator)
+		cfg.keyOnly = envelopeType(opts[optEnvelope]) == optEnvelopeKeyOnly
+		if manifestStr := q.Get(sinkParamManifest); manifestStr != `` {
+			if cfg.writeManifest, err = strconv.ParseBool(manifestStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamManifest)
+			}
+		}
+		q.Del(sinkParamManifest)
+		if listingStr := q.Get(sinkParamResolvedFileListing); listingStr != `` {
+			if cfg.listFiles, err = strconv.ParseBool(listingStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamResolvedFileListing)
+			}
+		}
+		q.Del(sinkParamResolvedFileListing)
+		switch cfg.resolvedGranularity = q.Get(sinkParamResolvedGranularity); cfg.resolvedGranularity {
+		case ``, cloudStorageResolvedGranularityChangefeed, cloudStorageResolvedGranularityBoth,
+			cloudStorageResolvedGranularityCombined:
+		case cloudStorageResolvedGranularityTopic:
+			// The listing is in the changefeed's resolved timestamp files.
+			if cfg.listFiles {
+				return nil, errors.Errorf(`%s is not supported with %s=%s`,
+					sinkParamResolvedFileListing, sinkParamResolvedGranularity,
+					cloudStorageResolvedGranularityTopic)
+			}
+		default:
+			return nil, errors.Errorf(`unknown %s: %s`,
+				sinkParamResolvedGranularity, cfg.resolvedGranularity)
+		}
+		q.Del(sinkParamResolvedGranularity)
+		if intervalStr := q.Get(sinkParamMinResolvedInterval); intervalStr != `` {
+			if cfg.minResolvedInterval, err = time.ParseDuration(intervalStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamMinResolvedInterval)
+			}
+			if cfg.minResolvedInterval <= 0 {
+				return nil, errors.Errorf(`%s must be positive: %s`,
+					sinkParamMinResolvedInterval, intervalStr)
+			}
+		}
+		q.Del(sinkParamMinResolvedInterval)
+		if metadataStr := q.Get(sinkParamMetadata); metadataStr != `` {
+			if cfg.metadata, err = strconv.ParseBool(metadataStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamMetadata)
+			}
+		}
+		q.Del(sinkParamMetadata)
+		if cfg.metadata {
+			// The metadata is added to the JSON value, which key_only doesn't
+			// write.
+			if format != optFormatJSON {
+				return nil, errors.Errorf(`%s is only supported with %s=%s`,
+					sinkParamMetadata, optFormat, optFormatJSON)
+			}
+			if cfg.keyOnly {
+				return nil, errors.Errorf(`%s is not supported with %s=%s`,
+					sinkParamMetadata, optEnvelope, optEnvelopeKeyOnly)
+			}
+		}
+		cfg.stateID = q.Get(sinkParamSinkID)
+		q.Del(sinkParamSinkID)
+		if spillThresholdStr := q.Get(sinkParamSpillThreshold); spillThresholdStr != `` {
+			if cfg.spillThreshold, err = humanizeutil.ParseBytes(spillThresholdStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamSpillThreshold)
+			}
+			if cfg.spillThreshold < 0 {
+				return nil, errors.Errorf(`%s must be non-negative: %d`,
+					sinkParamSpillThreshold, cfg.spillThreshold)
+			}
+		}
+		q.Del(sinkParamSpillThreshold)
+		cfg.spillDir = q.Get(sinkParamSpillDir)
+		q.Del(sinkParamSpillDir)
+		if flushBytesStr := q.Get(sinkParamFlushBytes); flushBytesStr != `` {
+			if cfg.flushBytes, err = humanizeutil.ParseBytes(flushBytesStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamFlushBytes)
+			}
+			if cfg.flushBytes < 0 {
+				return nil, errors.Errorf(`%s must be non-negative: %d`,
+					sinkParamFlushBytes, cfg.flushBytes)
+			}
+		}
+		q.Del(sinkParamFlushBytes)
+		if poolMaxBytesStr := q.Get(sinkParamBufferPoolMaxBytes); poolMaxBytesStr != `` {
+			poolMaxBytes, err := humanizeutil.ParseBytes(poolMaxBytesStr)
+			if err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamBufferPoolMaxBytes)
+			}
+			if poolMaxBytes <= 0 {
+				return nil, errors.Errorf(`%s must be positive: %s`,
+					sinkParamBufferPoolMaxBytes, poolMaxBytesStr)
+			}
+			cfg.bufferPoolMaxBytes = int(poolMaxBytes)
+		}
+		q.Del(sinkParamBufferPoolMaxBytes)
+		if maxFileAgeStr := q.Get(sinkParamMaxFileAge); maxFileAgeStr != `` {
+			if cfg.maxFileAge, err = time.ParseDuration(maxFileAgeStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamMaxFileAge)
+			}
+			if cfg.maxFileAge <= 0 {
+				return nil, errors.Errorf(`%s must be positive: %s`,
+					sinkParamMaxFileAge, maxFileAgeStr)
+			}
+		}
+		q.Del(sinkParamMaxFileAge)
+		cfg.partitionColumn = q.Get(sinkParamPartitionColumn)
+		q.Del(sinkParamPartitionColumn)
+		if atomicWritesStr := q.Get(sinkParamAtomicWrites); atomicWritesStr != `` {
+			if cfg.atomicWrites, err = strconv.ParseBool(atomicWritesStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamAtomicWrites)
+			}
+		}
+		q.Del(sinkParamAtomicWrites)
+		if idempotentStr := q.Get(sinkParamIdempotentFlush); idempotentStr != `` {
+			if cfg.idempotentFlush, err = strconv.ParseBool(idempotentStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamIdempotentFlush)
+			}
+		}
+		q.Del(sinkParamIdempotentFlush)
+		cfg.resolvedSuffix = q.Get(sinkParamResolvedSuffix)
+		q.Del(sinkParamResolvedSuffix)
+		if bucketStartStr := q.Get(sinkParamResolvedBucketStart); bucketStartStr != `` {
+			if cfg.resolvedBucketStart, err = strconv.ParseBool(bucketStartStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamResolvedBucketStart)
+			}
+		}
+		q.Del(sinkParamResolvedBucketStart)
+		if trimStr := q.Get(sinkParamTrimTrailingSeparator); trimStr != `` {
+			if cfg.trimTrailingSeparator, err = strconv.ParseBool(trimStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamTrimTrailingSeparator)
+			}
+		}
+		q.Del(sinkParamTrimTrailingSeparator)
+		if uploadTimeoutStr := q.Get(sinkParamUploadTimeout); uploadTimeoutStr != `` {
+			if cfg.uploadTimeout, err = time.ParseDuration(uploadTimeoutStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamUploadTimeout)
+			}
+			if cfg.uploadTimeout <= 0 {
+				return nil, errors.Errorf(`%s must be positive: %s`,
+					sinkParamUploadTimeout, uploadTimeoutStr)
+			}
+		}
+		q.Del(sinkParamUploadTimeout)
+		if uploadMaxRetriesStr := q.Get(sinkParamUploadMaxRetries); uploadMaxRetriesStr != `` {
+			if cfg.uploadMaxRetries, err = strconv.Atoi(uploadMaxRetriesStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamUploadMaxRetries)
+			}
+			if cfg.uploadMaxRetries < 0 {
+				return nil, errors.Errorf(`%s must be non-negative: %d`,
+					sinkParamUploadMaxRetries, cfg.uploadMaxRetries)
+			}
+		}
+		q.Del(sinkParamUploadMaxRetries)
+		if cfg.writeConcurrency, err = parseWriteConcurrency(
+			q.Get(sinkParamWriteConcurrency), sinkParamWriteConcurrency, 1,
+		); err != nil {
+			return nil, err
+		}
+		q.Del(sinkParamWriteConcurrency)
+		if cfg.backfillWriteConcurrency, err = parseWriteConcurrency(
+			q.Get(sinkParamBackfillWriteConcurrency), sinkParamBackfillWriteConcurrency,
+			cfg.writeConcurrency,
+		); err != nil {
+			return nil, err
+		}
+		q.Del(sinkParamBackfillWriteConcurrency)
+		var jobPrefix bool
+		if jobPrefixStr := q.Get(sinkParamJobPrefix); jobPrefixStr != `` {
+			if jobPrefix, err = strconv.ParseBool(jobPrefixStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamJobPrefix)
+			}
+		}
+		q.Del(sinkParamJobPrefix)
+		// The job ID isn't known yet when the sink is only created to check
+		// the sink URI, so the base directory is used as is.
+		if jobPrefix && jobID != 0 {
+			if sinkURI, err = cloudStorageJobURI(sinkURI, jobID); err != nil {
+				return nil, err
+			}
+		}
+		makeSink = func() (Sink, error) {
+			return makeCloudStorageSink(ctx, sinkURI, cfg, encoder, settings)
+		}
+	case sinkSchemeMetrics:
+		capabilities = counterSinkCapabilities
+		makeSink = func() (Sink, error) { return makeCounterSink(targets), nil }
+	case sinkSchemeRedis:
+		capabilities = redisSinkCapabilities
+		cfg, err := consumeRedisSinkConfig(q)
+		if err != nil {
+			return nil, err
+		}
+		makeSink = func() (Sink, error) {
+			return makeRedisSink(ctx, u, cfg, targets)
+		}
+	case sinkSchemeUnix:
+		capabilities = unixSinkCapabilities
+		makeSink = func() (Sink, error) {
+			return makeUnixSink(ctx, u.Path, targets, settings)
+		}
+	case sinkSchemeWebhookHTTP, sinkSchemeWebhookHTTPS:
+		capabilities = webhookSinkCapabilities
+		cfg, err := consumeWebhookSinkConfig(q)
 		if err != nil {
 			return nil, err
 		}
 		makeSink = func() (Sink, error) {
-			return makeCloudStorageSink(sinkURI, bucketSize, settings, opts)
+			return makeWebhookSink(u, cfg, targets)
 		}
 	case sinkSchemeExperimentalSQL:
+		capabilities = sqlSinkCapabilities
 		// Swap the changefeed prefix for the sql connection one that sqlSink
 		// expects.
 		u.Scheme = `postgres`
 		// TODO(dan): Make tableName configurable or based on the job ID or
 		// something.
 		tableName := `sqlsink`
+		var skipCreate bool
+		if skipCreateStr := q.Get(sinkParamSkipCreate); skipCreateStr != `` {
+			var err error
+			if skipCreate, err = strconv.ParseBool(skipCreateStr); err != nil {
+				return nil, errors.Wrapf(err, `parsing %s`, sinkParamSkipCreate)
+			}
+		}
+		q.Del(sinkParamSkipCreate)
+		codec, err := consumeSQLSinkCodec(q)
+		if err != nil {
+			return nil, err
+		}
+		diagnoseErrors, err := consumeSQLSinkDiagnoseErrors(q)
+		if err != nil {
+			return nil, err
+		}
+		maxStatementBytes, err := consumeSQLSinkMaxStatementBytes(q)
+		if err != nil {
+			return nil, err
+		}
+		partitionBy, err := consumeSQLSinkPartitionBy(q, format, opts)
+		if err != nil {
+			return nil, err
+		}
 		makeSink = func() (Sink, error) {
-			return makeSQLSink(u.String(), tableName, targets)
+			s, err := makeSQLSink(u.String(), tableName, skipCreate, targets)
+			if err != nil {
+				return nil, err
+			}
+			if codec != sqlSinkCodecNone && !s.codecColumn {
+				_ = s.Close()
+				return nil, errors.Errorf(`%s=%s needs a codec column in existing table %s`,
+					sinkParamCompression, codec, tableName)
+			}
+			s.codec = codec
+			s.diagnoseErrors = diagnoseErrors
+			s.maxStatementBytes = maxStatementBytes
+			s.partitionBy = partitionBy
+			return s, nil
 		}
 		// Remove parameters we know about for the unknown parameter check.
 		q.Del(`sslcert`)
@@ -130,16 +935,468 @@ func getSink(
 	}
 
 	for k := range q {
+		if schemes := sinkParamSchemes(k); len(schemes) > 0 {
+			return nil, errors.Errorf(`unknown sink query parameter: %s (only supported by %s)`,
+				k, strings.Join(schemes, `, `))
+		}
 		return nil, errors.Errorf(`unknown sink query parameter: %s`, k)
 	}
 
+	if err := capabilities.validate(format, opts); err != nil {
+		return nil, err
+	}
+
+	// What's sent to the dead letter sink is always a JSON record that includes
+	// the row's key and value, so it gets none of the changefeed's options and
+	// only has to be able to write values.
+	var deadLetter Sink
+	if deadLetterURI := opts[optDeadLetterSink]; deadLetterURI != `` {
+		deadLetterOpts := map[string]string{optEnvelope: string(optEnvelopeValueOnly)}
+		deadLetter, err = getSink(ctx, deadLetterURI, deadLetterOpts,
+			makeJSONEncoder(deadLetterOpts), targets, jobID, settings, knobs)
+		if err != nil {
+			return nil, errors.Wrapf(err, `creating %s`, optDeadLetterSink)
+		}
+	}
+
 	s, err := makeSink()
 	if err != nil {
+		if deadLetter != nil {
+			_ = deadLetter.Close()
+		}
 		return nil, err
 	}
+	if debugMirror.dir != `` {
+		mirror, err := makeDebugMirrorSink(ctx, s, debugMirror, jobID)
+		if err != nil {
+			_ = s.Close()
+			if deadLetter != nil {
+				_ = deadLetter.Close()
+			}
+			return nil, err
+		}
+		s = mirror
+	}
+	if debugSampleRate > 0 {
+		s = makeDebugTapSink(s, debugSampleRate)
+	}
+	// The dead letter sink has to wrap the limit to get the rows it rejects.
+	if valueLimit.maxBytes > 0 {
+		s = makeValueLimitSink(s, valueLimit)
+	}
+	if deadLetter != nil {
+		s = makeDeadLetterSink(s, deadLetter)
+	}
+	if rateLimits.enabled() {
+		s = makeRateLimitedSink(s, rateLimits)
+	}
 	return s, nil
 }
 
+// localSinkPath returns the node-local path that a sink writes to, confined to
+// the external IO dir like the paths of `nodelocal` URIs. Without settings,
+// which is only the case outside of a server, any path is allowed.
+func localSinkPath(path string, settings *cluster.Settings) (string, error) {
+	if settings == nil {
+		return path, nil
+	}
+	if settings.ExternalIODir == `` {
+		return ``, errors.Errorf(`local file access is disabled`)
+	}
+	local := filepath.Clean(filepath.Join(settings.ExternalIODir, path))
+	if local != settings.ExternalIODir &&
+		!strings.HasPrefix(local, settings.ExternalIODir+string(filepath.Separator)) {
+		return ``, errors.Errorf(
+			`local file access to paths outside of external-io-dir is not allowed`)
+	}
+	return local, nil
+}
+
+// validateSinkFormat returns an error if format is not one of the supported
+// formats of a sink.
+func validateSinkFormat(format formatType, supportedFormats []formatType) error {
+	for _, supported := range supportedFormats {
+		if format == supported {
+			return nil
+		}
+	}
+	return errors.Errorf(`this sink is incompatible with %s=%s`, optFormat, format)
+}
+
+// kafkaBackpressureWarnDuration is how long an emit must be blocked on a full
+// producer queue before it's logged as a warning.
+const kafkaBackpressureWarnDuration = 10 * time.Second
+
+// kafkaSlowFlushWarnDuration is how long a flush must wait on inflight
+// messages before the partitions that are holding it up are logged as a
+// warning. They're logged again each time it passes after that.
+const kafkaSlowFlushWarnDuration = 10 * time.Second
+
+// kafkaSlowFlushPartitionLimit bounds how many partitions are logged for a
+// slow flush. Only the ones with the most inflight messages are.
+const kafkaSlowFlushPartitionLimit = 10
+
+// kafkaMaxReconnectsPerFlush bounds how many times a single Flush rebuilds the
+// producer to resend messages that failed because the connection to kafka was
+// lost. Past that, the error is left to the changefeed to retry.
+//
+// Resending makes delivery at-least-once. The producer isn't idempotent, so a
+// message that the broker accepted but whose acknowledgement was lost with the
+// connection is written again, and consumers see it twice. Changefeeds already
+// allow duplicates, but every reconnect can add some.
+const kafkaMaxReconnectsPerFlush = 3
+
+// kafkaReconnectRetryOpts bounds the attempts to rebuild the client and
+// producer after the connection to kafka was lost.
+var kafkaReconnectRetryOpts = retry.Options{
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+	MaxRetries:     5,
+}
+
+// kafkaSinkConfig holds the sink params of a kafkaSink.
+type kafkaSinkConfig struct {
+	kafkaTopicPrefix string
+	// backpressureTimeout, if non-zero, is the longest an emit may block on a
+	// full producer queue before it fails with a backpressureSinkError.
+	backpressureTimeout time.Duration
+	// controlTopic, if non-empty, is the topic that schema change markers are
+	// emitted to. It is used as is, without the topic prefix.
+	controlTopic string
+	// resolvedChangedTopicsOnly, if true, restricts resolved timestamps to the
+	// topics that have had a row emitted since the previous resolved
+	// timestamp.
+	resolvedChangedTopicsOnly bool
+	// resolvedTopic, if non-empty, is the topic that resolved timestamps are
+	// emitted to, once for each data topic and keyed by it, instead of to
+	// every partition of every data topic. It is used as is, without the
+	// topic prefix.
+	resolvedTopic string
+	// topicGranularity is one of the kafkaTopicGranularity* constants. Empty
+	// means kafkaTopicGranularityTable.
+	topicGranularity string
+	// contentType, if non-empty, is put in the content-type header of every
+	// row and resolved timestamp message. It's set from the `format=`
+	// changefeed option, not a sink param.
+	contentType string
+	// highWaterHeader, if true, puts the high water set by SetHighWater in the
+	// high_water header of every row message. It's set from the `high_water`
+	// changefeed option, not a sink param.
+	highWaterHeader bool
+	// schemaVersionHeader, if true, puts the version of the table descriptor
+	// each row was encoded with in its schema_version header.
+	schemaVersionHeader bool
+	// sourceHeaders, if true, puts the IDs of the table and database of each
+	// row, and the database's name if it's known, in its table_id,
+	// database_id and database headers. It's set from the `source` changefeed
+	// option, not a sink param.
+	sourceHeaders bool
+	// maxInflightRequests, if non-zero, is how many requests the producer may
+	// have in flight to each broker at once. Sarama's default is 5. Above 1, a
+	// request that's retried can land after one sent later, which reorders the
+	// rows of a key. It's per broker connection, so it can't be set per topic.
+	maxInflightRequests int
+	// dialTimeout, readTimeout, and writeTimeout, if non-zero, bound how long
+	// connecting to a broker, waiting for a response, and sending a request may
+	// take. Sarama's default for each is 30s. A connect that times out while
+	// the sink is made fails it with a retryable error instead of hanging.
+	dialTimeout, readTimeout, writeTimeout time.Duration
+	// acksTimeout, if non-zero, is how long the brokers may wait for the
+	// replicas to acknowledge a produce request, sarama's
+	// Producer.Timeout, which defaults to 10s. It also makes the sink give up
+	// on the messages that sarama hasn't acknowledged or failed by the time all
+	// of its retries would have timed out, counted from when sarama took them
+	// off its queue, and on the ones that stay queued for as long, see
+	// kafkaSink.ackDeadline.
+	acksTimeout time.Duration
+	// relaxedOrderingTopics are the data topics whose rows may be sent to
+	// another partition than their key hashes to while that one has no leader,
+	// instead of waiting for it. That keeps the changefeed going through a
+	// broker outage, but the rows of a key are no longer all in one partition,
+	// so they can be seen out of order.
+	relaxedOrderingTopics map[string]struct{}
+	// partitioner is one of the kafkaPartitioner* constants. Empty means
+	// kafkaPartitionerFNV.
+	partitioner string
+	// partitionKeySalt and partitionKeyBuckets, if set, transform the key that
+	// picks the partition of a row before it's hashed, see partitionKey. The
+	// message key is delivered as is.
+	partitionKeySalt    string
+	partitionKeyBuckets int
+	// extraBootstrapServers are the comma-separated bootstrap servers of each
+	// kafka cluster that's emitted to besides the one of the sink URI, see
+	// kafkaMultiClusterSink.
+	extraBootstrapServers []string
+	// extraClusterFailurePolicy is one of the kafkaClusterFailurePolicy*
+	// constants. Empty means kafkaClusterFailurePolicyFailFast.
+	extraClusterFailurePolicy string
+	// idleFlushInterval, if non-zero, is how often the producer sends out
+	// whatever it has buffered, even if nothing new is emitted, so the tail of
+	// a burst of rows isn't left waiting. See makeKafkaSink.
+	idleFlushInterval time.Duration
+	// configHook, if non-nil, is applied to the sarama.Config last. It's set
+	// from TestingKnobs, not a sink param.
+	configHook KafkaConfigHook
+
+	saslEnabled   bool
+	saslHandshake bool
+	saslUser      string
+	saslPassword  string
+	// saslMechanism is always kafkaSASLMechanismPlain once SASL is enabled.
+	saslMechanism string
+}
+
+const (
+	// kafkaTopicGranularityTable emits each table to its own topic, named after
+	// the table.
+	kafkaTopicGranularityTable = `table`
+	// kafkaTopicGranularityDatabase emits all of the tables in a database to
+	// one topic, named after the database. Each message has a `table` header
+	// with the name of the table it's from.
+	kafkaTopicGranularityDatabase = `database`
+)
+
+const (
+	// kafkaPartitionerFNV hashes message keys with FNV-1a, modulo the number
+	// of partitions, like sarama's default partitioner.
+	kafkaPartitionerFNV = `fnv`
+	// kafkaPartitionerJump hashes message keys with a jump consistent hash.
+	// When partitions are added to a topic, only the keys that go to the new
+	// partitions move, instead of nearly all of them.
+	kafkaPartitionerJump = `jump`
+)
+
+// kafkaTableHeader is the message header that holds the table name of a row
+// when the topic_granularity sink param is database.
+const kafkaTableHeader = `table`
+
+// kafkaHighWaterHeader is the message header that holds the high water of a
+// row with the `high_water` option, as a decimal like the `updated` option.
+const kafkaHighWaterHeader = `high_water`
+
+// kafkaSchemaVersionHeader is the message header that holds the version of the
+// table descriptor a row was encoded with, with the schema_version_header sink
+// param. Versions only go up, and they're the ones in the markers sent to the
+// control topic, so a consumer that reads a row with an older version than one
+// it already has for the table knows it's from before a schema change and can
+// tell the row's value apart from the newer ones.
+const kafkaSchemaVersionHeader = `schema_version`
+
+// kafkaTableIDHeader, kafkaDatabaseIDHeader and kafkaDatabaseHeader are the
+// message headers that hold the source of a row with the `source` option, like
+// the `source` that it adds to JSON values.
+const (
+	kafkaTableIDHeader    = `table_id`
+	kafkaDatabaseIDHeader = `database_id`
+	kafkaDatabaseHeader   = `database`
+)
+
+// kafkaContentTypeHeader is the message header that holds
+// kafkaSinkConfig.contentType. The name is the one the CloudEvents kafka
+// protocol binding uses to recognize structured events.
+const kafkaContentTypeHeader = `content-type`
+
+// KafkaConfigHook mutates the sarama.Config of a kafka sink after the sink has
+// configured it and before the client is created. It's an escape hatch for
+// settings that have no sink param, such as the client ID or rack. The sink
+// depends on some of its own settings, most of all the producer's flush
+// settings and Return.Successes: a hook that changes them can make Flush block
+// forever or lose messages.
+type KafkaConfigHook func(*sarama.Config) error
+
+// consumeKafkaSinkConfig parses and removes the kafka sink params from q.
+func consumeKafkaSinkConfig(q url.Values) (kafkaSinkConfig, error) {
+	var cfg kafkaSinkConfig
+	cfg.kafkaTopicPrefix = q.Get(sinkParamTopicPrefix)
+	q.Del(sinkParamTopicPrefix)
+	schemaTopic := q.Get(sinkParamSchemaTopic)
+	q.Del(sinkParamSchemaTopic)
+	if schemaTopic != `` {
+		return kafkaSinkConfig{}, errors.Errorf(`%s is not yet supported`, sinkParamSchemaTopic)
+	}
+	if timeoutStr := q.Get(sinkParamBackpressureTimeout); timeoutStr != `` {
+		var err error
+		if cfg.backpressureTimeout, err = time.ParseDuration(timeoutStr); err != nil {
+			return kafkaSinkConfig{}, err
+		}
+	}
+	q.Del(sinkParamBackpressureTimeout)
+	cfg.controlTopic = q.Get(sinkParamControlTopic)
+	q.Del(sinkParamControlTopic)
+	if changedOnlyStr := q.Get(sinkParamResolvedChangedTopicsOnly); changedOnlyStr != `` {
+		var err error
+		if cfg.resolvedChangedTopicsOnly, err = strconv.ParseBool(changedOnlyStr); err != nil {
+			return kafkaSinkConfig{}, errors.Wrapf(
+				err, `parsing %s`, sinkParamResolvedChangedTopicsOnly)
+		}
+	}
+	q.Del(sinkParamResolvedChangedTopicsOnly)
+	if headerStr := q.Get(sinkParamSchemaVersionHeader); headerStr != `` {
+		var err error
+		if cfg.schemaVersionHeader, err = strconv.ParseBool(headerStr); err != nil {
+			return kafkaSinkConfig{}, errors.Wrapf(err, `parsing %s`, sinkParamSchemaVersionHeader)
+		}
+	}
+	q.Del(sinkParamSchemaVersionHeader)
+	cfg.resolvedTopic = q.Get(sinkParamResolvedTopic)
+	q.Del(sinkParamResolvedTopic)
+	switch cfg.topicGranularity = q.Get(sinkParamTopicGranularity); cfg.topicGranularity {
+	case ``, kafkaTopicGranularityTable, kafkaTopicGranularityDatabase:
+	default:
+		return kafkaSinkConfig{}, errors.Errorf(`unknown %s: %s`,
+			sinkParamTopicGranularity, cfg.topicGranularity)
+	}
+	q.Del(sinkParamTopicGranularity)
+	if maxInflightStr := q.Get(sinkParamMaxInflightRequests); maxInflightStr != `` {
+		var err error
+		if cfg.maxInflightRequests, err = strconv.Atoi(maxInflightStr); err != nil {
+			return kafkaSinkConfig{}, errors.Wrapf(err, `parsing %s`, sinkParamMaxInflightRequests)
+		}
+		if cfg.maxInflightRequests <= 0 {
+			return kafkaSinkConfig{}, errors.Errorf(`%s must be positive: %d`,
+				sinkParamMaxInflightRequests, cfg.maxInflightRequests)
+		}
+	}
+	q.Del(sinkParamMaxInflightRequests)
+	for _, timeout := range []struct {
+		param string
+		d     *time.Duration
+	}{
+		{sinkParamAcksTimeout, &cfg.acksTimeout},
+		{sinkParamDialTimeout, &cfg.dialTimeout},
+		{sinkParamIdleFlushInterval, &cfg.idleFlushInterval},
+		{sinkParamReadTimeout, &cfg.readTimeout},
+		{sinkParamWriteTimeout, &cfg.writeTimeout},
+	} {
+		if str := q.Get(timeout.param); str != `` {
+			d, err := time.ParseDuration(str)
+			if err != nil {
+				return kafkaSinkConfig{}, errors.Wrapf(err, `parsing %s`, timeout.param)
+			}
+			if d <= 0 {
+				return kafkaSinkConfig{}, errors.Errorf(`%s must be positive: %s`, timeout.param, str)
+			}
+			*timeout.d = d
+		}
+		q.Del(timeout.param)
+	}
+	if topicsStr := q.Get(sinkParamRelaxedOrderingTopics); topicsStr != `` {
+		cfg.relaxedOrderingTopics = make(map[string]struct{})
+		for _, topic := range strings.Split(topicsStr, `,`) {
+			cfg.relaxedOrderingTopics[topic] = struct{}{}
+		}
+	}
+	q.Del(sinkParamRelaxedOrderingTopics)
+	switch cfg.partitioner = q.Get(sinkParamPartitioner); cfg.partitioner {
+	case ``, kafkaPartitionerFNV, kafkaPartitionerJump:
+	default:
+		return kafkaSinkConfig{}, errors.Errorf(`unknown %s: %s`,
+			sinkParamPartitioner, cfg.partitioner)
+	}
+	q.Del(sinkParamPartitioner)
+	cfg.extraBootstrapServers = q[sinkParamExtraBootstrapServers]
+	q.Del(sinkParamExtraBootstrapServers)
+	cfg.extraClusterFailurePolicy = q.Get(sinkParamExtraClusterFailurePolicy)
+	q.Del(sinkParamExtraClusterFailurePolicy)
+	switch cfg.extraClusterFailurePolicy {
+	case ``, kafkaClusterFailurePolicyFailFast, kafkaClusterFailurePolicyBestEffort:
+	default:
+		return kafkaSinkConfig{}, errors.Errorf(`unknown %s: %s`,
+			sinkParamExtraClusterFailurePolicy, cfg.extraClusterFailurePolicy)
+	}
+	if len(cfg.extraBootstrapServers) > 0 && cfg.resolvedChangedTopicsOnly {
+		return kafkaSinkConfig{}, errors.Errorf(`%s is not supported with %s`,
+			sinkParamResolvedChangedTopicsOnly, sinkParamExtraBootstrapServers)
+	}
+	cfg.partitionKeySalt = q.Get(sinkParamPartitionKeySalt)
+	q.Del(sinkParamPartitionKeySalt)
+	if bucketsStr := q.Get(sinkParamPartitionKeyBuckets); bucketsStr != `` {
+		var err error
+		if cfg.partitionKeyBuckets, err = strconv.Atoi(bucketsStr); err != nil {
+			return kafkaSinkConfig{}, errors.Wrapf(err, `parsing %s`, sinkParamPartitionKeyBuckets)
+		}
+		if cfg.partitionKeyBuckets <= 0 {
+			return kafkaSinkConfig{}, errors.Errorf(`%s must be positive: %d`,
+				sinkParamPartitionKeyBuckets, cfg.partitionKeyBuckets)
+		}
+	}
+	q.Del(sinkParamPartitionKeyBuckets)
+
+	if saslEnabledStr := q.Get(sinkParamSASLEnabled); saslEnabledStr != `` {
+		var err error
+		if cfg.saslEnabled, err = strconv.ParseBool(saslEnabledStr); err != nil {
+			return kafkaSinkConfig{}, errors.Wrapf(err, `parsing %s`, sinkParamSASLEnabled)
+		}
+	}
+	q.Del(sinkParamSASLEnabled)
+	cfg.saslHandshake = true
+	if saslHandshakeStr := q.Get(sinkParamSASLHandshake); saslHandshakeStr != `` {
+		var err error
+		if cfg.saslHandshake, err = strconv.ParseBool(saslHandshakeStr); err != nil {
+			return kafkaSinkConfig{}, errors.Wrapf(err, `parsing %s`, sinkParamSASLHandshake)
+		}
+	}
+	q.Del(sinkParamSASLHandshake)
+	cfg.saslUser = q.Get(sinkParamSASLUser)
+	q.Del(sinkParamSASLUser)
+	cfg.saslPassword = q.Get(sinkParamSASLPassword)
+	q.Del(sinkParamSASLPassword)
+	cfg.saslMechanism = q.Get(sinkParamSASLMechanism)
+	q.Del(sinkParamSASLMechanism)
+
+	if cfg.saslEnabled {
+		switch cfg.saslMechanism {
+		case ``:
+			cfg.saslMechanism = kafkaSASLMechanismPlain
+		case kafkaSASLMechanismPlain:
+		default:
+			return kafkaSinkConfig{}, errors.Errorf(`unsupported %s: %s`,
+				sinkParamSASLMechanism, cfg.saslMechanism)
+		}
+		if cfg.saslUser == `` {
+			return kafkaSinkConfig{}, errors.Errorf(`%s must be provided when SASL is enabled`,
+				sinkParamSASLUser)
+		}
+		if cfg.saslPassword == `` {
+			return kafkaSinkConfig{}, errors.Errorf(`%s must be provided when SASL is enabled`,
+				sinkParamSASLPassword)
+		}
+	} else if cfg.saslUser != `` || cfg.saslPassword != `` || cfg.saslMechanism != `` {
+		return kafkaSinkConfig{}, errors.Errorf(`%s must be enabled to configure SASL`,
+			sinkParamSASLEnabled)
+	}
+	return cfg, nil
+}
+
+// kafkaSASLMechanismPlain is the only SASL mechanism the vendored sarama
+// supports; it always uses it once SASL is enabled. SCRAM needs sarama v1.22 or
+// later.
+const kafkaSASLMechanismPlain = `PLAIN`
+
+// configureSASL sets up SASL authentication on config, if it's enabled.
+func (cfg kafkaSinkConfig) configureSASL(config *sarama.Config) {
+	if !cfg.saslEnabled {
+		return
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = cfg.saslHandshake
+	config.Net.SASL.User = cfg.saslUser
+	config.Net.SASL.Password = cfg.saslPassword
+}
+
+var kafkaSinkCapabilities = SinkCapabilities{
+	Formats: []formatType{
+		optFormatJSON, optFormatAvro, optFormatCloudEvents, optFormatRaw, optFormatProtobuf,
+	},
+	Envelopes:     allEnvelopes,
+	Resolved:      true,
+	PartitionHint: true,
+	KeyFormat:     true,
+	HighWater:     true,
+	Lifecycle:     true,
+}
+
 // kafkaSink emits to Kafka asynchronously. It is not concurrency-safe; all
 // calls to Emit and Flush should be from the same goroutine.
 type kafkaSink struct {
@@ -147,12 +1404,47 @@ type kafkaSink struct {
 	// official confluent one depends on librdkafka and it didn't seem worth it
 	// to add a new c dep for the prototype. Revisit before 2.1 and check
 	// stability, performance, etc.
-	kafkaTopicPrefix string
-	client           sarama.Client
-	producer         sarama.AsyncProducer
-	topics           map[string]struct{}
+	cfg      kafkaSinkConfig
+	client   sarama.Client
+	producer sarama.AsyncProducer
+	topics   map[string]struct{}
+	// databaseTopics maps each table to its topic when cfg.topicGranularity is
+	// kafkaTopicGranularityDatabase.
+	databaseTopics map[sqlbase.ID]string
+	// databaseNames maps each table to the name of its database when
+	// cfg.sourceHeaders is set and the name is known.
+	databaseNames map[sqlbase.ID]string
+	// highWater is the latest high water set by SetHighWater.
+	highWater hlc.Timestamp
+	// metrics, if non-nil, is where time spent blocked on a full producer queue
+	// is recorded.
+	metrics *Metrics
+	// ackDeadline, if non-zero, is how long a message may wait to be sent by
+	// sarama, and then to be acknowledged, before the sink fails it itself,
+	// see kafkaAckDeadline and expireInflight.
+	ackDeadline time.Duration
+	// logCtx is what the sink's worker goroutine logs with, see sinkLogCtx.
+	logCtx context.Context
 
 	lastMetadataRefresh time.Time
+	// changedTopics is only used when cfg.resolvedChangedTopicsOnly is set. In
+	// a changeAggregator's sink, it's the set of topics that EmitRow has been
+	// called for since the last TakeChangedTopics. In a changeFrontier's sink,
+	// it's the set of topics reported by NoteChangedTopic since the last
+	// EmitResolvedTimestamp.
+	changedTopics map[string]struct{}
+	// partitions caches the most recently discovered partitions of each topic.
+	// It's used as a fallback when sarama fails to return the partitions of a
+	// topic, so that a transient metadata hiccup doesn't fail the resolved
+	// timestamp emit.
+	partitions map[string][]int32
+
+	// bootstrapServers, config and newClientFn are kept to rebuild the client
+	// and producer if the connection to kafka is lost. If newClientFn is nil,
+	// the producer is never rebuilt.
+	bootstrapServers []string
+	config           *sarama.Config
+	newClientFn      kafkaClientFactory
 
 	stopWorkerCh chan struct{}
 	worker       sync.WaitGroup
@@ -164,23 +1456,149 @@ type kafkaSink struct {
 		inflight int64
 		flushErr error
 		flushCh  chan struct{}
+		// inflightTables is the subset of inflight that are rows, by table
+		// name. It's lazily initialized.
+		inflightTables map[string]int64
+		// failed holds the messages that failed because the connection to
+		// kafka was lost, to be resent by Flush on a rebuilt producer.
+		failed []*sarama.ProducerMessage
+		// inflightMsgs are the messages counted by inflight, and rejected are
+		// the ones that kafka rejected since the last error returned by a
+		// Flush. They're reported by CloseAndDrain. inflightMsgs is lazily
+		// initialized.
+		inflightMsgs map[*sarama.ProducerMessage]kafkaInflightMsg
+		rejected     []*sarama.ProducerMessage
+		// inflightPartitions is inflight, by topic and partition, so that a
+		// slow flush can tell which partitions are holding it up. A message is
+		// counted under kafkaUnknownPartition until notePartition learns its
+		// partition. It's lazily initialized.
+		inflightPartitions map[kafkaTopicPartition]int64
+	}
+}
+
+// kafkaInflightMsg is what the sink keeps track of for an inflight message.
+type kafkaInflightMsg struct {
+	// partition is the partition it's counted under in inflightPartitions.
+	partition int32
+	// emitted is when it was emitted and sent is when sarama partitioned it,
+	// after which it's batched and sent to the partition's leader. sent is zero
+	// while it's still queued in sarama. Both are for ackDeadline.
+	emitted, sent time.Time
+}
+
+// kafkaUnknownPartition is the partition of an inflight message that sarama
+// hasn't partitioned yet, see kafkaSink.notePartition.
+const kafkaUnknownPartition = -1
+
+// kafkaTopicPartition is a partition of a kafka topic.
+type kafkaTopicPartition struct {
+	topic     string
+	partition int32
+}
+
+func (tp kafkaTopicPartition) String() string {
+	if tp.partition == kafkaUnknownPartition {
+		return tp.topic + `/?`
 	}
+	return fmt.Sprintf(`%s/%d`, tp.topic, tp.partition)
+}
+
+// kafkaClientFactory connects to the given kafka brokers and returns a client
+// and a producer that uses it. It exists so that tests can swap in fakes.
+type kafkaClientFactory func(
+	bootstrapServers []string, config *sarama.Config,
+) (sarama.Client, sarama.AsyncProducer, error)
+
+// newSaramaKafkaClient is the kafkaClientFactory used outside of tests.
+func newSaramaKafkaClient(
+	bootstrapServers []string, config *sarama.Config,
+) (sarama.Client, sarama.AsyncProducer, error) {
+	client, err := sarama.NewClient(bootstrapServers, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	producer, err := sarama.NewAsyncProducerFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, nil, err
+	}
+	return client, producer, nil
 }
 
 func makeKafkaSink(
-	kafkaTopicPrefix string, bootstrapServers string, targets jobspb.ChangefeedTargets,
+	ctx context.Context,
+	cfg kafkaSinkConfig,
+	bootstrapServers string,
+	targets jobspb.ChangefeedTargets,
+	newClientFn kafkaClientFactory,
 ) (Sink, error) {
 	sink := &kafkaSink{
-		kafkaTopicPrefix: kafkaTopicPrefix,
+		cfg:        cfg,
+		partitions: make(map[string][]int32),
+		logCtx:     sinkLogCtx(ctx),
 	}
 	sink.topics = make(map[string]struct{})
-	for _, t := range targets {
-		sink.topics[kafkaTopicPrefix+SQLNameToKafkaName(t.StatementTimeName)] = struct{}{}
+	if cfg.topicGranularity == kafkaTopicGranularityDatabase {
+		sink.databaseTopics = make(map[sqlbase.ID]string, len(targets))
+		for id, t := range targets {
+			if t.StatementTimeDatabaseName == `` {
+				return nil, errors.Errorf(`%s=%s is not supported by changefeeds created `+
+					`before it was introduced`, sinkParamTopicGranularity, cfg.topicGranularity)
+			}
+			topic := cfg.kafkaTopicPrefix + SQLNameToKafkaName(t.StatementTimeDatabaseName)
+			sink.databaseTopics[id] = topic
+			sink.topics[topic] = struct{}{}
+		}
+	} else {
+		for _, t := range targets {
+			sink.topics[cfg.kafkaTopicPrefix+SQLNameToKafkaName(t.StatementTimeName)] = struct{}{}
+		}
+	}
+	if cfg.sourceHeaders {
+		sink.databaseNames = make(map[sqlbase.ID]string, len(targets))
+		for id, t := range targets {
+			if t.StatementTimeDatabaseName != `` {
+				sink.databaseNames[id] = t.StatementTimeDatabaseName
+			}
+		}
+	}
+	for topic := range cfg.relaxedOrderingTopics {
+		if _, ok := sink.topics[topic]; !ok {
+			return nil, errors.Errorf(`%s names a topic that isn't emitted to: %s`,
+				sinkParamRelaxedOrderingTopics, topic)
+		}
 	}
 
 	config := sarama.NewConfig()
 	config.Producer.Return.Successes = true
-	config.Producer.Partitioner = newChangefeedPartitioner
+	partitioner := makeChangefeedPartitionerConstructor(cfg)
+	config.Producer.Partitioner = func(topic string) sarama.Partitioner {
+		p := partitioner(topic).(*changefeedPartitioner)
+		p.onPartition = sink.notePartition
+		return p
+	}
+	if cfg.maxInflightRequests > 0 {
+		config.Net.MaxOpenRequests = cfg.maxInflightRequests
+	}
+	if cfg.dialTimeout > 0 {
+		config.Net.DialTimeout = cfg.dialTimeout
+	}
+	if cfg.acksTimeout > 0 {
+		config.Producer.Timeout = cfg.acksTimeout
+	}
+	if cfg.readTimeout > 0 {
+		config.Net.ReadTimeout = cfg.readTimeout
+	}
+	if cfg.writeTimeout > 0 {
+		config.Net.WriteTimeout = cfg.writeTimeout
+	}
+	if cfg.topicGranularity == kafkaTopicGranularityDatabase || cfg.contentType != `` ||
+		cfg.highWaterHeader || cfg.schemaVersionHeader || cfg.sourceHeaders {
+		// Message headers were introduced in kafka 0.11 and sarama silently
+		// drops them unless it's told the brokers are at least that version.
+		config.Version = sarama.V0_11_0_0
+	}
+	cfg.configureSASL(config)
 
 	// When we emit messages to sarama, they're placed in a queue (as does any
 	// reasonable kafka producer client). When our sink's Flush is called, we
@@ -200,6 +1618,15 @@ func makeKafkaSink(
 	// with some messages, buffers any messages that come in while it is in
 	// flight, then sends those out.
 	config.Producer.Flush.Messages = 1
+	// The `idle_flush_interval` sink param is a backstop for that: sarama's
+	// flush timer also sends out whatever is buffered once per interval, so
+	// the tail of a burst never waits for the next row. The timer belongs to
+	// the producer, so it stops when the producer is closed, and what it
+	// flushes is acknowledged like anything else, so it doesn't affect the
+	// inflight count that Flush waits on.
+	if cfg.idleFlushInterval > 0 {
+		config.Producer.Flush.Frequency = cfg.idleFlushInterval
+	}
 
 	// This works around what seems to be a bug in sarama where it isn't
 	// computing the right value to compare against `Producer.MaxMessageBytes`
@@ -213,16 +1640,37 @@ func makeKafkaSink(
 	// to test this one more before changing it.
 	config.Producer.Flush.MaxMessages = 1000
 
+	if cfg.configHook != nil {
+		if err := cfg.configHook(config); err != nil {
+			return nil, errors.Wrap(err, `applying kafka config hook`)
+		}
+		if err := config.Validate(); err != nil {
+			return nil, errors.Wrap(err, `invalid kafka config after hook`)
+		}
+	}
+
+	if cfg.acksTimeout > 0 {
+		// After the config hook, which may change the retries.
+		sink.ackDeadline = kafkaAckDeadline(config)
+	}
+	sink.bootstrapServers = strings.Split(bootstrapServers, `,`)
+	sink.config = config
+	sink.newClientFn = newClientFn
 	var err error
-	sink.client, err = sarama.NewClient(strings.Split(bootstrapServers, `,`), config)
+	sink.client, sink.producer, err = newClientFn(sink.bootstrapServers, config)
 	if err != nil {
 		err = errors.Wrapf(err, `connecting to kafka: %s`, bootstrapServers)
 		return nil, &retryableSinkError{cause: err}
 	}
-	sink.producer, err = sarama.NewAsyncProducerFromClient(sink.client)
-	if err != nil {
-		err = errors.Wrapf(err, `connecting to kafka: %s`, bootstrapServers)
-		return nil, &retryableSinkError{cause: err}
+
+	// Pre-populate the partition cache so that resolved timestamps can be
+	// emitted to every topic even if the first metadata lookup for it fails.
+	// Errors are ignored here, the topic will be retried on the next resolved
+	// timestamp.
+	for topic := range sink.topics {
+		if partitions, err := sink.client.Partitions(topic); err == nil {
+			sink.partitions[topic] = partitions
+		}
 	}
 
 	sink.start()
@@ -235,6 +1683,11 @@ func (s *kafkaSink) start() {
 	go s.workerLoop()
 }
 
+// Capabilities implements the Sink interface.
+func (s *kafkaSink) Capabilities() SinkCapabilities {
+	return kafkaSinkCapabilities
+}
+
 // Close implements the Sink interface.
 func (s *kafkaSink) Close() error {
 	close(s.stopWorkerCh)
@@ -250,23 +1703,164 @@ func (s *kafkaSink) Close() error {
 	return nil
 }
 
-// EmitRow implements the Sink interface.
-func (s *kafkaSink) EmitRow(
-	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, _ hlc.Timestamp,
+// CloseAndDrain implements the Drainer interface. It waits for kafka to
+// acknowledge every inflight message, as Flush does, but doesn't resend the
+// ones that failed, and then closes the sink.
+func (s *kafkaSink) CloseAndDrain(ctx context.Context) ([]MessageRef, error) {
+	waitCh := make(chan struct{}, 1)
+	s.mu.Lock()
+	if s.mu.inflight > 0 {
+		s.mu.flushCh = waitCh
+	} else {
+		waitCh <- struct{}{}
+	}
+	s.mu.Unlock()
+	select {
+	case <-ctx.Done():
+	case <-waitCh:
+	}
+	err := s.Close()
+
+	// The worker is stopped, so nothing changes anymore.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var undelivered []MessageRef
+	for msg := range s.mu.inflightMsgs {
+		undelivered = append(undelivered, kafkaMessageRef(msg))
+	}
+	for _, msg := range s.mu.failed {
+		undelivered = append(undelivered, kafkaMessageRef(msg))
+	}
+	for _, msg := range s.mu.rejected {
+		undelivered = append(undelivered, kafkaMessageRef(msg))
+	}
+	return undelivered, err
+}
+
+// kafkaMessageRef returns the MessageRef of a message.
+func kafkaMessageRef(msg *sarama.ProducerMessage) MessageRef {
+	ref := MessageRef{Topic: msg.Topic}
+	if msg.Key != nil {
+		// The keys are always sarama.ByteEncoders, which can't fail.
+		ref.Key, _ = msg.Key.Encode()
+	}
+	return ref
+}
+
+// EmitRow implements the Sink interface.
+func (s *kafkaSink) EmitRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, _ hlc.Timestamp,
+) error {
+	return s.emitRow(ctx, table, key, value, partitionHint{})
+}
+
+// EmitRowWithPartitionHint implements the PartitionHintEmitter interface.
+func (s *kafkaSink) EmitRowWithPartitionHint(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	key, value []byte,
+	hint partitionHint,
+	_ hlc.Timestamp,
+) error {
+	return s.emitRow(ctx, table, key, value, hint)
+}
+
+// kafkaMessageMetadata is the Metadata of the sarama.ProducerMessage for a row.
+type kafkaMessageMetadata struct {
+	// table is the name of the row's table. It's used to track the inflight
+	// rows of each table, see FlushTable.
+	table string
+	// partitionHint, if set, is how changefeedPartitioner picks the partition
+	// instead of hashing the message key.
+	partitionHint partitionHint
+	// keyless is whether the row has no key, as with `envelope=value_only`.
+	// The message key is then null and, without a partitionHint, the rows are
+	// spread round-robin across the partitions. A resolved timestamp has no
+	// key either, but it has no metadata and is sent to the partition it's
+	// addressed to.
+	keyless bool
+}
+
+func (s *kafkaSink) emitRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, hint partitionHint,
 ) error {
-	topic := s.kafkaTopicPrefix + SQLNameToKafkaName(table.Name)
-	if _, ok := s.topics[topic]; !ok {
-		return errors.Errorf(`cannot emit to undeclared topic: %s`, topic)
+	var topic string
+	if s.cfg.topicGranularity == kafkaTopicGranularityDatabase {
+		var ok bool
+		if topic, ok = s.databaseTopics[table.ID]; !ok {
+			return errors.Errorf(`cannot emit undeclared table: %s`, table.Name)
+		}
+	} else {
+		topic = s.cfg.kafkaTopicPrefix + SQLNameToKafkaName(table.Name)
+		if _, ok := s.topics[topic]; !ok {
+			return errors.Errorf(`cannot emit to undeclared topic: %s`, topic)
+		}
 	}
+	s.NoteChangedTopic(topic)
 
 	msg := &sarama.ProducerMessage{
 		Topic: topic,
-		Key:   sarama.ByteEncoder(key),
 		Value: sarama.ByteEncoder(value),
+		Metadata: kafkaMessageMetadata{
+			table: table.Name, partitionHint: hint, keyless: key == nil,
+		},
+		Headers: s.contentTypeHeaders(),
+	}
+	if key != nil {
+		msg.Key = sarama.ByteEncoder(key)
+	}
+	if s.cfg.topicGranularity == kafkaTopicGranularityDatabase {
+		msg.Headers = append(msg.Headers,
+			sarama.RecordHeader{Key: []byte(kafkaTableHeader), Value: []byte(table.Name)})
+	}
+	if s.cfg.highWaterHeader {
+		highWater := tree.TimestampToDecimal(s.highWater).Decimal.String()
+		msg.Headers = append(msg.Headers,
+			sarama.RecordHeader{Key: []byte(kafkaHighWaterHeader), Value: []byte(highWater)})
+	}
+	if s.cfg.schemaVersionHeader {
+		version := strconv.FormatUint(uint64(table.Version), 10)
+		msg.Headers = append(msg.Headers,
+			sarama.RecordHeader{Key: []byte(kafkaSchemaVersionHeader), Value: []byte(version)})
+	}
+	if s.cfg.sourceHeaders {
+		msg.Headers = append(msg.Headers, s.sourceHeaders(table)...)
+	}
+	// The producer would reject the row too, but only once it's inflight,
+	// which fails the next flush and with it the changefeed.
+	if s.config != nil && len(key)+len(value) > s.config.Producer.MaxMessageBytes {
+		return &rowSinkError{cause: errors.Errorf(
+			`row of %d bytes is larger than the kafka producer's max message bytes of %d`,
+			len(key)+len(value), s.config.Producer.MaxMessageBytes)}
 	}
 	return s.emitMessage(ctx, msg)
 }
 
+// sourceHeaders returns the headers that hold the source of a row of the given
+// table, with the `source` option.
+func (s *kafkaSink) sourceHeaders(table *sqlbase.TableDescriptor) []sarama.RecordHeader {
+	headers := []sarama.RecordHeader{
+		{Key: []byte(kafkaTableIDHeader), Value: []byte(strconv.Itoa(int(table.ID)))},
+		{Key: []byte(kafkaDatabaseIDHeader), Value: []byte(strconv.Itoa(int(table.ParentID)))},
+	}
+	if database, ok := s.databaseNames[table.ID]; ok {
+		headers = append(headers,
+			sarama.RecordHeader{Key: []byte(kafkaDatabaseHeader), Value: []byte(database)})
+	}
+	return headers
+}
+
+// contentTypeHeaders returns the content-type header for a row or resolved
+// timestamp message, if there is one. The result is a new slice every time.
+func (s *kafkaSink) contentTypeHeaders() []sarama.RecordHeader {
+	if s.cfg.contentType == `` {
+		return nil
+	}
+	return []sarama.RecordHeader{
+		{Key: []byte(kafkaContentTypeHeader), Value: []byte(s.cfg.contentType)},
+	}
+}
+
 // EmitResolvedTimestamp implements the Sink interface.
 func (s *kafkaSink) EmitResolvedTimestamp(
 	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
@@ -275,11 +1869,11 @@ func (s *kafkaSink) EmitResolvedTimestamp(
 	// zookeeper, so it shouldn't be done too often, but beyond that this
 	// constant was picked pretty arbitrarily.
 	//
-	// TODO(dan): Add a test for this. We can't right now (2018-11-13) because
-	// we'd need to bump sarama, but that's a bad idea while we're still
-	// actively working on stability. At the same time, revisit this tuning.
+	// TODO(dan): Revisit this tuning.
 	const metadataRefreshMinDuration = time.Minute
-	if timeutil.Since(s.lastMetadataRefresh) > metadataRefreshMinDuration {
+	// The partitions of the data topics are only needed to broadcast to them.
+	needPartitions := s.cfg.resolvedTopic == ``
+	if needPartitions && timeutil.Since(s.lastMetadataRefresh) > metadataRefreshMinDuration {
 		topics := make([]string, 0, len(s.topics))
 		for topic := range s.topics {
 			topics = append(topics, topic)
@@ -290,18 +1884,37 @@ func (s *kafkaSink) EmitResolvedTimestamp(
 		s.lastMetadataRefresh = timeutil.Now()
 	}
 
-	for topic := range s.topics {
+	resolvedTopics := s.topics
+	if s.cfg.resolvedChangedTopicsOnly {
+		resolvedTopics, s.changedTopics = s.changedTopics, nil
+	}
+	for topic := range resolvedTopics {
 		payload, err := encoder.EncodeResolvedTimestamp(topic, resolved)
 		if err != nil {
 			return err
 		}
 		s.scratch, payload = s.scratch.Copy(payload, 0 /* extraCap */)
 
+		if !needPartitions {
+			// Key by data topic so that all of its resolved timestamps land in
+			// the same partition and keep their order.
+			msg := &sarama.ProducerMessage{
+				Topic:   s.cfg.resolvedTopic,
+				Key:     sarama.StringEncoder(topic),
+				Value:   sarama.ByteEncoder(payload),
+				Headers: s.contentTypeHeaders(),
+			}
+			if err := s.emitMessage(ctx, msg); err != nil {
+				return err
+			}
+			continue
+		}
+
 		// sarama caches this, which is why we have to periodically refresh the
 		// metadata above. Staleness here does not impact correctness. Some new
 		// partitions will miss this resolved timestamp, but they'll eventually
 		// be picked up and get later ones.
-		partitions, err := s.client.Partitions(topic)
+		partitions, err := s.topicPartitions(ctx, topic)
 		if err != nil {
 			return err
 		}
@@ -311,6 +1924,7 @@ func (s *kafkaSink) EmitResolvedTimestamp(
 				Partition: partition,
 				Key:       nil,
 				Value:     sarama.ByteEncoder(payload),
+				Headers:   s.contentTypeHeaders(),
 			}
 			if err := s.emitMessage(ctx, msg); err != nil {
 				return err
@@ -320,11 +1934,247 @@ func (s *kafkaSink) EmitResolvedTimestamp(
 	return nil
 }
 
+// schemaChangeMarker is the payload of the schema change markers emitted by
+// sinks. It's also how a changeAggregator forwards a schema change to the
+// changeFrontier.
+type schemaChangeMarker struct {
+	Table      string `json:"table"`
+	OldVersion int64  `json:"old_version"`
+	NewVersion int64  `json:"new_version"`
+}
+
+// feedLifecycleMarker is the payload of the lifecycle markers emitted by sinks.
+type feedLifecycleMarker struct {
+	Phase     feedPhase `json:"phase"`
+	Timestamp string    `json:"timestamp"`
+}
+
+func encodeFeedLifecycleMarker(phase feedPhase, ts hlc.Timestamp) ([]byte, error) {
+	return gojson.Marshal(feedLifecycleMarker{
+		Phase:     phase,
+		Timestamp: tree.TimestampToDecimal(ts).Decimal.String(),
+	})
+}
+
+func encodeSchemaChangeMarker(
+	table *sqlbase.TableDescriptor, oldVersion, newVersion sqlbase.DescriptorVersion,
+) ([]byte, error) {
+	return gojson.Marshal(schemaChangeMarker{
+		Table:      table.Name,
+		OldVersion: int64(oldVersion),
+		NewVersion: int64(newVersion),
+	})
+}
+
+// decodeSchemaChangeMarker is the inverse of encodeSchemaChangeMarker. The
+// returned table descriptor only has the name and the new version.
+func decodeSchemaChangeMarker(
+	payload []byte,
+) (*sqlbase.TableDescriptor, sqlbase.DescriptorVersion, error) {
+	var m schemaChangeMarker
+	if err := gojson.Unmarshal(payload, &m); err != nil {
+		return nil, 0, errors.Wrapf(err, `decoding schema change marker: %s`, payload)
+	}
+	table := &sqlbase.TableDescriptor{
+		Name:    m.Table,
+		Version: sqlbase.DescriptorVersion(m.NewVersion),
+	}
+	return table, sqlbase.DescriptorVersion(m.OldVersion), nil
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *kafkaSink) EmitSchemaChange(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	oldVersion, newVersion sqlbase.DescriptorVersion,
+) error {
+	if s.cfg.controlTopic == `` {
+		return nil
+	}
+	payload, err := encodeSchemaChangeMarker(table, oldVersion, newVersion)
+	if err != nil {
+		return err
+	}
+	// Key by table so that all markers for a table land in the same partition
+	// and keep their relative order.
+	msg := &sarama.ProducerMessage{
+		Topic: s.cfg.controlTopic,
+		Key:   sarama.StringEncoder(SQLNameToKafkaName(table.Name)),
+		Value: sarama.ByteEncoder(payload),
+	}
+	return s.emitMessage(ctx, msg)
+}
+
+// kafkaLifecycleMarkerKey is the key of every lifecycle marker, so that they
+// land in the same partition of the control topic and keep their order.
+const kafkaLifecycleMarkerKey = jsonMetaSentinel
+
+// EmitFeedLifecycle implements the LifecycleEmitter interface by emitting the
+// marker to the `control_topic` sink param, which the `lifecycle_markers`
+// option requires.
+func (s *kafkaSink) EmitFeedLifecycle(
+	ctx context.Context, phase feedPhase, ts hlc.Timestamp,
+) error {
+	if s.cfg.controlTopic == `` {
+		return nil
+	}
+	payload, err := encodeFeedLifecycleMarker(phase, ts)
+	if err != nil {
+		return err
+	}
+	msg := &sarama.ProducerMessage{
+		Topic: s.cfg.controlTopic,
+		Key:   sarama.StringEncoder(kafkaLifecycleMarkerKey),
+		Value: sarama.ByteEncoder(payload),
+	}
+	if err := s.emitMessage(ctx, msg); err != nil {
+		return err
+	}
+	return s.Flush(ctx, ts)
+}
+
+// NoteChangedTopic implements the ChangedTopicsTracker interface. It's a
+// no-op unless the `resolved_changed_topics_only` sink param is set.
+func (s *kafkaSink) NoteChangedTopic(topic string) {
+	if !s.cfg.resolvedChangedTopicsOnly {
+		return
+	}
+	if s.changedTopics == nil {
+		s.changedTopics = make(map[string]struct{})
+	}
+	s.changedTopics[topic] = struct{}{}
+}
+
+// TakeChangedTopics implements the ChangedTopicsTracker interface.
+func (s *kafkaSink) TakeChangedTopics() []string {
+	topics := make([]string, 0, len(s.changedTopics))
+	for topic := range s.changedTopics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	s.changedTopics = nil
+	return topics
+}
+
+// topicPartitions returns the partitions of the given topic. If sarama fails to
+// look them up because the brokers are briefly unavailable, the last
+// successfully discovered partitions are used instead, if there are any. Other
+// errors, such as the topic being deleted, are returned.
+func (s *kafkaSink) topicPartitions(ctx context.Context, topic string) ([]int32, error) {
+	partitions, err := s.client.Partitions(topic)
+	if err != nil {
+		if !isRetryableSinkError(err) && err != sarama.ErrOutOfBrokers {
+			return nil, err
+		}
+		cached, ok := s.partitions[topic]
+		if !ok {
+			return nil, err
+		}
+		log.Warningf(ctx, `using cached partitions for topic %s: %v`, topic, err)
+		return cached, nil
+	}
+	s.partitions[topic] = partitions
+	return partitions, nil
+}
+
 // Flush implements the Sink interface.
 func (s *kafkaSink) Flush(ctx context.Context, _ hlc.Timestamp) error {
 	// Ignore the timestamp and flush everything, which necessarily means that
 	// we've flushed everything >= the timestamp.
 
+	for reconnects := 0; ; reconnects++ {
+		failed, err := s.waitForInflight(ctx)
+		if err != nil || len(failed) == 0 {
+			return err
+		}
+		// Everything else was acknowledged, so once the failed messages are
+		// resent on a working producer and acknowledged, the flush is done.
+		// They may have been partially delivered, but duplicates are allowed.
+		if reconnects >= kafkaMaxReconnectsPerFlush {
+			return &retryableSinkError{cause: errors.Errorf(
+				`%d messages failed after %d kafka reconnects`, len(failed), reconnects)}
+		}
+		if err := s.reconnect(ctx); err != nil {
+			// Keep them for CloseAndDrain.
+			s.mu.Lock()
+			s.mu.failed = failed
+			s.mu.Unlock()
+			return err
+		}
+		for _, msg := range failed {
+			// Resend a copy, since sarama keeps retry state in the original.
+			msg = &sarama.ProducerMessage{
+				Topic:     msg.Topic,
+				Partition: msg.Partition,
+				Key:       msg.Key,
+				Value:     msg.Value,
+				Headers:   msg.Headers,
+				Metadata:  msg.Metadata,
+			}
+			if err := s.emitMessage(ctx, msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// SetHighWater implements the HighWaterSetter interface.
+func (s *kafkaSink) SetHighWater(highWater hlc.Timestamp) {
+	s.highWater.Forward(highWater)
+}
+
+// SetMetrics implements the MetricsSetter interface.
+func (s *kafkaSink) SetMetrics(metrics *Metrics, _ roachpb.NodeID) {
+	s.metrics = metrics
+}
+
+// Ping implements the Pinger interface by refreshing the metadata of the
+// sink's topics, which needs a broker to answer for each of them.
+func (s *kafkaSink) Ping(ctx context.Context) error {
+	// s.client is only nil in tests.
+	if s.client == nil {
+		return nil
+	}
+	topics := make([]string, 0, len(s.topics))
+	for topic := range s.topics {
+		topics = append(topics, topic)
+	}
+	if err := s.client.RefreshMetadata(topics...); err != nil {
+		return errors.Wrap(err, `refreshing kafka metadata`)
+	}
+	return nil
+}
+
+// InflightCount implements the InflightCounter interface.
+func (s *kafkaSink) InflightCount() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mu.inflight
+}
+
+// FlushTable implements the TableFlusher interface. Every table shares the one
+// producer queue, so there's no way to drain only some of it. Instead, this
+// returns immediately if none of the table's rows are inflight and otherwise
+// falls back to a full Flush.
+func (s *kafkaSink) FlushTable(ctx context.Context, tableName string, ts hlc.Timestamp) error {
+	s.mu.Lock()
+	inflight := s.mu.inflightTables[tableName]
+	flushErr := s.mu.flushErr
+	failed := len(s.mu.failed)
+	s.mu.Unlock()
+	if inflight == 0 && flushErr == nil && failed == 0 {
+		return nil
+	}
+	return s.Flush(ctx, ts)
+}
+
+// waitForInflight waits until every message emitted so far has been
+// acknowledged or failed. It returns the first error of a failed message,
+// unless the only failures were from losing the connection to kafka and the
+// producer can be rebuilt, in which case those messages are returned instead.
+func (s *kafkaSink) waitForInflight(
+	ctx context.Context,
+) (failed []*sarama.ProducerMessage, _ error) {
 	flushCh := make(chan struct{}, 1)
 
 	s.mu.Lock()
@@ -337,41 +2187,138 @@ func (s *kafkaSink) Flush(ctx context.Context, _ hlc.Timestamp) error {
 	}
 	s.mu.Unlock()
 
-	if immediateFlush {
-		if _, ok := flushErr.(*sarama.ProducerError); ok {
-			flushErr = &retryableSinkError{cause: flushErr}
+	if !immediateFlush {
+		if log.V(1) {
+			log.Infof(ctx, "flush waiting for %d inflight messages: %s",
+				inflight, s.describeInflightPartitions(kafkaSlowFlushPartitionLimit))
+		}
+		if err := s.awaitFlush(ctx, flushCh); err != nil {
+			return nil, err
 		}
-		return flushErr
-	}
-
-	if log.V(1) {
-		log.Infof(ctx, "flush waiting for %d inflight messages", inflight)
-	}
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-flushCh:
 		s.mu.Lock()
-		flushErr := s.mu.flushErr
+		flushErr = s.mu.flushErr
 		s.mu.flushErr = nil
 		s.mu.Unlock()
-		if _, ok := flushErr.(*sarama.ProducerError); ok {
-			flushErr = &retryableSinkError{cause: flushErr}
+	}
+
+	s.mu.Lock()
+	failed, s.mu.failed = s.mu.failed, nil
+	if flushErr != nil {
+		s.mu.rejected = nil
+	}
+	s.mu.Unlock()
+	if _, ok := flushErr.(*sarama.ProducerError); ok {
+		flushErr = &retryableSinkError{cause: flushErr}
+	}
+	if flushErr != nil {
+		return nil, flushErr
+	}
+	return failed, nil
+}
+
+// awaitFlush waits for flushCh to be signaled by the worker goroutine. While it
+// waits, it periodically logs which partitions are holding it up.
+func (s *kafkaSink) awaitFlush(ctx context.Context, flushCh <-chan struct{}) error {
+	start := timeutil.Now()
+	warn := timeutil.NewTimer()
+	defer warn.Stop()
+	warn.Reset(kafkaSlowFlushWarnDuration)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-flushCh:
+			return nil
+		case <-warn.C:
+			warn.Read = true
+			log.Warningf(ctx, `kafka flush has been waiting for %s on %d inflight messages: %s`,
+				timeutil.Since(start), s.InflightCount(),
+				s.describeInflightPartitions(kafkaSlowFlushPartitionLimit))
+			warn.Reset(kafkaSlowFlushWarnDuration)
+		}
+	}
+}
+
+// reconnect replaces the client and producer, which must have nothing
+// inflight, with new ones. The old ones are only closed once the new ones are
+// built, so if they can't be, a retryableSinkError is returned and the sink is
+// left as it was, to be flushed again or closed.
+func (s *kafkaSink) reconnect(ctx context.Context) error {
+	log.Infof(ctx, `reconnecting to kafka: %s`, strings.Join(s.bootstrapServers, `,`))
+	var err error
+	for r := retry.StartWithCtx(ctx, kafkaReconnectRetryOpts); r.Next(); {
+		var client sarama.Client
+		var producer sarama.AsyncProducer
+		if client, producer, err = s.newClientFn(s.bootstrapServers, s.config); err == nil {
+			close(s.stopWorkerCh)
+			s.worker.Wait()
+			_ = s.producer.Close()
+			if s.client != nil {
+				_ = s.client.Close()
+			}
+			s.client, s.producer = client, producer
+			// The brokers may have changed, so don't wait to refresh the
+			// metadata.
+			s.lastMetadataRefresh = time.Time{}
+			s.start()
+			return nil
 		}
-		return flushErr
+		log.Warningf(ctx, `failed to reconnect to kafka: %v`, err)
 	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	err = errors.Wrapf(err, `reconnecting to kafka: %s`, strings.Join(s.bootstrapServers, `,`))
+	return &retryableSinkError{cause: err}
+}
+
+// isKafkaConnectionError returns true if the error means that the producer
+// lost its connection to kafka, as opposed to kafka rejecting the message.
+func isKafkaConnectionError(err error) bool {
+	switch err {
+	case sarama.ErrOutOfBrokers, sarama.ErrNotConnected, sarama.ErrClosedClient,
+		sarama.ErrBrokerNotAvailable, io.EOF:
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
 }
 
 func (s *kafkaSink) emitMessage(ctx context.Context, msg *sarama.ProducerMessage) error {
 	s.mu.Lock()
 	s.mu.inflight++
 	inflight := s.mu.inflight
+	if s.mu.inflightMsgs == nil {
+		s.mu.inflightMsgs = make(map[*sarama.ProducerMessage]kafkaInflightMsg)
+		s.mu.inflightPartitions = make(map[kafkaTopicPartition]int64)
+	}
+	s.mu.inflightMsgs[msg] = kafkaInflightMsg{
+		partition: kafkaUnknownPartition,
+		emitted:   timeutil.Now(),
+	}
+	s.mu.inflightPartitions[kafkaTopicPartition{msg.Topic, kafkaUnknownPartition}]++
+	if md, ok := msg.Metadata.(kafkaMessageMetadata); ok {
+		if s.mu.inflightTables == nil {
+			s.mu.inflightTables = make(map[string]int64)
+		}
+		s.mu.inflightTables[md.table]++
+	}
 	s.mu.Unlock()
 
 	select {
-	case <-ctx.Done():
-		return ctx.Err()
 	case s.producer.Input() <- msg:
+	default:
+		// The producer's queue is full. Fall back to a blocking send that keeps
+		// track of how long we were backpressured.
+		if err := s.emitMessageBlocking(ctx, msg); err != nil {
+			// The message was never handed to the producer, so it won't be
+			// acknowledged. Stop counting it, or the next flush would wait on
+			// it forever.
+			s.mu.Lock()
+			s.ackLocked(msg)
+			s.mu.Unlock()
+			return err
+		}
 	}
 
 	if log.V(2) {
@@ -380,55 +2327,383 @@ func (s *kafkaSink) emitMessage(ctx context.Context, msg *sarama.ProducerMessage
 	return nil
 }
 
+// emitMessageBlocking sends msg to the producer, blocking until there is room
+// in its queue. The time spent blocked is recorded and, if it is sustained,
+// logged. If a backpressure timeout is configured and exceeded, a retryable
+// backpressureSinkError is returned.
+func (s *kafkaSink) emitMessageBlocking(ctx context.Context, msg *sarama.ProducerMessage) error {
+	start := timeutil.Now()
+	defer func() {
+		blocked := timeutil.Since(start)
+		if s.metrics != nil {
+			s.metrics.SinkBackpressureNanos.Inc(blocked.Nanoseconds())
+		}
+		if blocked > kafkaBackpressureWarnDuration {
+			log.Warningf(ctx, `kafka producer queue was full for %s`, blocked)
+		}
+	}()
+
+	var timeoutCh <-chan time.Time
+	if s.cfg.backpressureTimeout > 0 {
+		timer := timeutil.NewTimer()
+		defer timer.Stop()
+		timer.Reset(s.cfg.backpressureTimeout)
+		timeoutCh = timer.C
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case s.producer.Input() <- msg:
+		return nil
+	case <-timeoutCh:
+		return &retryableSinkError{cause: &backpressureSinkError{blocked: timeutil.Since(start)}}
+	}
+}
+
 func (s *kafkaSink) workerLoop() {
 	defer s.worker.Done()
 
+	var expireCh <-chan time.Time
+	if s.ackDeadline > 0 {
+		ticker := time.NewTicker(s.ackDeadline / 4)
+		defer ticker.Stop()
+		expireCh = ticker.C
+	}
 	for {
 		select {
 		case <-s.stopWorkerCh:
 			return
-		case <-s.producer.Successes():
+		case msg := <-s.producer.Successes():
+			s.mu.Lock()
+			s.ackLocked(msg)
+			s.mu.Unlock()
 		case err := <-s.producer.Errors():
 			s.mu.Lock()
-			if s.mu.flushErr == nil {
-				s.mu.flushErr = err
+			if s.ackLocked(err.Msg) {
+				s.recordErrLocked(err)
 			}
 			s.mu.Unlock()
+		case <-expireCh:
+			s.expireInflight(timeutil.Now())
 		}
+	}
+}
 
-		s.mu.Lock()
-		s.mu.inflight--
-		if s.mu.inflight == 0 && s.mu.flushCh != nil {
-			s.mu.flushCh <- struct{}{}
-			s.mu.flushCh = nil
+// ackLocked removes a message that was acknowledged or failed from the
+// inflight messages, waking up the flush waiting on them if it was the last
+// one. It returns false if the message was already removed by
+// expireInflight, in which case sarama's answer is ignored. s.mu must be held.
+func (s *kafkaSink) ackLocked(msg *sarama.ProducerMessage) bool {
+	if msg != nil {
+		m, ok := s.mu.inflightMsgs[msg]
+		if !ok {
+			return false
 		}
-		s.mu.Unlock()
+		s.uncountPartitionLocked(kafkaTopicPartition{msg.Topic, m.partition})
+		delete(s.mu.inflightMsgs, msg)
+		if md, ok := msg.Metadata.(kafkaMessageMetadata); ok {
+			if s.mu.inflightTables[md.table]--; s.mu.inflightTables[md.table] <= 0 {
+				delete(s.mu.inflightTables, md.table)
+			}
+		}
+	}
+	s.mu.inflight--
+	if s.mu.inflight == 0 && s.mu.flushCh != nil {
+		s.mu.flushCh <- struct{}{}
+		s.mu.flushCh = nil
 	}
+	return true
 }
 
-type changefeedPartitioner struct {
-	hash sarama.Partitioner
+// recordErrLocked records the error of a failed message for the next flush.
+// s.mu must be held.
+func (s *kafkaSink) recordErrLocked(err *sarama.ProducerError) {
+	if s.newClientFn != nil && isKafkaConnectionError(err.Err) {
+		s.mu.failed = append(s.mu.failed, err.Msg)
+		return
+	}
+	if s.mu.flushErr == nil {
+		s.mu.flushErr = err
+	}
+	if err.Msg != nil {
+		s.mu.rejected = append(s.mu.rejected, err.Msg)
+	}
+}
+
+// kafkaAckDeadline returns how long sarama may take to acknowledge or fail a
+// message with the given config if every attempt at sending it times out
+// waiting for the acks. Past that, it's stuck, as it can be when the leader of
+// its partition is gone and sarama keeps waiting for a new one, and the sink
+// fails it instead of letting the flush waiting on it hang.
+func kafkaAckDeadline(config *sarama.Config) time.Duration {
+	attempts := time.Duration(config.Producer.Retry.Max + 1)
+	return attempts * (config.Producer.Timeout + config.Producer.Retry.Backoff)
+}
+
+// expireInflight fails the messages that sarama sent more than ackDeadline ago
+// as of now with a retryable error, like sarama would have if it had given up
+// on them. Time spent queued in sarama behind other messages doesn't count
+// against the deadline, but a message that's still queued ackDeadline after
+// it was emitted is failed too, so the deadline of a message is at most twice
+// ackDeadline from when it was emitted.
+func (s *kafkaSink) expireInflight(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var counts map[kafkaTopicPartition]int64
+	for msg, m := range s.mu.inflightMsgs {
+		since, what := m.sent, `acknowledged`
+		if since.IsZero() {
+			since, what = m.emitted, `sent`
+		}
+		if now.Sub(since) <= s.ackDeadline {
+			continue
+		}
+		if counts == nil {
+			counts = make(map[kafkaTopicPartition]int64)
+		}
+		counts[kafkaTopicPartition{msg.Topic, m.partition}]++
+		s.ackLocked(msg)
+		s.recordErrLocked(&sarama.ProducerError{Msg: msg, Err: errors.Errorf(
+			`kafka message not %s after %s`, what, s.ackDeadline)})
+	}
+	if counts != nil {
+		log.Warningf(s.logCtx, `kafka messages not sent or acknowledged after %s: %s`,
+			s.ackDeadline, describePartitionCounts(counts, kafkaSlowFlushPartitionLimit))
+	}
+}
+
+// notePartition notes that sarama took an inflight message off its queue and
+// moves it from kafkaUnknownPartition to the partition that sarama picked for
+// it, given as the index that its partitioner returned. That's the partition
+// itself, except for the topics with relaxed ordering, which sarama only
+// partitions over the partitions with a leader, so their messages stay under
+// kafkaUnknownPartition until they're acknowledged. It's called by sarama,
+// once for each message.
+func (s *kafkaSink) notePartition(msg *sarama.ProducerMessage, choice int32) {
+	_, relaxed := s.cfg.relaxedOrderingTopics[msg.Topic]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.mu.inflightMsgs[msg]
+	if !ok {
+		return
+	}
+	if m.sent.IsZero() {
+		m.sent = timeutil.Now()
+	}
+	if !relaxed && m.partition == kafkaUnknownPartition {
+		s.uncountPartitionLocked(kafkaTopicPartition{msg.Topic, m.partition})
+		m.partition = choice
+		s.mu.inflightPartitions[kafkaTopicPartition{msg.Topic, choice}]++
+	}
+	s.mu.inflightMsgs[msg] = m
+}
+
+// uncountPartitionLocked removes one message from the inflight count of a
+// partition. s.mu must be held.
+func (s *kafkaSink) uncountPartitionLocked(tp kafkaTopicPartition) {
+	if s.mu.inflightPartitions[tp]--; s.mu.inflightPartitions[tp] <= 0 {
+		delete(s.mu.inflightPartitions, tp)
+	}
+}
+
+// describeInflightPartitions returns the partitions with inflight messages and
+// how many each has, see describePartitionCounts.
+func (s *kafkaSink) describeInflightPartitions(limit int) string {
+	s.mu.Lock()
+	counts := make(map[kafkaTopicPartition]int64, len(s.mu.inflightPartitions))
+	for tp, count := range s.mu.inflightPartitions {
+		counts[tp] = count
+	}
+	s.mu.Unlock()
+	return describePartitionCounts(counts, limit)
+}
+
+// describePartitionCounts returns the partitions with their counts of messages,
+// like `t/3: 12, t/0: 1`, with the most first and at most limit of them.
+func describePartitionCounts(counts map[kafkaTopicPartition]int64, limit int) string {
+	partitions := make([]kafkaTopicPartition, 0, len(counts))
+	for tp := range counts {
+		partitions = append(partitions, tp)
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		if counts[partitions[i]] != counts[partitions[j]] {
+			return counts[partitions[i]] > counts[partitions[j]]
+		}
+		if partitions[i].topic != partitions[j].topic {
+			return partitions[i].topic < partitions[j].topic
+		}
+		return partitions[i].partition < partitions[j].partition
+	})
+	var buf bytes.Buffer
+	for i, tp := range partitions {
+		if i == limit {
+			fmt.Fprintf(&buf, `, and %d more`, len(partitions)-limit)
+			break
+		}
+		if i > 0 {
+			buf.WriteString(`, `)
+		}
+		fmt.Fprintf(&buf, `%s: %d`, tp, counts[tp])
+	}
+	return buf.String()
+}
+
+type changefeedPartitioner struct {
+	hash sarama.Partitioner
+	// transformKey, if non-nil, is applied to the key of a row, or the key of
+	// its partitionHint, before it's hashed.
+	transformKey func(key []byte) []byte
+	// roundRobin spreads keyless rows across the partitions. Every keyless row
+	// would hash to the same one.
+	roundRobin sarama.Partitioner
+	// relaxed makes sarama only partition over the partitions that have a
+	// leader, see kafkaSinkConfig.relaxedOrderingTopics.
+	relaxed bool
+	// onPartition, if non-nil, is called with each message that's been
+	// partitioned and the partition it was given.
+	onPartition func(message *sarama.ProducerMessage, choice int32)
+}
+
+var _ sarama.Partitioner = &changefeedPartitioner{}
+var _ sarama.PartitionerConstructor = newChangefeedPartitioner
+
+func newChangefeedPartitioner(topic string) sarama.Partitioner {
+	return &changefeedPartitioner{
+		hash:       sarama.NewHashPartitioner(topic),
+		roundRobin: sarama.NewRoundRobinPartitioner(topic),
+	}
+}
+
+// makeChangefeedPartitionerConstructor returns a sarama.PartitionerConstructor
+// for changefeedPartitioners that hash keys with the configured partitioner and
+// are relaxed for the configured topics.
+func makeChangefeedPartitionerConstructor(cfg kafkaSinkConfig) sarama.PartitionerConstructor {
+	return func(topic string) sarama.Partitioner {
+		_, relaxed := cfg.relaxedOrderingTopics[topic]
+		p := &changefeedPartitioner{
+			hash:       sarama.NewHashPartitioner(topic),
+			roundRobin: sarama.NewRoundRobinPartitioner(topic),
+			relaxed:    relaxed,
+		}
+		if cfg.partitioner == kafkaPartitionerJump {
+			p.hash = jumpHashPartitioner{}
+		}
+		if cfg.partitionKeySalt != `` || cfg.partitionKeyBuckets > 0 {
+			p.transformKey = func(key []byte) []byte {
+				return partitionKey(key, cfg.partitionKeySalt, cfg.partitionKeyBuckets)
+			}
+		}
+		return p
+	}
+}
+
+// partitionKey returns the key that's hashed to pick the partition of a row
+// with the given key, for the `partition_key_salt` and `partition_key_buckets`
+// sink params. The salt is prepended to the key, which reshuffles which keys
+// end up together. Then, if buckets is non-zero, the salted key is hashed down
+// to one of that many buckets, and the bucket is what picks the partition.
+// With a bucket count that's a multiple of the number of partitions, every
+// partition gets the same share of the buckets no matter how skewed the keys
+// themselves are.
+func partitionKey(key []byte, salt string, buckets int) []byte {
+	if salt != `` {
+		key = append([]byte(salt), key...)
+	}
+	if buckets > 0 {
+		h := fnv.New64a()
+		_, _ = h.Write(key)
+		key = strconv.AppendUint(nil, h.Sum64()%uint64(buckets), 10)
+	}
+	return key
+}
+
+// jumpHashPartitioner is a sarama.Partitioner for keyed messages that uses the
+// jump consistent hash from "A Fast, Minimal Memory, Consistent Hash Algorithm"
+// by Lamping and Veach. Growing from n to n+1 partitions only moves 1/(n+1) of
+// the keys, all of them to the new partition.
+type jumpHashPartitioner struct{}
+
+var _ sarama.Partitioner = jumpHashPartitioner{}
+
+// Partition implements the sarama.Partitioner interface.
+func (jumpHashPartitioner) Partition(
+	message *sarama.ProducerMessage, numPartitions int32,
+) (int32, error) {
+	key, err := message.Key.Encode()
+	if err != nil {
+		return -1, err
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	return jumpHash(h.Sum64(), numPartitions), nil
 }
 
-var _ sarama.Partitioner = &changefeedPartitioner{}
-var _ sarama.PartitionerConstructor = newChangefeedPartitioner
+// RequiresConsistency implements the sarama.Partitioner interface.
+func (jumpHashPartitioner) RequiresConsistency() bool { return true }
 
-func newChangefeedPartitioner(topic string) sarama.Partitioner {
-	return &changefeedPartitioner{
-		hash: sarama.NewHashPartitioner(topic),
+// jumpHash returns the bucket out of numBuckets that key goes to.
+func jumpHash(key uint64, numBuckets int32) int32 {
+	var b, j int64 = -1, 0
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
 	}
+	return int32(b)
 }
 
-func (p *changefeedPartitioner) RequiresConsistency() bool { return true }
+func (p *changefeedPartitioner) RequiresConsistency() bool { return !p.relaxed }
 func (p *changefeedPartitioner) Partition(
 	message *sarama.ProducerMessage, numPartitions int32,
 ) (int32, error) {
+	choice, err := p.partition(message, numPartitions)
+	if err == nil && p.onPartition != nil {
+		p.onPartition(message, choice)
+	}
+	return choice, err
+}
+
+func (p *changefeedPartitioner) partition(
+	message *sarama.ProducerMessage, numPartitions int32,
+) (int32, error) {
+	if md, ok := message.Metadata.(kafkaMessageMetadata); ok {
+		if md.partitionHint.hasValue {
+			return md.partitionHint.partition(numPartitions), nil
+		}
+		if md.partitionHint.key != nil {
+			return p.hashKey(message, md.partitionHint.key, numPartitions)
+		}
+		if md.keyless {
+			return p.roundRobin.Partition(message, numPartitions)
+		}
+	}
 	if message.Key == nil {
 		return message.Partition, nil
 	}
+	if p.transformKey != nil {
+		key, err := message.Key.Encode()
+		if err != nil {
+			return -1, err
+		}
+		return p.hashKey(message, key, numPartitions)
+	}
 	return p.hash.Partition(message, numPartitions)
 }
 
+// hashKey picks the partition of message by hashing key, after transformKey,
+// exactly like a message key would be.
+func (p *changefeedPartitioner) hashKey(
+	message *sarama.ProducerMessage, key []byte, numPartitions int32,
+) (int32, error) {
+	if p.transformKey != nil {
+		key = p.transformKey(key)
+	}
+	keyed := *message
+	keyed.Key = sarama.ByteEncoder(key)
+	return p.hash.Partition(&keyed, numPartitions)
+}
+
 const (
 	sqlSinkCreateTableStmt = `CREATE TABLE IF NOT EXISTS "%s" (
 		topic STRING,
@@ -436,17 +2711,129 @@ const (
 		message_id INT,
 		key BYTES, value BYTES,
 		resolved BYTES,
+		codec STRING,
 		PRIMARY KEY (topic, partition, message_id)
 	)`
-	sqlSinkEmitStmt = `INSERT INTO "%s" (topic, partition, message_id, key, value, resolved)`
-	sqlSinkEmitCols = 6
+	// sqlSinkAddCodecStmt adds the codec column to a table created before it
+	// existed.
+	sqlSinkAddCodecStmt = `ALTER TABLE "%s" ADD COLUMN IF NOT EXISTS codec STRING`
+	// sqlSinkHasCodecStmt returns whether a table has the codec column, which
+	// a table used with the `skip_create` sink param may not.
+	sqlSinkHasCodecStmt = `SELECT count(*) > 0 FROM information_schema.columns ` +
+		`WHERE table_catalog = current_database() AND table_name = $1 AND column_name = 'codec'`
+	sqlSinkEmitStmt                = `INSERT INTO "%s" (%s)`
+	sqlSinkEmitColumnsWithoutCodec = `topic, partition, message_id, key, value, resolved`
+	sqlSinkEmitColumns             = sqlSinkEmitColumnsWithoutCodec + `, codec`
+	sqlSinkEmitCols                = 7
 	// Some amount of batching to mirror a bit how kafkaSink works.
 	sqlSinkRowBatchSize = 3
 	// While sqlSink is only used for testing, hardcode the number of
 	// partitions to something small but greater than 1.
 	sqlSinkNumPartitions = 3
+	// sqlSinkMaxPlaceholders is the most placeholders a statement can have,
+	// since the postgres wire protocol counts them with a uint16.
+	sqlSinkMaxPlaceholders = 65535
+)
+
+var sqlSinkCapabilities = SinkCapabilities{
+	Formats:       []formatType{optFormatJSON, optFormatAvro, optFormatRaw},
+	Envelopes:     allEnvelopes,
+	Resolved:      true,
+	PartitionHint: true,
+	KeyFormat:     true,
+}
+
+const (
+	// sqlSinkCodecNone is the codec of payloads that are written as is.
+	sqlSinkCodecNone = `none`
+	// sqlSinkCodecGzip is the codec of gzip-compressed payloads.
+	sqlSinkCodecGzip = `gzip`
+)
+
+// consumeSQLSinkCodec parses and removes the `compression` sink param from q
+// and returns the codec it selects.
+func consumeSQLSinkCodec(q url.Values) (string, error) {
+	codec := q.Get(sinkParamCompression)
+	q.Del(sinkParamCompression)
+	switch codec {
+	case ``:
+		return sqlSinkCodecNone, nil
+	case sqlSinkCodecNone, sqlSinkCodecGzip:
+		return codec, nil
+	default:
+		return ``, errors.Errorf(`unknown %s: %s`, sinkParamCompression, codec)
+	}
+}
+
+const (
+	// sqlSinkPartitionByKey hashes the key of a row to pick its partition.
+	sqlSinkPartitionByKey = `key`
+	// sqlSinkPartitionByValue hashes the value of a row to pick its partition.
+	sqlSinkPartitionByValue = `value`
 )
 
+// consumeSQLSinkPartitionBy parses and removes the `partition_by` sink param
+// from q and returns what's hashed to pick the partition of a row: one of the
+// sqlSinkPartitionBy constants or the name of a column, which needs
+// format=json to be read from the row.
+func consumeSQLSinkPartitionBy(
+	q url.Values, format formatType, opts map[string]string,
+) (string, error) {
+	partitionBy := q.Get(sinkParamPartitionBy)
+	q.Del(sinkParamPartitionBy)
+	switch partitionBy {
+	case ``:
+		return sqlSinkPartitionByKey, nil
+	case sqlSinkPartitionByKey:
+		return partitionBy, nil
+	}
+	// The partition hints of these options would override it.
+	for _, opt := range []string{optPartitionKey, optPartitionByColumn} {
+		if _, ok := opts[opt]; ok {
+			return ``, errors.Errorf(`%s=%s is not supported with %s`,
+				sinkParamPartitionBy, partitionBy, opt)
+		}
+	}
+	if partitionBy != sqlSinkPartitionByValue && format != optFormatJSON {
+		return ``, errors.Errorf(`%s with a column is only supported with %s=%s`,
+			sinkParamPartitionBy, optFormat, optFormatJSON)
+	}
+	return partitionBy, nil
+}
+
+// consumeSQLSinkDiagnoseErrors parses and removes the `diagnose_errors` sink
+// param from q.
+func consumeSQLSinkDiagnoseErrors(q url.Values) (bool, error) {
+	str := q.Get(sinkParamDiagnoseErrors)
+	q.Del(sinkParamDiagnoseErrors)
+	if str == `` {
+		return false, nil
+	}
+	diagnose, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, errors.Wrapf(err, `parsing %s`, sinkParamDiagnoseErrors)
+	}
+	return diagnose, nil
+}
+
+// consumeSQLSinkMaxStatementBytes parses and removes the `max_statement_bytes`
+// sink param from q. Zero means there's no limit.
+func consumeSQLSinkMaxStatementBytes(q url.Values) (int64, error) {
+	str := q.Get(sinkParamMaxStatementBytes)
+	q.Del(sinkParamMaxStatementBytes)
+	if str == `` {
+		return 0, nil
+	}
+	maxStatementBytes, err := humanizeutil.ParseBytes(str)
+	if err != nil {
+		return 0, errors.Wrapf(err, `parsing %s`, sinkParamMaxStatementBytes)
+	}
+	if maxStatementBytes <= 0 {
+		return 0, errors.Errorf(`%s must be positive: %s`, sinkParamMaxStatementBytes, str)
+	}
+	return maxStatementBytes, nil
+}
+
 // sqlSink mirrors the semantics offered by kafkaSink as closely as possible,
 // but writes to a SQL table (presumably in CockroachDB). Currently only for
 // testing.
@@ -455,6 +2842,19 @@ const (
 // table gets 3 partitions. Similar to kafkaSink, the order between two emits is
 // only preserved if they are emitted to by the same node and to the same
 // partition.
+//
+// With the `compression=gzip` sink param, values and resolved timestamps are
+// gzip-compressed. Keys are not, so rows can still be told apart. Every row
+// records the codec of its payload in the codec column, `none` or `gzip`, so
+// that a reader can decode it no matter how the changefeed that wrote it was
+// configured. A table used with the `skip_create` sink param may predate the
+// codec column, in which case every row is written uncompressed without one.
+//
+// A flush inserts the buffered rows with as few statements as possible, in
+// order, so rows of the same partition keep their order. A statement never has
+// more placeholders than the wire protocol allows or, with the
+// `max_statement_bytes` sink param, more than that many bytes of keys, values
+// and other columns, unless it's a single row that's larger by itself.
 type sqlSink struct {
 	db *gosql.DB
 
@@ -462,11 +2862,51 @@ type sqlSink struct {
 	topics    map[string]struct{}
 	hasher    hash.Hash32
 
+	// unverifiedTable is true if the table was not created by the sink and
+	// nothing has been successfully inserted into it yet, so it may not have
+	// the expected columns.
+	unverifiedTable bool
+	// lastMessageID is the last message id generated for each partition.
+	lastMessageID [sqlSinkNumPartitions]int64
+	// nextKeylessPartition is the partition of the next row without a key.
+	// Every empty key hashes the same, so keyless rows are spread round-robin
+	// instead, like a kafka producer spreads keyless messages.
+	nextKeylessPartition int32
+	// codec is how values and resolved timestamps are encoded, one of the
+	// sqlSinkCodec constants.
+	codec string
+	// codecColumn is whether the table has the codec column. Only a table
+	// that was not created by the sink can be missing it, in which case the
+	// codec isn't written and must be sqlSinkCodecNone.
+	codecColumn bool
+	// diagnoseErrors, if true, makes a batch that fails to insert be retried
+	// one row at a time, so that the error says which rows caused it. It's set
+	// by the `diagnose_errors` sink param.
+	diagnoseErrors bool
+	// maxStatementBytes, if non-zero, caps the size of the rows inserted by one
+	// statement. It's set by the `max_statement_bytes` sink param.
+	maxStatementBytes int64
+	// partitionBy is what's hashed to pick the partition of a row: one of the
+	// sqlSinkPartitionBy constants or the name of a column. It's set by the
+	// `partition_by` sink param.
+	partitionBy string
+
 	rowBuf  []interface{}
 	scratch bufalloc.ByteAllocator
+	// gzipBuf and gzipWriter are reused to compress payloads when codec is
+	// sqlSinkCodecGzip.
+	gzipBuf    bytes.Buffer
+	gzipWriter *gzip.Writer
 }
 
-func makeSQLSink(uri, tableName string, targets jobspb.ChangefeedTargets) (*sqlSink, error) {
+// makeSQLSink returns a sqlSink that writes to tableName in the database at
+// uri. The table is created if it doesn't exist, unless skipCreate is true, in
+// which case it must already exist with at least the columns that the sink
+// would have created, except that the codec column is optional. Any other
+// columns must have defaults.
+func makeSQLSink(
+	uri, tableName string, skipCreate bool, targets jobspb.ChangefeedTargets,
+) (*sqlSink, error) {
 	if u, err := url.Parse(uri); err != nil {
 		return nil, err
 	} else if u.Path == `` {
@@ -476,44 +2916,131 @@ func makeSQLSink(uri, tableName string, targets jobspb.ChangefeedTargets) (*sqlS
 	if err != nil {
 		return nil, err
 	}
-	if _, err := db.Exec(fmt.Sprintf(sqlSinkCreateTableStmt, tableName)); err != nil {
-		db.Close()
-		return nil, err
+	if !skipCreate {
+		for _, stmt := range []string{sqlSinkCreateTableStmt, sqlSinkAddCodecStmt} {
+			if _, err := db.Exec(fmt.Sprintf(stmt, tableName)); err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+	}
+	s := newSQLSink(db, tableName, targets)
+	if skipCreate {
+		s.unverifiedTable = true
+		if err := db.QueryRow(sqlSinkHasCodecStmt, tableName).Scan(&s.codecColumn); err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
+	return s, nil
+}
 
+// newSQLSink returns a sqlSink that writes to an already created table.
+func newSQLSink(db *gosql.DB, tableName string, targets jobspb.ChangefeedTargets) *sqlSink {
 	s := &sqlSink{
-		db:        db,
-		tableName: tableName,
-		topics:    make(map[string]struct{}),
-		hasher:    fnv.New32a(),
+		db:          db,
+		tableName:   tableName,
+		topics:      make(map[string]struct{}),
+		hasher:      fnv.New32a(),
+		codec:       sqlSinkCodecNone,
+		codecColumn: true,
+		partitionBy: sqlSinkPartitionByKey,
 	}
 	for _, t := range targets {
 		s.topics[t.StatementTimeName] = struct{}{}
 	}
-	return s, nil
+	return s
 }
 
 // EmitRow implements the Sink interface.
 func (s *sqlSink) EmitRow(
 	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, _ hlc.Timestamp,
+) error {
+	return s.emitRow(ctx, table, key, value, partitionHint{})
+}
+
+// EmitRowWithPartitionHint implements the PartitionHintEmitter interface.
+func (s *sqlSink) EmitRowWithPartitionHint(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	key, value []byte,
+	hint partitionHint,
+	_ hlc.Timestamp,
+) error {
+	return s.emitRow(ctx, table, key, value, hint)
+}
+
+func (s *sqlSink) emitRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, hint partitionHint,
 ) error {
 	topic := table.Name
 	if _, ok := s.topics[topic]; !ok {
 		return errors.Errorf(`cannot emit to undeclared topic: %s`, topic)
 	}
 
+	partitionKey, err := s.partitionKey(table, key, value)
+	if err != nil {
+		return err
+	}
+	partition, err := s.partition(partitionKey, hint)
+	if err != nil {
+		return err
+	}
+	value, err = s.encodePayload(value)
+	if err != nil {
+		return err
+	}
+	var noResolved []byte
+	return s.emit(ctx, topic, partition, key, value, noResolved)
+}
+
+// partitionKey returns what's hashed to pick the partition of a row, which is
+// its key unless the `partition_by` sink param says otherwise. A row without a
+// value for the partition column hashes like a NULL one.
+func (s *sqlSink) partitionKey(
+	table *sqlbase.TableDescriptor, key, value []byte,
+) ([]byte, error) {
+	switch s.partitionBy {
+	case sqlSinkPartitionByKey:
+		return key, nil
+	case sqlSinkPartitionByValue:
+		return value, nil
+	}
+	raw, err := rowColumnJSON(table, s.partitionBy, key, value, sinkParamPartitionBy)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		raw = gojson.RawMessage(`null`)
+	}
+	return raw, nil
+}
+
+// partition returns the partition of a row with the given key and partition
+// hint.
+func (s *sqlSink) partition(key []byte, hint partitionHint) (int32, error) {
+	if hint.hasValue {
+		return hint.partition(sqlSinkNumPartitions), nil
+	}
+	partitionKey := key
+	if hint.key != nil {
+		partitionKey = hint.key
+	}
+	if len(partitionKey) == 0 {
+		partition := s.nextKeylessPartition
+		s.nextKeylessPartition = (partition + 1) % sqlSinkNumPartitions
+		return partition, nil
+	}
 	// Hashing logic copied from sarama.HashPartitioner.
 	s.hasher.Reset()
-	if _, err := s.hasher.Write(key); err != nil {
-		return err
+	if _, err := s.hasher.Write(partitionKey); err != nil {
+		return 0, err
 	}
 	partition := int32(s.hasher.Sum32()) % sqlSinkNumPartitions
 	if partition < 0 {
 		partition = -partition
 	}
-
-	var noResolved []byte
-	return s.emit(ctx, topic, partition, key, value, noResolved)
+	return partition, nil
 }
 
 // EmitResolvedTimestamp implements the Sink interface.
@@ -521,29 +3048,93 @@ func (s *sqlSink) EmitResolvedTimestamp(
 	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
 ) error {
 	var noKey, noValue []byte
+	// The resolved timestamp is only buffered for every partition before the
+	// batch size is checked, so that all of it is inserted by the same
+	// statement. Otherwise, a reader could see it in some partitions and not
+	// others.
 	for topic := range s.topics {
 		payload, err := encoder.EncodeResolvedTimestamp(topic, resolved)
 		if err != nil {
 			return err
 		}
-		s.scratch, payload = s.scratch.Copy(payload, 0 /* extraCap */)
+		// The payload is buffered past this call, so it needs a copy, which
+		// encodePayload already makes of a compressed one.
+		if s.codec == sqlSinkCodecNone {
+			s.scratch, payload = s.scratch.Copy(payload, 0 /* extraCap */)
+		} else if payload, err = s.encodePayload(payload); err != nil {
+			return err
+		}
 		for partition := int32(0); partition < sqlSinkNumPartitions; partition++ {
-			if err := s.emit(ctx, topic, partition, noKey, noValue, payload); err != nil {
-				return err
-			}
+			s.bufferRow(topic, partition, noKey, noValue, payload)
 		}
 	}
+	return s.maybeFlush(ctx)
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *sqlSink) EmitSchemaChange(
+	context.Context, *sqlbase.TableDescriptor, sqlbase.DescriptorVersion, sqlbase.DescriptorVersion,
+) error {
 	return nil
 }
 
 func (s *sqlSink) emit(
 	ctx context.Context, topic string, partition int32, key, value, resolved []byte,
 ) error {
+	s.bufferRow(topic, partition, key, value, resolved)
+	return s.maybeFlush(ctx)
+}
+
+// encodePayload encodes a value or resolved timestamp with the sink's codec. A
+// nil payload stays nil. A compressed payload is copied to the sink's scratch
+// space and stays valid until the next flush.
+func (s *sqlSink) encodePayload(payload []byte) ([]byte, error) {
+	if payload == nil || s.codec != sqlSinkCodecGzip {
+		return payload, nil
+	}
+	s.gzipBuf.Reset()
+	if s.gzipWriter == nil {
+		s.gzipWriter = gzip.NewWriter(&s.gzipBuf)
+	} else {
+		s.gzipWriter.Reset(&s.gzipBuf)
+	}
+	if _, err := s.gzipWriter.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := s.gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+	var compressed []byte
+	s.scratch, compressed = s.scratch.Copy(s.gzipBuf.Bytes(), 0 /* extraCap */)
+	return compressed, nil
+}
+
+// bufferRow adds a row to the next batch without flushing it. The value and
+// resolved timestamp must already be encoded with the sink's codec.
+func (s *sqlSink) bufferRow(topic string, partition int32, key, value, resolved []byte) {
+	messageID := s.nextMessageID(partition)
+	s.rowBuf = append(s.rowBuf, topic, partition, messageID, key, value, resolved, s.codec)
+}
+
+// nextMessageID returns a message id that's greater than every one previously
+// returned for the same partition.
+func (s *sqlSink) nextMessageID(partition int32) int64 {
 	// Generate the message id on the client to match the guaranttees of kafka
 	// (two messages are only guaranteed to keep their order if emitted from the
-	// same producer to the same partition).
-	messageID := builtins.GenerateUniqueInt(roachpb.NodeID(partition))
-	s.rowBuf = append(s.rowBuf, topic, partition, messageID, key, value, resolved)
+	// same producer to the same partition). The ids are time-based, so they
+	// also increase across sinks writing to the same table, such as when a
+	// changefeed restarts. Within this sink, don't rely on the resolution of
+	// the clock: bump the id if it isn't past the last one.
+	messageID := int64(builtins.GenerateUniqueInt(roachpb.NodeID(partition)))
+	if last := s.lastMessageID[partition]; messageID <= last {
+		messageID = last + 1
+	}
+	s.lastMessageID[partition] = messageID
+	return messageID
+}
+
+// maybeFlush flushes if the buffered rows have reached the batch size.
+func (s *sqlSink) maybeFlush(ctx context.Context) error {
 	if len(s.rowBuf)/sqlSinkEmitCols >= sqlSinkRowBatchSize {
 		var gcTs hlc.Timestamp
 		return s.Flush(ctx, gcTs)
@@ -560,12 +3151,124 @@ func (s *sqlSink) Flush(ctx context.Context, _ hlc.Timestamp) error {
 		return nil
 	}
 
+	err := s.insertBatches(ctx)
+	if err != nil && s.diagnoseErrors && !isRetryableSinkError(err) {
+		err = s.insertRowByRow(ctx)
+	}
+	if err != nil {
+		if s.unverifiedTable {
+			return errors.Wrapf(err, `inserting into existing table %s, which must have `+
+				`columns (%s)`, s.tableName, s.emitColumns())
+		}
+		return err
+	}
+	s.unverifiedTable = false
+	s.rowBuf = s.rowBuf[:0]
+	return nil
+}
+
+// insertBatches inserts the buffered rows, split into statements by
+// statementLen. The rows of each statement are removed from the buffer once
+// it succeeds, so if one fails, only the rows that weren't inserted are left,
+// and retrying them doesn't duplicate any message ids.
+func (s *sqlSink) insertBatches(ctx context.Context) error {
+	var inserted int
+	for inserted < len(s.rowBuf) {
+		n := s.statementLen(s.rowBuf[inserted:])
+		if err := s.insert(ctx, s.rowBuf[inserted:inserted+n]); err != nil {
+			s.rowBuf = append(s.rowBuf[:0], s.rowBuf[inserted:]...)
+			return err
+		}
+		inserted += n
+	}
+	return nil
+}
+
+// statementLen returns how many of rows, which are sqlSinkEmitCols values per
+// row, to insert with the next statement: the most whole rows that fit under
+// sqlSinkMaxPlaceholders and maxStatementBytes, but always at least one. A
+// run of resolved timestamp rows is never split by maxStatementBytes, so that
+// each resolved timestamp stays visible in every partition at once, see
+// EmitResolvedTimestamp. Only a run with more rows than fit under
+// sqlSinkMaxPlaceholders, which takes thousands of topics, is split.
+func (s *sqlSink) statementLen(rows []interface{}) int {
+	var n int
+	var size int64
+	for n < len(rows) {
+		unitLen := sqlSinkEmitCols
+		for isSQLSinkResolvedRow(rows[n:]) && isSQLSinkResolvedRow(rows[n+unitLen:]) {
+			unitLen += sqlSinkEmitCols
+		}
+		unitSize := sqlSinkRowBytes(rows[n : n+unitLen])
+		if n > 0 && (n+unitLen > sqlSinkMaxPlaceholders ||
+			(s.maxStatementBytes > 0 && size+unitSize > s.maxStatementBytes)) {
+			break
+		}
+		size += unitSize
+		n += unitLen
+	}
+	if n > sqlSinkMaxPlaceholders {
+		n = sqlSinkMaxPlaceholders / sqlSinkEmitCols * sqlSinkEmitCols
+	}
+	return n
+}
+
+// isSQLSinkResolvedRow returns whether the first of rows, which are
+// sqlSinkEmitCols values per row, is a resolved timestamp. It returns false if
+// there are no rows.
+func isSQLSinkResolvedRow(rows []interface{}) bool {
+	if len(rows) == 0 {
+		return false
+	}
+	// The resolved column, see bufferRow.
+	resolved, _ := rows[5].([]byte)
+	return resolved != nil
+}
+
+// sqlSinkRowBytes returns the size of the values of buffered rows, counting
+// the integer columns as 8 bytes each.
+func sqlSinkRowBytes(rows []interface{}) int64 {
+	var size int64
+	for _, v := range rows {
+		switch v := v.(type) {
+		case []byte:
+			size += int64(len(v))
+		case string:
+			size += int64(len(v))
+		default:
+			size += 8
+		}
+	}
+	return size
+}
+
+// emitColumns returns the columns that insert writes.
+func (s *sqlSink) emitColumns() string {
+	if !s.codecColumn {
+		return sqlSinkEmitColumnsWithoutCodec
+	}
+	return sqlSinkEmitColumns
+}
+
+// insert inserts rows, which are sqlSinkEmitCols values per row, in one
+// statement. Without a codec column, the codec of each row is left out.
+func (s *sqlSink) insert(ctx context.Context, rows []interface{}) error {
+	numCols := sqlSinkEmitCols
+	if !s.codecColumn {
+		// The codec is the last value of each row, see bufferRow.
+		numCols--
+		args := make([]interface{}, 0, len(rows)/sqlSinkEmitCols*numCols)
+		for i := 0; i < len(rows); i += sqlSinkEmitCols {
+			args = append(args, rows[i:i+numCols]...)
+		}
+		rows = args
+	}
 	var stmt strings.Builder
-	fmt.Fprintf(&stmt, sqlSinkEmitStmt, s.tableName)
-	for i := 0; i < len(s.rowBuf); i++ {
+	fmt.Fprintf(&stmt, sqlSinkEmitStmt, s.tableName, s.emitColumns())
+	for i := 0; i < len(rows); i++ {
 		if i == 0 {
 			stmt.WriteString(` VALUES (`)
-		} else if i%sqlSinkEmitCols == 0 {
+		} else if i%numCols == 0 {
 			stmt.WriteString(`),(`)
 		} else {
 			stmt.WriteString(`,`)
@@ -573,12 +3276,89 @@ func (s *sqlSink) Flush(ctx context.Context, _ hlc.Timestamp) error {
 		fmt.Fprintf(&stmt, `$%d`, i+1)
 	}
 	stmt.WriteString(`)`)
-	_, err := s.db.Exec(stmt.String(), s.rowBuf...)
-	if err != nil {
+	return sqlSinkExecWithRetry(ctx, sqlSinkRetryOpts, func() error {
+		_, err := s.db.ExecContext(ctx, stmt.String(), rows...)
 		return err
+	})
+}
+
+// insertRowByRow inserts the buffered rows one at a time after their batch
+// failed, and returns an error that identifies each row that still fails. The
+// rows that are inserted are removed from the buffer, so only the failed ones
+// are left. This is much slower than a batch, so it's only done with the
+// `diagnose_errors` sink param.
+func (s *sqlSink) insertRowByRow(ctx context.Context) error {
+	var failed []interface{}
+	var errs []string
+	for i := 0; i < len(s.rowBuf); i += sqlSinkEmitCols {
+		row := s.rowBuf[i : i+sqlSinkEmitCols]
+		if err := s.insert(ctx, row); err != nil {
+			if isRetryableSinkError(err) {
+				s.rowBuf = append(failed, s.rowBuf[i:]...)
+				return err
+			}
+			failed = append(failed, row...)
+			errs = append(errs, fmt.Sprintf(`topic %s partition %d message_id %d: %v`,
+				row[0], row[1], row[2], err))
+		}
 	}
-	s.rowBuf = s.rowBuf[:0]
-	return nil
+	numRows := len(s.rowBuf) / sqlSinkEmitCols
+	s.rowBuf = append(s.rowBuf[:0], failed...)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.Errorf(`%d of %d rows failed to insert: %s`,
+		len(errs), numRows, strings.Join(errs, `; `))
+}
+
+// sqlSinkRetryOpts bounds how many times, and how often, sqlSink retries a
+// batch that CockroachDB rejected with a retryable error. Contention is
+// expected when multiple changefeeds write to the same table.
+var sqlSinkRetryOpts = retry.Options{
+	InitialBackoff:      10 * time.Millisecond,
+	MaxBackoff:          time.Second,
+	Multiplier:          2,
+	RandomizationFactor: 0.5,
+	MaxRetries:          5,
+}
+
+// sqlSinkExecWithRetry runs fn, retrying it with jittered backoff while it
+// fails with a retryable error, as long as opts allows. If it still fails with
+// a retryable error, that's returned as a retryableSinkError so the changefeed
+// restarts instead of failing.
+func sqlSinkExecWithRetry(ctx context.Context, opts retry.Options, fn func() error) error {
+	var err error
+	for r := retry.StartWithCtx(ctx, opts); r.Next(); {
+		if err = fn(); err == nil || !isSQLSinkRetryableError(err) {
+			return err
+		}
+		if log.V(1) {
+			log.Infof(ctx, `retrying sql sink insert: %v`, err)
+		}
+	}
+	if isSQLSinkRetryableError(err) {
+		return &retryableSinkError{cause: err}
+	}
+	return err
+}
+
+// isSQLSinkRetryableError returns true if the error is one that CockroachDB
+// returns for a transaction that can safely be retried, such as a
+// serialization failure.
+func isSQLSinkRetryableError(err error) bool {
+	pqErr, ok := errors.Cause(err).(*pq.Error)
+	return ok && pqErr.Code == pgerror.CodeSerializationFailureError
+}
+
+// Ping implements the Pinger interface.
+func (s *sqlSink) Ping(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `SELECT 1`)
+	return err
+}
+
+// Capabilities implements the Sink interface.
+func (s *sqlSink) Capabilities() SinkCapabilities {
+	return sqlSinkCapabilities
 }
 
 // Close implements the Sink interface.
@@ -604,11 +3384,39 @@ func (b *encDatumRowBuffer) Pop() sqlbase.EncDatumRow {
 	return ret
 }
 
+var bufferSinkCapabilities = SinkCapabilities{
+	Formats:   []formatType{optFormatJSON, optFormatAvro, optFormatRaw, optFormatProtobuf},
+	Envelopes: allEnvelopes,
+	Resolved:  true,
+	KeyFormat: true,
+}
+
 type bufferSink struct {
 	buf     encDatumRowBuffer
 	alloc   sqlbase.DatumAlloc
 	scratch bufalloc.ByteAllocator
 	closed  bool
+
+	// maxRows, if non-zero, caps the number of rows retained in buf. Once it's
+	// reached, emitting another row either drops the oldest one, if dropOldest
+	// is set, or returns an error. Zero means no cap.
+	maxRows    int
+	dropOldest bool
+	// dropped is the number of rows dropped because of maxRows.
+	dropped int64
+}
+
+// push adds a row to buf, enforcing maxRows.
+func (s *bufferSink) push(row sqlbase.EncDatumRow) error {
+	if s.maxRows > 0 && len(s.buf) >= s.maxRows {
+		if !s.dropOldest {
+			return errors.Errorf(`buffer sink is full: %d rows`, len(s.buf))
+		}
+		s.buf.Pop()
+		s.dropped++
+	}
+	s.buf.Push(row)
+	return nil
 }
 
 // EmitRow implements the Sink interface.
@@ -619,13 +3427,12 @@ func (s *bufferSink) EmitRow(
 		return errors.New(`cannot EmitRow on a closed sink`)
 	}
 	topic := table.Name
-	s.buf.Push(sqlbase.EncDatumRow{
+	return s.push(sqlbase.EncDatumRow{
 		{Datum: tree.DNull}, // resolved span
 		{Datum: s.alloc.NewDString(tree.DString(topic))}, // topic
 		{Datum: s.alloc.NewDBytes(tree.DBytes(key))},     // key
 		{Datum: s.alloc.NewDBytes(tree.DBytes(value))},   //value
 	})
-	return nil
 }
 
 // EmitResolvedTimestamp implements the Sink interface.
@@ -641,12 +3448,21 @@ func (s *bufferSink) EmitResolvedTimestamp(
 		return err
 	}
 	s.scratch, payload = s.scratch.Copy(payload, 0 /* extraCap */)
-	s.buf.Push(sqlbase.EncDatumRow{
+	return s.push(sqlbase.EncDatumRow{
 		{Datum: tree.DNull}, // resolved span
 		{Datum: tree.DNull}, // topic
 		{Datum: tree.DNull}, // key
 		{Datum: s.alloc.NewDBytes(tree.DBytes(payload))}, // value
 	})
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *bufferSink) EmitSchemaChange(
+	context.Context, *sqlbase.TableDescriptor, sqlbase.DescriptorVersion, sqlbase.DescriptorVersion,
+) error {
+	if s.closed {
+		return errors.New(`cannot EmitSchemaChange on a closed sink`)
+	}
 	return nil
 }
 
@@ -655,36 +3471,340 @@ func (s *bufferSink) Flush(_ context.Context, _ hlc.Timestamp) error {
 	return nil
 }
 
+// Capabilities implements the Sink interface.
+func (s *bufferSink) Capabilities() SinkCapabilities {
+	return bufferSinkCapabilities
+}
+
 // Close implements the Sink interface.
 func (s *bufferSink) Close() error {
 	s.closed = true
 	return nil
 }
 
-// cloudStorageFormatBucket formats times as YYYYMMDDHHMMSSNNNNNNNNN.
-func cloudStorageFormatBucket(t time.Time) string {
-	// TODO(dan): Instead do the minimal thing necessary to differentiate times
-	// truncated to some bucket size.
-	const f = `20060102150405`
-	return fmt.Sprintf(`%s%09d`, t.Format(f), t.Nanosecond())
+// cloudStorageFormatBucket formats times as YYYYMMDDHHMMSSNNNNNNNNN.
+func cloudStorageFormatBucket(t time.Time) string {
+	// TODO(dan): Instead do the minimal thing necessary to differentiate times
+	// truncated to some bucket size.
+	const f = `20060102150405`
+	return fmt.Sprintf(`%s%09d`, t.Format(f), t.Nanosecond())
+}
+
+const (
+	cloudStorageRecordSeparatorLF             = `lf`
+	cloudStorageRecordSeparatorCRLF           = `crlf`
+	cloudStorageRecordSeparatorLengthPrefixed = `length_prefixed`
+)
+
+// cloudStorageSinkConfig holds the sink params of a cloudStorageSink.
+type cloudStorageSinkConfig struct {
+	// bucketSize is the duration that the timestamp of each row is truncated
+	// to when picking the file it goes in.
+	bucketSize time.Duration
+	// recordSeparator is one of the cloudStorageRecordSeparator* constants and
+	// selects how records are framed within a data file. Empty means
+	// cloudStorageRecordSeparatorLF.
+	recordSeparator string
+	// writeManifest, if true, makes Flush write a manifest for each bucket
+	// after all of the bucket's data files have been written.
+	writeManifest bool
+	// listFiles, if true, makes each resolved timestamp file list the data
+	// files that were completed since the previous one.
+	listFiles bool
+	// resolvedGranularity is one of the cloudStorageResolvedGranularity*
+	// constants. Empty means cloudStorageResolvedGranularityChangefeed.
+	resolvedGranularity string
+	// minResolvedInterval, if non-zero, is how far a resolved timestamp must
+	// be past the last one written for a new resolved timestamp file to be
+	// written. The ones in between are dropped.
+	minResolvedInterval time.Duration
+	// metadata, if true, adds the full MVCC timestamp of each row and the node
+	// that emitted it to its record. See withCloudStorageRecordMetadata.
+	metadata bool
+	// stateID, if non-empty, makes the sink resumable. It must be unique to the
+	// changefeed and stable across restarts of it. See ResumeFromState.
+	stateID string
+	// spillThreshold, if non-zero, is the size in bytes past which a data
+	// file being buffered is moved from memory to a temporary file in
+	// spillDir.
+	spillThreshold int64
+	// spillDir is where spilled data files are kept. Empty means the default
+	// directory for temporary files.
+	spillDir string
+	// flushBytes, if non-zero, is the total size in bytes of buffered data
+	// files past which EmitRow writes all of them out, without waiting for the
+	// next Flush.
+	flushBytes int64
+	// bufferPoolMaxBytes, if non-zero, makes the in-memory buffers of data
+	// files that have been written out be reused for the next ones, unless
+	// they're larger than this many bytes. See chunkPool.
+	bufferPoolMaxBytes int
+	// maxFileAge, if non-zero, is how long a data file may be buffered, from
+	// its first record, before Flush writes it out, even if the resolved
+	// timestamp hasn't reached its bucket yet.
+	maxFileAge time.Duration
+	// partitionColumn, if non-empty, is the column whose value further splits
+	// up the data files of each table.
+	partitionColumn string
+	// atomicWrites, if true, makes every file be written under a temporary
+	// name and then renamed, so that a node dying midway through a write never
+	// leaves a partial file under the final name. It's only honored by storage
+	// that supports renames; object stores don't need it, since their writes
+	// are already all or nothing.
+	atomicWrites bool
+	// idempotentFlush, if true, makes Flush skip the data files that haven't
+	// changed since they were last written out, so that retrying a Flush that
+	// failed partway through only writes the files it didn't get to.
+	idempotentFlush bool
+	// resolvedSuffix is appended to the timestamp to name resolved timestamp
+	// files. Empty means cloudStorageDefaultResolvedSuffix.
+	resolvedSuffix string
+	// resolvedBucketStart, if true, names resolved timestamp files after the
+	// start of the last complete bucket instead of its last nanosecond.
+	resolvedBucketStart bool
+	// writeConcurrency is the number of data files that are written out at
+	// once. It's at least 1.
+	writeConcurrency int
+	// backfillWriteConcurrency replaces writeConcurrency while the sink is in
+	// backfill mode, which lets the rows of a full table scan be written out
+	// faster without making the steady state more aggressive.
+	backfillWriteConcurrency int
+	// keyOnly, if true, makes the key of each row be written as its record
+	// instead of the value, for `envelope=key_only`.
+	keyOnly bool
+	// trimTrailingSeparator, if true, leaves out the record separator after
+	// the last record of each data file, for parsers that reject it. Only
+	// separators that are delimiters can be trimmed.
+	trimTrailingSeparator bool
+	// uploadTimeout, if non-zero, bounds each attempt at writing a file.
+	uploadTimeout time.Duration
+	// uploadMaxRetries is how many more times a file is written after an
+	// attempt fails, before the error is returned.
+	uploadMaxRetries int
+}
+
+// parseWriteConcurrency parses the value of a concurrency sink param, which
+// must be a positive integer, or returns def if it's empty.
+func parseWriteConcurrency(s, param string, def int) (int, error) {
+	if s == `` {
+		return def, nil
+	}
+	concurrency, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.Wrapf(err, `parsing %s`, param)
+	}
+	if concurrency < 1 {
+		return 0, errors.Errorf(`%s must be positive: %d`, param, concurrency)
+	}
+	return concurrency, nil
+}
+
+const cloudStorageDefaultResolvedSuffix = `.RESOLVED`
+
+const (
+	// cloudStorageResolvedGranularityChangefeed writes resolved timestamp
+	// files for the changefeed as a whole.
+	cloudStorageResolvedGranularityChangefeed = `changefeed`
+	// cloudStorageResolvedGranularityTopic writes them for each topic.
+	cloudStorageResolvedGranularityTopic = `topic`
+	// cloudStorageResolvedGranularityBoth writes both.
+	cloudStorageResolvedGranularityBoth = `both`
+	// cloudStorageResolvedGranularityCombined writes the changefeed's resolved
+	// timestamp files with the resolved timestamp of each topic in them, see
+	// cloudStorageCombinedResolved.
+	cloudStorageResolvedGranularityCombined = `combined`
+)
+
+// cloudStorageCombinedResolved is the contents of a resolved timestamp file
+// written with `resolved_granularity=combined`, as JSON. The timestamps are
+// decimals, like the `resolved` field of a JSON changefeed's resolved
+// timestamps. Topics is keyed by topic name. Every topic's timestamp is at
+// or past the changefeed's.
+type cloudStorageCombinedResolved struct {
+	Resolved string            `json:"resolved"`
+	Topics   map[string]string `json:"topics"`
+}
+
+// encodeCloudStorageCombinedResolved returns the contents of a resolved
+// timestamp file for `resolved_granularity=combined`.
+func encodeCloudStorageCombinedResolved(
+	resolved hlc.Timestamp, topicResolved map[string]hlc.Timestamp,
+) ([]byte, error) {
+	combined := cloudStorageCombinedResolved{
+		Resolved: tree.TimestampToDecimal(resolved).Decimal.String(),
+		Topics:   make(map[string]string, len(topicResolved)),
+	}
+	for topic, ts := range topicResolved {
+		combined.Topics[topic] = tree.TimestampToDecimal(ts).Decimal.String()
+	}
+	return gojson.Marshal(combined)
+}
+
+// validateResolvedSuffix checks that resolved timestamp files named with the
+// given suffix keep the lexicographic ordering guarantee described on
+// cloudStorageSink and can't be mistaken for any other file the sink writes.
+func validateResolvedSuffix(suffix, dataExt string, bucketStart bool) error {
+	switch {
+	case suffix == ``:
+		return errors.Errorf(`%s must not be empty`, sinkParamResolvedSuffix)
+	case strings.Contains(suffix, `/`):
+		return errors.Errorf(`%s must not contain /: %s`, sinkParamResolvedSuffix, suffix)
+	case suffix[0] == '-' || (suffix[0] >= '0' && suffix[0] <= '9'):
+		// The timestamp must be followed by something that isn't part of it,
+		// and data files and manifests are `<timestamp>-...`.
+		return errors.Errorf(`%s must not start with a digit or -: %s`,
+			sinkParamResolvedSuffix, suffix)
+	case bucketStart && suffix[0] < '-':
+		// Named after the start of a bucket, the resolved timestamp file must
+		// sort after the data files of that bucket, see
+		// cloudStorageResolvedBucket.
+		return errors.Errorf(`%s must start with a character that sorts after - with %s: %s`,
+			sinkParamResolvedSuffix, sinkParamResolvedBucketStart, suffix)
+	}
+	for _, ext := range []string{dataExt, `.MANIFEST`, `.STATE`} {
+		if strings.HasSuffix(suffix, ext) {
+			return errors.Errorf(`%s must not end with %s: %s`, sinkParamResolvedSuffix, ext, suffix)
+		}
+	}
+	return nil
+}
+
+// cloudStorageTempSuffix is appended to the name of a file while it's being
+// written when cloudStorageSinkConfig.atomicWrites is set.
+const cloudStorageTempSuffix = `.tmp`
+
+type cloudStorageSinkKey struct {
+	Bucket   time.Time
+	Topic    string
+	SchemaID sqlbase.DescriptorVersion
+	// Partition is only set if the `partition_column` sink param is.
+	Partition string
+	SinkID    string
+	Ext       string
+}
+
+// cloudStorageSchemaFilename returns the name of a file about one schema of a
+// topic, like its .DESCRIPTOR or .SCHEMACHANGE file. The topic and schema id
+// are the same as in the names of the topic's data files for that schema.
+func cloudStorageSchemaFilename(
+	topic string, schemaID sqlbase.DescriptorVersion, suffix string,
+) string {
+	return fmt.Sprintf(`%s-%d%s`, topic, schemaID, suffix)
+}
+
+// Filename returns the name of the fileIdx-th data file written for the key.
+// Only the files after the first one, which exist when the key's data was
+// split up, have a file_idx.
+func (k cloudStorageSinkKey) Filename(fileIdx int) string {
+	name := fmt.Sprintf(`%s-%s-%d`, cloudStorageFormatBucket(k.Bucket), k.Topic, k.SchemaID)
+	if k.Partition != `` {
+		name += `-` + k.Partition
+	}
+	name += `-` + k.SinkID
+	if fileIdx > 0 {
+		name += `-` + strconv.Itoa(fileIdx)
+	}
+	return name + k.Ext
+}
+
+// cloudStoragePartitionNull is the partition of rows with a NULL partition
+// column. It's also used for deleted rows when the partition column isn't in
+// the primary key, since their values are unknown.
+const cloudStoragePartitionNull = `null`
+
+// rowColumnJSON returns the JSON of the value of column in a row, read from the
+// row's JSON encoded value, an object of its columns, or, if it's not there
+// (as with deletes), from its JSON encoded key. It's nil if the value isn't in
+// either. The param that the column is for is used for errors.
+func rowColumnJSON(
+	table *sqlbase.TableDescriptor, column string, key, value []byte, param string,
+) (gojson.RawMessage, error) {
+	var found bool
+	for _, col := range table.Columns {
+		if col.Name == column {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.Errorf(`table %s has no column %s for %s`, table.Name, column, param)
+	}
+
+	var raw gojson.RawMessage
+	if len(value) > 0 {
+		var fields map[string]gojson.RawMessage
+		if err := gojson.Unmarshal(value, &fields); err != nil {
+			return nil, errors.Wrapf(err, `decoding value for %s`, param)
+		}
+		raw = fields[column]
+	}
+	if raw == nil {
+		for i, name := range table.PrimaryIndex.ColumnNames {
+			if name != column {
+				continue
+			}
+			var keyValues []gojson.RawMessage
+			if err := gojson.Unmarshal(key, &keyValues); err != nil {
+				return nil, errors.Wrapf(err, `decoding key for %s`, param)
+			}
+			if i < len(keyValues) {
+				raw = keyValues[i]
+			}
+			break
+		}
+	}
+	return raw, nil
+}
+
+// cloudStoragePartition returns the partition of a row: the value of column,
+// escaped so that it's safe to use in a filename. See rowColumnJSON.
+func cloudStoragePartition(
+	table *sqlbase.TableDescriptor, column string, key, value []byte,
+) (string, error) {
+	raw, err := rowColumnJSON(table, column, key, value, sinkParamPartitionColumn)
+	if err != nil {
+		return ``, err
+	}
+	if raw == nil || string(raw) == `null` {
+		return cloudStoragePartitionNull, nil
+	}
+	// Strings are used without their quotes, anything else as its JSON text.
+	var partition string
+	if err := gojson.Unmarshal(raw, &partition); err != nil {
+		partition = string(raw)
+	}
+	return escapeFilenamePart(partition), nil
 }
 
-type cloudStorageSinkKey struct {
-	Bucket   time.Time
-	Topic    string
-	SchemaID sqlbase.DescriptorVersion
-	SinkID   string
-	Ext      string
+// cloudStorageSinkCapabilities only allows the envelopes that write one of the
+// key or the value of each row, because records have no room for both. With
+// diff, the previous version of each row is in the value. With key_only, the
+// key is the record.
+var cloudStorageSinkCapabilities = SinkCapabilities{
+	Formats: []formatType{optFormatJSON, optFormatRaw, optFormatProtobuf},
+	Envelopes: []envelopeType{
+		optEnvelopeKeyOnly, optEnvelopeValueOnly, optEnvelopeDiff,
+	},
+	Resolved:  true,
+	Lifecycle: true,
 }
 
-func (k cloudStorageSinkKey) Filename() string {
-	return fmt.Sprintf(`%s-%s-%d-%s%s`,
-		cloudStorageFormatBucket(k.Bucket), k.Topic, k.SchemaID, k.SinkID, k.Ext)
+// cloudStorageJobURI returns the cloud storage sink URI with a `job_<id>`
+// directory added to the end of its path.
+func cloudStorageJobURI(sinkURI string, jobID int64) (string, error) {
+	u, err := url.Parse(sinkURI)
+	if err != nil {
+		return ``, err
+	}
+	u.Path = path.Join(u.Path, fmt.Sprintf(`job_%d`, jobID))
+	return u.String(), nil
 }
 
 // cloudStorageSink emits to files on cloud storage.
 //
-// The data files are named `<timestamp>_<topic>_<schema_id>_<uniquer>.<ext>`.
+// The data files are named `<timestamp>-<topic>-<schema_id>-<uniquer>.<ext>`,
+// or `<timestamp>-<topic>-<schema_id>-<uniquer>-<file_idx>.<ext>` for the files
+// after the first when the data was split up, see `<file_idx>` below.
 //
 // `<timestamp>` is truncated to some bucket size, specified by the required
 // sink param `bucket_size`. Bucket size is a tradeoff between number of files
@@ -701,84 +3821,358 @@ func (k cloudStorageSinkKey) Filename() string {
 // from overwriting its own data if there are multiple changefeeds, or if a
 // changefeed gets canceled/restarted.
 //
-// `<ext>` implies the format of the file: currently the only option is
-// `ndjson`, which means a text file conforming to the "Newline Delimited JSON"
-// spec.
+// If the `job_prefix` sink param is set, all of the files are written in a
+// `job_<job_id>` directory under the sink URI instead, which separates the
+// output of changefeeds sharing a bucket. The guarantees below then hold for
+// the files in each such directory.
+//
+// If the `partition_column` sink param is set, the data files of each table are
+// also split up by the value of that column and named
+// `<timestamp>-<topic>-<schema_id>-<partition>-<uniquer>[-<file_idx>].<ext>`,
+// so that readers can skip the files for the partitions they don't need.
+// `<partition>` is the column's value, with anything but `[A-Za-z0-9_]` escaped
+// as in topic names, or `null`. Deleted rows only have the values of their
+// primary key, so if the column isn't part of it, they're all in the `null`
+// partition.
+//
+// `<file_idx>` subdivides the data for one timestamp, topic and schema_id into
+// multiple files. See `flush_bytes` below. The first file has none, so it's
+// only there when the data was actually split up, starting at 1.
+//
+// `<ext>` implies the format of the file: `ndjson` means a text file
+// conforming to the "Newline Delimited JSON" spec, and `ndraw` means
+// `format=raw` values delimited the same way. The `record_separator` sink
+// param can be used to change the framing: `lf` and `crlf` keep the `nd`
+// extensions, while `length_prefixed` writes each record preceded by its
+// length as a 4-byte big-endian integer and uses `lpjson` or `lpraw`. The
+// default is `lf`, except with `format=raw`, whose values can contain a
+// newline, where it's `length_prefixed`.
 //
 // Each record in the data files is a value, keys are not included, so the
-// `envelope` option must be set to `row`, which is the default. Within a file,
+// `envelope` option must be set to `value_only` or `diff`. Within a file,
 // records are not guaranteed to be sorted by timestamp. A duplicate of some
 // record might exist in a different file or even in the same file.
 //
+// Rows are bucketed by the physical (wall time) part of their MVCC timestamp
+// only, so rows that differ only in the logical part always share a bucket.
+// There is no option to bucket by the logical part: a bucket is a span of wall
+// time and the logical part never moves a row out of one. Whether a row is a
+// duplicate, on the other hand, is decided with the whole timestamp. A row is
+// only dropped if it's at or below a timestamp the sink has already flushed, so
+// a row with the same wall time as that timestamp but a higher logical time is
+// still written. Comparing only the wall time would be stricter but wrong, since
+// it would drop such rows, which haven't been written yet.
+//
+// When the schema of a table changes, a marker file named
+// `<topic>-<schema_id>.SCHEMACHANGE` is written with the old and new schema ids,
+// where `<schema_id>` is the new one, as in the names of the data files with the
+// new schema. It's written once per change by the changefeed's frontier, after
+// the aggregators have started writing rows with the new schema.
+//
+// With the `lifecycle_markers` option, a `<timestamp>.FEEDSTART` file is written
+// once the initial scan is complete and a `<timestamp>.FEEDEND` file once the
+// changefeed is done. See EmitFeedLifecycle.
+//
+// With `format=protobuf`, the data files are `.protodelim`, each record preceded
+// by its length as a varint, and a `<topic>-<schema_id>.DESCRIPTOR` file with
+// the descriptor of the table's message is written before the first row of
+// each schema_id is buffered. See protobufEncoder.
+//
+// If the `manifest` sink param is true, each flush also writes a
+// `<timestamp>-<uniquer>.MANIFEST` file per bucket, listing the data files it
+// wrote for that bucket along with their sizes and CRC-32C checksums. It's
+// written after the data files and before the RESOLVED file for the bucket.
+//
+// If the `resolved_file_listing` sink param is true, each RESOLVED file is the
+// encoded resolved timestamp followed by a newline and then the names of the
+// data files completed since the previous RESOLVED file, each followed by a
+// newline. A data file is complete once its bucket can't get any more rows, so
+// a reader can process exactly the listed files instead of relying on a
+// consistent listing of the bucket. Every data file in a bucket at or before
+// the one a RESOLVED file is named after is listed by it or an earlier one,
+// but a file may be listed before its bucket is resolved. Files completed just
+// before the changefeed restarts may not be listed.
+//
+// If the `sink_id` sink param is set, the sink records how far it has flushed
+// in a `.STATE` file so that a restarted changefeed doesn't rewrite rows that
+// were already written. See ResumeFromState.
+//
+// Data files are buffered in memory until they're flushed. If the
+// `spill_threshold` sink param is set, any data file that grows past that many
+// bytes is instead buffered in a temporary local file, in the `spill_dir`
+// directory if that's set. This allows much larger bucket sizes on nodes with
+// limited memory. If the `buffer_pool_max_bytes` sink param is set, the memory
+// of a data file that's been written out is reused for the next ones instead
+// of being garbage collected, unless it's larger than that many bytes, which
+// cuts down on the garbage made by busy changefeeds.
+//
+// Data files are otherwise only written by Flush, which is called as often as
+// resolved timestamps are. If the `flush_bytes` sink param is set, then once
+// the data files being buffered add up to more than that many bytes, they're
+// all written out immediately and each one's `<file_idx>` is incremented, so
+// that later rows for the same bucket go to a new file. This bounds the memory
+// (or local disk) used by the sink and the latency of data reaching cloud
+// storage, regardless of how often resolved timestamps are emitted.
+//
+// Flush only writes the data files of the buckets that begin before its
+// timestamp, so rows can sit in memory for as long as the resolved timestamp
+// lags behind them. If the `max_file_age` sink param is set, each Flush also
+// writes out any data file whose first record was buffered more than that long
+// ago, and later rows for its bucket go to a new file. The changefeed flushes
+// its sinks about once per poll interval, whether or not resolved timestamps
+// are emitted, so this bounds the latency of data reaching cloud storage. A
+// file written out early is no different from one written out because of
+// `flush_bytes`: its bucket is only garbage collected, and its manifest and
+// RESOLVED file listing only finalized, once the bucket is resolved.
+//
+// By default, data files are written one at a time. The `write_concurrency`
+// sink param writes up to that many at once. While the changefeed is emitting
+// the rows of a full table scan, which is when the most files are written, the
+// sink is in backfill mode and uses the `backfill_write_concurrency` sink param
+// instead, so that an initial scan can be written out quickly without the
+// steady state being as aggressive.
+//
+// The `upload_timeout` sink param bounds each attempt at writing a file, and
+// the `upload_max_retries` sink param retries failed attempts, so that one
+// slow request to a flaky endpoint can't stall a flush forever. See upload.
+//
 // The resolved timestamp files are named `<timestamp>.RESOLVED`. This is
 // carefully done so that we can offer the following external guarantee: At any
 // given time, if the the files are iterated in lexicographic filename order,
 // then encountering any filename containing `RESOLVED` means that everything
 // before it is finalized (and thus can be ingested into some other system and
 // deleted, included in hive queries, etc). A typical user of cloudStorageSink
-// would periodically do exactly this.
+// would periodically do exactly this. The `<timestamp>` is the last nanosecond
+// of the last complete bucket, or its start with the `resolved_bucket_start`
+// sink param, see cloudStorageResolvedBucket. The `resolved_suffix` sink param
+// replaces `.RESOLVED`, but the timestamp always comes first so the guarantee
+// holds. If the `min_resolved_interval` sink param is set, a resolved
+// timestamp file is only written once the resolved timestamp is at least that
+// far past the one of the last file, so feeds that resolve often don't write
+// a flood of tiny files.
+//
+// If the `resolved_granularity` sink param is `topic` or `both`, resolved
+// timestamp files are also written for each topic, named
+// `<topic>-<timestamp>.RESOLVED`, as soon as every span of the topic's table is
+// resolved, so a reader of one table doesn't wait on a lagging one. Such a
+// file means that every data file of the topic whose `<timestamp>` sorts
+// before the file's is finalized. `topic` doesn't write the changefeed's own
+// resolved timestamp files. With `both`, a reader relying on the guarantee
+// above must skip the files that don't start with a timestamp. `combined`
+// instead puts the resolved timestamp of every topic in the changefeed's own
+// resolved timestamp files, so a reader learns the progress of every topic from
+// one file and a changefeed with many topics doesn't write a file for each.
+// Such a file holds, whatever the `format`, one line of JSON like
+// `{"resolved":"<ts>","topics":{"<topic>":"<ts>",...}}`. It's named and
+// guarantees the same as any other changefeed resolved timestamp file, and
+// for each topic it also means that every row of the topic at or before the
+// topic's timestamp is in a file that's already written.
 //
 // Still TODO is writing out data schemas, Avro support, bounding memory usage.
 // Eliminating duplicates would be great, but may not be immediately practical.
 type cloudStorageSink struct {
-	base       *url.URL
-	bucketSize time.Duration
-	settings   *cluster.Settings
-	sinkID     string
+	base     *url.URL
+	cfg      cloudStorageSinkConfig
+	settings *cluster.Settings
+	sinkID   string
 
-	ext           string
-	recordDelimFn func(io.Writer) error
+	ext            string
+	resolvedSuffix string
+	writeRecordFn  func(w io.Writer, record []byte) error
+	// leadingDelimiter, if non-nil, is written before every record of a data
+	// file but the first, instead of writeRecordFn delimiting every record,
+	// so that the last record isn't followed by the delimiter. It's set by
+	// cfg.trimTrailingSeparator. The delimiter isn't trimmed when the file is
+	// written out because the size and checksum of the contents are kept as
+	// they're written.
+	leadingDelimiter []byte
+	// renameFiles is whether files are written with a temporary name and
+	// renamed. It's set if cfg.atomicWrites is and the storage supports it.
+	renameFiles bool
+	// descriptorEncoder, if non-nil, is the encoder when its messages need a
+	// descriptor file. writtenDescriptors are the table versions whose
+	// descriptor file has been written.
+	descriptorEncoder  DescriptorEncoder
+	writtenDescriptors map[tableIDAndVersion]struct{}
 
-	files           map[cloudStorageSinkKey]*bytes.Buffer
+	files map[cloudStorageSinkKey]*cloudStorageSinkFile
+	// bufferPool, if non-nil, is where the buffers of files come from, see
+	// cloudStorageSinkConfig.bufferPoolMaxBytes.
+	bufferPool *chunkPool
+	// bufferedBytes is the total size of files.
+	bufferedBytes int64
+	// writtenEntries, if the `manifest` sink param is set, holds the manifest
+	// entries of the data files that were written out because of flushBytes,
+	// by bucket, until the bucket's manifest has been written for the last
+	// time.
+	writtenEntries map[time.Time][]cloudStorageManifestEntry
+	// incompleteFiles, if the `resolved_file_listing` sink param is set,
+	// holds the names of the data files that have been written out, by
+	// bucket, until the bucket is complete.
+	incompleteFiles map[time.Time]map[string]struct{}
+	// completedThrough is the timestamp of the latest Flush, as of which every
+	// bucket that ends at or before it is complete.
+	completedThrough time.Time
+	// completedFiles are the names of the data files whose bucket has been
+	// completed since the last TakeCompletedFiles.
+	completedFiles []string
+	// listedFiles are the names of the data files to be listed in the next
+	// resolved timestamp file. The files are written by the sinks of the
+	// change aggregators and passed on to the change frontier's sink, which
+	// writes the resolved timestamp files, with NoteCompletedFile.
+	listedFiles     []string
 	localResolvedTs hlc.Timestamp
+	// stateFilename, if non-empty, is where localResolvedTs is persisted after
+	// every Flush. It's set by ResumeFromState.
+	stateFilename string
+	// persistedResolvedTs is the localResolvedTs last written to
+	// stateFilename.
+	persistedResolvedTs hlc.Timestamp
+	// lastResolvedWritten and lastTopicResolvedWritten are the timestamps of
+	// the last resolved timestamp files written for the changefeed and for
+	// each topic, for cfg.minResolvedInterval.
+	lastResolvedWritten      hlc.Timestamp
+	lastTopicResolvedWritten map[string]hlc.Timestamp
+	// combinedTopicResolved is the resolved timestamp of each topic for the
+	// next resolved timestamp file, with `resolved_granularity=combined`. See
+	// SetCombinedTopicResolved.
+	combinedTopicResolved map[string]hlc.Timestamp
+	// metrics, if non-nil, is where the size of each data file and the time
+	// spent writing it are recorded.
+	metrics *Metrics
+	// nodeID is the node that the sink emits rows from, for cfg.metadata.
+	nodeID roachpb.NodeID
+	// backfill is whether the sink is in backfill mode. See SetBackfillMode.
+	backfill bool
+	// now is timeutil.Now, except in tests. It's used for cfg.maxFileAge.
+	now func() time.Time
+}
+
+// cloudStorageWriteStats summarizes the data files written out at once, for
+// logging.
+type cloudStorageWriteStats struct {
+	files       int
+	bytes       int64
+	slowest     string
+	slowestTime time.Duration
+}
+
+// record adds a data file that was written out in the given time.
+func (st *cloudStorageWriteStats) record(filename string, size int64, elapsed time.Duration) {
+	st.files++
+	st.bytes += size
+	if elapsed >= st.slowestTime {
+		st.slowest, st.slowestTime = filename, elapsed
+	}
 }
 
+// maybeLog logs the summary at verbosity 1, if any files were written.
+func (st *cloudStorageWriteStats) maybeLog(ctx context.Context, what string) {
+	if st.files > 0 && log.V(1) {
+		log.Infof(ctx, "%s wrote %d files (%d bytes), the slowest was %s in %s",
+			what, st.files, st.bytes, st.slowest, st.slowestTime)
+	}
+}
+
+// exportStorageFromURI is how the cloud storage sink opens its storage. Tests
+// replace it to capture what the sink writes, see useMemExportStorage.
+var exportStorageFromURI = storageccl.ExportStorageFromURI
+
 func makeCloudStorageSink(
-	baseURI string, bucketSize time.Duration, settings *cluster.Settings, opts map[string]string,
+	ctx context.Context,
+	baseURI string,
+	cfg cloudStorageSinkConfig,
+	encoder Encoder,
+	settings *cluster.Settings,
 ) (Sink, error) {
 	base, err := url.Parse(baseURI)
 	if err != nil {
 		return nil, err
 	}
+	if _, ok := encoder.(*rawEncoder); ok && cfg.recordSeparator == `` {
+		// Raw values are opaque, so nothing stops them from containing a
+		// newline.
+		cfg.recordSeparator = cloudStorageRecordSeparatorLengthPrefixed
+	}
 	// TODO(dan): Each sink needs a unique id for the reasons described in the
 	// above docs, but this is a pretty ugly way to do it.
 	sinkID := uuid.MakeV4().String()
 	s := &cloudStorageSink{
-		base:       base,
-		bucketSize: bucketSize,
-		settings:   settings,
-		sinkID:     sinkID,
-		files:      make(map[cloudStorageSinkKey]*bytes.Buffer),
-	}
-
-	switch formatType(opts[optFormat]) {
-	case optFormatJSON:
-		// TODO(dan): It seems like these should be on the encoder, but that
-		// seems to require a bit of refactoring.
-		s.ext = `.ndjson`
-		s.recordDelimFn = func(w io.Writer) error {
-			_, err := w.Write([]byte{'\n'})
-			return err
+		base:     base,
+		cfg:      cfg,
+		settings: settings,
+		sinkID:   sinkID,
+		files:    make(map[cloudStorageSinkKey]*cloudStorageSinkFile),
+		now:      timeutil.Now,
+	}
+	if cfg.bufferPoolMaxBytes > 0 {
+		s.bufferPool = makeChunkPool(cfg.bufferPoolMaxBytes)
+	}
+	if cfg.writeManifest {
+		s.writtenEntries = make(map[time.Time][]cloudStorageManifestEntry)
+	}
+	if cfg.listFiles {
+		s.incompleteFiles = make(map[time.Time]map[string]struct{})
+	}
+
+	fileEncoder, ok := encoder.(FileEncoder)
+	if !ok {
+		format, err := encoderFormat(encoder)
+		if err != nil {
+			return nil, err
+		}
+		return nil, validateSinkFormat(format, cloudStorageSinkCapabilities.Formats)
+	}
+	if s.ext, s.writeRecordFn, err = fileEncoder.FileFormat(cfg.recordSeparator); err != nil {
+		return nil, err
+	}
+	if d, ok := encoder.(DescriptorEncoder); ok {
+		// Records have no separator to trim.
+		if cfg.trimTrailingSeparator {
+			format, err := encoderFormat(encoder)
+			if err != nil {
+				return nil, err
+			}
+			return nil, errors.Errorf(`%s is not supported with %s=%s`,
+				sinkParamTrimTrailingSeparator, optFormat, format)
+		}
+		s.descriptorEncoder = d
+		s.writtenDescriptors = make(map[tableIDAndVersion]struct{})
+	}
+	if cfg.trimTrailingSeparator {
+		if s.leadingDelimiter, err = cloudStorageRecordDelimiter(cfg.recordSeparator); err != nil {
+			return nil, err
+		}
+		if s.leadingDelimiter == nil {
+			return nil, errors.Errorf(`%s is not supported with %s=%s`,
+				sinkParamTrimTrailingSeparator, sinkParamRecordSeparator, cfg.recordSeparator)
 		}
-	default:
-		return nil, errors.Errorf(`this sink is incompatible with %s=%s`,
-			optFormat, opts[optFormat])
 	}
 
-	switch envelopeType(opts[optEnvelope]) {
-	case optEnvelopeValueOnly:
-	default:
-		return nil, errors.Errorf(`this sink is incompatible with %s=%s`,
-			optEnvelope, opts[optEnvelope])
+	s.resolvedSuffix = cloudStorageDefaultResolvedSuffix
+	if cfg.resolvedSuffix != `` {
+		if err := validateResolvedSuffix(
+			cfg.resolvedSuffix, s.ext, cfg.resolvedBucketStart,
+		); err != nil {
+			return nil, err
+		}
+		s.resolvedSuffix = cfg.resolvedSuffix
 	}
 
 	{
 		// Sanity check that we can connect.
-		ctx := context.Background()
-		es, err := storageccl.ExportStorageFromURI(ctx, s.base.String(), settings)
+		es, err := exportStorageFromURI(ctx, s.base.String(), settings)
 		if err != nil {
 			return nil, err
 		}
+		if cfg.atomicWrites {
+			if _, ok := es.(storageccl.ExportStorageRenamer); ok {
+				s.renameFiles = true
+			} else {
+				log.Warningf(ctx, `%s is not supported by %s, files will be written in place`,
+					sinkParamAtomicWrites, s.base.Scheme)
+			}
+		}
 		if err := es.Close(); err != nil {
 			return nil, err
 		}
@@ -788,78 +4182,603 @@ func makeCloudStorageSink(
 
 // EmitRow implements the Sink interface.
 func (s *cloudStorageSink) EmitRow(
-	_ context.Context, table *sqlbase.TableDescriptor, _, value []byte, updated hlc.Timestamp,
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	encodedKey, value []byte,
+	updated hlc.Timestamp,
+) error {
+	if s.files == nil {
+		return errors.New(`cannot EmitRow on a closed sink`)
+	}
+
+	// localResolvedTs is a guarantee that any rows <= to it are duplicates and
+	// we can drop them. This compares the logical part of the timestamps too,
+	// unlike the bucketing below.
+	//
+	// TODO(dan): We could actually move this higher up the changefeed stack and
+	// do it for all sinks.
+	if !s.localResolvedTs.Less(updated) {
+		return nil
+	}
+
+	if s.descriptorEncoder != nil {
+		if err := s.maybeWriteDescriptor(ctx, table); err != nil {
+			return err
+		}
+	}
+
+	// Intentionally throw away the logical part of the timestamp for bucketing.
+	key := cloudStorageSinkKey{
+		Bucket:   updated.GoTime().Truncate(s.cfg.bucketSize),
+		Topic:    table.Name,
+		SchemaID: table.Version,
+		SinkID:   s.sinkID,
+		Ext:      s.ext,
+	}
+	if s.cfg.partitionColumn != `` {
+		var err error
+		key.Partition, err = cloudStoragePartition(table, s.cfg.partitionColumn, encodedKey, value)
+		if err != nil {
+			return err
+		}
+	}
+	file := s.files[key]
+	if file == nil {
+		file = s.newFile(0 /* idx */)
+		s.files[key] = file
+	}
+
+	// TODO(dan): Memory monitoring for this
+	record := value
+	if s.cfg.keyOnly {
+		record = encodedKey
+	} else if s.cfg.metadata {
+		var err error
+		if record, err = withCloudStorageRecordMetadata(value, updated, s.nodeID); err != nil {
+			return err
+		}
+	}
+	size := file.size
+	if size == 0 {
+		file.opened = s.now()
+	}
+	var err error
+	if s.leadingDelimiter == nil {
+		err = s.writeRecordFn(file, record)
+	} else {
+		if file.size > 0 {
+			_, err = file.Write(s.leadingDelimiter)
+		}
+		if err == nil {
+			_, err = file.Write(record)
+		}
+	}
+	s.bufferedBytes += file.size - size
+	if err != nil {
+		return err
+	}
+	if err := file.maybeSpill(s.cfg.spillDir, s.cfg.spillThreshold); err != nil {
+		return err
+	}
+	if s.cfg.flushBytes > 0 && s.bufferedBytes > s.cfg.flushBytes {
+		return s.writeBufferedFiles(ctx, nil /* include */)
+	}
+	return nil
+}
+
+// cloudStorageRecordMetadata is what `metadata=true` adds to each record of a
+// cloud storage sink, for auditing where and when exactly each change came
+// from. The updated option's timestamp is the same MVCC timestamp, but as a
+// decimal, which doesn't make the logical part obvious.
+type cloudStorageRecordMetadata struct {
+	Wall    int64          `json:"wall"`
+	Logical int32          `json:"logical"`
+	NodeID  roachpb.NodeID `json:"node_id"`
+}
+
+// withCloudStorageRecordMetadata returns the JSON value of a row with its
+// cloudStorageRecordMetadata added under `metadata` in the `__crdb__` object,
+// next to the rest of the row's metadata, like
+// `{"__crdb__":{"metadata":{"wall":1,"logical":0,"node_id":1}},"a":1}`. The
+// result is re-encoded, so it's compact and its fields are sorted.
+func withCloudStorageRecordMetadata(
+	value []byte, updated hlc.Timestamp, nodeID roachpb.NodeID,
+) ([]byte, error) {
+	var fields map[string]gojson.RawMessage
+	if err := gojson.Unmarshal(value, &fields); err != nil {
+		return nil, errors.Wrapf(err, `decoding value for %s`, sinkParamMetadata)
+	}
+	// The rest of the metadata, like the previous version of the row with
+	// `envelope=diff`, is kept as is.
+	var meta map[string]gojson.RawMessage
+	if raw, ok := fields[jsonMetaSentinel]; ok {
+		if err := gojson.Unmarshal(raw, &meta); err != nil {
+			return nil, errors.Wrapf(err, `decoding value for %s`, sinkParamMetadata)
+		}
+	}
+	if meta == nil {
+		meta = make(map[string]gojson.RawMessage)
+	}
+	var err error
+	if meta[`metadata`], err = gojson.Marshal(cloudStorageRecordMetadata{
+		Wall: updated.WallTime, Logical: updated.Logical, NodeID: nodeID,
+	}); err != nil {
+		return nil, err
+	}
+	metaRaw, err := gojson.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		fields = make(map[string]gojson.RawMessage)
+	}
+	fields[jsonMetaSentinel] = metaRaw
+	return gojson.Marshal(fields)
+}
+
+// cloudStorageResolvedBucket returns the time that the resolved timestamp file
+// for the given resolved timestamp is named after. Resolving some given time
+// means that everything in the _previous_ bucket is finished, so by default
+// that's the last nanosecond of the previous bucket. If bucketStart is set,
+// it's the start of the previous bucket instead, which is easier to read; the
+// file still sorts after every data file of that bucket, since those are named
+// `<bucket>-...`, as long as the suffix sorts after `-`.
+//
+// The bucket containing the resolved timestamp is never complete, even when
+// the timestamp is on the last nanosecond of it, because rows may still come
+// in at that walltime with a higher logical time.
+func cloudStorageResolvedBucket(
+	resolved hlc.Timestamp, bucketSize time.Duration, bucketStart bool,
+) time.Time {
+	if bucketStart {
+		return resolved.GoTime().Truncate(bucketSize).Add(-bucketSize)
+	}
+	return resolved.GoTime().Truncate(bucketSize).Add(-time.Nanosecond)
+}
+
+// writeBufferedFiles writes out every data file being buffered for which
+// include returns true (or every one, if include is nil) and starts a new,
+// empty one with the next file_idx in its place. Unlike Flush, it doesn't
+// garbage collect anything, it only moves the data from the sink to cloud
+// storage.
+func (s *cloudStorageSink) writeBufferedFiles(
+	ctx context.Context, include func(cloudStorageSinkKey) bool,
+) error {
+	var stats cloudStorageWriteStats
+	var toWrite []cloudStorageDataFile
+	for key, file := range s.files {
+		if file.size == 0 || (include != nil && !include(key)) {
+			continue
+		}
+		toWrite = append(toWrite, cloudStorageDataFile{
+			key: key, filename: key.Filename(file.idx), file: file,
+		})
+	}
+	if err := s.writeDataFiles(ctx, toWrite, &stats); err != nil {
+		return err
+	}
+	for _, w := range toWrite {
+		key, filename, file := w.key, w.filename, w.file
+		if s.writtenEntries != nil {
+			s.writtenEntries[key.Bucket] = append(s.writtenEntries[key.Bucket],
+				cloudStorageManifestEntry{Filename: filename, Bytes: file.size, CRC32C: file.crc32c})
+		}
+		s.noteWrittenFile(key.Bucket, filename)
+		s.bufferedBytes -= file.size
+		if err := file.Close(); err != nil {
+			log.Warningf(ctx, `failed to clean up %s: %s`, filename, err)
+		}
+		s.files[key] = s.newFile(file.idx + 1)
+	}
+	stats.maybeLog(ctx, `early write`)
+	return nil
+}
+
+// newFile returns an empty data file with the given file_idx, which uses the
+// buffer pool if there is one.
+func (s *cloudStorageSink) newFile(idx int) *cloudStorageSinkFile {
+	return &cloudStorageSinkFile{idx: idx, buf: chunkedBuffer{pool: s.bufferPool}}
+}
+
+// cloudStorageDataFile is a buffered data file and the name it's written out
+// under.
+type cloudStorageDataFile struct {
+	key      cloudStorageSinkKey
+	filename string
+	file     *cloudStorageSinkFile
+}
+
+// SetBackfillMode implements the BackfillModeSetter interface. In backfill
+// mode, data files are written out with the `backfill_write_concurrency` sink
+// param instead of `write_concurrency`.
+func (s *cloudStorageSink) SetBackfillMode(backfill bool) {
+	s.backfill = backfill
+}
+
+// SetMetrics implements the MetricsSetter interface. The node is recorded in
+// the metadata of each record, with the `metadata` sink param.
+func (s *cloudStorageSink) SetMetrics(metrics *Metrics, nodeID roachpb.NodeID) {
+	s.metrics = metrics
+	s.nodeID = nodeID
+}
+
+// writeConcurrency returns the number of data files to write out at once.
+func (s *cloudStorageSink) writeConcurrency() int {
+	concurrency := s.cfg.writeConcurrency
+	if s.backfill {
+		concurrency = s.cfg.backfillWriteConcurrency
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return concurrency
+}
+
+// writeDataFiles writes out the given data files, up to writeConcurrency of
+// them at once, and returns the first error. All of them have been written
+// when it returns nil, in no particular order.
+func (s *cloudStorageSink) writeDataFiles(
+	ctx context.Context, files []cloudStorageDataFile, stats *cloudStorageWriteStats,
+) error {
+	concurrency := s.writeConcurrency()
+	if concurrency == 1 || len(files) <= 1 {
+		for _, f := range files {
+			elapsed, err := s.writeDataFile(ctx, f.filename, f.file)
+			if err != nil {
+				return err
+			}
+			stats.record(f.filename, f.file.size, elapsed)
+		}
+		return nil
+	}
+
+	if concurrency > len(files) {
+		concurrency = len(files)
+	}
+	work := make(chan cloudStorageDataFile, len(files))
+	for _, f := range files {
+		work <- f
+	}
+	close(work)
+	var statsMu syncutil.Mutex
+	return ctxgroup.GroupWorkers(ctx, concurrency, func(ctx context.Context) error {
+		for f := range work {
+			// Stop early once another worker has failed.
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			elapsed, err := s.writeDataFile(ctx, f.filename, f.file)
+			if err != nil {
+				return err
+			}
+			statsMu.Lock()
+			stats.record(f.filename, f.file.size, elapsed)
+			statsMu.Unlock()
+		}
+		return nil
+	})
+}
+
+// writeDataFile writes out a buffered data file and returns how long it took.
+// The size and time are recorded in the metrics, if there are any. It's safe
+// to call concurrently for different files.
+func (s *cloudStorageSink) writeDataFile(
+	ctx context.Context, filename string, file *cloudStorageSinkFile,
+) (time.Duration, error) {
+	start := timeutil.Now()
+	contents, err := file.Reader()
+	if err != nil {
+		return 0, err
+	}
+	if err := s.writeFile(ctx, filename, contents); err != nil {
+		return 0, err
+	}
+	elapsed := timeutil.Since(start)
+	file.writtenSize = file.size
+	if log.V(2) {
+		log.Infof(ctx, "wrote %s (%d bytes) in %s", filename, file.size, elapsed)
+	}
+	if s.metrics != nil {
+		s.metrics.CloudStorageFileBytesHist.RecordValue(file.size)
+		s.metrics.CloudStorageFileWriteNanosHist.RecordValue(elapsed.Nanoseconds())
+	}
+	return elapsed, nil
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *cloudStorageSink) EmitResolvedTimestamp(
+	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
 ) error {
 	if s.files == nil {
 		return errors.New(`cannot EmitRow on a closed sink`)
 	}
-
-	// localResolvedTs is a guarantee that any rows <= to it are duplicates and
-	// we can drop them.
-	//
-	// TODO(dan): We could actually move this higher up the changefeed stack and
-	// do it for all sinks.
-	if !s.localResolvedTs.Less(updated) {
-		return nil
+	if s.cfg.resolvedGranularity == cloudStorageResolvedGranularityTopic {
+		return nil
+	}
+	// The files completed since the last resolved timestamp file stay in
+	// listedFiles for the next one.
+	if s.tooSoonForResolved(s.lastResolvedWritten, resolved) {
+		return nil
+	}
+
+	var payload []byte
+	var err error
+	if s.cfg.resolvedGranularity == cloudStorageResolvedGranularityCombined {
+		payload, err = encodeCloudStorageCombinedResolved(resolved, s.combinedTopicResolved)
+	} else {
+		var noTopic string
+		payload, err = encoder.EncodeResolvedTimestamp(noTopic, resolved)
+	}
+	if err != nil {
+		return err
+	}
+	// Don't need to copy payload because we never buffer it anywhere.
+	if s.cfg.listFiles {
+		var buf bytes.Buffer
+		buf.Write(payload)
+		buf.WriteByte('\n')
+		for _, filename := range s.listedFiles {
+			buf.WriteString(filename)
+			buf.WriteByte('\n')
+		}
+		payload = buf.Bytes()
+	}
+
+	es, err := exportStorageFromURI(ctx, s.base.String(), s.settings)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := es.Close(); err != nil {
+			log.Warningf(ctx, `failed to close %s, resources may have leaked: %s`, s.base.String(), err)
+		}
+	}()
+
+	resolvedBucket := cloudStorageResolvedBucket(resolved, s.cfg.bucketSize, s.cfg.resolvedBucketStart)
+	name := cloudStorageFormatBucket(resolvedBucket) + s.resolvedSuffix
+	if log.V(1) {
+		log.Info(ctx, "writing ", name)
+	}
+
+	if err := s.upload(ctx, name, bytes.NewReader(payload), func(
+		ctx context.Context, contents io.ReadSeeker,
+	) error {
+		return es.WriteFile(ctx, name, contents)
+	}); err != nil {
+		return err
+	}
+	s.listedFiles = nil
+	s.lastResolvedWritten = resolved
+	return nil
+}
+
+// tooSoonForResolved returns whether a resolved timestamp file for resolved
+// would be less than the `min_resolved_interval` sink param past the last one,
+// written for last, if any. Dropping it doesn't break the guarantee that a
+// resolved timestamp file gives, it only makes the files less frequent.
+func (s *cloudStorageSink) tooSoonForResolved(last, resolved hlc.Timestamp) bool {
+	return s.cfg.minResolvedInterval > 0 && last != (hlc.Timestamp{}) &&
+		resolved.GoTime().Sub(last.GoTime()) < s.cfg.minResolvedInterval
+}
+
+// CombinesTopicResolved implements the TopicResolvedCombiner interface. It's
+// true with `resolved_granularity=combined`.
+func (s *cloudStorageSink) CombinesTopicResolved() bool {
+	return s.cfg.resolvedGranularity == cloudStorageResolvedGranularityCombined
+}
+
+// SetCombinedTopicResolved implements the TopicResolvedCombiner interface. The
+// resolved timestamps are written to the next resolved timestamp file.
+func (s *cloudStorageSink) SetCombinedTopicResolved(topicResolved map[string]hlc.Timestamp) {
+	s.combinedTopicResolved = topicResolved
+}
+
+// EmitsTopicResolved implements the TopicResolvedEmitter interface. It's true
+// with `resolved_granularity=topic` or `resolved_granularity=both`.
+func (s *cloudStorageSink) EmitsTopicResolved() bool {
+	switch s.cfg.resolvedGranularity {
+	case cloudStorageResolvedGranularityTopic, cloudStorageResolvedGranularityBoth:
+		return true
+	}
+	return false
+}
+
+// EmitTopicResolvedTimestamp implements the TopicResolvedEmitter interface. It
+// writes the resolved timestamp file of one topic.
+func (s *cloudStorageSink) EmitTopicResolvedTimestamp(
+	ctx context.Context, encoder Encoder, topic string, resolved hlc.Timestamp,
+) error {
+	if s.files == nil {
+		return errors.New(`cannot EmitResolvedTimestamp on a closed sink`)
+	}
+	if s.tooSoonForResolved(s.lastTopicResolvedWritten[topic], resolved) {
+		return nil
+	}
+	payload, err := encoder.EncodeResolvedTimestamp(topic, resolved)
+	if err != nil {
+		return err
+	}
+	resolvedBucket := cloudStorageResolvedBucket(resolved, s.cfg.bucketSize, s.cfg.resolvedBucketStart)
+	name := topic + `-` + cloudStorageFormatBucket(resolvedBucket) + s.resolvedSuffix
+	if log.V(1) {
+		log.Info(ctx, "writing ", name)
+	}
+	if err := s.writeFile(ctx, name, bytes.NewReader(payload)); err != nil {
+		return err
+	}
+	if s.lastTopicResolvedWritten == nil {
+		s.lastTopicResolvedWritten = make(map[string]hlc.Timestamp)
 	}
+	s.lastTopicResolvedWritten[topic] = resolved
+	return nil
+}
 
-	// Intentionally throw away the logical part of the timestamp for bucketing.
-	key := cloudStorageSinkKey{
-		Bucket:   updated.GoTime().Truncate(s.bucketSize),
-		Topic:    table.Name,
-		SchemaID: table.Version,
-		SinkID:   s.sinkID,
-		Ext:      s.ext,
+// noteWrittenFile records that a data file of the given bucket has been written
+// out, if the `resolved_file_listing` sink param is set. A file that's written
+// out again with more rows keeps its name, so it's only recorded once. Files
+// of a complete bucket, which Flush writes out again until they're garbage
+// collected, were already recorded.
+func (s *cloudStorageSink) noteWrittenFile(bucket time.Time, filename string) {
+	if s.incompleteFiles == nil || !s.completedThrough.Before(bucket.Add(s.cfg.bucketSize)) {
+		return
 	}
-	file := s.files[key]
-	if file == nil {
-		// We could pool the bytes.Buffers if necessary, but we'd need to be
-		// careful to bound the size of the memory held by the pool.
-		file = &bytes.Buffer{}
-		s.files[key] = file
+	filenames, ok := s.incompleteFiles[bucket]
+	if !ok {
+		filenames = make(map[string]struct{})
+		s.incompleteFiles[bucket] = filenames
 	}
+	filenames[filename] = struct{}{}
+}
 
-	// TODO(dan): Memory monitoring for this
-	if _, err := file.Write(value); err != nil {
-		return err
+// TakeCompletedFiles implements the CompletedFilesTracker interface. A
+// bucket is completed by a Flush.
+func (s *cloudStorageSink) TakeCompletedFiles() []string {
+	filenames := s.completedFiles
+	sort.Strings(filenames)
+	s.completedFiles = nil
+	return filenames
+}
+
+// NoteCompletedFile implements the CompletedFilesTracker interface. The file
+// is listed in the next resolved timestamp file. It's a no-op unless the
+// `resolved_file_listing` sink param is set.
+func (s *cloudStorageSink) NoteCompletedFile(filename string) {
+	if !s.cfg.listFiles {
+		return
 	}
-	return s.recordDelimFn(file)
+	s.listedFiles = append(s.listedFiles, filename)
 }
 
-// EmitResolvedTimestamp implements the Sink interface.
-func (s *cloudStorageSink) EmitResolvedTimestamp(
-	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
+// EmitSchemaChange implements the Sink interface.
+func (s *cloudStorageSink) EmitSchemaChange(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	oldVersion, newVersion sqlbase.DescriptorVersion,
 ) error {
 	if s.files == nil {
-		return errors.New(`cannot EmitRow on a closed sink`)
+		return errors.New(`cannot EmitSchemaChange on a closed sink`)
 	}
-
-	var noTopic string
-	payload, err := encoder.EncodeResolvedTimestamp(noTopic, resolved)
+	payload, err := encodeSchemaChangeMarker(table, oldVersion, newVersion)
 	if err != nil {
 		return err
 	}
-	// Don't need to copy payload because we never buffer it anywhere.
+	name := cloudStorageSchemaFilename(table.Name, newVersion, `.SCHEMACHANGE`)
+	if log.V(1) {
+		log.Info(ctx, "writing ", name)
+	}
+	return s.writeFile(ctx, name, bytes.NewReader(payload))
+}
+
+const (
+	cloudStorageFeedStartSuffix = `.FEEDSTART`
+	cloudStorageFeedEndSuffix   = `.FEEDEND`
+)
 
-	es, err := storageccl.ExportStorageFromURI(ctx, s.base.String(), s.settings)
+// EmitFeedLifecycle implements the LifecycleEmitter interface by writing a
+// `<timestamp>.FEEDSTART` or `<timestamp>.FEEDEND` marker file. It's named
+// like the resolved timestamp file for ts, so it comes with the same
+// guarantee about the files that sort before it.
+func (s *cloudStorageSink) EmitFeedLifecycle(
+	ctx context.Context, phase feedPhase, ts hlc.Timestamp,
+) error {
+	if s.files == nil {
+		return errors.New(`cannot EmitFeedLifecycle on a closed sink`)
+	}
+	payload, err := encodeFeedLifecycleMarker(phase, ts)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := es.Close(); err != nil {
-			log.Warningf(ctx, `failed to close %s, resources may have leaked: %s`, s.base.String(), err)
-		}
-	}()
+	suffix := cloudStorageFeedStartSuffix
+	if phase == feedPhaseEnd {
+		suffix = cloudStorageFeedEndSuffix
+	}
+	bucket := cloudStorageResolvedBucket(ts, s.cfg.bucketSize, s.cfg.resolvedBucketStart)
+	name := cloudStorageFormatBucket(bucket) + suffix
+	if log.V(1) {
+		log.Info(ctx, "writing ", name)
+	}
+	return s.writeFile(ctx, name, bytes.NewReader(payload))
+}
 
-	// resolving some given time means that every in the _previous_ bucket is
-	// finished.
-	resolvedBucket := resolved.GoTime().Truncate(s.bucketSize).Add(-time.Nanosecond)
-	name := cloudStorageFormatBucket(resolvedBucket) + `.RESOLVED`
+// maybeWriteDescriptor writes the descriptor file of a table version, named
+// `<topic>-<schema_id>.DESCRIPTOR`, the first time a row of it is emitted, so
+// it's there before any data file that needs it.
+func (s *cloudStorageSink) maybeWriteDescriptor(
+	ctx context.Context, table *sqlbase.TableDescriptor,
+) error {
+	key := makeTableIDAndVersion(table.ID, table.Version)
+	if _, ok := s.writtenDescriptors[key]; ok {
+		return nil
+	}
+	payload, err := s.descriptorEncoder.EncodeDescriptor(table)
+	if err != nil {
+		return err
+	}
+	name := cloudStorageSchemaFilename(table.Name, table.Version, `.DESCRIPTOR`)
 	if log.V(1) {
 		log.Info(ctx, "writing ", name)
 	}
+	if err := s.writeFile(ctx, name, bytes.NewReader(payload)); err != nil {
+		return err
+	}
+	s.writtenDescriptors[key] = struct{}{}
+	return nil
+}
+
+// delimitedFileFormat returns the file extension and record writer for files of
+// the given kind of records, such as `json`, separated as the
+// `record_separator` sink param says.
+func delimitedFileFormat(
+	kind, recordSeparator string,
+) (string, func(io.Writer, []byte) error, error) {
+	delim, err := cloudStorageRecordDelimiter(recordSeparator)
+	if err != nil {
+		return ``, nil, err
+	}
+	if delim == nil {
+		return `.lp` + kind, writeLengthPrefixedRecord, nil
+	}
+	return `.nd` + kind, makeDelimitedRecordWriter(delim), nil
+}
+
+// cloudStorageRecordDelimiter returns the delimiter that follows each record
+// as the `record_separator` sink param says, or nil if records are length
+// prefixed instead.
+func cloudStorageRecordDelimiter(recordSeparator string) ([]byte, error) {
+	switch recordSeparator {
+	case ``, cloudStorageRecordSeparatorLF:
+		return []byte{'\n'}, nil
+	case cloudStorageRecordSeparatorCRLF:
+		return []byte{'\r', '\n'}, nil
+	case cloudStorageRecordSeparatorLengthPrefixed:
+		return nil, nil
+	default:
+		return nil, errors.Errorf(`unknown %s: %s`, sinkParamRecordSeparator, recordSeparator)
+	}
+}
+
+// makeDelimitedRecordWriter returns a function that writes a record followed by
+// the given delimiter.
+func makeDelimitedRecordWriter(delim []byte) func(io.Writer, []byte) error {
+	return func(w io.Writer, record []byte) error {
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+		_, err := w.Write(delim)
+		return err
+	}
+}
 
-	return es.WriteFile(ctx, name, bytes.NewReader(payload))
+// writeLengthPrefixedRecord writes a record preceded by its length, encoded as
+// a 4-byte big-endian integer.
+func writeLengthPrefixedRecord(w io.Writer, record []byte) error {
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(len(record)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(record)
+	return err
 }
 
 // Flush implements the Sink interface.
@@ -871,7 +4790,25 @@ func (s *cloudStorageSink) Flush(ctx context.Context, ts hlc.Timestamp) error {
 		s.localResolvedTs = ts
 	}
 
+	// The files in buckets that begin before ts are all written out below.
+	// Of the rest, the ones that have been buffered for too long are written
+	// out early.
+	if s.cfg.maxFileAge > 0 {
+		openedBefore := s.now().Add(-s.cfg.maxFileAge)
+		if err := s.writeBufferedFiles(ctx, func(key cloudStorageSinkKey) bool {
+			return !key.Bucket.Before(ts.GoTime()) && s.files[key].opened.Before(openedBefore)
+		}); err != nil {
+			return err
+		}
+	}
+
+	var stats cloudStorageWriteStats
+	var toWrite []cloudStorageDataFile
 	var gcKeys []cloudStorageSinkKey
+	var manifests map[time.Time][]cloudStorageManifestEntry
+	if s.cfg.writeManifest {
+		manifests = make(map[time.Time][]cloudStorageManifestEntry)
+	}
 	for key, file := range s.files {
 		// Any files where the bucket begin is `>= ts` don't need to be flushed
 		// because of the Flush contract w.r.t. `ts`. (Bucket begin time is
@@ -880,43 +4817,298 @@ func (s *cloudStorageSink) Flush(ctx context.Context, ts hlc.Timestamp) error {
 			continue
 		}
 
-		// TODO(dan): These files should be further subdivided for three
-		// reasons. 1) we could always gc anything we flush and later write a
-		// followup bucket subdivion if needed 2) very large bucket sizes could
-		// mean very large files, which are unwieldy once written 3) smooth
-		// and/or control memory usage of the sink.
-		filename := key.Filename()
-		if log.V(1) {
-			log.Info(ctx, "writing ", filename)
-		}
-		if err := s.writeFile(ctx, filename, file); err != nil {
-			return err
+		// A file is left empty when its contents were written out by
+		// writeBufferedFiles and nothing has been added to it since.
+		filename := key.Filename(file.idx)
+		if file.size > 0 {
+			if !s.cfg.idempotentFlush || file.writtenSize != file.size {
+				toWrite = append(toWrite, cloudStorageDataFile{key: key, filename: filename, file: file})
+			}
+			if manifests != nil {
+				manifests[key.Bucket] = append(manifests[key.Bucket], cloudStorageManifestEntry{
+					Filename: filename,
+					Bytes:    file.size,
+					CRC32C:   file.crc32c,
+				})
+			}
 		}
 
 		// If the bucket end is `<= ts`, we'll never see another _previously
 		// unseen_ row for this bucket. We drop any future such rows so that it
 		// can be cleaned up.
-		if end := key.Bucket.Add(s.bucketSize); ts.GoTime().After(end) {
+		if end := key.Bucket.Add(s.cfg.bucketSize); ts.GoTime().After(end) {
 			gcKeys = append(gcKeys, key)
 		} else {
 			if log.V(2) {
-				log.Infof(ctx, "wrote %s but was not eligible for gc", filename)
+				log.Infof(ctx, "%s is not eligible for gc", filename)
 			}
 		}
 	}
+	// Write the files in filename order, so that which of them a Flush that
+	// fails partway through got to is predictable.
+	sort.Slice(toWrite, func(i, j int) bool { return toWrite[i].filename < toWrite[j].filename })
+	if err := s.writeDataFiles(ctx, toWrite, &stats); err != nil {
+		return err
+	}
+	stats.maybeLog(ctx, `flush`)
+	for _, w := range toWrite {
+		s.noteWrittenFile(w.key.Bucket, w.filename)
+	}
+	// A bucket is complete once ts is at or past its end, see
+	// cloudStorageResolvedBucket.
+	if s.completedThrough.Before(ts.GoTime()) {
+		s.completedThrough = ts.GoTime()
+	}
+	for bucket, filenames := range s.incompleteFiles {
+		if ts.GoTime().Before(bucket.Add(s.cfg.bucketSize)) {
+			continue
+		}
+		for filename := range filenames {
+			s.completedFiles = append(s.completedFiles, filename)
+		}
+		delete(s.incompleteFiles, bucket)
+	}
 	for _, key := range gcKeys {
+		file := s.files[key]
+		s.bufferedBytes -= file.size
+		if err := file.Close(); err != nil {
+			log.Warningf(ctx, `failed to clean up %s: %s`, key.Filename(file.idx), err)
+		}
 		delete(s.files, key)
 	}
+	// The manifest for a bucket lists the files written out early by
+	// writeBufferedFiles too. Once the bucket can't get any more rows, its
+	// manifest is final and they don't need to be remembered.
+	for bucket, entries := range s.writtenEntries {
+		if !bucket.Before(ts.GoTime()) {
+			continue
+		}
+		manifests[bucket] = append(manifests[bucket], entries...)
+		if end := bucket.Add(s.cfg.bucketSize); ts.GoTime().After(end) {
+			delete(s.writtenEntries, bucket)
+		}
+	}
+
+	// Manifests are only written once every data file above has been written
+	// successfully, so that a manifest always describes complete data. Flush
+	// returns before the changefeed is allowed to write the RESOLVED file
+	// covering these buckets, which gives the data -> manifest -> resolved
+	// ordering.
+	for bucket, entries := range manifests {
+		if err := s.writeManifest(ctx, bucket, entries); err != nil {
+			return err
+		}
+	}
+
+	// Everything at or below localResolvedTs has now been written, so it's safe
+	// to record that a restarted sink can skip those rows.
+	if s.stateFilename != `` && s.persistedResolvedTs.Less(s.localResolvedTs) {
+		contents, err := gojson.Marshal(s.localResolvedTs)
+		if err != nil {
+			return err
+		}
+		if err := s.writeFile(ctx, s.stateFilename, bytes.NewReader(contents)); err != nil {
+			return err
+		}
+		s.persistedResolvedTs = s.localResolvedTs
+	}
 
 	return nil
 }
 
+// FlushTable implements the TableFlusher interface. It writes out the files of
+// the given table in buckets that begin before ts. Because the other tables
+// aren't flushed, localResolvedTs isn't advanced and nothing is garbage
+// collected, that's left to the next Flush.
+func (s *cloudStorageSink) FlushTable(
+	ctx context.Context, tableName string, ts hlc.Timestamp,
+) error {
+	if s.files == nil {
+		return errors.New(`cannot Flush on a closed sink`)
+	}
+	return s.writeBufferedFiles(ctx, func(key cloudStorageSinkKey) bool {
+		return key.Topic == tableName && key.Bucket.Before(ts.GoTime())
+	})
+}
+
+// ResumeFromState implements the StateResumer interface. It makes the sink
+// persist the timestamp it has flushed up to, and loads any timestamp
+// persisted by a previous incarnation of it. It's a no-op unless the `sink_id`
+// sink param is set.
+//
+// The persisted timestamp is the resolved timestamp of the watched spans, so
+// it's only meaningful for that exact set of spans. The state file is named
+// `<sink_id>-<hash of spans>.STATE`, so that if the spans are assigned
+// differently after a restart, no state is found and nothing is skipped.
+func (s *cloudStorageSink) ResumeFromState(ctx context.Context, spans []roachpb.Span) error {
+	if s.cfg.stateID == `` {
+		return nil
+	}
+	h := fnv.New64a()
+	for _, span := range spans {
+		_, _ = h.Write(span.Key)
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write(span.EndKey)
+		_, _ = h.Write([]byte{0})
+	}
+	s.stateFilename = fmt.Sprintf(`%s-%016x.STATE`, s.cfg.stateID, h.Sum64())
+
+	u := *s.base
+	u.Path = filepath.Join(u.Path, s.stateFilename)
+	es, err := exportStorageFromURI(ctx, u.String(), s.settings)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := es.Close(); err != nil {
+			log.Warningf(ctx, `failed to close %s, resources may have leaked: %s`, s.stateFilename, err)
+		}
+	}()
+	r, err := es.ReadFile(ctx, ``)
+	if err != nil {
+		// ExportStorage doesn't distinguish a missing file from other errors.
+		// Either way, starting without the state is safe, it only means
+		// duplicates.
+		log.Infof(ctx, `not resuming from %s: %v`, s.stateFilename, err)
+		return nil
+	}
+	defer r.Close()
+	var persisted hlc.Timestamp
+	if err := gojson.NewDecoder(r).Decode(&persisted); err != nil {
+		return errors.Wrapf(err, `decoding %s`, s.stateFilename)
+	}
+	log.Infof(ctx, `resuming from %s at %s`, s.stateFilename, persisted)
+	s.persistedResolvedTs = persisted
+	if s.localResolvedTs.Less(persisted) {
+		s.localResolvedTs = persisted
+	}
+	return nil
+}
+
+// cloudStorageManifestEntry describes one data file written by a Flush.
+type cloudStorageManifestEntry struct {
+	Filename string `json:"filename"`
+	Bytes    int64  `json:"bytes"`
+	CRC32C   uint32 `json:"crc32c"`
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// writeManifest writes `<bucket>-<uniquer>.MANIFEST`, listing the data files
+// written for the bucket by this sink. The uniquer keeps the sinks on
+// different nodes from overwriting each other's manifests.
+func (s *cloudStorageSink) writeManifest(
+	ctx context.Context, bucket time.Time, entries []cloudStorageManifestEntry,
+) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Filename < entries[j].Filename })
+	contents, err := gojson.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf(`%s-%s.MANIFEST`, cloudStorageFormatBucket(bucket), s.sinkID)
+	if log.V(1) {
+		log.Info(ctx, "writing ", name)
+	}
+	return s.writeFile(ctx, name, bytes.NewReader(contents))
+}
+
+// cloudStorageUploadRetryOpts is how often cloudStorageSink retries writing a
+// file. How many times is the `upload_max_retries` sink param.
+var cloudStorageUploadRetryOpts = retry.Options{
+	InitialBackoff:      100 * time.Millisecond,
+	MaxBackoff:          5 * time.Second,
+	Multiplier:          2,
+	RandomizationFactor: 0.5,
+}
+
+// upload runs write, which writes the named file with the given contents,
+// retrying it with jittered backoff up to the `upload_max_retries` sink param
+// times. Each attempt starts from the beginning of the contents and, if the
+// `upload_timeout` sink param is set, its context is canceled once that has
+// passed, which the storage layer's requests honor. If the last attempt timed
+// out, the error is a retryableSinkError, so a stuck upload restarts the
+// changefeed instead of wedging its flush. Any other error is returned as is,
+// as before.
+func (s *cloudStorageSink) upload(
+	ctx context.Context,
+	name string,
+	contents io.ReadSeeker,
+	write func(context.Context, io.ReadSeeker) error,
+) error {
+	attempt := func() (timedOut bool, err error) {
+		if _, err := contents.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		if s.cfg.uploadTimeout == 0 {
+			return false, write(ctx, contents)
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, s.cfg.uploadTimeout)
+		defer cancel()
+		err = write(attemptCtx, contents)
+		return err != nil && attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil, err
+	}
+
+	var timedOut bool
+	var err error
+	if s.cfg.uploadMaxRetries == 0 {
+		// A retry.Options with MaxRetries of 0 retries forever.
+		timedOut, err = attempt()
+	} else {
+		opts := cloudStorageUploadRetryOpts
+		opts.MaxRetries = s.cfg.uploadMaxRetries
+		for r := retry.StartWithCtx(ctx, opts); r.Next(); {
+			if timedOut, err = attempt(); err == nil {
+				return nil
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			log.Warningf(ctx, `retrying write of %s: %v`, name, err)
+		}
+	}
+	if timedOut {
+		return &retryableSinkError{cause: errors.Wrapf(err, `writing %s timed out after %s`,
+			name, s.cfg.uploadTimeout)}
+	}
+	return err
+}
+
+// writeFile writes the named file, under the sink's base URI, bounded by the
+// `upload_timeout` and `upload_max_retries` sink params. See upload.
 func (s *cloudStorageSink) writeFile(
-	ctx context.Context, name string, contents *bytes.Buffer,
+	ctx context.Context, name string, contents io.ReadSeeker,
+) error {
+	return s.upload(ctx, name, contents, func(ctx context.Context, contents io.ReadSeeker) error {
+		return s.writeFileOnce(ctx, name, contents)
+	})
+}
+
+func (s *cloudStorageSink) writeFileOnce(
+	ctx context.Context, name string, contents io.ReadSeeker,
 ) error {
+	if s.renameFiles {
+		return s.writeFileAtomic(ctx, name, contents)
+	}
 	u := *s.base
 	u.Path = filepath.Join(u.Path, name)
-	es, err := storageccl.ExportStorageFromURI(ctx, u.String(), s.settings)
+	es, err := exportStorageFromURI(ctx, u.String(), s.settings)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := es.Close(); err != nil {
+			log.Warningf(ctx, `failed to close %s, resources may have leaked: %s`, name, err)
+		}
+	}()
+	return es.WriteFile(ctx, ``, contents)
+}
+
+// writeFileAtomic writes the file under a temporary name and then renames it,
+// so that it's never visible under its final name until it's complete.
+func (s *cloudStorageSink) writeFileAtomic(
+	ctx context.Context, name string, contents io.ReadSeeker,
+) error {
+	es, err := exportStorageFromURI(ctx, s.base.String(), s.settings)
 	if err != nil {
 		return err
 	}
@@ -925,14 +5117,68 @@ func (s *cloudStorageSink) writeFile(
 			log.Warningf(ctx, `failed to close %s, resources may have leaked: %s`, name, err)
 		}
 	}()
-	r := bytes.NewReader(contents.Bytes())
-	return es.WriteFile(ctx, ``, r)
+	tmpName := name + cloudStorageTempSuffix
+	if err := es.WriteFile(ctx, tmpName, contents); err != nil {
+		return err
+	}
+	return es.(storageccl.ExportStorageRenamer).Rename(ctx, tmpName, name)
+}
+
+// Ping implements the Pinger interface by writing an empty file and deleting
+// it. The file has the temporary suffix, so readers already skip it.
+func (s *cloudStorageSink) Ping(ctx context.Context) error {
+	es, err := exportStorageFromURI(ctx, s.base.String(), s.settings)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := es.Close(); err != nil {
+			log.Warningf(ctx, `failed to close %s, resources may have leaked: %s`, s.base, err)
+		}
+	}()
+	name := `ping-` + s.sinkID + cloudStorageTempSuffix
+	if err := es.WriteFile(ctx, name, bytes.NewReader(nil)); err != nil {
+		return err
+	}
+	return es.Delete(ctx, name)
+}
+
+// Capabilities implements the Sink interface.
+func (s *cloudStorageSink) Capabilities() SinkCapabilities {
+	return cloudStorageSinkCapabilities
+}
+
+// CloseAndDrain implements the Drainer interface. It writes out every
+// buffered data file, as an early write, and then closes the sink. If they
+// can't all be written, each of them is reported by its topic and bucket.
+func (s *cloudStorageSink) CloseAndDrain(ctx context.Context) ([]MessageRef, error) {
+	var undelivered []MessageRef
+	if s.files != nil {
+		if err := s.writeBufferedFiles(ctx, nil /* include */); err != nil {
+			log.Warningf(ctx, `failed to write buffered data files before closing: %v`, err)
+			for key, file := range s.files {
+				if file.size > 0 {
+					undelivered = append(undelivered, MessageRef{Topic: key.Topic, Bucket: key.Bucket})
+				}
+			}
+		}
+	}
+	return undelivered, s.Close()
 }
 
 // Close implements the Sink interface.
 func (s *cloudStorageSink) Close() error {
+	// Any spilled files must be removed, even though they might not have been
+	// flushed, so they don't leak local disk.
+	var err error
+	for _, file := range s.files {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
 	s.files = nil
-	return nil
+	s.bufferedBytes = 0
+	return err
 }
 
 // causer matches the (unexported) interface used by Go to allow errors to wrap
@@ -956,6 +5202,120 @@ func (e retryableSinkError) Error() string {
 }
 func (e retryableSinkError) Cause() error { return e.cause }
 
+// rowSinkError is returned by a sink that can't emit one particular row, for a
+// reason that has nothing to do with the rows around it, such as the row being
+// too large for the sink. Retrying won't help, but the sink is otherwise
+// healthy, so a changefeed with a dead letter sink sends the row there instead
+// and carries on.
+type rowSinkError struct {
+	cause error
+}
+
+func (e *rowSinkError) Error() string { return e.cause.Error() }
+func (e *rowSinkError) Cause() error  { return e.cause }
+
+// isRowSinkError returns true if the supplied error, or any of its parent
+// causes, is a rowSinkError.
+func isRowSinkError(err error) bool {
+	for {
+		if _, ok := err.(*rowSinkError); ok {
+			return true
+		}
+		if e, ok := err.(causer); ok {
+			err = e.Cause()
+			continue
+		}
+		return false
+	}
+}
+
+// sinkRetryBudget bounds how many times in a row a changefeed is restarted
+// because of retryable sink errors, so that a sink that's persistently broken
+// pauses the changefeed instead of restarting it forever. Once the sink is
+// fixed, the changefeed can be resumed from where it left off. A sink is recreated
+// by every restart, so the restarts are counted by the job rather than by the
+// sink. The count is reset whenever the changefeed's high-water advances,
+// which means the sink was flushed successfully in the meantime.
+type sinkRetryBudget struct {
+	// max is the number of consecutive restarts allowed, set by the
+	// `retry_budget` sink param. Zero means there's no limit.
+	max           int
+	consecutive   int
+	lastHighWater hlc.Timestamp
+}
+
+// consumeSinkRetryBudget parses and removes the retry budget sink param from
+// q.
+func consumeSinkRetryBudget(q url.Values) (int, error) {
+	var budget int
+	if str := q.Get(sinkParamRetryBudget); str != `` {
+		var err error
+		if budget, err = strconv.Atoi(str); err != nil {
+			return 0, errors.Wrapf(err, `parsing %s`, sinkParamRetryBudget)
+		}
+		if budget < 0 {
+			return 0, errors.Errorf(`%s must be non-negative: %d`, sinkParamRetryBudget, budget)
+		}
+	}
+	q.Del(sinkParamRetryBudget)
+	return budget, nil
+}
+
+// makeSinkRetryBudget returns the retry budget for a changefeed with the given
+// sink URI and high-water.
+func makeSinkRetryBudget(sinkURI string, highWater hlc.Timestamp) (sinkRetryBudget, error) {
+	u, err := url.Parse(sinkURI)
+	if err != nil {
+		return sinkRetryBudget{}, err
+	}
+	budget, err := consumeSinkRetryBudget(u.Query())
+	if err != nil {
+		return sinkRetryBudget{}, err
+	}
+	return sinkRetryBudget{max: budget, lastHighWater: highWater}, nil
+}
+
+// onRetryableError records that the changefeed is about to be restarted
+// because of err, when its high-water is the given one. If that exhausts the
+// budget, it returns the error to pause the changefeed with.
+func (b *sinkRetryBudget) onRetryableError(err error, highWater hlc.Timestamp) error {
+	if b.lastHighWater.Less(highWater) {
+		b.consecutive = 0
+		b.lastHighWater = highWater
+	}
+	b.consecutive++
+	if b.max > 0 && b.consecutive > b.max {
+		return errors.Errorf(`giving up after %d consecutive sink failures without progress `+
+			`(%s=%d): %v`, b.consecutive, sinkParamRetryBudget, b.max, err)
+	}
+	return nil
+}
+
+// backpressureSinkError is returned by a sink that was unable to enqueue a
+// message for longer than it was configured to wait.
+type backpressureSinkError struct {
+	blocked time.Duration
+}
+
+func (e *backpressureSinkError) Error() string {
+	return fmt.Sprintf("backpressure: sink blocked for %s", e.blocked)
+}
+
+// isBackpressureSinkError returns true if the supplied error, or any of its
+// parent causes, is a backpressureSinkError.
+func isBackpressureSinkError(err error) bool {
+	for {
+		if _, ok := err.(*backpressureSinkError); ok {
+			return true
+		}
+		if e, ok := err.(causer); ok {
+			err = e.Cause()
+			continue
+		}
+		return false
+	}
+}
+
 // isRetryableSinkError returns true if the supplied error, or any of its parent
 // causes, is a retryableSinkError.
 func isRetryableSinkError(err error) bool {
@@ -0,0 +1,462 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/pkg/errors"
+)
+
+// sinkBreakerDefaultCooldown is how long a sink circuit breaker stays open if
+// the `breaker_cooldown` sink param isn't set.
+const sinkBreakerDefaultCooldown = 30 * time.Second
+
+// sinkBreakerConfig is the optional `breaker_failures` and `breaker_cooldown`
+// sink params. Zero failures means there's no breaker.
+type sinkBreakerConfig struct {
+	failures int
+	cooldown time.Duration
+}
+
+func (c sinkBreakerConfig) enabled() bool {
+	return c.failures > 0
+}
+
+// consumeSinkBreakerConfig parses and removes the circuit breaker sink params
+// from q.
+func consumeSinkBreakerConfig(q url.Values) (sinkBreakerConfig, error) {
+	cfg := sinkBreakerConfig{cooldown: sinkBreakerDefaultCooldown}
+	if str := q.Get(sinkParamBreakerFailures); str != `` {
+		failures, err := strconv.Atoi(str)
+		if err != nil {
+			return sinkBreakerConfig{}, errors.Wrapf(err, `parsing %s`, sinkParamBreakerFailures)
+		}
+		if failures <= 0 {
+			return sinkBreakerConfig{}, errors.Errorf(
+				`%s must be positive: %d`, sinkParamBreakerFailures, failures)
+		}
+		cfg.failures = failures
+	}
+	q.Del(sinkParamBreakerFailures)
+	if str := q.Get(sinkParamBreakerCooldown); str != `` {
+		if !cfg.enabled() {
+			return sinkBreakerConfig{}, errors.Errorf(
+				`%s requires %s`, sinkParamBreakerCooldown, sinkParamBreakerFailures)
+		}
+		cooldown, err := time.ParseDuration(str)
+		if err != nil {
+			return sinkBreakerConfig{}, errors.Wrapf(err, `parsing %s`, sinkParamBreakerCooldown)
+		}
+		if cooldown <= 0 {
+			return sinkBreakerConfig{}, errors.Errorf(
+				`%s must be positive: %s`, sinkParamBreakerCooldown, str)
+		}
+		cfg.cooldown = cooldown
+	}
+	q.Del(sinkParamBreakerCooldown)
+	return cfg, nil
+}
+
+// sinkBreakerState is the state of a sinkBreaker.
+type sinkBreakerState int
+
+const (
+	// sinkBreakerClosed lets every call through and counts consecutive
+	// failures.
+	sinkBreakerClosed sinkBreakerState = iota
+	// sinkBreakerOpen fails every call fast until the cooldown is over.
+	sinkBreakerOpen
+	// sinkBreakerHalfOpen lets calls through again to probe the sink, but
+	// opens again on the first failure.
+	sinkBreakerHalfOpen
+)
+
+// sinkBreaker is a circuit breaker for a sink that's failing persistently, so
+// that a changefeed whose downstream is hard down doesn't make the full round
+// trip to it on every restart. After `breaker_failures` consecutive retryable
+// errors, it opens and fails everything fast with a retryable error for
+// `breaker_cooldown`. Then it's half-open and lets calls through to probe the
+// sink: it closes once a flush succeeds and opens again if anything fails. Only
+// a successful flush resets the failures, because most sinks buffer rows, so
+// emitting them succeeds even when the downstream is down.
+//
+// A sink is recreated by every restart of a changefeed, and a retryable error
+// restarts it, so a sink never sees more than one. The breaker has to outlive
+// the sink to be useful, so the breakers are kept in a registry and shared by
+// the processors of a changefeed on a node, which guard making the sink with it
+// too, because that usually connects to the downstream. The job's resumer also
+// holds on to the breaker for as long as the job runs on its node, so that it
+// outlives the processors there, which are all closed by every restart. The
+// failures that open a breaker count against the `retry_budget` sink param like
+// any other retryable error, but the fast failures while it's open don't,
+// because they never reached the sink.
+//
+// A nil sinkBreaker lets everything through.
+type sinkBreaker struct {
+	key sinkBreakerKey
+	cfg sinkBreakerConfig
+	now func() time.Time
+
+	mu struct {
+		syncutil.Mutex
+		state    sinkBreakerState
+		failures int
+		openedAt time.Time
+		// refs is the number of processors using the breaker.
+		refs int
+	}
+}
+
+// sinkBreakerKey identifies the breaker of one changefeed.
+type sinkBreakerKey struct {
+	jobID   int64
+	sinkURI string
+}
+
+// sinkBreakers is the registry of breakers. A breaker is only kept while it's
+// used, by a processor or the job's resumer.
+var sinkBreakers = struct {
+	syncutil.Mutex
+	m map[sinkBreakerKey]*sinkBreaker
+}{m: make(map[sinkBreakerKey]*sinkBreaker)}
+
+// acquireSinkBreaker returns the breaker of the changefeed with the given job
+// and sink URI, which must be released once the processor or resumer using it
+// is done with it.
+// It's nil if the sink URI doesn't configure one or there's no job: the errors
+// of a sinkless changefeed, or of the canary sink made by CREATE CHANGEFEED,
+// are returned to the user instead of restarting anything.
+func acquireSinkBreaker(sinkURI string, jobID int64) (*sinkBreaker, error) {
+	u, err := url.Parse(sinkURI)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := consumeSinkBreakerConfig(u.Query())
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.enabled() || jobID == 0 {
+		return nil, nil
+	}
+
+	key := sinkBreakerKey{jobID: jobID, sinkURI: sinkURI}
+	sinkBreakers.Lock()
+	defer sinkBreakers.Unlock()
+	b, ok := sinkBreakers.m[key]
+	if !ok {
+		b = &sinkBreaker{key: key, cfg: cfg, now: timeutil.Now}
+		sinkBreakers.m[key] = b
+	}
+	b.mu.Lock()
+	b.mu.refs++
+	b.mu.Unlock()
+	return b, nil
+}
+
+// release releases a breaker returned by acquireSinkBreaker. The last release
+// removes it from the registry.
+func (b *sinkBreaker) release() {
+	if b == nil {
+		return
+	}
+	sinkBreakers.Lock()
+	defer sinkBreakers.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mu.refs--
+	if b.mu.refs == 0 {
+		delete(sinkBreakers.m, b.key)
+	}
+}
+
+// String used to match the errors of an open breaker when they have been
+// "flattened" into a pgerror, like retryableSinkErrorString.
+const sinkBreakerOpenErrorString = "sink circuit breaker is open"
+
+// sinkBreakerOpenError is the cause of the retryable error that an open
+// breaker fails a call with, without the call reaching the sink.
+type sinkBreakerOpenError struct {
+	failures  int
+	remaining time.Duration
+}
+
+func (e *sinkBreakerOpenError) Error() string {
+	return fmt.Sprintf(sinkBreakerOpenErrorString+` after %d consecutive failures, `+
+		`probing again in %s`, e.failures, e.remaining)
+}
+
+// isSinkBreakerOpenError returns true if the supplied error, or any of its
+// parent causes, is a sinkBreakerOpenError.
+func isSinkBreakerOpenError(err error) bool {
+	for {
+		if _, ok := err.(*sinkBreakerOpenError); ok {
+			return true
+		}
+		if _, ok := err.(*pgerror.Error); ok {
+			return strings.Contains(err.Error(), sinkBreakerOpenErrorString)
+		}
+		if e, ok := err.(causer); ok {
+			err = e.Cause()
+			continue
+		}
+		return false
+	}
+}
+
+// allow returns a retryable error if the breaker is open. Otherwise, the call
+// it guards may go ahead and its result must be passed to record.
+func (b *sinkBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.mu.state != sinkBreakerOpen {
+		return nil
+	}
+	if remaining := b.cfg.cooldown - b.now().Sub(b.mu.openedAt); remaining > 0 {
+		return &retryableSinkError{cause: &sinkBreakerOpenError{
+			failures: b.mu.failures, remaining: remaining,
+		}}
+	}
+	b.mu.state = sinkBreakerHalfOpen
+	return nil
+}
+
+// record updates the breaker with the result of a call that allow let through,
+// which was a flush if flushed is true. Only retryable errors count as
+// failures, any other error fails the changefeed anyway.
+func (b *sinkBreaker) record(ctx context.Context, err error, flushed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if !flushed {
+			return
+		}
+		if b.mu.state != sinkBreakerClosed {
+			log.Infof(ctx, `sink circuit breaker closed after a successful flush`)
+		}
+		b.mu.state = sinkBreakerClosed
+		b.mu.failures = 0
+		return
+	}
+	if !isRetryableSinkError(err) {
+		return
+	}
+	b.mu.failures++
+	if b.mu.state == sinkBreakerHalfOpen || b.mu.failures >= b.cfg.failures {
+		if b.mu.state != sinkBreakerOpen {
+			log.Warningf(ctx, `sink circuit breaker opened for %s after %d consecutive failures: %v`,
+				b.cfg.cooldown, b.mu.failures, err)
+		}
+		b.mu.state = sinkBreakerOpen
+		b.mu.openedAt = b.now()
+	}
+}
+
+// call runs fn if the breaker allows it and records the result.
+func (b *sinkBreaker) call(ctx context.Context, fn func() error) error {
+	return b.do(ctx, fn, false /* flushed */)
+}
+
+// flush is call for a flush of the sink.
+func (b *sinkBreaker) flush(ctx context.Context, fn func() error) error {
+	return b.do(ctx, fn, true /* flushed */)
+}
+
+func (b *sinkBreaker) do(ctx context.Context, fn func() error, flushed bool) error {
+	if b == nil {
+		return fn()
+	}
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.record(ctx, err, flushed)
+	return err
+}
+
+// breakerSink wraps a Sink and guards every call that can reach the downstream
+// with a sinkBreaker.
+type breakerSink struct {
+	wrapped Sink
+	breaker *sinkBreaker
+}
+
+// makeBreakerSink returns s guarded by breaker, or s itself if breaker is nil.
+func makeBreakerSink(s Sink, breaker *sinkBreaker) Sink {
+	if breaker == nil {
+		return s
+	}
+	return &breakerSink{wrapped: s, breaker: breaker}
+}
+
+// EmitRow implements the Sink interface.
+func (s *breakerSink) EmitRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, updated hlc.Timestamp,
+) error {
+	return s.breaker.call(ctx, func() error {
+		return s.wrapped.EmitRow(ctx, table, key, value, updated)
+	})
+}
+
+// EmitRowWithPartitionHint implements the PartitionHintEmitter interface.
+func (s *breakerSink) EmitRowWithPartitionHint(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	key, value []byte,
+	hint partitionHint,
+	updated hlc.Timestamp,
+) error {
+	return s.breaker.call(ctx, func() error {
+		return emitRowWithPartitionHint(ctx, s.wrapped, table, key, value, hint, updated)
+	})
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *breakerSink) EmitResolvedTimestamp(
+	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
+) error {
+	return s.breaker.call(ctx, func() error {
+		return s.wrapped.EmitResolvedTimestamp(ctx, encoder, resolved)
+	})
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *breakerSink) EmitSchemaChange(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	oldVersion, newVersion sqlbase.DescriptorVersion,
+) error {
+	return s.breaker.call(ctx, func() error {
+		return s.wrapped.EmitSchemaChange(ctx, table, oldVersion, newVersion)
+	})
+}
+
+// Flush implements the Sink interface.
+func (s *breakerSink) Flush(ctx context.Context, ts hlc.Timestamp) error {
+	return s.breaker.flush(ctx, func() error {
+		return s.wrapped.Flush(ctx, ts)
+	})
+}
+
+// FlushTable implements the TableFlusher interface.
+func (s *breakerSink) FlushTable(ctx context.Context, tableName string, ts hlc.Timestamp) error {
+	return s.breaker.call(ctx, func() error {
+		return flushTable(ctx, s.wrapped, tableName, ts)
+	})
+}
+
+// Ping implements the Pinger interface.
+func (s *breakerSink) Ping(ctx context.Context) error {
+	return pingSink(ctx, s.wrapped)
+}
+
+// SetHighWater implements the HighWaterSetter interface.
+func (s *breakerSink) SetHighWater(highWater hlc.Timestamp) {
+	setSinkHighWater(s.wrapped, highWater)
+}
+
+// EmitFeedLifecycle implements the LifecycleEmitter interface.
+func (s *breakerSink) EmitFeedLifecycle(
+	ctx context.Context, phase feedPhase, ts hlc.Timestamp,
+) error {
+	return s.breaker.call(ctx, func() error {
+		return emitFeedLifecycle(ctx, s.wrapped, phase, ts)
+	})
+}
+
+// InflightCount implements the InflightCounter interface.
+func (s *breakerSink) InflightCount() int64 {
+	return sinkInflightCount(s.wrapped)
+}
+
+// SetBackfillMode implements the BackfillModeSetter interface.
+func (s *breakerSink) SetBackfillMode(backfill bool) {
+	if b, ok := s.wrapped.(BackfillModeSetter); ok {
+		b.SetBackfillMode(backfill)
+	}
+}
+
+// SetMetrics implements the MetricsSetter interface.
+func (s *breakerSink) SetMetrics(metrics *Metrics, nodeID roachpb.NodeID) {
+	setSinkMetrics(s.wrapped, metrics, nodeID)
+}
+
+// ResumeFromState implements the StateResumer interface.
+func (s *breakerSink) ResumeFromState(ctx context.Context, spans []roachpb.Span) error {
+	return resumeSinkFromState(ctx, s.wrapped, spans)
+}
+
+// TakeChangedTopics implements the ChangedTopicsTracker interface.
+func (s *breakerSink) TakeChangedTopics() []string {
+	return takeSinkChangedTopics(s.wrapped)
+}
+
+// NoteChangedTopic implements the ChangedTopicsTracker interface.
+func (s *breakerSink) NoteChangedTopic(topic string) {
+	noteSinkChangedTopic(s.wrapped, topic)
+}
+
+// TakeCompletedFiles implements the CompletedFilesTracker interface.
+func (s *breakerSink) TakeCompletedFiles() []string {
+	return takeSinkCompletedFiles(s.wrapped)
+}
+
+// NoteCompletedFile implements the CompletedFilesTracker interface.
+func (s *breakerSink) NoteCompletedFile(filename string) {
+	noteSinkCompletedFile(s.wrapped, filename)
+}
+
+// CombinesTopicResolved implements the TopicResolvedCombiner interface.
+func (s *breakerSink) CombinesTopicResolved() bool {
+	return sinkCombinesTopicResolved(s.wrapped)
+}
+
+// SetCombinedTopicResolved implements the TopicResolvedCombiner interface.
+func (s *breakerSink) SetCombinedTopicResolved(topicResolved map[string]hlc.Timestamp) {
+	setSinkCombinedTopicResolved(s.wrapped, topicResolved)
+}
+
+// EmitsTopicResolved implements the TopicResolvedEmitter interface.
+func (s *breakerSink) EmitsTopicResolved() bool {
+	return sinkEmitsTopicResolved(s.wrapped)
+}
+
+// EmitTopicResolvedTimestamp implements the TopicResolvedEmitter interface.
+func (s *breakerSink) EmitTopicResolvedTimestamp(
+	ctx context.Context, encoder Encoder, topic string, resolved hlc.Timestamp,
+) error {
+	return emitSinkTopicResolvedTimestamp(ctx, s.wrapped, encoder, topic, resolved)
+}
+
+// Capabilities implements the Sink interface.
+func (s *breakerSink) Capabilities() SinkCapabilities {
+	return s.wrapped.Capabilities()
+}
+
+// Close implements the Sink interface.
+func (s *breakerSink) Close() error {
+	return s.wrapped.Close()
+}
+
+// CloseAndDrain implements the Drainer interface.
+func (s *breakerSink) CloseAndDrain(ctx context.Context) ([]MessageRef, error) {
+	return closeAndDrainSink(ctx, s.wrapped)
+}
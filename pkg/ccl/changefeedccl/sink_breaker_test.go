@@ -0,0 +1,165 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSinkBreaker(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	const sinkURI = `kafka://nope?breaker_failures=2&breaker_cooldown=1m`
+	b, err := acquireSinkBreaker(sinkURI, 1 /* jobID */)
+	require.NoError(t, err)
+	defer b.release()
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+
+	var calls int
+	succeed := func() error { calls++; return nil }
+	fail := func() error { calls++; return &retryableSinkError{cause: errors.New(`boom`)} }
+	state := func() sinkBreakerState {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.mu.state
+	}
+
+	// Closed: the failures have to be consecutive, only a flush resets them,
+	// and only retryable errors count.
+	require.Error(t, b.call(ctx, fail))
+	require.NoError(t, b.flush(ctx, succeed))
+	require.Error(t, b.call(ctx, fail))
+	require.NoError(t, b.call(ctx, succeed))
+	require.Error(t, b.call(ctx, func() error { return errors.New(`terminal`) }))
+	require.Equal(t, sinkBreakerClosed, state())
+	require.Error(t, b.flush(ctx, fail))
+	require.Equal(t, sinkBreakerOpen, state())
+
+	// Open: everything fails fast with a retryable error until the cooldown is
+	// over.
+	calls = 0
+	now = now.Add(30 * time.Second)
+	err = b.flush(ctx, succeed)
+	require.True(t, isRetryableSinkError(err))
+	require.Regexp(t, `open after 2 consecutive failures, probing again in 30s`, err)
+	require.Equal(t, 0, calls)
+
+	// Half-open: calls go through, and the first failure opens it again.
+	now = now.Add(30 * time.Second)
+	require.NoError(t, b.call(ctx, succeed))
+	require.Equal(t, sinkBreakerHalfOpen, state())
+	require.Error(t, b.call(ctx, fail))
+	require.Equal(t, sinkBreakerOpen, state())
+	require.Equal(t, 2, calls)
+	require.Error(t, b.call(ctx, succeed))
+	require.Equal(t, 2, calls)
+
+	// Half-open again, and a successful flush closes it.
+	now = now.Add(time.Minute)
+	require.NoError(t, b.call(ctx, succeed))
+	require.NoError(t, b.flush(ctx, succeed))
+	require.Equal(t, sinkBreakerClosed, state())
+	require.Error(t, b.call(ctx, fail))
+	require.Equal(t, sinkBreakerClosed, state())
+
+	// A sink guarded by an open breaker fails fast.
+	require.Error(t, b.call(ctx, fail))
+	require.Equal(t, sinkBreakerOpen, state())
+	s := makeBreakerSink(&bufferSink{}, b)
+	err = s.EmitRow(ctx, &sqlbase.TableDescriptor{Name: `foo`}, nil, nil, zeroTS)
+	require.True(t, isRetryableSinkError(err))
+	require.NoError(t, s.Close())
+}
+
+func TestSinkBreakerRegistry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// There's no breaker unless it's configured and there's a job.
+	b, err := acquireSinkBreaker(`kafka://nope`, 1 /* jobID */)
+	require.NoError(t, err)
+	require.Nil(t, b)
+	b, err = acquireSinkBreaker(`kafka://nope?breaker_failures=1`, 0 /* jobID */)
+	require.NoError(t, err)
+	require.Nil(t, b)
+	require.NoError(t, b.call(ctx, func() error { return nil }))
+	b.release()
+	s := &bufferSink{}
+	require.Equal(t, s, makeBreakerSink(s, b))
+
+	// The resumer and processors of a changefeed share a breaker, so it
+	// outlives the processors closed by a restart.
+	const sinkURI = `kafka://nope?breaker_failures=1`
+	resumer, err := acquireSinkBreaker(sinkURI, 2 /* jobID */)
+	require.NoError(t, err)
+	b1, err := acquireSinkBreaker(sinkURI, 2 /* jobID */)
+	require.NoError(t, err)
+	require.True(t, resumer == b1)
+	other, err := acquireSinkBreaker(sinkURI, 3 /* jobID */)
+	require.NoError(t, err)
+	require.True(t, b1 != other)
+	other.release()
+
+	require.Error(t, b1.call(ctx, func() error {
+		return &retryableSinkError{cause: errors.New(`boom`)}
+	}))
+	b1.release()
+	restarted, err := acquireSinkBreaker(sinkURI, 2 /* jobID */)
+	require.NoError(t, err)
+	require.True(t, b1 == restarted)
+	err = restarted.call(ctx, func() error { return nil })
+	require.True(t, isSinkBreakerOpenError(err), `%+v`, err)
+	require.True(t, isRetryableSinkError(err), `%+v`, err)
+
+	// It's dropped with the last one using it, even if it's open, so nothing
+	// is left behind once the job is done here.
+	restarted.release()
+	resumer.release()
+	sinkBreakers.Lock()
+	_, ok := sinkBreakers.m[restarted.key]
+	sinkBreakers.Unlock()
+	require.False(t, ok)
+	require.False(t, isSinkBreakerOpenError(&retryableSinkError{cause: errors.New(`boom`)}))
+}
+
+func TestConsumeSinkBreakerConfig(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	cfg, err := consumeSinkBreakerConfig(url.Values{})
+	require.NoError(t, err)
+	require.False(t, cfg.enabled())
+	cfg, err = consumeSinkBreakerConfig(url.Values{sinkParamBreakerFailures: {`5`}})
+	require.NoError(t, err)
+	require.Equal(t, sinkBreakerConfig{failures: 5, cooldown: sinkBreakerDefaultCooldown}, cfg)
+	q := url.Values{sinkParamBreakerFailures: {`5`}, sinkParamBreakerCooldown: {`10s`}}
+	cfg, err = consumeSinkBreakerConfig(q)
+	require.NoError(t, err)
+	require.Equal(t, sinkBreakerConfig{failures: 5, cooldown: 10 * time.Second}, cfg)
+	require.Empty(t, q)
+
+	_, err = consumeSinkBreakerConfig(url.Values{sinkParamBreakerFailures: {`0`}})
+	require.EqualError(t, err, `breaker_failures must be positive: 0`)
+	_, err = consumeSinkBreakerConfig(url.Values{sinkParamBreakerFailures: {`x`}})
+	require.Regexp(t, `parsing breaker_failures`, err)
+	_, err = consumeSinkBreakerConfig(url.Values{sinkParamBreakerCooldown: {`10s`}})
+	require.EqualError(t, err, `breaker_cooldown requires breaker_failures`)
+	_, err = consumeSinkBreakerConfig(
+		url.Values{sinkParamBreakerFailures: {`1`}, sinkParamBreakerCooldown: {`-1s`}})
+	require.EqualError(t, err, `breaker_cooldown must be positive: -1s`)
+}
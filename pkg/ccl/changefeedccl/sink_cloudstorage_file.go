@@ -0,0 +1,314 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"bufio"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cloudStorageSinkFile buffers the contents of one data file of a
+// cloudStorageSink until it's flushed. It starts out in memory and, once it
+// grows past a threshold, moves to a temporary local file, which trades memory
+// for local disk IO.
+//
+// The size and CRC-32C checksum of the contents are maintained as they're
+// written, so that they're available without reading the contents back.
+type cloudStorageSinkFile struct {
+	buf chunkedBuffer
+	// spill, if non-nil, holds all of the contents and buf is unused. It's
+	// written through spillW, so the contents are only all in it once spillW
+	// is flushed.
+	spill  *os.File
+	spillW *bufio.Writer
+	size   int64
+	crc32c uint32
+	// idx is the file_idx of the data file in its cloudStorageSinkKey.
+	idx int
+	// writtenSize is the size of the contents when they were last written out.
+	// Records are only ever appended, so the contents are unchanged since then
+	// if it's equal to size.
+	writtenSize int64
+	// opened is when the first record was written, see
+	// cloudStorageSinkConfig.maxFileAge.
+	opened time.Time
+}
+
+// Write implements the io.Writer interface.
+func (f *cloudStorageSinkFile) Write(p []byte) (int, error) {
+	var n int
+	var err error
+	if f.spill != nil {
+		n, err = f.spillW.Write(p)
+	} else {
+		n, err = f.buf.Write(p)
+	}
+	f.size += int64(n)
+	f.crc32c = crc32.Update(f.crc32c, crc32cTable, p[:n])
+	return n, err
+}
+
+// maybeSpill moves the contents to a temporary file in dir (or the default
+// directory for temporary files, if dir is empty) if they're larger than
+// threshold. A threshold of 0 disables spilling.
+func (f *cloudStorageSinkFile) maybeSpill(dir string, threshold int64) error {
+	if f.spill != nil || threshold <= 0 || f.size <= threshold {
+		return nil
+	}
+	spill, err := ioutil.TempFile(dir, `changefeed-cloudstorage-`)
+	if err != nil {
+		return errors.Wrap(err, `spilling cloud storage buffer`)
+	}
+	// Records are small, so write them to the file in larger pieces.
+	spillW := bufio.NewWriter(spill)
+	if _, err := f.buf.WriteTo(spillW); err != nil {
+		_ = spill.Close()
+		_ = os.Remove(spill.Name())
+		return errors.Wrap(err, `spilling cloud storage buffer`)
+	}
+	f.spill, f.spillW = spill, spillW
+	// Release the memory rather than keeping it around for this file, which is
+	// the whole point. It's only kept for others if it's small enough for the
+	// buffer pool, if there is one.
+	f.buf.reset()
+	return nil
+}
+
+// Reader returns the contents. It doesn't consume them and further Writes are
+// allowed, but they invalidate the returned reader. If the contents were
+// spilled, the writes buffered for the temporary file are flushed and the file
+// is synced first, which is where errors writing it show up.
+func (f *cloudStorageSinkFile) Reader() (io.ReadSeeker, error) {
+	if f.spill != nil {
+		if err := f.spillW.Flush(); err != nil {
+			return nil, errors.Wrap(err, `flushing spilled cloud storage buffer`)
+		}
+		if err := f.spill.Sync(); err != nil {
+			return nil, errors.Wrap(err, `syncing spilled cloud storage buffer`)
+		}
+		// A SectionReader uses ReadAt, so reading doesn't move the offset that
+		// Write appends at.
+		return io.NewSectionReader(f.spill, 0, f.size), nil
+	}
+	return io.NewSectionReader(&f.buf, 0, f.buf.Len()), nil
+}
+
+// Close releases the contents, removing the temporary file if there is one.
+func (f *cloudStorageSinkFile) Close() error {
+	f.buf.reset()
+	if f.spill == nil {
+		return nil
+	}
+	// The contents are being dropped, so there's no need to flush spillW.
+	name := f.spill.Name()
+	err := f.spill.Close()
+	f.spill, f.spillW = nil, nil
+	if rmErr := os.Remove(name); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+const (
+	// chunkedBufferMinChunkSize is the size of the first chunk of a
+	// chunkedBuffer.
+	chunkedBufferMinChunkSize = 512
+	// chunkedBufferMaxChunkSize is the size that the chunks of a chunkedBuffer
+	// grow to.
+	chunkedBufferMaxChunkSize = 64 << 10 // 64 KiB
+)
+
+// chunkedBuffer is an in-memory, append-only buffer that's kept in a list of
+// chunks instead of one contiguous slice. Unlike a bytes.Buffer, growing it
+// never copies what's already been written, and never temporarily needs twice
+// its size, which smooths out the memory use of large buffers and the garbage
+// they produce. The chunks double in size from chunkedBufferMinChunkSize up to
+// chunkedBufferMaxChunkSize, so small buffers stay small.
+//
+// The zero value is an empty buffer ready to use.
+type chunkedBuffer struct {
+	// chunks are full, except for the last one. Past its length, it may hold
+	// empty chunks from pool to reuse.
+	chunks [][]byte
+	size   int64
+	// pool, if non-nil, is where the chunks come from, when there are some to
+	// reuse, and where they go back to when the buffer is reset.
+	pool *chunkPool
+}
+
+var _ io.Writer = &chunkedBuffer{}
+var _ io.ReaderAt = &chunkedBuffer{}
+var _ io.WriterTo = &chunkedBuffer{}
+
+// Write implements the io.Writer interface. It never returns an error.
+func (b *chunkedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		last := len(b.chunks) - 1
+		if last < 0 || len(b.chunks[last]) == cap(b.chunks[last]) {
+			b.addChunk()
+			last++
+		}
+		chunk := b.chunks[last]
+		written := copy(chunk[len(chunk):cap(chunk)], p)
+		b.chunks[last] = chunk[:len(chunk)+written]
+		p = p[written:]
+	}
+	b.size += int64(n)
+	return n, nil
+}
+
+// addChunk appends an empty chunk, reusing one from the pool if there is one.
+func (b *chunkedBuffer) addChunk() {
+	if b.chunks == nil {
+		b.chunks = b.pool.get()
+	}
+	size := b.nextChunkSize()
+	// The chunks of every buffer have the same sizes in the same order, so a
+	// pooled one is the right size unless it was never allocated.
+	if n := len(b.chunks); n < cap(b.chunks) {
+		if chunk := b.chunks[:n+1][n]; cap(chunk) == size {
+			b.chunks = append(b.chunks, chunk[:0])
+			return
+		}
+	}
+	b.chunks = append(b.chunks, make([]byte, 0, size))
+}
+
+// reset empties the buffer and gives its chunks back to the pool.
+func (b *chunkedBuffer) reset() {
+	b.pool.put(b.chunks)
+	b.chunks, b.size = nil, 0
+}
+
+func (b *chunkedBuffer) nextChunkSize() int {
+	size := chunkedBufferMinChunkSize
+	for i := 0; i < len(b.chunks) && size < chunkedBufferMaxChunkSize; i++ {
+		size *= 2
+	}
+	if size > chunkedBufferMaxChunkSize {
+		size = chunkedBufferMaxChunkSize
+	}
+	return size
+}
+
+// Len returns the number of bytes written.
+func (b *chunkedBuffer) Len() int64 {
+	return b.size
+}
+
+// Cap returns the number of bytes allocated.
+func (b *chunkedBuffer) Cap() int {
+	var c int
+	for _, chunk := range b.chunks {
+		c += cap(chunk)
+	}
+	return c
+}
+
+// ReadAt implements the io.ReaderAt interface. Like for a file, reading
+// doesn't interfere with later writes, but it only sees what was written
+// before it.
+func (b *chunkedBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New(`chunkedBuffer.ReadAt: negative offset`)
+	}
+	var n int
+	// Skip the chunks before off. Only the last chunk can be shorter than its
+	// capacity, so the chunk that off is in could be computed directly, but
+	// the number of chunks is small enough that it doesn't matter.
+	for _, chunk := range b.chunks {
+		if len(p) == 0 {
+			break
+		}
+		if off >= int64(len(chunk)) {
+			off -= int64(len(chunk))
+			continue
+		}
+		copied := copy(p, chunk[off:])
+		n += copied
+		p = p[copied:]
+		off = 0
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteTo implements the io.WriterTo interface. It doesn't consume the
+// contents.
+func (b *chunkedBuffer) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	for _, chunk := range b.chunks {
+		written, err := w.Write(chunk)
+		n += int64(written)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// chunkPool keeps the chunks of chunkedBuffers that have been reset, so that
+// buffers that are filled and emptied over and over, like the data files of a
+// busy cloud storage sink, reuse their memory instead of making garbage. The
+// chunks of a buffer are kept and reused together, in order.
+//
+// It's backed by a sync.Pool, so it only holds on to them until the next
+// garbage collections, but that's still memory that isn't otherwise in use, so
+// the chunks of a buffer are dropped instead of pooled if there's more than
+// maxBytes of them. That keeps one large buffer, like a data file of a
+// backfill, from being held on to for the small ones after it.
+type chunkPool struct {
+	maxBytes int
+	pool     sync.Pool
+}
+
+func makeChunkPool(maxBytes int) *chunkPool {
+	return &chunkPool{maxBytes: maxBytes}
+}
+
+// get returns the chunks of a reset buffer, all empty, or nil if there are
+// none. It may be called on a nil chunkPool, which has none.
+func (p *chunkPool) get() [][]byte {
+	if p == nil {
+		return nil
+	}
+	chunks, _ := p.pool.Get().(*[][]byte)
+	if chunks == nil {
+		return nil
+	}
+	return (*chunks)[:0]
+}
+
+// put keeps the chunks of a buffer for get, including the unused ones past the
+// length, unless there are too many bytes of them. It may be called on a nil
+// chunkPool, which drops them.
+func (p *chunkPool) put(chunks [][]byte) {
+	if p == nil || cap(chunks) == 0 {
+		return
+	}
+	chunks = chunks[:cap(chunks)]
+	var size int
+	for _, chunk := range chunks {
+		size += cap(chunk)
+	}
+	if size > p.maxBytes {
+		return
+	}
+	p.pool.Put(&chunks)
+}
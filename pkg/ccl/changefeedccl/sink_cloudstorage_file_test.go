@@ -0,0 +1,188 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloudStorageSinkFileSpill(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	spilled := func() []string {
+		infos, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return names
+	}
+	contents := func(f *cloudStorageSinkFile) string {
+		r, err := f.Reader()
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		return string(b)
+	}
+	spilledSize := func(f *cloudStorageSinkFile) int64 {
+		info, err := f.spill.Stat()
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	var f cloudStorageSinkFile
+	_, err := f.Write([]byte(`abc`))
+	require.NoError(t, err)
+	require.NoError(t, f.maybeSpill(dir, 0 /* threshold */))
+	require.NoError(t, f.maybeSpill(dir, 3 /* threshold */))
+	require.Nil(t, f.spill)
+	require.Empty(t, spilled())
+
+	_, err = f.Write([]byte(`def`))
+	require.NoError(t, err)
+	require.NoError(t, f.maybeSpill(dir, 3 /* threshold */))
+	require.NotNil(t, f.spill)
+	require.Len(t, spilled(), 1)
+	require.Equal(t, 0, f.buf.Cap())
+	// The writes to the temporary file are buffered until it's read.
+	require.Equal(t, int64(0), spilledSize(&f))
+	require.Equal(t, `abcdef`, contents(&f))
+	require.Equal(t, int64(6), spilledSize(&f))
+
+	// Reading doesn't interfere with later writes.
+	_, err = f.Write([]byte(`ghi`))
+	require.NoError(t, err)
+	require.Equal(t, `abcdefghi`, contents(&f))
+	require.Equal(t, int64(9), f.size)
+	require.Equal(t, crc32.Checksum([]byte(`abcdefghi`), crc32cTable), f.crc32c)
+
+	require.NoError(t, f.Close())
+	require.Empty(t, spilled())
+}
+
+func TestChunkedBufferPool(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewPseudoRand()
+
+	// Buffers that reuse each other's chunks, whether or not the pool kept
+	// them, have only what was written to them since they were reset.
+	pool := makeChunkPool(4 * chunkedBufferMaxChunkSize)
+	for i := 0; i < 20; i++ {
+		b := chunkedBuffer{pool: pool}
+		expected := randutil.RandBytes(rng, rng.Intn(8*chunkedBufferMaxChunkSize))
+		for p := expected; len(p) > 0; {
+			n := rng.Intn(len(p)) + 1
+			_, err := b.Write(p[:n])
+			require.NoError(t, err)
+			p = p[n:]
+		}
+		var actual bytes.Buffer
+		_, err := b.WriteTo(&actual)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual.Bytes())
+		b.reset()
+		require.Equal(t, int64(0), b.Len())
+	}
+
+	// A nil pool never has anything.
+	var nilPool *chunkPool
+	nilPool.put([][]byte{make([]byte, 0, chunkedBufferMinChunkSize)})
+	require.Nil(t, nilPool.get())
+}
+
+func TestChunkedBuffer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	rng, _ := randutil.NewPseudoRand()
+
+	var b chunkedBuffer
+	require.Equal(t, int64(0), b.Len())
+	n, err := b.ReadAt(make([]byte, 1), 0)
+	require.Equal(t, 0, n)
+	require.Equal(t, io.EOF, err)
+
+	// Write several MiB in randomly sized pieces, some bigger than a chunk,
+	// and check it against a bytes.Buffer.
+	var expected bytes.Buffer
+	for expected.Len() < 4<<20 {
+		p := randutil.RandBytes(rng, rng.Intn(3*chunkedBufferMaxChunkSize))
+		n, err := b.Write(p)
+		require.NoError(t, err)
+		require.Equal(t, len(p), n)
+		expected.Write(p)
+	}
+	require.Equal(t, int64(expected.Len()), b.Len())
+	// Only the last chunk has unused capacity.
+	require.True(t, b.Cap() < expected.Len()+chunkedBufferMaxChunkSize,
+		`%d bytes allocated for %d`, b.Cap(), expected.Len())
+
+	var written bytes.Buffer
+	n64, err := b.WriteTo(&written)
+	require.NoError(t, err)
+	require.Equal(t, int64(expected.Len()), n64)
+	require.Equal(t, expected.Bytes(), written.Bytes())
+
+	for i := 0; i < 100; i++ {
+		off := rng.Int63n(b.Len())
+		p := make([]byte, rng.Intn(2*chunkedBufferMaxChunkSize))
+		n, err := b.ReadAt(p, off)
+		end := off + int64(len(p))
+		if end > b.Len() {
+			require.Equal(t, io.EOF, err)
+			end = b.Len()
+		} else {
+			require.NoError(t, err)
+		}
+		require.Equal(t, expected.Bytes()[off:end], p[:n])
+	}
+
+	// The file reader reads the whole thing.
+	f := cloudStorageSinkFile{buf: b, size: b.Len()}
+	r, err := f.Reader()
+	require.NoError(t, err)
+	contents, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, expected.Bytes(), contents)
+}
+
+func BenchmarkChunkedBufferPool(b *testing.B) {
+	record := bytes.Repeat([]byte(`x`), 200)
+	for _, pooled := range []bool{false, true} {
+		b.Run(fmt.Sprintf(`pooled=%t`, pooled), func(b *testing.B) {
+			var pool *chunkPool
+			if pooled {
+				pool = makeChunkPool(1 << 20)
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// Roughly one data file.
+				buf := chunkedBuffer{pool: pool}
+				for j := 0; j < 1000; j++ {
+					_, _ = buf.Write(record)
+				}
+				buf.reset()
+			}
+		})
+	}
+}
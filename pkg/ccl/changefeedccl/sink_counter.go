@@ -0,0 +1,193 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	gojson "encoding/json"
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+// counterSinkCapabilities only allows JSON values with the previous version of
+// the row, because an insert can't be told apart from an update without it.
+var counterSinkCapabilities = SinkCapabilities{
+	Formats:   []formatType{optFormatJSON},
+	Envelopes: []envelopeType{optEnvelopeDiff},
+	Resolved:  true,
+}
+
+// counterSinkTableCounts are the changes counted by a counterSink for one
+// table.
+type counterSinkTableCounts struct {
+	inserts, updates, deletes, bytes int64
+}
+
+// counterSink counts the rows emitted to it instead of delivering them
+// anywhere, which lets operators monitor the volume of changes to a set of
+// tables without standing up a downstream consumer. The sink URI is
+// `experimental-metrics://`.
+//
+// It needs `envelope=diff` and JSON values. A row without a previous version
+// is counted as an insert, one without columns other than the metadata as a
+// delete, and the rest as updates. The bytes are those of the encoded key and
+// value. The counts are exported as the `changefeed.counter_sink.*` node
+// metrics, which are broken down by a `table` label in the Prometheus
+// endpoint, and logged by Flush. Resolved timestamps are ignored.
+type counterSink struct {
+	// metrics, if non-nil, is where the totals are exported.
+	metrics *Metrics
+	tables  map[string]*counterSinkTableCounts
+	closed  bool
+}
+
+func makeCounterSink(targets jobspb.ChangefeedTargets) *counterSink {
+	s := &counterSink{tables: make(map[string]*counterSinkTableCounts)}
+	for _, t := range targets {
+		s.tables[t.StatementTimeName] = &counterSinkTableCounts{}
+	}
+	return s
+}
+
+// EmitRow implements the Sink interface.
+func (s *counterSink) EmitRow(
+	_ context.Context, table *sqlbase.TableDescriptor, key, value []byte, _ hlc.Timestamp,
+) error {
+	if s.closed {
+		return errors.New(`cannot EmitRow on a closed sink`)
+	}
+	counts, ok := s.tables[table.Name]
+	if !ok {
+		return errors.Errorf(`cannot emit to undeclared topic: %s`, table.Name)
+	}
+	op, err := counterSinkOp(value)
+	if err != nil {
+		return err
+	}
+	bytes := int64(len(key) + len(value))
+	counts.bytes += bytes
+	switch op {
+	case counterSinkInsert:
+		counts.inserts++
+	case counterSinkUpdate:
+		counts.updates++
+	case counterSinkDelete:
+		counts.deletes++
+	}
+	if s.metrics != nil {
+		switch op {
+		case counterSinkInsert:
+			s.metrics.CounterSinkInserts.IncWithLabel(table.Name, 1)
+		case counterSinkUpdate:
+			s.metrics.CounterSinkUpdates.IncWithLabel(table.Name, 1)
+		case counterSinkDelete:
+			s.metrics.CounterSinkDeletes.IncWithLabel(table.Name, 1)
+		}
+		s.metrics.CounterSinkBytes.IncWithLabel(table.Name, bytes)
+	}
+	return nil
+}
+
+// counterSinkRowOp is the kind of change that a row emitted to a counterSink
+// is.
+type counterSinkRowOp int
+
+const (
+	counterSinkInsert counterSinkRowOp = iota
+	counterSinkUpdate
+	counterSinkDelete
+)
+
+// counterSinkOp returns the kind of change that a row with the given JSON
+// value, encoded with `envelope=diff`, is.
+func counterSinkOp(value []byte) (counterSinkRowOp, error) {
+	// A deletion of a row without a known previous version has no value.
+	if value == nil {
+		return counterSinkDelete, nil
+	}
+	var fields map[string]gojson.RawMessage
+	if err := gojson.Unmarshal(value, &fields); err != nil {
+		return 0, errors.Wrap(err, `decoding row value`)
+	}
+	var meta struct {
+		Before gojson.RawMessage `json:"before"`
+	}
+	if m, ok := fields[jsonMetaSentinel]; ok {
+		if err := gojson.Unmarshal(m, &meta); err != nil {
+			return 0, errors.Wrap(err, `decoding row metadata`)
+		}
+		delete(fields, jsonMetaSentinel)
+	}
+	switch {
+	case len(fields) == 0:
+		return counterSinkDelete, nil
+	case len(meta.Before) == 0 || string(meta.Before) == `null`:
+		return counterSinkInsert, nil
+	default:
+		return counterSinkUpdate, nil
+	}
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *counterSink) EmitResolvedTimestamp(context.Context, Encoder, hlc.Timestamp) error {
+	if s.closed {
+		return errors.New(`cannot EmitResolvedTimestamp on a closed sink`)
+	}
+	return nil
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *counterSink) EmitSchemaChange(
+	context.Context, *sqlbase.TableDescriptor, sqlbase.DescriptorVersion, sqlbase.DescriptorVersion,
+) error {
+	return nil
+}
+
+// Flush implements the Sink interface. Nothing is buffered, so it only logs
+// the per-table counts.
+func (s *counterSink) Flush(ctx context.Context, _ hlc.Timestamp) error {
+	if s.closed {
+		return errors.New(`cannot Flush on a closed sink`)
+	}
+	if log.V(1) {
+		names := make([]string, 0, len(s.tables))
+		for name := range s.tables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			counts := s.tables[name]
+			log.Infof(ctx, `%s: %d inserts, %d updates, %d deletes, %d bytes`,
+				name, counts.inserts, counts.updates, counts.deletes, counts.bytes)
+		}
+	}
+	return nil
+}
+
+// SetMetrics implements the MetricsSetter interface.
+func (s *counterSink) SetMetrics(metrics *Metrics, _ roachpb.NodeID) {
+	s.metrics = metrics
+}
+
+// Capabilities implements the Sink interface.
+func (s *counterSink) Capabilities() SinkCapabilities {
+	return counterSinkCapabilities
+}
+
+// Close implements the Sink interface.
+func (s *counterSink) Close() error {
+	s.closed = true
+	return nil
+}
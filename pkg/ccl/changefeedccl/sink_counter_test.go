@@ -0,0 +1,86 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	targets := jobspb.ChangefeedTargets{
+		0: jobspb.ChangefeedTarget{StatementTimeName: `foo`},
+		1: jobspb.ChangefeedTarget{StatementTimeName: `bar`},
+	}
+	s := makeCounterSink(targets)
+	metrics := MakeMetrics(time.Minute).(*Metrics)
+	s.metrics = metrics
+
+	foo := &sqlbase.TableDescriptor{Name: `foo`}
+	bar := &sqlbase.TableDescriptor{Name: `bar`}
+	insert := []byte(`{"__crdb__": {"before": null}, "a": 1}`)
+	update := []byte(`{"__crdb__": {"before": {"a": 1}}, "a": 2}`)
+	deleteWithBefore := []byte(`{"__crdb__": {"before": {"a": 2}}}`)
+	require.NoError(t, s.EmitRow(ctx, foo, []byte(`[1]`), insert, zeroTS))
+	require.NoError(t, s.EmitRow(ctx, foo, []byte(`[1]`), update, zeroTS))
+	require.NoError(t, s.EmitRow(ctx, foo, []byte(`[1]`), deleteWithBefore, zeroTS))
+	require.NoError(t, s.EmitRow(ctx, bar, []byte(`[2]`), insert, zeroTS))
+	require.NoError(t, s.EmitRow(ctx, bar, []byte(`[2]`), nil, zeroTS))
+	require.EqualError(t, s.EmitRow(ctx, &sqlbase.TableDescriptor{Name: `nope`}, nil, nil, zeroTS),
+		`cannot emit to undeclared topic: nope`)
+	require.EqualError(t, s.EmitRow(ctx, foo, []byte(`[1]`), []byte(`nope`), zeroTS),
+		`decoding row value: invalid character 'o' in literal null (expecting 'u')`)
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, makeJSONEncoder(nil), zeroTS))
+	require.NoError(t, s.Flush(ctx, zeroTS))
+
+	fooBytes := int64(3*len(`[1]`) + len(insert) + len(update) + len(deleteWithBefore))
+	barBytes := int64(2*len(`[2]`) + len(insert))
+	require.Equal(t, counterSinkTableCounts{inserts: 1, updates: 1, deletes: 1, bytes: fooBytes},
+		*s.tables[`foo`])
+	require.Equal(t, counterSinkTableCounts{inserts: 1, deletes: 1, bytes: barBytes},
+		*s.tables[`bar`])
+
+	// The metrics are kept per table too.
+	require.Equal(t, int64(2), metrics.CounterSinkInserts.Count())
+	require.Equal(t, int64(1), metrics.CounterSinkInserts.Child(`foo`))
+	require.Equal(t, int64(1), metrics.CounterSinkInserts.Child(`bar`))
+	require.Equal(t, int64(1), metrics.CounterSinkUpdates.Count())
+	require.Equal(t, int64(1), metrics.CounterSinkUpdates.Child(`foo`))
+	require.Equal(t, int64(0), metrics.CounterSinkUpdates.Child(`bar`))
+	require.Equal(t, int64(2), metrics.CounterSinkDeletes.Count())
+	require.Equal(t, int64(1), metrics.CounterSinkDeletes.Child(`bar`))
+	require.Equal(t, fooBytes+barBytes, metrics.CounterSinkBytes.Count())
+	require.Equal(t, fooBytes, metrics.CounterSinkBytes.Child(`foo`))
+
+	require.NoError(t, s.Close())
+	require.EqualError(t, s.EmitRow(ctx, foo, nil, nil, zeroTS), `cannot EmitRow on a closed sink`)
+}
+
+func TestCounterSinkCapabilities(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// Inserts can't be told apart from updates without the previous version
+	// of the row.
+	err := counterSinkCapabilities.validate(optFormatJSON, map[string]string{})
+	require.EqualError(t, err, `this sink is incompatible with envelope=row`)
+	err = counterSinkCapabilities.validate(optFormatAvro,
+		map[string]string{optEnvelope: string(optEnvelopeDiff)})
+	require.EqualError(t, err, `this sink is incompatible with format=experimental_avro`)
+	require.NoError(t, counterSinkCapabilities.validate(optFormatJSON,
+		map[string]string{optEnvelope: string(optEnvelopeDiff)}))
+}
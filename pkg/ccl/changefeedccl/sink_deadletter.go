@@ -0,0 +1,267 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	gojson "encoding/json"
+	"unicode/utf8"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+// deadLetterRecord is the value of a row sent to a dead letter sink. The key
+// and value are those the row had, base64 encoded in the `_base64` fields
+// instead if they aren't valid UTF-8, such as avro.
+type deadLetterRecord struct {
+	Topic       string `json:"topic"`
+	Key         string `json:"key,omitempty"`
+	KeyBase64   []byte `json:"key_base64,omitempty"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 []byte `json:"value_base64,omitempty"`
+	// Updated is the updated timestamp of the row, as a decimal.
+	Updated string `json:"updated"`
+	// Error is why the row couldn't be emitted.
+	Error string `json:"error"`
+}
+
+// deadLetterSink wraps a Sink and, when it fails to emit a row with a
+// rowSinkError, emits a deadLetterRecord of the row to the `dead_letter_sink`
+// changefeed option's sink instead, so that one poison row doesn't fail an
+// otherwise healthy changefeed. Every other error is returned as usual.
+//
+// The record is emitted to the dead letter sink with the row's table and key,
+// so it ends up in the topic or directory that the dead letter sink would use
+// for the table. Nothing else, such as resolved timestamps, is emitted to the
+// dead letter sink, but it's flushed along with the wrapped sink, so a row
+// that was dead lettered is as durable as the ones that weren't once a flush
+// returns.
+type deadLetterSink struct {
+	wrapped    Sink
+	deadLetter Sink
+}
+
+func makeDeadLetterSink(s Sink, deadLetter Sink) *deadLetterSink {
+	return &deadLetterSink{wrapped: s, deadLetter: deadLetter}
+}
+
+// maybeDeadLetter emits the row to the dead letter sink if err is a
+// rowSinkError. Otherwise, it returns err.
+func (s *deadLetterSink) maybeDeadLetter(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	key, value []byte,
+	updated hlc.Timestamp,
+	err error,
+) error {
+	if err == nil || !isRowSinkError(err) {
+		return err
+	}
+	r := deadLetterRecord{
+		Topic:   table.Name,
+		Updated: tree.TimestampToDecimal(updated).Decimal.String(),
+		Error:   err.Error(),
+	}
+	if utf8.Valid(key) {
+		r.Key = string(key)
+	} else {
+		r.KeyBase64 = key
+	}
+	if utf8.Valid(value) {
+		r.Value = string(value)
+	} else {
+		r.ValueBase64 = value
+	}
+	record, marshalErr := gojson.Marshal(r)
+	if marshalErr != nil {
+		return marshalErr
+	}
+	log.Warningf(ctx, `sending row of %s to %s: %v`, table.Name, optDeadLetterSink, err)
+	if err := s.deadLetter.EmitRow(ctx, table, key, record, updated); err != nil {
+		return errors.Wrapf(err, `emitting to %s`, optDeadLetterSink)
+	}
+	return nil
+}
+
+// EmitRow implements the Sink interface.
+func (s *deadLetterSink) EmitRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, updated hlc.Timestamp,
+) error {
+	err := s.wrapped.EmitRow(ctx, table, key, value, updated)
+	return s.maybeDeadLetter(ctx, table, key, value, updated, err)
+}
+
+// EmitRowWithPartitionHint implements the PartitionHintEmitter interface.
+func (s *deadLetterSink) EmitRowWithPartitionHint(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	key, value []byte,
+	hint partitionHint,
+	updated hlc.Timestamp,
+) error {
+	err := emitRowWithPartitionHint(ctx, s.wrapped, table, key, value, hint, updated)
+	return s.maybeDeadLetter(ctx, table, key, value, updated, err)
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *deadLetterSink) EmitResolvedTimestamp(
+	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
+) error {
+	return s.wrapped.EmitResolvedTimestamp(ctx, encoder, resolved)
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *deadLetterSink) EmitSchemaChange(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	oldVersion, newVersion sqlbase.DescriptorVersion,
+) error {
+	return s.wrapped.EmitSchemaChange(ctx, table, oldVersion, newVersion)
+}
+
+// Flush implements the Sink interface.
+func (s *deadLetterSink) Flush(ctx context.Context, ts hlc.Timestamp) error {
+	if err := s.wrapped.Flush(ctx, ts); err != nil {
+		return err
+	}
+	if err := s.deadLetter.Flush(ctx, ts); err != nil {
+		return errors.Wrapf(err, `flushing %s`, optDeadLetterSink)
+	}
+	return nil
+}
+
+// FlushTable implements the TableFlusher interface.
+func (s *deadLetterSink) FlushTable(
+	ctx context.Context, tableName string, ts hlc.Timestamp,
+) error {
+	if err := flushTable(ctx, s.wrapped, tableName, ts); err != nil {
+		return err
+	}
+	if err := flushTable(ctx, s.deadLetter, tableName, ts); err != nil {
+		return errors.Wrapf(err, `flushing %s`, optDeadLetterSink)
+	}
+	return nil
+}
+
+// Ping implements the Pinger interface.
+func (s *deadLetterSink) Ping(ctx context.Context) error {
+	if err := pingSink(ctx, s.wrapped); err != nil {
+		return err
+	}
+	if err := pingSink(ctx, s.deadLetter); err != nil {
+		return errors.Wrapf(err, `pinging %s`, optDeadLetterSink)
+	}
+	return nil
+}
+
+// SetHighWater implements the HighWaterSetter interface.
+func (s *deadLetterSink) SetHighWater(highWater hlc.Timestamp) {
+	setSinkHighWater(s.wrapped, highWater)
+}
+
+// EmitFeedLifecycle implements the LifecycleEmitter interface.
+func (s *deadLetterSink) EmitFeedLifecycle(
+	ctx context.Context, phase feedPhase, ts hlc.Timestamp,
+) error {
+	return emitFeedLifecycle(ctx, s.wrapped, phase, ts)
+}
+
+// InflightCount implements the InflightCounter interface.
+func (s *deadLetterSink) InflightCount() int64 {
+	return sinkInflightCount(s.wrapped) + sinkInflightCount(s.deadLetter)
+}
+
+// SetBackfillMode implements the BackfillModeSetter interface.
+func (s *deadLetterSink) SetBackfillMode(backfill bool) {
+	if b, ok := s.wrapped.(BackfillModeSetter); ok {
+		b.SetBackfillMode(backfill)
+	}
+}
+
+// SetMetrics implements the MetricsSetter interface.
+func (s *deadLetterSink) SetMetrics(metrics *Metrics, nodeID roachpb.NodeID) {
+	setSinkMetrics(s.wrapped, metrics, nodeID)
+}
+
+// ResumeFromState implements the StateResumer interface.
+func (s *deadLetterSink) ResumeFromState(ctx context.Context, spans []roachpb.Span) error {
+	return resumeSinkFromState(ctx, s.wrapped, spans)
+}
+
+// TakeChangedTopics implements the ChangedTopicsTracker interface.
+func (s *deadLetterSink) TakeChangedTopics() []string {
+	return takeSinkChangedTopics(s.wrapped)
+}
+
+// NoteChangedTopic implements the ChangedTopicsTracker interface.
+func (s *deadLetterSink) NoteChangedTopic(topic string) {
+	noteSinkChangedTopic(s.wrapped, topic)
+}
+
+// TakeCompletedFiles implements the CompletedFilesTracker interface.
+func (s *deadLetterSink) TakeCompletedFiles() []string {
+	return takeSinkCompletedFiles(s.wrapped)
+}
+
+// NoteCompletedFile implements the CompletedFilesTracker interface.
+func (s *deadLetterSink) NoteCompletedFile(filename string) {
+	noteSinkCompletedFile(s.wrapped, filename)
+}
+
+// CombinesTopicResolved implements the TopicResolvedCombiner interface.
+func (s *deadLetterSink) CombinesTopicResolved() bool {
+	return sinkCombinesTopicResolved(s.wrapped)
+}
+
+// SetCombinedTopicResolved implements the TopicResolvedCombiner interface.
+func (s *deadLetterSink) SetCombinedTopicResolved(topicResolved map[string]hlc.Timestamp) {
+	setSinkCombinedTopicResolved(s.wrapped, topicResolved)
+}
+
+// EmitsTopicResolved implements the TopicResolvedEmitter interface.
+func (s *deadLetterSink) EmitsTopicResolved() bool {
+	return sinkEmitsTopicResolved(s.wrapped)
+}
+
+// EmitTopicResolvedTimestamp implements the TopicResolvedEmitter interface.
+func (s *deadLetterSink) EmitTopicResolvedTimestamp(
+	ctx context.Context, encoder Encoder, topic string, resolved hlc.Timestamp,
+) error {
+	return emitSinkTopicResolvedTimestamp(ctx, s.wrapped, encoder, topic, resolved)
+}
+
+// Capabilities implements the Sink interface.
+func (s *deadLetterSink) Capabilities() SinkCapabilities {
+	return s.wrapped.Capabilities()
+}
+
+// Close implements the Sink interface.
+func (s *deadLetterSink) Close() error {
+	err := s.wrapped.Close()
+	if deadLetterErr := s.deadLetter.Close(); err == nil {
+		err = deadLetterErr
+	}
+	return err
+}
+
+// CloseAndDrain implements the Drainer interface. A row that didn't make it
+// to the dead letter sink is reported with the topic of the dead letter sink.
+func (s *deadLetterSink) CloseAndDrain(ctx context.Context) ([]MessageRef, error) {
+	undelivered, err := closeAndDrainSink(ctx, s.wrapped)
+	deadLetterUndelivered, deadLetterErr := closeAndDrainSink(ctx, s.deadLetter)
+	if err == nil {
+		err = deadLetterErr
+	}
+	return append(undelivered, deadLetterUndelivered...), err
+}
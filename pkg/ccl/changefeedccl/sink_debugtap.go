@@ -0,0 +1,214 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"math/rand"
+	"net/url"
+	"strconv"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+// debugTapVerbosity is the verbosity that sampled rows are logged at.
+const debugTapVerbosity = 2
+
+// consumeSinkDebugSampleRate parses and removes the `debug_sample_rate` sink
+// param from q. Zero means no rows are sampled.
+func consumeSinkDebugSampleRate(q url.Values) (float64, error) {
+	str := q.Get(sinkParamDebugSampleRate)
+	q.Del(sinkParamDebugSampleRate)
+	if str == `` {
+		return 0, nil
+	}
+	sampleRate, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, `parsing %s`, sinkParamDebugSampleRate)
+	}
+	if !(sampleRate > 0 && sampleRate <= 1) {
+		return 0, errors.Errorf(
+			`%s must be greater than 0 and at most 1: %s`, sinkParamDebugSampleRate, str)
+	}
+	return sampleRate, nil
+}
+
+// debugTapSink wraps a Sink and logs a random sample of the rows emitted to
+// it, so what a changefeed is sending can be looked at without a consumer.
+// Nothing is sampled unless the verbosity of this file is at least
+// debugTapVerbosity, so it costs a verbosity check per row otherwise. Rows are
+// logged before they're passed on and whether they're sampled has no effect on
+// their delivery.
+type debugTapSink struct {
+	wrapped    Sink
+	sampleRate float64
+	// logf is log.Infof, except in tests.
+	logf func(ctx context.Context, format string, args ...interface{})
+}
+
+func makeDebugTapSink(s Sink, sampleRate float64) *debugTapSink {
+	return &debugTapSink{wrapped: s, sampleRate: sampleRate, logf: log.Infof}
+}
+
+// tap logs the row if it's sampled.
+func (s *debugTapSink) tap(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, updated hlc.Timestamp,
+) {
+	if !log.V(debugTapVerbosity) || rand.Float64() >= s.sampleRate {
+		return
+	}
+	s.logf(ctx, `sampled row: topic=%s updated=%s key=%q value=%q`,
+		table.Name, updated, key, value)
+}
+
+// EmitRow implements the Sink interface.
+func (s *debugTapSink) EmitRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, updated hlc.Timestamp,
+) error {
+	s.tap(ctx, table, key, value, updated)
+	return s.wrapped.EmitRow(ctx, table, key, value, updated)
+}
+
+// EmitRowWithPartitionHint implements the PartitionHintEmitter interface.
+func (s *debugTapSink) EmitRowWithPartitionHint(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	key, value []byte,
+	hint partitionHint,
+	updated hlc.Timestamp,
+) error {
+	s.tap(ctx, table, key, value, updated)
+	return emitRowWithPartitionHint(ctx, s.wrapped, table, key, value, hint, updated)
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *debugTapSink) EmitResolvedTimestamp(
+	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
+) error {
+	return s.wrapped.EmitResolvedTimestamp(ctx, encoder, resolved)
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *debugTapSink) EmitSchemaChange(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	oldVersion, newVersion sqlbase.DescriptorVersion,
+) error {
+	return s.wrapped.EmitSchemaChange(ctx, table, oldVersion, newVersion)
+}
+
+// Flush implements the Sink interface.
+func (s *debugTapSink) Flush(ctx context.Context, ts hlc.Timestamp) error {
+	return s.wrapped.Flush(ctx, ts)
+}
+
+// FlushTable implements the TableFlusher interface.
+func (s *debugTapSink) FlushTable(ctx context.Context, tableName string, ts hlc.Timestamp) error {
+	return flushTable(ctx, s.wrapped, tableName, ts)
+}
+
+// Ping implements the Pinger interface.
+func (s *debugTapSink) Ping(ctx context.Context) error {
+	return pingSink(ctx, s.wrapped)
+}
+
+// SetHighWater implements the HighWaterSetter interface.
+func (s *debugTapSink) SetHighWater(highWater hlc.Timestamp) {
+	setSinkHighWater(s.wrapped, highWater)
+}
+
+// EmitFeedLifecycle implements the LifecycleEmitter interface.
+func (s *debugTapSink) EmitFeedLifecycle(
+	ctx context.Context, phase feedPhase, ts hlc.Timestamp,
+) error {
+	return emitFeedLifecycle(ctx, s.wrapped, phase, ts)
+}
+
+// InflightCount implements the InflightCounter interface.
+func (s *debugTapSink) InflightCount() int64 {
+	return sinkInflightCount(s.wrapped)
+}
+
+// SetBackfillMode implements the BackfillModeSetter interface.
+func (s *debugTapSink) SetBackfillMode(backfill bool) {
+	if b, ok := s.wrapped.(BackfillModeSetter); ok {
+		b.SetBackfillMode(backfill)
+	}
+}
+
+// SetMetrics implements the MetricsSetter interface.
+func (s *debugTapSink) SetMetrics(metrics *Metrics, nodeID roachpb.NodeID) {
+	setSinkMetrics(s.wrapped, metrics, nodeID)
+}
+
+// ResumeFromState implements the StateResumer interface.
+func (s *debugTapSink) ResumeFromState(ctx context.Context, spans []roachpb.Span) error {
+	return resumeSinkFromState(ctx, s.wrapped, spans)
+}
+
+// TakeChangedTopics implements the ChangedTopicsTracker interface.
+func (s *debugTapSink) TakeChangedTopics() []string {
+	return takeSinkChangedTopics(s.wrapped)
+}
+
+// NoteChangedTopic implements the ChangedTopicsTracker interface.
+func (s *debugTapSink) NoteChangedTopic(topic string) {
+	noteSinkChangedTopic(s.wrapped, topic)
+}
+
+// TakeCompletedFiles implements the CompletedFilesTracker interface.
+func (s *debugTapSink) TakeCompletedFiles() []string {
+	return takeSinkCompletedFiles(s.wrapped)
+}
+
+// NoteCompletedFile implements the CompletedFilesTracker interface.
+func (s *debugTapSink) NoteCompletedFile(filename string) {
+	noteSinkCompletedFile(s.wrapped, filename)
+}
+
+// CombinesTopicResolved implements the TopicResolvedCombiner interface.
+func (s *debugTapSink) CombinesTopicResolved() bool {
+	return sinkCombinesTopicResolved(s.wrapped)
+}
+
+// SetCombinedTopicResolved implements the TopicResolvedCombiner interface.
+func (s *debugTapSink) SetCombinedTopicResolved(topicResolved map[string]hlc.Timestamp) {
+	setSinkCombinedTopicResolved(s.wrapped, topicResolved)
+}
+
+// EmitsTopicResolved implements the TopicResolvedEmitter interface.
+func (s *debugTapSink) EmitsTopicResolved() bool {
+	return sinkEmitsTopicResolved(s.wrapped)
+}
+
+// EmitTopicResolvedTimestamp implements the TopicResolvedEmitter interface.
+func (s *debugTapSink) EmitTopicResolvedTimestamp(
+	ctx context.Context, encoder Encoder, topic string, resolved hlc.Timestamp,
+) error {
+	return emitSinkTopicResolvedTimestamp(ctx, s.wrapped, encoder, topic, resolved)
+}
+
+// Capabilities implements the Sink interface.
+func (s *debugTapSink) Capabilities() SinkCapabilities {
+	return s.wrapped.Capabilities()
+}
+
+// Close implements the Sink interface.
+func (s *debugTapSink) Close() error {
+	return s.wrapped.Close()
+}
+
+// CloseAndDrain implements the Drainer interface.
+func (s *debugTapSink) CloseAndDrain(ctx context.Context) ([]MessageRef, error) {
+	return closeAndDrainSink(ctx, s.wrapped)
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugTapSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	q := url.Values{}
+	q.Set(sinkParamDebugSampleRate, `1`)
+	sampleRate, err := consumeSinkDebugSampleRate(q)
+	require.NoError(t, err)
+	require.Empty(t, q)
+	require.Equal(t, 1.0, sampleRate)
+	for _, str := range []string{`0`, `-0.5`, `1.5`, `NaN`} {
+		q.Set(sinkParamDebugSampleRate, str)
+		_, err = consumeSinkDebugSampleRate(q)
+		require.EqualError(t, err,
+			`debug_sample_rate must be greater than 0 and at most 1: `+str)
+	}
+
+	buf := &bufferSink{}
+	s := makeDebugTapSink(buf, sampleRate)
+	var logged []string
+	s.logf = func(_ context.Context, format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+
+	// Nothing is sampled below the verbosity.
+	ctx := context.Background()
+	table := &sqlbase.TableDescriptor{Name: `t`}
+	updated := hlc.Timestamp{WallTime: 1}
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`k1`), []byte(`v1`), updated))
+	require.Empty(t, logged)
+
+	require.NoError(t, log.SetVModule(fmt.Sprintf(`sink_debugtap=%d`, debugTapVerbosity)))
+	defer func() { require.NoError(t, log.SetVModule(``)) }()
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`k2`), []byte(`v2`), updated))
+	require.Equal(t, []string{
+		`sampled row: topic=t updated=0.000000001,0 key="k2" value="v2"`,
+	}, logged)
+
+	// Sampled or not, every row is delivered.
+	require.Len(t, buf.buf, 2)
+}
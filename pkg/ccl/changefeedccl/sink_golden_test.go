@@ -0,0 +1,244 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/datadriven"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+// goldenSinkRows are the rows emitted to every sink by TestSinkGolden, in
+// order, followed by a resolved timestamp of goldenSinkResolved.
+var goldenSinkRows = []struct {
+	table      string
+	key, value string
+	updated    hlc.Timestamp
+}{
+	{`foo`, `[1]`, `{"a": 1}`, hlc.Timestamp{WallTime: int64(1 * time.Second)}},
+	{`bar`, `[1]`, `{"b": 1}`, hlc.Timestamp{WallTime: int64(2 * time.Second)}},
+	{`foo`, `[3]`, `{"a": 3}`, hlc.Timestamp{WallTime: int64(3 * time.Second)}},
+}
+
+var goldenSinkResolved = hlc.Timestamp{WallTime: int64(4 * time.Second)}
+
+var goldenSinkTargets = jobspb.ChangefeedTargets{
+	0: jobspb.ChangefeedTarget{StatementTimeName: `foo`},
+	1: jobspb.ChangefeedTarget{StatementTimeName: `bar`},
+}
+
+// emitGoldenSinkRows emits goldenSinkRows to the sink, flushes it and then
+// emits goldenSinkResolved, like a changefeed would.
+func emitGoldenSinkRows(t *testing.T, s Sink) {
+	ctx := context.Background()
+	for _, row := range goldenSinkRows {
+		table := &sqlbase.TableDescriptor{Name: row.table}
+		require.NoError(t, s.EmitRow(ctx, table, []byte(row.key), []byte(row.value), row.updated))
+	}
+	require.NoError(t, s.Flush(ctx, goldenSinkResolved))
+	e := makeJSONEncoder(nil /* opts */)
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, e, goldenSinkResolved))
+}
+
+// TestSinkGolden runs goldenSinkRows through each sink, with its downstream
+// replaced by a fake or a local equivalent, and compares what the sink wrote
+// with testdata/sink_golden, to catch accidental changes to the formats that
+// consumers parse. After an intentional change, run it with -rewrite and check
+// the diff of the testdata.
+//
+// The commands are `kafka`, `cloudstorage` and `sql` (backed by a test
+// server). The arguments of `kafka` are sink params, while `cloudstorage` only
+// takes `bucket_size` and `record_separator`.
+func TestSinkGolden(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	datadriven.RunTest(t, `testdata/sink_golden`, func(d *datadriven.TestData) string {
+		switch d.Cmd {
+		case `kafka`:
+			return goldenKafka(t, d)
+		case `cloudstorage`:
+			return goldenCloudStorage(t, d)
+		case `sql`:
+			return goldenSQL(t)
+		default:
+			d.Fatalf(t, `unknown command: %s`, d.Cmd)
+			return ``
+		}
+	})
+}
+
+// goldenKafka returns the messages sent to the producer, one per line, as
+// `<topic>: <key>-><value>`. Messages that are addressed to a partition, rather
+// than partitioned by the producer, have `[<partition>]` after the topic. The
+// messages are sorted by topic, since resolved timestamps are emitted to the
+// topics in no particular order, but otherwise kept in the order they were sent.
+func goldenKafka(t *testing.T, d *datadriven.TestData) string {
+	q := url.Values{}
+	for _, arg := range d.CmdArgs {
+		q[arg.Key] = arg.Vals
+	}
+	cfg, err := consumeKafkaSinkConfig(q)
+	require.NoError(t, err)
+	require.Empty(t, q)
+
+	client := &fakeKafkaClient{partitions: map[string][]int32{
+		cfg.kafkaTopicPrefix + `foo`: {0, 1},
+		cfg.kafkaTopicPrefix + `bar`: {0},
+	}}
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 16),
+		successesCh: make(chan *sarama.ProducerMessage, 16),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	ctx := context.Background()
+	s, err := makeKafkaSink(ctx, cfg, `golden:9092`, goldenSinkTargets,
+		func([]string, *sarama.Config) (sarama.Client, sarama.AsyncProducer, error) {
+			return client, p, nil
+		})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+
+	// Rows are only acknowledged once they've all been sent, so Flush doesn't
+	// block until then.
+	for _, row := range goldenSinkRows {
+		table := &sqlbase.TableDescriptor{Name: row.table}
+		require.NoError(t, s.EmitRow(ctx, table, []byte(row.key), []byte(row.value), row.updated))
+	}
+	e := makeJSONEncoder(nil /* opts */)
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, e, goldenSinkResolved))
+	var msgs []*sarama.ProducerMessage
+	for len(p.inputCh) > 0 {
+		m := <-p.inputCh
+		msgs = append(msgs, m)
+		p.successesCh <- m
+	}
+	require.NoError(t, s.Flush(ctx, goldenSinkResolved))
+
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Topic < msgs[j].Topic })
+	var buf strings.Builder
+	for _, m := range msgs {
+		var key, value []byte
+		if m.Key != nil {
+			key, err = m.Key.Encode()
+			require.NoError(t, err)
+		}
+		if m.Value != nil {
+			value, err = m.Value.Encode()
+			require.NoError(t, err)
+		}
+		buf.WriteString(m.Topic)
+		if _, isRow := m.Metadata.(kafkaMessageMetadata); !isRow && key == nil {
+			fmt.Fprintf(&buf, `[%d]`, m.Partition)
+		}
+		fmt.Fprintf(&buf, ": %s->%s", key, value)
+		for _, h := range m.Headers {
+			fmt.Fprintf(&buf, ` %s=%s`, h.Key, h.Value)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// goldenCloudStorage returns the files written to storage, one per line, as
+// `<filename>: <quoted contents>`, in lexicographic order. The sink's random
+// uniquer is replaced by `golden` so that the filenames are stable.
+func goldenCloudStorage(t *testing.T, d *datadriven.TestData) string {
+	ctx := context.Background()
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	cfg := cloudStorageSinkConfig{bucketSize: time.Second}
+	for _, arg := range d.CmdArgs {
+		switch arg.Key {
+		case sinkParamBucketSize:
+			var err error
+			cfg.bucketSize, err = time.ParseDuration(arg.Vals[0])
+			require.NoError(t, err)
+		case sinkParamRecordSeparator:
+			cfg.recordSeparator = arg.Vals[0]
+		default:
+			d.Fatalf(t, `unknown argument: %s`, arg.Key)
+		}
+	}
+	s, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+	s.(*cloudStorageSink).sinkID = `golden`
+	emitGoldenSinkRows(t, s)
+
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var buf strings.Builder
+	for _, info := range infos {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		require.NoError(t, err)
+		fmt.Fprintf(&buf, "%s: %q\n", info.Name(), contents)
+	}
+	return buf.String()
+}
+
+// goldenSQL returns the rows of the sql sink's table, one per line, as
+// `<topic>[<partition>]: <key>-><value>` or, for resolved timestamps,
+// `<topic>[<partition>]: resolved <resolved>`, in the order a reader of each
+// partition sees them.
+func goldenSQL(t *testing.T) string {
+	ctx := context.Background()
+	srv, sqlDBRaw, _ := serverutils.StartServer(t, base.TestServerArgs{UseDatabase: "d"})
+	defer srv.Stopper().Stop(ctx)
+	sqlDB := sqlutils.MakeSQLRunner(sqlDBRaw)
+	sqlDB.Exec(t, `CREATE DATABASE d`)
+
+	sinkURL, cleanup := sqlutils.PGUrl(t, srv.ServingAddr(), t.Name(), url.User(security.RootUser))
+	defer cleanup()
+	sinkURL.Path = `d`
+
+	s, err := makeSQLSink(sinkURL.String(), `sink`, false /* skipCreate */, goldenSinkTargets)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+	emitGoldenSinkRows(t, s)
+	require.NoError(t, s.Flush(ctx, goldenSinkResolved))
+
+	rows := sqlDB.Query(t, `SELECT topic, partition, key, value, resolved FROM sink `+
+		`ORDER BY topic, partition, message_id`)
+	defer rows.Close()
+	var buf strings.Builder
+	for rows.Next() {
+		var topic string
+		var partition int32
+		var key, value, resolved []byte
+		require.NoError(t, rows.Scan(&topic, &partition, &key, &value, &resolved))
+		if resolved != nil {
+			fmt.Fprintf(&buf, "%s[%d]: resolved %s\n", topic, partition, resolved)
+		} else {
+			fmt.Fprintf(&buf, "%s[%d]: %s->%s\n", topic, partition, key, value)
+		}
+	}
+	require.NoError(t, rows.Err())
+	return buf.String()
+}
@@ -0,0 +1,367 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/pkg/errors"
+)
+
+const (
+	// kafkaClusterFailurePolicyFailFast fails the changefeed when an extra
+	// cluster fails, like when the sink URI's cluster does.
+	kafkaClusterFailurePolicyFailFast = `fail_fast`
+	// kafkaClusterFailurePolicyBestEffort logs the failures of an extra
+	// cluster and otherwise ignores them.
+	kafkaClusterFailurePolicyBestEffort = `best_effort`
+)
+
+// kafkaExtraClusterFlushTimeout is how much longer than the primary a best
+// effort extra cluster may take to flush before it's left out.
+const kafkaExtraClusterFlushTimeout = 30 * time.Second
+
+// kafkaMultiClusterSink emits everything to the kafka cluster of the sink URI,
+// the primary, and to the cluster of each `extra_bootstrap_servers` sink param,
+// so that one changefeed is delivered to several clusters, like one in each
+// region for disaster recovery. Each cluster needs its own producer, so each
+// has its own kafkaSink, all made with the same config. A Flush waits for every
+// cluster to acknowledge everything, flushing them all at once, so it takes as
+// long as the slowest cluster instead of the sum of them, and the resolved
+// timestamps of the changefeed only move on once every cluster is caught up.
+//
+// A failure of the primary always fails the changefeed, as it would without
+// extra clusters. So does a failure of an extra cluster with the default
+// `extra_cluster_failure_policy` of `fail_fast`, so every cluster gets every
+// row, with the usual retries. With `best_effort`, the failures of an extra
+// cluster are logged and otherwise ignored, so it can't stop the changefeed.
+// Nor can it hold up a Flush for more than extraFlushTimeout past the primary:
+// a cluster that's still flushing by then is left out. The rows and resolved
+// timestamps that it missed aren't resent, and an extra cluster that's left
+// out, or that can't be connected to when the sink is made, stays left out
+// until the changefeed is restarted.
+type kafkaMultiClusterSink struct {
+	primary *kafkaSink
+	extra   []*kafkaSink
+	// extraBootstrapServers are the bootstrap servers of each of extra, for
+	// errors.
+	extraBootstrapServers []string
+	bestEffort            bool
+	// extraFlushTimeout is kafkaExtraClusterFlushTimeout, except in tests.
+	extraFlushTimeout time.Duration
+	// logCtx is what the sinks of extra clusters are closed in the background
+	// with, see sinkLogCtx.
+	logCtx context.Context
+}
+
+func makeKafkaMultiClusterSink(
+	ctx context.Context,
+	cfg kafkaSinkConfig,
+	bootstrapServers string,
+	targets jobspb.ChangefeedTargets,
+	newClientFn kafkaClientFactory,
+) (Sink, error) {
+	primary, err := makeKafkaSink(ctx, cfg, bootstrapServers, targets, newClientFn)
+	if err != nil {
+		return nil, err
+	}
+	s := &kafkaMultiClusterSink{
+		primary:           primary.(*kafkaSink),
+		bestEffort:        cfg.extraClusterFailurePolicy == kafkaClusterFailurePolicyBestEffort,
+		extraFlushTimeout: kafkaExtraClusterFlushTimeout,
+		logCtx:            sinkLogCtx(ctx),
+	}
+	for _, extraBootstrapServers := range cfg.extraBootstrapServers {
+		extra, err := makeKafkaSink(ctx, cfg, extraBootstrapServers, targets, newClientFn)
+		if err != nil {
+			if s.bestEffort {
+				log.Warningf(ctx, `leaving out kafka cluster %s: %v`,
+					extraBootstrapServers, err)
+				continue
+			}
+			_ = s.Close()
+			return nil, err
+		}
+		s.extra = append(s.extra, extra.(*kafkaSink))
+		s.extraBootstrapServers = append(s.extraBootstrapServers, extraBootstrapServers)
+	}
+	return s, nil
+}
+
+// SetMetrics implements the MetricsSetter interface for the sinks of every
+// cluster.
+func (s *kafkaMultiClusterSink) SetMetrics(metrics *Metrics, _ roachpb.NodeID) {
+	s.primary.metrics = metrics
+	for _, extra := range s.extra {
+		extra.metrics = metrics
+	}
+}
+
+// extraErr handles the error of the extra cluster with the given index
+// according to the failure policy.
+func (s *kafkaMultiClusterSink) extraErr(ctx context.Context, i int, err error) error {
+	if err == nil {
+		return nil
+	}
+	// Wrap keeps the cause, so a rowSinkError or a retryableSinkError is
+	// still recognized.
+	err = errors.Wrapf(err, `kafka cluster %s`, s.extraBootstrapServers[i])
+	if s.bestEffort {
+		log.Warningf(ctx, `%v`, err)
+		return nil
+	}
+	return err
+}
+
+// each calls fn with the sink of every cluster in turn, the primary first, and
+// returns the first error that isn't ignored.
+func (s *kafkaMultiClusterSink) each(ctx context.Context, fn func(*kafkaSink) error) error {
+	if err := fn(s.primary); err != nil {
+		return err
+	}
+	for i, extra := range s.extra {
+		if err := s.extraErr(ctx, i, fn(extra)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachConcurrently is like each, but calls fn for every cluster at once and
+// waits for all of them. With best_effort, once the primary succeeds, the
+// extra clusters get extraFlushTimeout to catch up. The context of those that
+// don't is canceled, and they're left out with leaveOut.
+func (s *kafkaMultiClusterSink) eachConcurrently(
+	ctx context.Context, fn func(context.Context, *kafkaSink) error,
+) error {
+	extraCtx, cancelExtra := context.WithCancel(ctx)
+	defer cancelExtra()
+	errs := make([]error, len(s.extra))
+	doneCh := make(chan int, len(s.extra))
+	for i := range s.extra {
+		go func(i int) {
+			errs[i] = fn(extraCtx, s.extra[i])
+			doneCh <- i
+		}(i)
+	}
+	primaryErr := fn(ctx, s.primary)
+
+	timer := timeutil.NewTimer()
+	defer timer.Stop()
+	var timeoutCh <-chan time.Time
+	if s.bestEffort && primaryErr == nil {
+		timer.Reset(s.extraFlushTimeout)
+		timeoutCh = timer.C
+	}
+	done := make([]bool, len(s.extra))
+	var lagging []int
+	for remaining := len(s.extra); remaining > 0; {
+		select {
+		case i := <-doneCh:
+			done[i] = true
+			remaining--
+		case <-timeoutCh:
+			timer.Read = true
+			timeoutCh = nil
+			for i := range s.extra {
+				if !done[i] {
+					lagging = append(lagging, i)
+				}
+			}
+			cancelExtra()
+		}
+	}
+	if primaryErr != nil {
+		return primaryErr
+	}
+	for i, err := range errs {
+		if isLagging(lagging, i) {
+			continue
+		}
+		if err := s.extraErr(ctx, i, err); err != nil {
+			return err
+		}
+	}
+	s.leaveOut(ctx, lagging)
+	return nil
+}
+
+// isLagging returns whether i is one of the sorted indexes in lagging.
+func isLagging(lagging []int, i int) bool {
+	j := sort.SearchInts(lagging, i)
+	return j < len(lagging) && lagging[j] == i
+}
+
+// leaveOut stops emitting to the extra clusters with the given sorted indexes
+// and closes their sinks in the background, since a cluster that's too slow
+// to flush may be just as slow to close.
+func (s *kafkaMultiClusterSink) leaveOut(ctx context.Context, lagging []int) {
+	if len(lagging) == 0 {
+		return
+	}
+	var extra []*kafkaSink
+	var extraBootstrapServers []string
+	for i := range s.extra {
+		if !isLagging(lagging, i) {
+			extra = append(extra, s.extra[i])
+			extraBootstrapServers = append(extraBootstrapServers, s.extraBootstrapServers[i])
+			continue
+		}
+		log.Warningf(ctx, `leaving out kafka cluster %s, which took over %s longer to flush `+
+			`than the primary`, s.extraBootstrapServers[i], s.extraFlushTimeout)
+		go func(k *kafkaSink, bootstrapServers string) {
+			if err := k.Close(); err != nil {
+				log.Warningf(s.logCtx, `closing kafka cluster %s: %v`, bootstrapServers, err)
+			}
+		}(s.extra[i], s.extraBootstrapServers[i])
+	}
+	s.extra, s.extraBootstrapServers = extra, extraBootstrapServers
+}
+
+// EmitRow implements the Sink interface.
+func (s *kafkaMultiClusterSink) EmitRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, updated hlc.Timestamp,
+) error {
+	return s.each(ctx, func(k *kafkaSink) error {
+		return k.EmitRow(ctx, table, key, value, updated)
+	})
+}
+
+// EmitRowWithPartitionHint implements the PartitionHintEmitter interface.
+func (s *kafkaMultiClusterSink) EmitRowWithPartitionHint(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	key, value []byte,
+	hint partitionHint,
+	updated hlc.Timestamp,
+) error {
+	return s.each(ctx, func(k *kafkaSink) error {
+		return k.EmitRowWithPartitionHint(ctx, table, key, value, hint, updated)
+	})
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *kafkaMultiClusterSink) EmitResolvedTimestamp(
+	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
+) error {
+	return s.each(ctx, func(k *kafkaSink) error {
+		return k.EmitResolvedTimestamp(ctx, encoder, resolved)
+	})
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *kafkaMultiClusterSink) EmitSchemaChange(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	oldVersion, newVersion sqlbase.DescriptorVersion,
+) error {
+	return s.each(ctx, func(k *kafkaSink) error {
+		return k.EmitSchemaChange(ctx, table, oldVersion, newVersion)
+	})
+}
+
+// Flush implements the Sink interface.
+func (s *kafkaMultiClusterSink) Flush(ctx context.Context, ts hlc.Timestamp) error {
+	return s.eachConcurrently(ctx, func(ctx context.Context, k *kafkaSink) error {
+		return k.Flush(ctx, ts)
+	})
+}
+
+// FlushTable implements the TableFlusher interface.
+func (s *kafkaMultiClusterSink) FlushTable(
+	ctx context.Context, tableName string, ts hlc.Timestamp,
+) error {
+	return s.eachConcurrently(ctx, func(k *kafkaSink) error {
+		return k.FlushTable(ctx, tableName, ts)
+	})
+}
+
+// Ping implements the Pinger interface.
+func (s *kafkaMultiClusterSink) Ping(ctx context.Context) error {
+	return s.each(ctx, func(k *kafkaSink) error {
+		return k.Ping(ctx)
+	})
+}
+
+// SetHighWater implements the HighWaterSetter interface.
+func (s *kafkaMultiClusterSink) SetHighWater(highWater hlc.Timestamp) {
+	s.primary.SetHighWater(highWater)
+	for _, extra := range s.extra {
+		extra.SetHighWater(highWater)
+	}
+}
+
+// EmitFeedLifecycle implements the LifecycleEmitter interface.
+func (s *kafkaMultiClusterSink) EmitFeedLifecycle(
+	ctx context.Context, phase feedPhase, ts hlc.Timestamp,
+) error {
+	return s.each(ctx, func(k *kafkaSink) error {
+		return k.EmitFeedLifecycle(ctx, phase, ts)
+	})
+}
+
+// InflightCount implements the InflightCounter interface.
+func (s *kafkaMultiClusterSink) InflightCount() int64 {
+	inflight := s.primary.InflightCount()
+	for _, extra := range s.extra {
+		inflight += extra.InflightCount()
+	}
+	return inflight
+}
+
+// Capabilities implements the Sink interface.
+func (s *kafkaMultiClusterSink) Capabilities() SinkCapabilities {
+	return s.primary.Capabilities()
+}
+
+// CloseAndDrain implements the Drainer interface. The clusters are drained at
+// once and each reports what it didn't get, so a message missed by several is
+// reported once for each of them, even with `best_effort`.
+func (s *kafkaMultiClusterSink) CloseAndDrain(ctx context.Context) ([]MessageRef, error) {
+	sinks := append([]*kafkaSink{s.primary}, s.extra...)
+	undelivered := make([][]MessageRef, len(sinks))
+	errs := make([]error, len(sinks))
+	var wg sync.WaitGroup
+	for i := range sinks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			undelivered[i], errs[i] = sinks[i].CloseAndDrain(ctx)
+		}(i)
+	}
+	wg.Wait()
+	var all []MessageRef
+	var err error
+	for i := range sinks {
+		all = append(all, undelivered[i]...)
+		if err == nil {
+			err = errs[i]
+		}
+	}
+	return all, err
+}
+
+// Close implements the Sink interface.
+func (s *kafkaMultiClusterSink) Close() error {
+	err := s.primary.Close()
+	for _, extra := range s.extra {
+		if extraErr := extra.Close(); err == nil {
+			err = extraErr
+		}
+	}
+	return err
+}
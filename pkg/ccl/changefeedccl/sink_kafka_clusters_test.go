@@ -0,0 +1,122 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKafkaMultiClusterSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	for params, expectedErr := range map[string]string{
+		`extra_cluster_failure_policy=nope`: `unknown extra_cluster_failure_policy: nope`,
+		`extra_bootstrap_servers=b:9092&resolved_changed_topics_only=true`: `` +
+			`resolved_changed_topics_only is not supported with extra_bootstrap_servers`,
+	} {
+		q, err := url.ParseQuery(params)
+		require.NoError(t, err)
+		_, err = consumeKafkaSinkConfig(q)
+		require.EqualError(t, err, expectedErr)
+	}
+	q, err := url.ParseQuery(`extra_bootstrap_servers=b:9092,c:9092&extra_bootstrap_servers=d:9092`)
+	require.NoError(t, err)
+	cfg, err := consumeKafkaSinkConfig(q)
+	require.NoError(t, err)
+	require.Equal(t, []string{`b:9092,c:9092`, `d:9092`}, cfg.extraBootstrapServers)
+
+	// Only the clusters in producers can be connected to.
+	var producers map[string]asyncProducerMock
+	newClientFn := func(b []string, _ *sarama.Config) (sarama.Client, sarama.AsyncProducer, error) {
+		p, ok := producers[strings.Join(b, `,`)]
+		if !ok {
+			return nil, nil, errors.New(`no brokers`)
+		}
+		return &fakeKafkaClient{partitions: map[string][]int32{`t`: {0}}}, p, nil
+	}
+	resetProducers := func(clusters ...string) {
+		producers = make(map[string]asyncProducerMock)
+		for _, cluster := range clusters {
+			producers[cluster] = asyncProducerMock{
+				inputCh:     make(chan *sarama.ProducerMessage, 1),
+				successesCh: make(chan *sarama.ProducerMessage, 1),
+				errorsCh:    make(chan *sarama.ProducerError, 1),
+			}
+		}
+	}
+	targets := jobspb.ChangefeedTargets{0: jobspb.ChangefeedTarget{StatementTimeName: `t`}}
+	table := &sqlbase.TableDescriptor{Name: `t`}
+
+	// An extra cluster that can't be connected to fails the sink, unless it's
+	// best effort, in which case it's left out.
+	resetProducers(`a:9092`, `b:9092`)
+	cfg = kafkaSinkConfig{extraBootstrapServers: []string{`b:9092`, `c:9092`}}
+	_, err = makeKafkaMultiClusterSink(ctx, cfg, `a:9092`, targets, newClientFn)
+	require.Regexp(t, `connecting to kafka: c:9092: no brokers`, err)
+
+	resetProducers(`a:9092`, `b:9092`)
+	cfg.extraClusterFailurePolicy = kafkaClusterFailurePolicyBestEffort
+	sink, err := makeKafkaMultiClusterSink(ctx, cfg, `a:9092`, targets, newClientFn)
+	require.NoError(t, err)
+	s := sink.(*kafkaMultiClusterSink)
+	require.Equal(t, []string{`b:9092`}, s.extraBootstrapServers)
+
+	// Every row goes to every cluster and is inflight until each of them has
+	// acknowledged it. A best effort cluster's failures don't fail the flush.
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`k`), []byte(`v`), zeroTS))
+	require.Equal(t, int64(2), s.InflightCount())
+	primary, extra := producers[`a:9092`], producers[`b:9092`]
+	m := <-primary.inputCh
+	require.Equal(t, sarama.ByteEncoder(`k`), m.Key)
+	primary.successesCh <- m
+	m = <-extra.inputCh
+	require.Equal(t, sarama.ByteEncoder(`k`), m.Key)
+	extra.errorsCh <- &sarama.ProducerError{Msg: m, Err: errors.New(`boom`)}
+	require.NoError(t, s.Flush(ctx, zeroTS))
+	require.Equal(t, int64(0), s.InflightCount())
+
+	// With fail fast, they do.
+	s.bestEffort = false
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`k`), []byte(`v`), zeroTS))
+	primary.successesCh <- <-primary.inputCh
+	m = <-extra.inputCh
+	extra.errorsCh <- &sarama.ProducerError{Msg: m, Err: errors.New(`boom`)}
+	err = s.Flush(ctx, zeroTS)
+	require.Regexp(t, `kafka cluster b:9092: .*boom`, err)
+	require.True(t, isRetryableSinkError(err), `expected retryable error got: %+v`, err)
+
+	// A best effort cluster that's still flushing well after the primary is
+	// done is left out, so it doesn't hold up this flush or get later rows.
+	s.bestEffort = true
+	s.extraFlushTimeout = time.Millisecond
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`k`), []byte(`v`), zeroTS))
+	primary.successesCh <- <-primary.inputCh
+	<-extra.inputCh
+	require.NoError(t, s.Flush(ctx, zeroTS))
+	require.Empty(t, s.extra)
+	require.Empty(t, s.extraBootstrapServers)
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`k`), []byte(`v`), zeroTS))
+	primary.successesCh <- <-primary.inputCh
+	require.NoError(t, s.Flush(ctx, zeroTS))
+	require.Len(t, extra.inputCh, 0)
+
+	require.NoError(t, s.Close())
+}
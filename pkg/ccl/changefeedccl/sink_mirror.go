@@ -0,0 +1,450 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"bufio"
+	"context"
+	gojson "encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/pkg/errors"
+)
+
+// debugMirrorDefaultMaxFileSize is the size of a debug file past which it's
+// rotated, unless the `debug_max_file_size` sink param is set.
+const debugMirrorDefaultMaxFileSize = 64 << 20 // 64 MiB
+
+// debugMirrorConfig holds the sink params of a debugMirrorSink.
+type debugMirrorConfig struct {
+	// dir, if non-empty, is the local directory that the debug file is written
+	// to. Empty disables mirroring.
+	dir string
+	// maxFileSize is the size in bytes past which the debug file is rotated.
+	maxFileSize int64
+}
+
+// consumeSinkDebugMirrorConfig parses and removes the `debug_dir` and
+// `debug_max_file_size` sink params from q.
+func consumeSinkDebugMirrorConfig(q url.Values) (debugMirrorConfig, error) {
+	cfg := debugMirrorConfig{
+		dir:         q.Get(sinkParamDebugDir),
+		maxFileSize: debugMirrorDefaultMaxFileSize,
+	}
+	q.Del(sinkParamDebugDir)
+	if str := q.Get(sinkParamDebugMaxFileSize); str != `` {
+		if cfg.dir == `` {
+			return debugMirrorConfig{}, errors.Errorf(`%s requires %s`,
+				sinkParamDebugMaxFileSize, sinkParamDebugDir)
+		}
+		var err error
+		if cfg.maxFileSize, err = humanizeutil.ParseBytes(str); err != nil {
+			return debugMirrorConfig{}, errors.Wrapf(err, `parsing %s`, sinkParamDebugMaxFileSize)
+		}
+		if cfg.maxFileSize <= 0 {
+			return debugMirrorConfig{}, errors.Errorf(`%s must be positive: %s`,
+				sinkParamDebugMaxFileSize, str)
+		}
+	}
+	q.Del(sinkParamDebugMaxFileSize)
+	return cfg, nil
+}
+
+// debugMirrorRecord is one line of a debug file. Keys and values that aren't
+// valid UTF-8, such as avro, are base64 encoded in the `_base64` fields
+// instead.
+type debugMirrorRecord struct {
+	Type        string `json:"type"`
+	Topic       string `json:"topic,omitempty"`
+	Key         string `json:"key,omitempty"`
+	KeyBase64   []byte `json:"key_base64,omitempty"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 []byte `json:"value_base64,omitempty"`
+	// Timestamp is the updated timestamp of a row, the resolved timestamp of a
+	// resolved timestamp and the timestamp of a flush, as a decimal.
+	Timestamp string `json:"ts"`
+}
+
+const (
+	debugMirrorTypeRow      = `row`
+	debugMirrorTypeResolved = `resolved`
+	debugMirrorTypeFlush    = `flush`
+)
+
+// debugMirrorSink wraps a Sink and appends everything that's successfully
+// emitted to it, and every successful flush, to a local NDJSON file, so that
+// what a changefeed sent can be looked at after the fact without capturing it
+// downstream. The file is in the `debug_dir` sink param's directory, which
+// getSink confines to the external IO dir, on the node that runs the sink.
+//
+// Each sink of a job that's open at the same time on a node writes its own
+// file, named `changefeed-<job_id>-<slot>.ndjson`, where the slot is the
+// lowest one that no other open sink of the job on the node is using. A sink
+// made after another one is closed, like when the changefeed restarts, takes
+// over its file and appends to it, so the number of files of a job is bounded
+// by how many of its sinks are ever open at once, not by how many it makes.
+//
+// Once the file is larger than the `debug_max_file_size` sink param, it's
+// renamed to the same name with `.1` appended, replacing any earlier one, and a
+// new file is started, so at most about twice that is kept per slot. Records
+// are buffered, so the file is only guaranteed to be up to date as of the last
+// Flush.
+//
+// The file is closed by Close, and removed if it's empty, like when CREATE
+// CHANGEFEED checks the sink. A failure to write the file never fails the
+// changefeed: it's logged and mirroring stops.
+type debugMirrorSink struct {
+	wrapped     Sink
+	path        string
+	maxFileSize int64
+
+	// f and w are nil once mirroring has stopped.
+	f *os.File
+	w *bufio.Writer
+	// size is the number of bytes written to w since the file was started.
+	size int64
+	// logCtx is what closing the file logs with, see sinkLogCtx.
+	logCtx context.Context
+}
+
+// debugMirrorFiles are the paths of the debug files of the open
+// debugMirrorSinks of this process.
+var debugMirrorFiles struct {
+	syncutil.Mutex
+	open map[string]struct{}
+}
+
+// acquireDebugMirrorFile returns the path of the debug file in dir with the
+// lowest slot that's free for the given job, and takes it until it's released.
+func acquireDebugMirrorFile(dir string, jobID int64) string {
+	debugMirrorFiles.Lock()
+	defer debugMirrorFiles.Unlock()
+	if debugMirrorFiles.open == nil {
+		debugMirrorFiles.open = make(map[string]struct{})
+	}
+	for slot := 0; ; slot++ {
+		path := filepath.Join(dir, fmt.Sprintf(`changefeed-%d-%d.ndjson`, jobID, slot))
+		if _, ok := debugMirrorFiles.open[path]; !ok {
+			debugMirrorFiles.open[path] = struct{}{}
+			return path
+		}
+	}
+}
+
+// releaseDebugMirrorFile frees the slot of a debug file for the next sink.
+func releaseDebugMirrorFile(path string) {
+	debugMirrorFiles.Lock()
+	defer debugMirrorFiles.Unlock()
+	delete(debugMirrorFiles.open, path)
+}
+
+func makeDebugMirrorSink(
+	ctx context.Context, s Sink, cfg debugMirrorConfig, jobID int64,
+) (*debugMirrorSink, error) {
+	if err := os.MkdirAll(cfg.dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, `creating %s`, sinkParamDebugDir)
+	}
+	m := &debugMirrorSink{
+		wrapped:     s,
+		path:        acquireDebugMirrorFile(cfg.dir, jobID),
+		maxFileSize: cfg.maxFileSize,
+		logCtx:      sinkLogCtx(ctx),
+	}
+	if err := m.open(); err != nil {
+		releaseDebugMirrorFile(m.path)
+		return nil, err
+	}
+	return m, nil
+}
+
+// open opens the debug file, appending to it if it already exists.
+func (s *debugMirrorSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, `opening debug file`)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, `opening debug file`)
+	}
+	s.f, s.w, s.size = f, bufio.NewWriter(f), info.Size()
+	return nil
+}
+
+// stop logs err and stops mirroring.
+func (s *debugMirrorSink) stop(ctx context.Context, err error) {
+	log.Warningf(ctx, `no longer mirroring changefeed output to %s: %v`, s.path, err)
+	_ = s.f.Close()
+	s.f, s.w = nil, nil
+}
+
+// rotate moves the current debug file out of the way and starts a new one.
+func (s *debugMirrorSink) rotate() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(s.path, s.path+`.1`); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// record appends a record to the debug file, rotating it first if it's full.
+func (s *debugMirrorSink) record(ctx context.Context, r debugMirrorRecord) {
+	if s.w == nil {
+		return
+	}
+	line, err := gojson.Marshal(r)
+	if err != nil {
+		s.stop(ctx, err)
+		return
+	}
+	line = append(line, '\n')
+	if s.size > 0 && s.size+int64(len(line)) > s.maxFileSize {
+		if err := s.rotate(); err != nil {
+			s.stop(ctx, err)
+			return
+		}
+	}
+	if _, err := s.w.Write(line); err != nil {
+		s.stop(ctx, err)
+		return
+	}
+	s.size += int64(len(line))
+}
+
+func (s *debugMirrorSink) recordRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, updated hlc.Timestamp,
+) {
+	r := debugMirrorRecord{
+		Type:      debugMirrorTypeRow,
+		Topic:     table.Name,
+		Timestamp: tree.TimestampToDecimal(updated).Decimal.String(),
+	}
+	if utf8.Valid(key) {
+		r.Key = string(key)
+	} else {
+		r.KeyBase64 = key
+	}
+	if utf8.Valid(value) {
+		r.Value = string(value)
+	} else {
+		r.ValueBase64 = value
+	}
+	s.record(ctx, r)
+}
+
+// EmitRow implements the Sink interface.
+func (s *debugMirrorSink) EmitRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, updated hlc.Timestamp,
+) error {
+	if err := s.wrapped.EmitRow(ctx, table, key, value, updated); err != nil {
+		return err
+	}
+	s.recordRow(ctx, table, key, value, updated)
+	return nil
+}
+
+// EmitRowWithPartitionHint implements the PartitionHintEmitter interface.
+func (s *debugMirrorSink) EmitRowWithPartitionHint(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	key, value []byte,
+	hint partitionHint,
+	updated hlc.Timestamp,
+) error {
+	err := emitRowWithPartitionHint(ctx, s.wrapped, table, key, value, hint, updated)
+	if err != nil {
+		return err
+	}
+	s.recordRow(ctx, table, key, value, updated)
+	return nil
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *debugMirrorSink) EmitResolvedTimestamp(
+	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
+) error {
+	if err := s.wrapped.EmitResolvedTimestamp(ctx, encoder, resolved); err != nil {
+		return err
+	}
+	s.record(ctx, debugMirrorRecord{
+		Type:      debugMirrorTypeResolved,
+		Timestamp: tree.TimestampToDecimal(resolved).Decimal.String(),
+	})
+	return nil
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *debugMirrorSink) EmitSchemaChange(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	oldVersion, newVersion sqlbase.DescriptorVersion,
+) error {
+	return s.wrapped.EmitSchemaChange(ctx, table, oldVersion, newVersion)
+}
+
+// Flush implements the Sink interface.
+func (s *debugMirrorSink) Flush(ctx context.Context, ts hlc.Timestamp) error {
+	if err := s.wrapped.Flush(ctx, ts); err != nil {
+		return err
+	}
+	s.record(ctx, debugMirrorRecord{
+		Type:      debugMirrorTypeFlush,
+		Timestamp: tree.TimestampToDecimal(ts).Decimal.String(),
+	})
+	if s.w != nil {
+		if err := s.w.Flush(); err != nil {
+			s.stop(ctx, err)
+		}
+	}
+	return nil
+}
+
+// FlushTable implements the TableFlusher interface.
+func (s *debugMirrorSink) FlushTable(
+	ctx context.Context, tableName string, ts hlc.Timestamp,
+) error {
+	return flushTable(ctx, s.wrapped, tableName, ts)
+}
+
+// Ping implements the Pinger interface.
+func (s *debugMirrorSink) Ping(ctx context.Context) error {
+	return pingSink(ctx, s.wrapped)
+}
+
+// SetHighWater implements the HighWaterSetter interface.
+func (s *debugMirrorSink) SetHighWater(highWater hlc.Timestamp) {
+	setSinkHighWater(s.wrapped, highWater)
+}
+
+// EmitFeedLifecycle implements the LifecycleEmitter interface.
+func (s *debugMirrorSink) EmitFeedLifecycle(
+	ctx context.Context, phase feedPhase, ts hlc.Timestamp,
+) error {
+	return emitFeedLifecycle(ctx, s.wrapped, phase, ts)
+}
+
+// InflightCount implements the InflightCounter interface.
+func (s *debugMirrorSink) InflightCount() int64 {
+	return sinkInflightCount(s.wrapped)
+}
+
+// SetBackfillMode implements the BackfillModeSetter interface.
+func (s *debugMirrorSink) SetBackfillMode(backfill bool) {
+	if b, ok := s.wrapped.(BackfillModeSetter); ok {
+		b.SetBackfillMode(backfill)
+	}
+}
+
+// SetMetrics implements the MetricsSetter interface.
+func (s *debugMirrorSink) SetMetrics(metrics *Metrics, nodeID roachpb.NodeID) {
+	setSinkMetrics(s.wrapped, metrics, nodeID)
+}
+
+// ResumeFromState implements the StateResumer interface.
+func (s *debugMirrorSink) ResumeFromState(ctx context.Context, spans []roachpb.Span) error {
+	return resumeSinkFromState(ctx, s.wrapped, spans)
+}
+
+// TakeChangedTopics implements the ChangedTopicsTracker interface.
+func (s *debugMirrorSink) TakeChangedTopics() []string {
+	return takeSinkChangedTopics(s.wrapped)
+}
+
+// NoteChangedTopic implements the ChangedTopicsTracker interface.
+func (s *debugMirrorSink) NoteChangedTopic(topic string) {
+	noteSinkChangedTopic(s.wrapped, topic)
+}
+
+// TakeCompletedFiles implements the CompletedFilesTracker interface.
+func (s *debugMirrorSink) TakeCompletedFiles() []string {
+	return takeSinkCompletedFiles(s.wrapped)
+}
+
+// NoteCompletedFile implements the CompletedFilesTracker interface.
+func (s *debugMirrorSink) NoteCompletedFile(filename string) {
+	noteSinkCompletedFile(s.wrapped, filename)
+}
+
+// CombinesTopicResolved implements the TopicResolvedCombiner interface.
+func (s *debugMirrorSink) CombinesTopicResolved() bool {
+	return sinkCombinesTopicResolved(s.wrapped)
+}
+
+// SetCombinedTopicResolved implements the TopicResolvedCombiner interface.
+func (s *debugMirrorSink) SetCombinedTopicResolved(topicResolved map[string]hlc.Timestamp) {
+	setSinkCombinedTopicResolved(s.wrapped, topicResolved)
+}
+
+// EmitsTopicResolved implements the TopicResolvedEmitter interface.
+func (s *debugMirrorSink) EmitsTopicResolved() bool {
+	return sinkEmitsTopicResolved(s.wrapped)
+}
+
+// EmitTopicResolvedTimestamp implements the TopicResolvedEmitter interface.
+func (s *debugMirrorSink) EmitTopicResolvedTimestamp(
+	ctx context.Context, encoder Encoder, topic string, resolved hlc.Timestamp,
+) error {
+	return emitSinkTopicResolvedTimestamp(ctx, s.wrapped, encoder, topic, resolved)
+}
+
+// Capabilities implements the Sink interface.
+func (s *debugMirrorSink) Capabilities() SinkCapabilities {
+	return s.wrapped.Capabilities()
+}
+
+// Close implements the Sink interface.
+func (s *debugMirrorSink) Close() error {
+	s.closeMirror()
+	return s.wrapped.Close()
+}
+
+// CloseAndDrain implements the Drainer interface. Only what the wrapped sink
+// didn't deliver is reported; the mirror is written out as in Close.
+func (s *debugMirrorSink) CloseAndDrain(ctx context.Context) ([]MessageRef, error) {
+	s.closeMirror()
+	return closeAndDrainSink(ctx, s.wrapped)
+}
+
+// closeMirror writes out and closes the mirror file, if it's open, removes it
+// if it's empty and releases its slot.
+func (s *debugMirrorSink) closeMirror() {
+	defer releaseDebugMirrorFile(s.path)
+	if s.w != nil {
+		empty := s.size == 0
+		if err := s.w.Flush(); err != nil {
+			log.Warningf(s.logCtx, `failed to write %s: %v`, s.path, err)
+		}
+		if err := s.f.Close(); err != nil {
+			log.Warningf(s.logCtx, `failed to close %s: %v`, s.path, err)
+		}
+		if empty {
+			if err := os.Remove(s.path); err != nil {
+				log.Warningf(s.logCtx, `failed to remove %s: %v`, s.path, err)
+			}
+		}
+		s.f, s.w = nil, nil
+	}
+}
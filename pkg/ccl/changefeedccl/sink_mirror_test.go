@@ -0,0 +1,155 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugMirrorSinkConfig(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	cfg, err := consumeSinkDebugMirrorConfig(url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, ``, cfg.dir)
+
+	q := url.Values{sinkParamDebugDir: {`/tmp/cdc`}, sinkParamDebugMaxFileSize: {`1KiB`}}
+	cfg, err = consumeSinkDebugMirrorConfig(q)
+	require.NoError(t, err)
+	require.Empty(t, q)
+	require.Equal(t, debugMirrorConfig{dir: `/tmp/cdc`, maxFileSize: 1 << 10}, cfg)
+
+	_, err = consumeSinkDebugMirrorConfig(url.Values{sinkParamDebugMaxFileSize: {`1KiB`}})
+	require.EqualError(t, err, `debug_max_file_size requires debug_dir`)
+	_, err = consumeSinkDebugMirrorConfig(
+		url.Values{sinkParamDebugDir: {`/tmp/cdc`}, sinkParamDebugMaxFileSize: {`0`}})
+	require.EqualError(t, err, `debug_max_file_size must be positive: 0`)
+}
+
+func TestDebugMirrorSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+	debugDir := filepath.Join(dir, `debug`)
+
+	// A sink that never emits anything leaves no file behind.
+	s, err := makeDebugMirrorSink(ctx, &bufferSink{}, debugMirrorConfig{dir: debugDir}, 7)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	infos, err := ioutil.ReadDir(debugDir)
+	require.NoError(t, err)
+	require.Empty(t, infos)
+
+	buf := &bufferSink{}
+	s, err = makeDebugMirrorSink(ctx, buf, debugMirrorConfig{dir: debugDir, maxFileSize: 256}, 7)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(filepath.Base(s.path), `changefeed-7-`), s.path)
+	lines := func(path string) []string {
+		b, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	}
+
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	table := &sqlbase.TableDescriptor{Name: `foo`}
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`[1]`), []byte(`{"a": 1}`), ts(1)))
+	require.NoError(t, s.EmitRow(ctx, table, []byte{0xff}, nil, ts(2)))
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, testEncoder{}, ts(3)))
+	require.NoError(t, s.Flush(ctx, ts(3)))
+	require.Len(t, buf.buf, 3)
+	require.Equal(t, []string{
+		`{"type":"row","topic":"foo","key":"[1]","value":"{\"a\": 1}","ts":"1.0000000000"}`,
+		`{"type":"row","topic":"foo","key_base64":"/w==","ts":"2.0000000000"}`,
+		`{"type":"resolved","ts":"3.0000000000"}`,
+		`{"type":"flush","ts":"3.0000000000"}`,
+	}, lines(s.path))
+
+	// The next record would take the file past debug_max_file_size, so it's
+	// renamed with `.1` appended and the record starts a new one.
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, testEncoder{}, ts(4)))
+	require.NoError(t, s.Close())
+	require.Equal(t, []string{`{"type":"resolved","ts":"4.0000000000"}`}, lines(s.path))
+	require.Len(t, lines(s.path+`.1`), 4)
+
+	// Failing to write the debug file doesn't fail the sink, it only stops the
+	// mirroring.
+	buf = &bufferSink{}
+	s, err = makeDebugMirrorSink(ctx, buf, debugMirrorConfig{dir: debugDir}, 8)
+	require.NoError(t, err)
+	require.NoError(t, s.f.Close())
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, testEncoder{}, ts(1)))
+	require.NoError(t, s.Flush(ctx, ts(1)))
+	require.Nil(t, s.w)
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, testEncoder{}, ts(2)))
+	require.Len(t, buf.buf, 2)
+	require.NoError(t, s.Close())
+
+	// Sinks of a job that are open at once get their own files. Once one is
+	// closed, the next sink takes over its file and appends to it, so a
+	// restarting changefeed doesn't pile up files.
+	a, err := makeDebugMirrorSink(ctx, &bufferSink{}, debugMirrorConfig{dir: debugDir}, 9)
+	require.NoError(t, err)
+	b, err := makeDebugMirrorSink(ctx, &bufferSink{}, debugMirrorConfig{dir: debugDir}, 9)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(debugDir, `changefeed-9-0.ndjson`), a.path)
+	require.Equal(t, filepath.Join(debugDir, `changefeed-9-1.ndjson`), b.path)
+	require.NoError(t, a.EmitResolvedTimestamp(ctx, testEncoder{}, ts(1)))
+	require.NoError(t, a.Close())
+	a, err = makeDebugMirrorSink(ctx, &bufferSink{}, debugMirrorConfig{dir: debugDir}, 9)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(debugDir, `changefeed-9-0.ndjson`), a.path)
+	require.NoError(t, a.EmitResolvedTimestamp(ctx, testEncoder{}, ts(2)))
+	require.NoError(t, a.Close())
+	require.NoError(t, b.Close())
+	require.Equal(t, []string{
+		`{"type":"resolved","ts":"1.0000000000"}`,
+		`{"type":"resolved","ts":"2.0000000000"}`,
+	}, lines(a.path))
+}
+
+func TestDebugMirrorSinkExternalIODir(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	settings := cluster.MakeTestingClusterSettings()
+	_, err := getSink(ctx, `experimental-metrics://?debug_dir=debug`, map[string]string{},
+		&jsonEncoder{}, nil /* targets */, 0 /* jobID */, settings, TestingKnobs{})
+	require.EqualError(t, err, `debug_dir: local file access is disabled`)
+
+	// The directory is relative to the external IO dir and can't escape it.
+	settings.ExternalIODir = dir
+	_, err = getSink(ctx, `experimental-metrics://?debug_dir=../debug`, map[string]string{},
+		&jsonEncoder{}, nil /* targets */, 0 /* jobID */, settings, TestingKnobs{})
+	require.EqualError(t, err,
+		`debug_dir: local file access to paths outside of external-io-dir is not allowed`)
+	opts := map[string]string{optEnvelope: string(optEnvelopeDiff)}
+	s, err := getSink(ctx, `experimental-metrics://?debug_dir=debug`, opts,
+		&jsonEncoder{}, nil /* targets */, 0 /* jobID */, settings, TestingKnobs{})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	_, err = ioutil.ReadDir(filepath.Join(dir, `debug`))
+	require.NoError(t, err)
+}
@@ -0,0 +1,248 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// sinkRateLimits are the optional `max_rows_per_sec` and `max_bytes_per_sec`
+// sink params. Zero means unlimited.
+type sinkRateLimits struct {
+	rowsPerSec  int64
+	bytesPerSec int64
+}
+
+func (l sinkRateLimits) enabled() bool {
+	return l.rowsPerSec > 0 || l.bytesPerSec > 0
+}
+
+// consumeSinkRateLimits parses and removes the rate limit sink params from q.
+func consumeSinkRateLimits(q url.Values) (sinkRateLimits, error) {
+	var l sinkRateLimits
+	for param, dest := range map[string]*int64{
+		sinkParamMaxRowsPerSec:  &l.rowsPerSec,
+		sinkParamMaxBytesPerSec: &l.bytesPerSec,
+	} {
+		if str := q.Get(param); str != `` {
+			v, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				return sinkRateLimits{}, errors.Wrapf(err, `parsing %s`, param)
+			}
+			if v < 0 {
+				return sinkRateLimits{}, errors.Errorf(`%s must be non-negative: %d`, param, v)
+			}
+			*dest = v
+		}
+		q.Del(param)
+	}
+	return l, nil
+}
+
+// rateLimitedSink wraps a Sink and blocks EmitRow whenever the configured row
+// or byte budget is exhausted. Only EmitRow is limited; resolved timestamps,
+// Flush and Close are passed through untouched so limiting can never hold up a
+// flush.
+//
+// The underlying limiters are safe for concurrent use.
+type rateLimitedSink struct {
+	wrapped Sink
+	rows    *rate.Limiter
+	bytes   *rate.Limiter
+}
+
+func makeRateLimitedSink(s Sink, limits sinkRateLimits) *rateLimitedSink {
+	r := &rateLimitedSink{wrapped: s}
+	if limits.rowsPerSec > 0 {
+		r.rows = rate.NewLimiter(rate.Limit(limits.rowsPerSec), int(limits.rowsPerSec))
+	}
+	if limits.bytesPerSec > 0 {
+		r.bytes = rate.NewLimiter(rate.Limit(limits.bytesPerSec), int(limits.bytesPerSec))
+	}
+	return r
+}
+
+// EmitRow implements the Sink interface.
+func (s *rateLimitedSink) EmitRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, updated hlc.Timestamp,
+) error {
+	if err := s.wait(ctx, key, value); err != nil {
+		return err
+	}
+	return s.wrapped.EmitRow(ctx, table, key, value, updated)
+}
+
+// EmitRowWithPartitionHint implements the PartitionHintEmitter interface.
+func (s *rateLimitedSink) EmitRowWithPartitionHint(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	key, value []byte,
+	hint partitionHint,
+	updated hlc.Timestamp,
+) error {
+	if err := s.wait(ctx, key, value); err != nil {
+		return err
+	}
+	return emitRowWithPartitionHint(ctx, s.wrapped, table, key, value, hint, updated)
+}
+
+// wait blocks until the limits allow a row with the given key and value to be
+// emitted.
+func (s *rateLimitedSink) wait(ctx context.Context, key, value []byte) error {
+	if s.rows != nil {
+		if err := s.rows.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if s.bytes != nil {
+		// The limiter disallows anything greater than its burst, so cap the
+		// cost of very large rows. This means they aren't fully accounted for,
+		// but it's better than rejecting them.
+		cost := len(key) + len(value)
+		if burst := s.bytes.Burst(); cost > burst {
+			cost = burst
+		}
+		if err := s.bytes.WaitN(ctx, cost); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *rateLimitedSink) EmitResolvedTimestamp(
+	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
+) error {
+	return s.wrapped.EmitResolvedTimestamp(ctx, encoder, resolved)
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *rateLimitedSink) EmitSchemaChange(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	oldVersion, newVersion sqlbase.DescriptorVersion,
+) error {
+	return s.wrapped.EmitSchemaChange(ctx, table, oldVersion, newVersion)
+}
+
+// Flush implements the Sink interface.
+func (s *rateLimitedSink) Flush(ctx context.Context, ts hlc.Timestamp) error {
+	return s.wrapped.Flush(ctx, ts)
+}
+
+// FlushTable implements the TableFlusher interface.
+func (s *rateLimitedSink) FlushTable(
+	ctx context.Context, tableName string, ts hlc.Timestamp,
+) error {
+	return flushTable(ctx, s.wrapped, tableName, ts)
+}
+
+// Ping implements the Pinger interface.
+func (s *rateLimitedSink) Ping(ctx context.Context) error {
+	return pingSink(ctx, s.wrapped)
+}
+
+// SetHighWater implements the HighWaterSetter interface.
+func (s *rateLimitedSink) SetHighWater(highWater hlc.Timestamp) {
+	setSinkHighWater(s.wrapped, highWater)
+}
+
+// EmitFeedLifecycle implements the LifecycleEmitter interface.
+func (s *rateLimitedSink) EmitFeedLifecycle(
+	ctx context.Context, phase feedPhase, ts hlc.Timestamp,
+) error {
+	return emitFeedLifecycle(ctx, s.wrapped, phase, ts)
+}
+
+// InflightCount implements the InflightCounter interface.
+func (s *rateLimitedSink) InflightCount() int64 {
+	return sinkInflightCount(s.wrapped)
+}
+
+// SetBackfillMode implements the BackfillModeSetter interface.
+func (s *rateLimitedSink) SetBackfillMode(backfill bool) {
+	if b, ok := s.wrapped.(BackfillModeSetter); ok {
+		b.SetBackfillMode(backfill)
+	}
+}
+
+// SetMetrics implements the MetricsSetter interface.
+func (s *rateLimitedSink) SetMetrics(metrics *Metrics, nodeID roachpb.NodeID) {
+	setSinkMetrics(s.wrapped, metrics, nodeID)
+}
+
+// ResumeFromState implements the StateResumer interface.
+func (s *rateLimitedSink) ResumeFromState(ctx context.Context, spans []roachpb.Span) error {
+	return resumeSinkFromState(ctx, s.wrapped, spans)
+}
+
+// TakeChangedTopics implements the ChangedTopicsTracker interface.
+func (s *rateLimitedSink) TakeChangedTopics() []string {
+	return takeSinkChangedTopics(s.wrapped)
+}
+
+// NoteChangedTopic implements the ChangedTopicsTracker interface.
+func (s *rateLimitedSink) NoteChangedTopic(topic string) {
+	noteSinkChangedTopic(s.wrapped, topic)
+}
+
+// TakeCompletedFiles implements the CompletedFilesTracker interface.
+func (s *rateLimitedSink) TakeCompletedFiles() []string {
+	return takeSinkCompletedFiles(s.wrapped)
+}
+
+// NoteCompletedFile implements the CompletedFilesTracker interface.
+func (s *rateLimitedSink) NoteCompletedFile(filename string) {
+	noteSinkCompletedFile(s.wrapped, filename)
+}
+
+// CombinesTopicResolved implements the TopicResolvedCombiner interface.
+func (s *rateLimitedSink) CombinesTopicResolved() bool {
+	return sinkCombinesTopicResolved(s.wrapped)
+}
+
+// SetCombinedTopicResolved implements the TopicResolvedCombiner interface.
+func (s *rateLimitedSink) SetCombinedTopicResolved(topicResolved map[string]hlc.Timestamp) {
+	setSinkCombinedTopicResolved(s.wrapped, topicResolved)
+}
+
+// EmitsTopicResolved implements the TopicResolvedEmitter interface.
+func (s *rateLimitedSink) EmitsTopicResolved() bool {
+	return sinkEmitsTopicResolved(s.wrapped)
+}
+
+// EmitTopicResolvedTimestamp implements the TopicResolvedEmitter interface.
+func (s *rateLimitedSink) EmitTopicResolvedTimestamp(
+	ctx context.Context, encoder Encoder, topic string, resolved hlc.Timestamp,
+) error {
+	return emitSinkTopicResolvedTimestamp(ctx, s.wrapped, encoder, topic, resolved)
+}
+
+// Capabilities implements the Sink interface.
+func (s *rateLimitedSink) Capabilities() SinkCapabilities {
+	return s.wrapped.Capabilities()
+}
+
+// Close implements the Sink interface.
+func (s *rateLimitedSink) Close() error {
+	return s.wrapped.Close()
+}
+
+// CloseAndDrain implements the Drainer interface.
+func (s *rateLimitedSink) CloseAndDrain(ctx context.Context) ([]MessageRef, error) {
+	return closeAndDrainSink(ctx, s.wrapped)
+}
@@ -0,0 +1,50 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitedSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	q := url.Values{}
+	q.Set(sinkParamMaxRowsPerSec, `1`)
+	limits, err := consumeSinkRateLimits(q)
+	require.NoError(t, err)
+	require.Empty(t, q)
+	require.Equal(t, sinkRateLimits{rowsPerSec: 1}, limits)
+
+	q.Set(sinkParamMaxBytesPerSec, `-1`)
+	_, err = consumeSinkRateLimits(q)
+	require.EqualError(t, err, `max_bytes_per_sec must be non-negative: -1`)
+
+	table := &sqlbase.TableDescriptor{Name: `t`}
+	s := makeRateLimitedSink(&bufferSink{}, limits)
+
+	// The first row fits in the burst.
+	ctx := context.Background()
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`k`), []byte(`v`), zeroTS))
+
+	// The budget is now exhausted, so the next row has to wait, which a
+	// canceled context refuses to do.
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Error(t, s.EmitRow(canceledCtx, table, []byte(`k`), []byte(`v`), zeroTS))
+
+	// Flush is never limited.
+	require.NoError(t, s.Flush(canceledCtx, zeroTS))
+}
@@ -0,0 +1,331 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/pkg/errors"
+)
+
+const (
+	redisDialTimeout = 10 * time.Second
+	// redisMaxPending bounds the number of commands that are written before
+	// their replies are read, which keeps the server's reply buffer for this
+	// connection from growing without bound between Flushes.
+	redisMaxPending = 1000
+)
+
+// redisSinkConfig holds the sink params of a redisSink.
+type redisSinkConfig struct {
+	streamPrefix string
+	// maxLen, if non-zero, caps each stream at approximately this many
+	// entries.
+	maxLen int64
+}
+
+// consumeRedisSinkConfig parses and removes the redis sink params from q.
+func consumeRedisSinkConfig(q url.Values) (redisSinkConfig, error) {
+	var cfg redisSinkConfig
+	cfg.streamPrefix = q.Get(sinkParamStreamPrefix)
+	q.Del(sinkParamStreamPrefix)
+	if maxLenStr := q.Get(sinkParamMaxLen); maxLenStr != `` {
+		var err error
+		if cfg.maxLen, err = strconv.ParseInt(maxLenStr, 10, 64); err != nil {
+			return redisSinkConfig{}, errors.Wrapf(err, `parsing %s`, sinkParamMaxLen)
+		}
+		if cfg.maxLen <= 0 {
+			return redisSinkConfig{}, errors.Errorf(`%s must be positive: %d`,
+				sinkParamMaxLen, cfg.maxLen)
+		}
+	}
+	q.Del(sinkParamMaxLen)
+	return cfg, nil
+}
+
+var redisSinkCapabilities = SinkCapabilities{
+	Formats:   []formatType{optFormatJSON, optFormatAvro, optFormatRaw},
+	Envelopes: allEnvelopes,
+	Resolved:  true,
+	KeyFormat: true,
+}
+
+// redisSink emits to Redis Streams. Each table is a stream, named by the table
+// with an optional prefix, and each row is XADDed to it with `key` and `value`
+// fields. Resolved timestamps are XADDed to every stream with a `resolved`
+// field.
+//
+// Commands are pipelined: EmitRow and EmitResolvedTimestamp only buffer them,
+// and Flush sends them and then waits for each of them to be acknowledged. It
+// is not concurrency-safe; all calls to Emit and Flush should be from the same
+// goroutine.
+type redisSink struct {
+	cfg     redisSinkConfig
+	conn    net.Conn
+	w       *bufio.Writer
+	r       *bufio.Reader
+	streams map[string]struct{}
+
+	// pending is the number of commands that have been written but whose
+	// replies have not been read.
+	pending int
+	args    [][]byte
+}
+
+func makeRedisSink(
+	ctx context.Context, u *url.URL, cfg redisSinkConfig, targets jobspb.ChangefeedTargets,
+) (Sink, error) {
+	dialer := net.Dialer{Timeout: redisDialTimeout}
+	conn, err := dialer.DialContext(ctx, `tcp`, u.Host)
+	if err != nil {
+		err = errors.Wrapf(err, `connecting to redis: %s`, u.Host)
+		return nil, &retryableSinkError{cause: err}
+	}
+	s := newRedisSink(conn, cfg, targets)
+
+	var setup [][]string
+	if password, ok := u.User.Password(); ok {
+		if user := u.User.Username(); user != `` {
+			setup = append(setup, []string{`AUTH`, user, password})
+		} else {
+			setup = append(setup, []string{`AUTH`, password})
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, `/`); db != `` {
+		if _, err := strconv.Atoi(db); err != nil {
+			_ = conn.Close()
+			return nil, errors.Errorf(`invalid redis database: %s`, db)
+		}
+		setup = append(setup, []string{`SELECT`, db})
+	}
+	for _, cmd := range setup {
+		args := make([][]byte, len(cmd))
+		for i := range cmd {
+			args[i] = []byte(cmd[i])
+		}
+		if err := s.send(args...); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if err := s.Flush(ctx, hlc.Timestamp{}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func newRedisSink(
+	conn net.Conn, cfg redisSinkConfig, targets jobspb.ChangefeedTargets,
+) *redisSink {
+	s := &redisSink{
+		cfg:     cfg,
+		conn:    conn,
+		w:       bufio.NewWriter(conn),
+		r:       bufio.NewReader(conn),
+		streams: make(map[string]struct{}),
+	}
+	for _, t := range targets {
+		s.streams[cfg.streamPrefix+t.StatementTimeName] = struct{}{}
+	}
+	return s
+}
+
+// EmitRow implements the Sink interface.
+func (s *redisSink) EmitRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, _ hlc.Timestamp,
+) error {
+	stream := s.cfg.streamPrefix + table.Name
+	if _, ok := s.streams[stream]; !ok {
+		return errors.Errorf(`cannot emit to undeclared stream: %s`, stream)
+	}
+	return s.xadd(ctx, stream, []byte(`key`), key, []byte(`value`), value)
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *redisSink) EmitResolvedTimestamp(
+	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
+) error {
+	for stream := range s.streams {
+		payload, err := encoder.EncodeResolvedTimestamp(stream, resolved)
+		if err != nil {
+			return err
+		}
+		if err := s.xadd(ctx, stream, []byte(`resolved`), payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *redisSink) EmitSchemaChange(
+	context.Context, *sqlbase.TableDescriptor, sqlbase.DescriptorVersion, sqlbase.DescriptorVersion,
+) error {
+	return nil
+}
+
+func (s *redisSink) xadd(ctx context.Context, stream string, fieldsAndValues ...[]byte) error {
+	s.args = append(s.args[:0], []byte(`XADD`), []byte(stream))
+	if s.cfg.maxLen > 0 {
+		s.args = append(s.args,
+			[]byte(`MAXLEN`), []byte(`~`), []byte(strconv.FormatInt(s.cfg.maxLen, 10)))
+	}
+	s.args = append(s.args, []byte(`*`))
+	s.args = append(s.args, fieldsAndValues...)
+	if err := s.send(s.args...); err != nil {
+		return err
+	}
+	if s.pending >= redisMaxPending {
+		return s.Flush(ctx, hlc.Timestamp{})
+	}
+	return nil
+}
+
+// send buffers a command. It's not necessarily written to the connection until
+// the next Flush.
+func (s *redisSink) send(args ...[]byte) error {
+	if err := writeRESPCommand(s.w, args...); err != nil {
+		return &retryableSinkError{cause: err}
+	}
+	s.pending++
+	return nil
+}
+
+// Flush implements the Sink interface.
+func (s *redisSink) Flush(ctx context.Context, _ hlc.Timestamp) error {
+	// Ignore the timestamp and flush everything, which necessarily means that
+	// we've flushed everything >= the timestamp.
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := s.conn.SetDeadline(deadline); err != nil {
+			return &retryableSinkError{cause: err}
+		}
+		defer func() { _ = s.conn.SetDeadline(time.Time{}) }()
+	}
+	if err := s.w.Flush(); err != nil {
+		return &retryableSinkError{cause: err}
+	}
+	// Read every outstanding reply, even after an error reply, so the
+	// connection is left in a usable state.
+	var firstErr error
+	for ; s.pending > 0; s.pending-- {
+		reply, err := readRESPReply(s.r)
+		if err != nil {
+			return &retryableSinkError{cause: err}
+		}
+		if replyErr, ok := reply.(redisError); ok && firstErr == nil {
+			firstErr = replyErr
+		}
+	}
+	return firstErr
+}
+
+// Capabilities implements the Sink interface.
+func (s *redisSink) Capabilities() SinkCapabilities {
+	return redisSinkCapabilities
+}
+
+// Close implements the Sink interface.
+func (s *redisSink) Close() error {
+	return s.conn.Close()
+}
+
+// redisError is an error reply from a Redis server.
+type redisError string
+
+func (e redisError) Error() string { return `redis: ` + string(e) }
+
+// writeRESPCommand writes a command as a RESP array of bulk strings.
+func writeRESPCommand(w *bufio.Writer, args ...[]byte) error {
+	var buf []byte
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		buf = append(buf[:0], '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		if _, err := w.Write(arg); err != nil {
+			return err
+		}
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRESPReply reads one RESP value. Simple strings are returned as string,
+// errors as redisError, integers as int64, bulk strings as []byte (nil for the
+// null bulk string) and arrays as []interface{}.
+func readRESPReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.Errorf(`malformed redis reply: %q`, line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return redisError(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []byte(nil), nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []interface{}(nil), nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readRESPReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, errors.Errorf(`malformed redis reply: %q`, string(kind)+line)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedisServer reads RESP commands from conn and sends them on cmds,
+// acknowledging XADDs to the `bad` stream with an error and everything else
+// with a stream entry id.
+func fakeRedisServer(conn net.Conn, cmds chan<- string) {
+	defer close(cmds)
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readRESPReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		cmd := strings.Join(args, ` `)
+		cmds <- cmd
+		response := "+1-0\r\n"
+		if len(args) > 1 && args[1] == `bad` {
+			response = "-ERR bad stream\r\n"
+		}
+		if _, err := conn.Write([]byte(response)); err != nil {
+			return
+		}
+	}
+}
+
+func TestRedisSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	q := url.Values{}
+	q.Set(sinkParamStreamPrefix, `p_`)
+	q.Set(sinkParamMaxLen, `100`)
+	cfg, err := consumeRedisSinkConfig(q)
+	require.NoError(t, err)
+	require.Empty(t, q)
+	require.Equal(t, redisSinkConfig{streamPrefix: `p_`, maxLen: 100}, cfg)
+
+	q.Set(sinkParamMaxLen, `0`)
+	_, err = consumeRedisSinkConfig(q)
+	require.EqualError(t, err, `max_len must be positive: 0`)
+
+	client, server := net.Pipe()
+	cmds := make(chan string, 10)
+	go fakeRedisServer(server, cmds)
+
+	table := func(name string) *sqlbase.TableDescriptor {
+		return &sqlbase.TableDescriptor{Name: name}
+	}
+	targets := jobspb.ChangefeedTargets{
+		0: jobspb.ChangefeedTarget{StatementTimeName: `t`},
+	}
+	s := newRedisSink(client, cfg, targets)
+	defer func() { require.NoError(t, s.Close()) }()
+
+	ctx := context.Background()
+	require.EqualError(t, s.EmitRow(ctx, table(`u`), []byte(`k`), []byte(`v`), zeroTS),
+		`cannot emit to undeclared stream: p_u`)
+
+	// Nothing is acknowledged until a Flush.
+	require.NoError(t, s.EmitRow(ctx, table(`t`), []byte(`k1`), []byte(`v1`), zeroTS))
+	require.NoError(t, s.EmitRow(ctx, table(`t`), []byte(`k2`), []byte(`v2`), zeroTS))
+	require.Equal(t, 2, s.pending)
+	require.NoError(t, s.Flush(ctx, zeroTS))
+	require.Equal(t, 0, s.pending)
+	require.Equal(t, `XADD p_t MAXLEN ~ 100 * key k1 value v1`, <-cmds)
+	require.Equal(t, `XADD p_t MAXLEN ~ 100 * key k2 value v2`, <-cmds)
+
+	// Error replies are returned by Flush, after all the replies are read.
+	s.streams[`bad`] = struct{}{}
+	require.NoError(t, s.xadd(ctx, `bad`, []byte(`key`), []byte(`k`)))
+	require.NoError(t, s.xadd(ctx, `p_t`, []byte(`key`), []byte(`k`)))
+	require.EqualError(t, s.Flush(ctx, zeroTS), `redis: ERR bad stream`)
+	require.Equal(t, 0, s.pending)
+	<-cmds
+	<-cmds
+
+	// A broken connection is retryable.
+	require.NoError(t, server.Close())
+	require.NoError(t, s.EmitRow(ctx, table(`t`), []byte(`k`), []byte(`v`), zeroTS))
+	require.True(t, isRetryableSinkError(s.Flush(ctx, zeroTS)))
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"sort"
+	"strings"
+)
+
+// SinkParamType is the type of the value of a sink param.
+type SinkParamType string
+
+const (
+	// SinkParamTypeString is any string.
+	SinkParamTypeString SinkParamType = `string`
+	// SinkParamTypeStringList is a comma-separated list of strings.
+	SinkParamTypeStringList SinkParamType = `string_list`
+	// SinkParamTypeBool is anything strconv.ParseBool accepts.
+	SinkParamTypeBool SinkParamType = `bool`
+	// SinkParamTypeInt is an integer.
+	SinkParamTypeInt SinkParamType = `int`
+	// SinkParamTypeFloat is a floating point number.
+	SinkParamTypeFloat SinkParamType = `float`
+	// SinkParamTypeDuration is anything time.ParseDuration accepts, like `10s`.
+	SinkParamTypeDuration SinkParamType = `duration`
+	// SinkParamTypeBytes is a size in bytes, like `64MiB`.
+	SinkParamTypeBytes SinkParamType = `bytes`
+)
+
+// SinkParamSpec describes a sink param.
+type SinkParamSpec struct {
+	// Name is the name of the query parameter or, if Prefix is set, the
+	// prefix of the names of a family of them.
+	Name   string
+	Prefix bool
+	Type   SinkParamType
+	// Required is whether the sink can't be created without the param.
+	Required bool
+	// Values, if non-empty, are the only values the param accepts.
+	Values []string
+}
+
+// SchemeSpec describes a sink URI scheme and the sink params it accepts.
+type SchemeSpec struct {
+	Scheme string
+	Params []SinkParamSpec
+}
+
+// genericSinkParams are accepted by every scheme, since getSink consumes them
+// before it looks at the scheme.
+var genericSinkParams = []SinkParamSpec{
+	{Name: sinkParamBreakerCooldown, Type: SinkParamTypeDuration},
+	{Name: sinkParamBreakerFailures, Type: SinkParamTypeInt},
+	{Name: sinkParamDebugDir, Type: SinkParamTypeString},
+	{Name: sinkParamDebugMaxFileSize, Type: SinkParamTypeBytes},
+	{Name: sinkParamDebugSampleRate, Type: SinkParamTypeFloat},
+	{Name: sinkParamFlushSLA, Type: SinkParamTypeDuration},
+	{Name: sinkParamMaxBytesPerSec, Type: SinkParamTypeInt},
+	{Name: sinkParamMaxRowsPerSec, Type: SinkParamTypeInt},
+	{Name: sinkParamMaxValueBytes, Type: SinkParamTypeBytes},
+	{Name: sinkParamMaxValuePolicy, Type: SinkParamTypeString,
+		Values: []string{sinkValueLimitPolicyReject, sinkValueLimitPolicyTruncate}},
+	{Name: sinkParamRetryBudget, Type: SinkParamTypeInt},
+}
+
+var kafkaSinkParams = []SinkParamSpec{
+	{Name: sinkParamAcksTimeout, Type: SinkParamTypeDuration},
+	{Name: sinkParamBackpressureTimeout, Type: SinkParamTypeDuration},
+	{Name: sinkParamControlTopic, Type: SinkParamTypeString},
+	{Name: sinkParamDialTimeout, Type: SinkParamTypeDuration},
+	{Name: sinkParamExtraBootstrapServers, Type: SinkParamTypeStringList},
+	{Name: sinkParamExtraClusterFailurePolicy, Type: SinkParamTypeString, Values: []string{
+		kafkaClusterFailurePolicyFailFast, kafkaClusterFailurePolicyBestEffort,
+	}},
+	{Name: sinkParamIdleFlushInterval, Type: SinkParamTypeDuration},
+	{Name: sinkParamMaxInflightRequests, Type: SinkParamTypeInt},
+	{Name: sinkParamPartitionKeyBuckets, Type: SinkParamTypeInt},
+	{Name: sinkParamPartitionKeySalt, Type: SinkParamTypeString},
+	{Name: sinkParamPartitioner, Type: SinkParamTypeString,
+		Values: []string{kafkaPartitionerFNV, kafkaPartitionerJump}},
+	{Name: sinkParamReadTimeout, Type: SinkParamTypeDuration},
+	{Name: sinkParamRelaxedOrderingTopics, Type: SinkParamTypeStringList},
+	{Name: sinkParamResolvedChangedTopicsOnly, Type: SinkParamTypeBool},
+	{Name: sinkParamResolvedTopic, Type: SinkParamTypeString},
+	{Name: sinkParamSASLEnabled, Type: SinkParamTypeBool},
+	{Name: sinkParamSASLHandshake, Type: SinkParamTypeBool},
+	{Name: sinkParamSASLMechanism, Type: SinkParamTypeString, Values: []string{
+		kafkaSASLMechanismPlain,
+	}},
+	{Name: sinkParamSASLPassword, Type: SinkParamTypeString},
+	{Name: sinkParamSASLUser, Type: SinkParamTypeString},
+	{Name: sinkParamSchemaVersionHeader, Type: SinkParamTypeBool},
+	{Name: sinkParamTopicGranularity, Type: SinkParamTypeString,
+		Values: []string{kafkaTopicGranularityTable, kafkaTopicGranularityDatabase}},
+	{Name: sinkParamTopicPrefix, Type: SinkParamTypeString},
+	{Name: sinkParamWriteTimeout, Type: SinkParamTypeDuration},
+}
+
+// cloudStorageSinkSchemes are the schemes of the cloud storage sink, which
+// are those of the storage it writes to with an `experimental-` prefix.
+var cloudStorageSinkSchemes = []string{
+	`experimental-azure`, `experimental-gs`, `experimental-http`, `experimental-https`,
+	`experimental-nodelocal`, `experimental-s3`,
+}
+
+var cloudStorageSinkParams = []SinkParamSpec{
+	{Name: sinkParamAtomicWrites, Type: SinkParamTypeBool},
+	{Name: sinkParamBackfillWriteConcurrency, Type: SinkParamTypeInt},
+	{Name: sinkParamBucketSize, Type: SinkParamTypeDuration, Required: true},
+	{Name: sinkParamBufferPoolMaxBytes, Type: SinkParamTypeBytes},
+	{Name: sinkParamFlushBytes, Type: SinkParamTypeBytes},
+	{Name: sinkParamIdempotentFlush, Type: SinkParamTypeBool},
+	{Name: sinkParamJobPrefix, Type: SinkParamTypeBool},
+	{Name: sinkParamManifest, Type: SinkParamTypeBool},
+	{Name: sinkParamMaxFileAge, Type: SinkParamTypeDuration},
+	{Name: sinkParamMetadata, Type: SinkParamTypeBool},
+	{Name: sinkParamMinResolvedInterval, Type: SinkParamTypeDuration},
+	{Name: sinkParamPartitionColumn, Type: SinkParamTypeString},
+	{Name: sinkParamRecordSeparator, Type: SinkParamTypeString},
+	{Name: sinkParamResolvedBucketStart, Type: SinkParamTypeBool},
+	{Name: sinkParamResolvedFileListing, Type: SinkParamTypeBool},
+	{Name: sinkParamResolvedGranularity, Type: SinkParamTypeString, Values: []string{
+		cloudStorageResolvedGranularityChangefeed, cloudStorageResolvedGranularityTopic,
+		cloudStorageResolvedGranularityBoth, cloudStorageResolvedGranularityCombined,
+	}},
+	{Name: sinkParamResolvedSuffix, Type: SinkParamTypeString},
+	{Name: sinkParamSinkID, Type: SinkParamTypeString},
+	{Name: sinkParamSpillDir, Type: SinkParamTypeString},
+	{Name: sinkParamSpillThreshold, Type: SinkParamTypeBytes},
+	{Name: sinkParamTrimTrailingSeparator, Type: SinkParamTypeBool},
+	{Name: sinkParamUploadMaxRetries, Type: SinkParamTypeInt},
+	{Name: sinkParamUploadTimeout, Type: SinkParamTypeDuration},
+	{Name: sinkParamWriteConcurrency, Type: SinkParamTypeInt},
+}
+
+var redisSinkParams = []SinkParamSpec{
+	{Name: sinkParamMaxLen, Type: SinkParamTypeInt},
+	{Name: sinkParamStreamPrefix, Type: SinkParamTypeString},
+}
+
+var webhookSinkParams = []SinkParamSpec{
+	{Name: sinkParamHeaderPrefix, Prefix: true, Type: SinkParamTypeString},
+	{Name: sinkParamHMACHeader, Type: SinkParamTypeString},
+	{Name: sinkParamHMACSecret, Type: SinkParamTypeString},
+	{Name: sinkParamOAuthClientID, Type: SinkParamTypeString},
+	{Name: sinkParamOAuthClientSecret, Type: SinkParamTypeString},
+	{Name: sinkParamOAuthScope, Type: SinkParamTypeString},
+	{Name: sinkParamOAuthTokenURL, Type: SinkParamTypeString},
+}
+
+// sqlSinkParams are the params of the sql sink, which also passes the ssl
+// params of the connection through.
+var sqlSinkParams = []SinkParamSpec{
+	{Name: sinkParamCompression, Type: SinkParamTypeString,
+		Values: []string{sqlSinkCodecNone, sqlSinkCodecGzip}},
+	{Name: sinkParamDiagnoseErrors, Type: SinkParamTypeBool},
+	{Name: sinkParamMaxStatementBytes, Type: SinkParamTypeBytes},
+	// Any column name is valid too.
+	{Name: sinkParamPartitionBy, Type: SinkParamTypeString,
+		Values: []string{sqlSinkPartitionByKey, sqlSinkPartitionByValue}},
+	{Name: sinkParamSkipCreate, Type: SinkParamTypeBool},
+	{Name: `sslcert`, Type: SinkParamTypeString},
+	{Name: `sslkey`, Type: SinkParamTypeString},
+	{Name: `sslmode`, Type: SinkParamTypeString},
+	{Name: `sslrootcert`, Type: SinkParamTypeString},
+}
+
+// SinkSchemes returns every scheme that a changefeed's sink URI can have,
+// sorted, with the sink params it accepts, sorted by name. It's meant for
+// tooling that builds CREATE CHANGEFEED statements. Which values of a param
+// are valid can depend on the other params and the changefeed's options, so
+// getSink has the final say.
+func SinkSchemes() []SchemeSpec {
+	schemes := []SchemeSpec{
+		{Scheme: sinkSchemeExperimentalSQL, Params: sqlSinkParams},
+		{Scheme: sinkSchemeKafka, Params: kafkaSinkParams},
+		{Scheme: sinkSchemeMetrics},
+		{Scheme: sinkSchemeRedis, Params: redisSinkParams},
+		{Scheme: sinkSchemeUnix},
+		{Scheme: sinkSchemeWebhookHTTP, Params: webhookSinkParams},
+		{Scheme: sinkSchemeWebhookHTTPS, Params: webhookSinkParams},
+	}
+	for _, scheme := range cloudStorageSinkSchemes {
+		schemes = append(schemes, SchemeSpec{Scheme: scheme, Params: cloudStorageSinkParams})
+	}
+	for i := range schemes {
+		params := append(genericSinkParams[:len(genericSinkParams):len(genericSinkParams)],
+			schemes[i].Params...)
+		sort.Slice(params, func(a, b int) bool { return params[a].Name < params[b].Name })
+		schemes[i].Params = params
+	}
+	sort.Slice(schemes, func(i, j int) bool { return schemes[i].Scheme < schemes[j].Scheme })
+	return schemes
+}
+
+// sinkParamSchemes returns the schemes that accept the sink param with the
+// given name, sorted.
+func sinkParamSchemes(name string) []string {
+	var schemes []string
+	for _, scheme := range SinkSchemes() {
+		for _, param := range scheme.Params {
+			if param.Name == name || (param.Prefix && strings.HasPrefix(name, param.Name)) {
+				schemes = append(schemes, scheme.Scheme)
+				break
+			}
+		}
+	}
+	return schemes
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSinkSchemes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	sampleValues := map[SinkParamType]string{
+		SinkParamTypeString:     `x`,
+		SinkParamTypeStringList: `x,y`,
+		SinkParamTypeBool:       `true`,
+		SinkParamTypeInt:        `1`,
+		SinkParamTypeFloat:      `0.5`,
+		SinkParamTypeDuration:   `1s`,
+		SinkParamTypeBytes:      `1KiB`,
+	}
+	sampleValue := func(param SinkParamSpec) string {
+		if len(param.Values) > 0 {
+			return param.Values[0]
+		}
+		v, ok := sampleValues[param.Type]
+		require.True(t, ok, `unknown type %s of %s`, param.Type, param.Name)
+		return v
+	}
+
+	// Every param in the catalog is consumed by getSink. The unsupported
+	// envelope fails the capabilities check after the params are checked, so
+	// that no sink is actually created.
+	opts := map[string]string{optEnvelope: `nope`}
+	for _, scheme := range SinkSchemes() {
+		required := url.Values{}
+		for _, param := range scheme.Params {
+			if param.Required {
+				required.Set(param.Name, sampleValue(param))
+			}
+		}
+		for _, param := range scheme.Params {
+			q := url.Values{}
+			for k, v := range required {
+				q[k] = v
+			}
+			name := param.Name
+			if param.Prefix {
+				name += `X-Foo`
+			}
+			q.Set(name, sampleValue(param))
+			u := url.URL{Scheme: scheme.Scheme, Host: `host`, Path: `/d`, RawQuery: q.Encode()}
+			_, err := getSink(ctx, u.String(), opts, makeJSONEncoder(nil /* opts */),
+				nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+			require.Error(t, err)
+			require.NotRegexp(t, `unknown sink query parameter`, err, u.String())
+		}
+	}
+
+	// And the other way around, every param that getSink accepts is in the
+	// catalog, under every scheme that accepts it. The params are the
+	// `sinkParam` consts, and getSink has to reject them as unknown under the
+	// schemes whose catalog doesn't have them.
+	var names []string
+	for _, param := range sinkParamConsts(t) {
+		if param == sinkParamSchemaTopic {
+			// Consumed only to say it's not supported yet.
+			continue
+		}
+		require.NotEmpty(t, sinkParamSchemes(param), `%s is not in the catalog`, param)
+		names = append(names, param)
+	}
+	for _, scheme := range SinkSchemes() {
+		required := url.Values{}
+		for _, param := range scheme.Params {
+			if param.Required {
+				required.Set(param.Name, sampleValue(param))
+			}
+		}
+		for _, name := range names {
+			if schemes := sinkParamSchemes(name); containsString(schemes, scheme.Scheme) {
+				continue
+			}
+			q := url.Values{}
+			for k, v := range required {
+				q[k] = v
+			}
+			if strings.HasSuffix(name, `.`) {
+				name += `X-Foo`
+			}
+			q.Set(name, `x`)
+			u := url.URL{Scheme: scheme.Scheme, Host: `host`, Path: `/d`, RawQuery: q.Encode()}
+			_, err := getSink(ctx, u.String(), opts, makeJSONEncoder(nil /* opts */),
+				nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+			require.Regexp(t, `unknown sink query parameter: `+name, err, u.String())
+		}
+	}
+
+	require.Equal(t, []string{sinkSchemeKafka}, sinkParamSchemes(sinkParamTopicPrefix))
+	require.Equal(t, []string{sinkSchemeWebhookHTTP, sinkSchemeWebhookHTTPS},
+		sinkParamSchemes(sinkParamHeaderPrefix+`X-Foo`))
+	_, err := getSink(ctx, `experimental-metrics://?topic_prefix=foo`, map[string]string{},
+		makeJSONEncoder(nil /* opts */),
+		nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+	require.EqualError(t, err, `unknown sink query parameter: topic_prefix (only supported by kafka)`)
+}
+
+// sinkParamConsts returns the values of the `sinkParam` consts, which are the
+// names of every sink param, parsed out of the source that declares them.
+func sinkParamConsts(t *testing.T) []string {
+	f, err := parser.ParseFile(token.NewFileSet(), `changefeed_stmt.go`, nil, 0 /* mode */)
+	require.NoError(t, err)
+	var params []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		spec, ok := n.(*ast.ValueSpec)
+		if !ok {
+			return true
+		}
+		for i, name := range spec.Names {
+			if !strings.HasPrefix(name.Name, `sinkParam`) || i >= len(spec.Values) {
+				continue
+			}
+			lit, ok := spec.Values[i].(*ast.BasicLit)
+			require.True(t, ok, `%s isn't a literal`, name.Name)
+			param, err := strconv.Unquote(lit.Value)
+			require.NoError(t, err)
+			params = append(params, param)
+		}
+		return true
+	})
+	require.NotEmpty(t, params)
+	return params
+}
+
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,242 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/pkg/errors"
+)
+
+// slaSinkBreachLogInterval throttles the warnings logged by an slaSink.
+const slaSinkBreachLogInterval = time.Minute
+
+// consumeSinkFlushSLA parses and removes the optional `flush_sla` sink param
+// from q. Zero means no SLA.
+func consumeSinkFlushSLA(q url.Values) (time.Duration, error) {
+	str := q.Get(sinkParamFlushSLA)
+	q.Del(sinkParamFlushSLA)
+	if str == `` {
+		return 0, nil
+	}
+	sla, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, errors.Wrapf(err, `parsing %s`, sinkParamFlushSLA)
+	}
+	if sla <= 0 {
+		return 0, errors.Errorf(`%s must be positive: %s`, sinkParamFlushSLA, str)
+	}
+	return sla, nil
+}
+
+// sinkFlushSLA returns the `flush_sla` sink param of sinkURI. Zero means no
+// SLA.
+func sinkFlushSLA(sinkURI string) (time.Duration, error) {
+	u, err := url.Parse(sinkURI)
+	if err != nil {
+		return 0, err
+	}
+	return consumeSinkFlushSLA(u.Query())
+}
+
+// slaSink wraps a Sink and measures the lag of each successful Flush: the time
+// between the timestamp that was flushed and the wall time when the flush
+// completed. This is how far behind the sink's consumers are, no matter which
+// sink it is. The lag is recorded in the `changefeed.flush_lag` metric and, if
+// it's over the `flush_sla` sink param, counted as a breach and logged.
+// Delivery isn't affected.
+type slaSink struct {
+	wrapped Sink
+	// metrics, if non-nil, is where the lag and breaches are recorded.
+	metrics *Metrics
+	// sla, if non-zero, is the lag above which a flush breaches the SLA.
+	sla time.Duration
+
+	breachLog log.EveryN
+}
+
+func makeSLASink(s Sink, metrics *Metrics, sla time.Duration) *slaSink {
+	return &slaSink{
+		wrapped:   s,
+		metrics:   metrics,
+		sla:       sla,
+		breachLog: log.Every(slaSinkBreachLogInterval),
+	}
+}
+
+// EmitRow implements the Sink interface.
+func (s *slaSink) EmitRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, updated hlc.Timestamp,
+) error {
+	return s.wrapped.EmitRow(ctx, table, key, value, updated)
+}
+
+// EmitRowWithPartitionHint implements the PartitionHintEmitter interface.
+func (s *slaSink) EmitRowWithPartitionHint(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	key, value []byte,
+	hint partitionHint,
+	updated hlc.Timestamp,
+) error {
+	return emitRowWithPartitionHint(ctx, s.wrapped, table, key, value, hint, updated)
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *slaSink) EmitResolvedTimestamp(
+	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
+) error {
+	return s.wrapped.EmitResolvedTimestamp(ctx, encoder, resolved)
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *slaSink) EmitSchemaChange(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	oldVersion, newVersion sqlbase.DescriptorVersion,
+) error {
+	return s.wrapped.EmitSchemaChange(ctx, table, oldVersion, newVersion)
+}
+
+// Flush implements the Sink interface.
+func (s *slaSink) Flush(ctx context.Context, ts hlc.Timestamp) error {
+	if err := s.wrapped.Flush(ctx, ts); err != nil {
+		return err
+	}
+	// Nothing is resolved yet before the initial scan is done, so there's no
+	// lag to measure.
+	if ts == (hlc.Timestamp{}) {
+		return nil
+	}
+	s.recordLag(ctx, timeutil.Since(ts.GoTime()))
+	return nil
+}
+
+func (s *slaSink) recordLag(ctx context.Context, lag time.Duration) {
+	if s.metrics != nil {
+		s.metrics.FlushLagNanosHist.RecordValue(lag.Nanoseconds())
+	}
+	if s.sla == 0 || lag <= s.sla {
+		return
+	}
+	if s.metrics != nil {
+		s.metrics.FlushSLABreaches.Inc(1)
+	}
+	if s.breachLog.ShouldLog() {
+		log.Warningf(ctx, `flush lag %s is over the %s of %s`, lag, sinkParamFlushSLA, s.sla)
+	}
+}
+
+// FlushTable implements the TableFlusher interface.
+func (s *slaSink) FlushTable(ctx context.Context, tableName string, ts hlc.Timestamp) error {
+	return flushTable(ctx, s.wrapped, tableName, ts)
+}
+
+// Ping implements the Pinger interface.
+func (s *slaSink) Ping(ctx context.Context) error {
+	return pingSink(ctx, s.wrapped)
+}
+
+// SetHighWater implements the HighWaterSetter interface.
+func (s *slaSink) SetHighWater(highWater hlc.Timestamp) {
+	setSinkHighWater(s.wrapped, highWater)
+}
+
+// EmitFeedLifecycle implements the LifecycleEmitter interface.
+func (s *slaSink) EmitFeedLifecycle(
+	ctx context.Context, phase feedPhase, ts hlc.Timestamp,
+) error {
+	return emitFeedLifecycle(ctx, s.wrapped, phase, ts)
+}
+
+// InflightCount implements the InflightCounter interface.
+func (s *slaSink) InflightCount() int64 {
+	return sinkInflightCount(s.wrapped)
+}
+
+// SetBackfillMode implements the BackfillModeSetter interface.
+func (s *slaSink) SetBackfillMode(backfill bool) {
+	if b, ok := s.wrapped.(BackfillModeSetter); ok {
+		b.SetBackfillMode(backfill)
+	}
+}
+
+// SetMetrics implements the MetricsSetter interface.
+func (s *slaSink) SetMetrics(metrics *Metrics, nodeID roachpb.NodeID) {
+	setSinkMetrics(s.wrapped, metrics, nodeID)
+}
+
+// ResumeFromState implements the StateResumer interface.
+func (s *slaSink) ResumeFromState(ctx context.Context, spans []roachpb.Span) error {
+	return resumeSinkFromState(ctx, s.wrapped, spans)
+}
+
+// TakeChangedTopics implements the ChangedTopicsTracker interface.
+func (s *slaSink) TakeChangedTopics() []string {
+	return takeSinkChangedTopics(s.wrapped)
+}
+
+// NoteChangedTopic implements the ChangedTopicsTracker interface.
+func (s *slaSink) NoteChangedTopic(topic string) {
+	noteSinkChangedTopic(s.wrapped, topic)
+}
+
+// TakeCompletedFiles implements the CompletedFilesTracker interface.
+func (s *slaSink) TakeCompletedFiles() []string {
+	return takeSinkCompletedFiles(s.wrapped)
+}
+
+// NoteCompletedFile implements the CompletedFilesTracker interface.
+func (s *slaSink) NoteCompletedFile(filename string) {
+	noteSinkCompletedFile(s.wrapped, filename)
+}
+
+// CombinesTopicResolved implements the TopicResolvedCombiner interface.
+func (s *slaSink) CombinesTopicResolved() bool {
+	return sinkCombinesTopicResolved(s.wrapped)
+}
+
+// SetCombinedTopicResolved implements the TopicResolvedCombiner interface.
+func (s *slaSink) SetCombinedTopicResolved(topicResolved map[string]hlc.Timestamp) {
+	setSinkCombinedTopicResolved(s.wrapped, topicResolved)
+}
+
+// EmitsTopicResolved implements the TopicResolvedEmitter interface.
+func (s *slaSink) EmitsTopicResolved() bool {
+	return sinkEmitsTopicResolved(s.wrapped)
+}
+
+// EmitTopicResolvedTimestamp implements the TopicResolvedEmitter interface.
+func (s *slaSink) EmitTopicResolvedTimestamp(
+	ctx context.Context, encoder Encoder, topic string, resolved hlc.Timestamp,
+) error {
+	return emitSinkTopicResolvedTimestamp(ctx, s.wrapped, encoder, topic, resolved)
+}
+
+// Capabilities implements the Sink interface.
+func (s *slaSink) Capabilities() SinkCapabilities {
+	return s.wrapped.Capabilities()
+}
+
+// Close implements the Sink interface.
+func (s *slaSink) Close() error {
+	return s.wrapped.Close()
+}
+
+// CloseAndDrain implements the Drainer interface.
+func (s *slaSink) CloseAndDrain(ctx context.Context) ([]MessageRef, error) {
+	return closeAndDrainSink(ctx, s.wrapped)
+}
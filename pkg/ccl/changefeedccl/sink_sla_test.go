@@ -0,0 +1,66 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSLASink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	metrics := MakeMetrics(time.Minute).(*Metrics)
+	s := makeSLASink(&bufferSink{}, metrics, time.Hour)
+
+	// Nothing is resolved yet, so there's no lag.
+	require.NoError(t, s.Flush(ctx, zeroTS))
+	require.Equal(t, int64(0), metrics.FlushLagNanosHist.TotalCount())
+
+	// Within the SLA.
+	recent := hlc.Timestamp{WallTime: timeutil.Now().Add(-time.Minute).UnixNano()}
+	require.NoError(t, s.Flush(ctx, recent))
+	require.Equal(t, int64(1), metrics.FlushLagNanosHist.TotalCount())
+	require.Equal(t, int64(0), metrics.FlushSLABreaches.Count())
+
+	// Over the SLA.
+	old := hlc.Timestamp{WallTime: timeutil.Now().Add(-2 * time.Hour).UnixNano()}
+	require.NoError(t, s.Flush(ctx, old))
+	require.Equal(t, int64(2), metrics.FlushLagNanosHist.TotalCount())
+	require.Equal(t, int64(1), metrics.FlushSLABreaches.Count())
+
+	// Without an SLA, the lag is only recorded.
+	s = makeSLASink(&bufferSink{}, metrics, 0 /* sla */)
+	require.NoError(t, s.Flush(ctx, old))
+	require.Equal(t, int64(3), metrics.FlushLagNanosHist.TotalCount())
+	require.Equal(t, int64(1), metrics.FlushSLABreaches.Count())
+	require.NoError(t, s.Close())
+}
+
+func TestSinkFlushSLA(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	sla, err := sinkFlushSLA(`kafka://nope`)
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), sla)
+	sla, err = sinkFlushSLA(`kafka://nope?flush_sla=30s`)
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, sla)
+	_, err = sinkFlushSLA(`kafka://nope?flush_sla=-1s`)
+	require.EqualError(t, err, `flush_sla must be positive: -1s`)
+	_, err = sinkFlushSLA(`kafka://nope?flush_sla=soon`)
+	require.Regexp(t, `parsing flush_sla`, err)
+}
@@ -9,23 +9,40 @@
 package changefeedccl
 
 import (
+	"bytes"
 	"context"
+	gosql "database/sql"
+	gojson "encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/security"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/distsqlrun"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
@@ -166,181 +183,3564 @@ func TestKafkaSinkEscaping(t *testing.T) {
 	require.Equal(t, sarama.ByteEncoder(`v☃`), m.Value)
 }
 
+func TestKafkaSinkPartitionHint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	sink := &kafkaSink{
+		producer: p,
+		topics:   map[string]struct{}{`t`: {}},
+	}
+	sink.start()
+	defer func() { require.NoError(t, sink.Close()) }()
+
+	// Rows with different keys but the same partition key are all sent to the
+	// partition the partition key hashes to, under their own keys.
+	table := &sqlbase.TableDescriptor{Name: `t`}
+	partitioner := newChangefeedPartitioner(`t`)
+	const numPartitions = 16
+	expected, err := partitioner.Partition(&sarama.ProducerMessage{
+		Key: sarama.ByteEncoder(`["a"]`),
+	}, numPartitions)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf(`["a", %d]`, i))
+		require.NoError(t, sink.EmitRowWithPartitionHint(
+			ctx, table, key, []byte(`v`), partitionHint{key: []byte(`["a"]`)}, zeroTS))
+		m := <-p.inputCh
+		require.Equal(t, sarama.ByteEncoder(key), m.Key)
+		partition, err := partitioner.Partition(m, numPartitions)
+		require.NoError(t, err)
+		require.Equal(t, expected, partition)
+		p.successesCh <- m
+	}
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+
+	// An explicit value pins the row to that partition, modulo the number of
+	// partitions, even without a key.
+	for value, expected := range map[int64]int32{0: 0, 5: 5, 21: 5, -1: 15} {
+		hint := partitionHint{value: value, hasValue: true}
+		require.NoError(t, sink.EmitRowWithPartitionHint(
+			ctx, table, nil /* key */, []byte(`v`), hint, zeroTS))
+		m := <-p.inputCh
+		partition, err := partitioner.Partition(m, numPartitions)
+		require.NoError(t, err)
+		require.Equal(t, expected, partition, `value %d`, value)
+		p.successesCh <- m
+	}
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+}
+
+func TestKafkaSinkKeylessRows(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	sink := &kafkaSink{
+		producer: p,
+		topics:   map[string]struct{}{`t`: {}},
+	}
+	sink.start()
+	defer func() { require.NoError(t, sink.Close()) }()
+
+	// Keyless rows have a null key and are spread round-robin instead of all
+	// hashing to the same partition.
+	table := &sqlbase.TableDescriptor{Name: `t`}
+	partitioner := newChangefeedPartitioner(`t`)
+	const numPartitions = 3
+	for i := 0; i < 2*numPartitions; i++ {
+		require.NoError(t, sink.EmitRow(ctx, table, nil /* key */, []byte(`v`), zeroTS))
+		m := <-p.inputCh
+		require.Nil(t, m.Key)
+		partition, err := partitioner.Partition(m, numPartitions)
+		require.NoError(t, err)
+		require.Equal(t, int32(i%numPartitions), partition)
+		p.successesCh <- m
+	}
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+
+	// A resolved timestamp has no key either, but it's pinned to the partition
+	// it's addressed to.
+	resolved := &sarama.ProducerMessage{Topic: `t`, Partition: 2}
+	for i := 0; i < numPartitions; i++ {
+		partition, err := partitioner.Partition(resolved, numPartitions)
+		require.NoError(t, err)
+		require.Equal(t, int32(2), partition)
+	}
+}
+
+func TestKafkaSinkJumpHashPartitioner(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	q := url.Values{}
+	q.Set(sinkParamPartitioner, `murmur3`)
+	_, err := consumeKafkaSinkConfig(q)
+	require.EqualError(t, err, `unknown partitioner: murmur3`)
+	q.Set(sinkParamPartitioner, kafkaPartitionerJump)
+	cfg, err := consumeKafkaSinkConfig(q)
+	require.NoError(t, err)
+	require.Empty(t, q)
+
+	partitioner := makeChangefeedPartitionerConstructor(cfg)(`t`)
+	require.True(t, partitioner.RequiresConsistency())
+	partition := func(key string, numPartitions int32) int32 {
+		p, err := partitioner.Partition(&sarama.ProducerMessage{
+			Key:      sarama.ByteEncoder(key),
+			Metadata: kafkaMessageMetadata{},
+		}, numPartitions)
+		require.NoError(t, err)
+		require.True(t, p >= 0 && p < numPartitions, `%d out of %d`, p, numPartitions)
+		return p
+	}
+
+	// Going from 10 to 11 partitions only moves the keys that go to the new
+	// partition, about 1/11 of them.
+	const numKeys = 10000
+	var moved int
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf(`[%d]`, i)
+		before, after := partition(key, 10), partition(key, 11)
+		if before != after {
+			require.Equal(t, int32(10), after, `key %s moved to an old partition`, key)
+			moved++
+		}
+	}
+	require.True(t, moved > numKeys/22 && moved < numKeys*2/11, `%d keys moved`, moved)
+
+	// The partition key of a hint is hashed the same way.
+	hinted, err := partitioner.Partition(&sarama.ProducerMessage{
+		Key:      sarama.ByteEncoder(`["a", 1]`),
+		Metadata: kafkaMessageMetadata{partitionHint: partitionHint{key: []byte(`["a"]`)}},
+	}, 16)
+	require.NoError(t, err)
+	require.Equal(t, partition(`["a"]`, 16), hinted)
+}
+
+func TestKafkaSinkPartitionKeyTransform(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for params, expectedErr := range map[string]string{
+		`partition_key_buckets=nope`: `parsing partition_key_buckets: ` +
+			`strconv.Atoi: parsing "nope": invalid syntax`,
+		`partition_key_buckets=0`: `partition_key_buckets must be positive: 0`,
+	} {
+		q, err := url.ParseQuery(params)
+		require.NoError(t, err)
+		_, err = consumeKafkaSinkConfig(q)
+		require.EqualError(t, err, expectedErr)
+	}
+
+	require.Equal(t, []byte(`s["a"]`), partitionKey([]byte(`["a"]`), `s`, 0 /* buckets */))
+	q := url.Values{}
+	q.Set(sinkParamPartitionKeySalt, `s`)
+	q.Set(sinkParamPartitionKeyBuckets, `4`)
+	cfg, err := consumeKafkaSinkConfig(q)
+	require.NoError(t, err)
+	require.Empty(t, q)
+
+	const numPartitions = 16
+	transformed := makeChangefeedPartitionerConstructor(cfg)(`t`)
+	plain := newChangefeedPartitioner(`t`)
+	partition := func(p sarama.Partitioner, m *sarama.ProducerMessage) int32 {
+		partition, err := p.Partition(m, numPartitions)
+		require.NoError(t, err)
+		return partition
+	}
+	keyed := func(key string) *sarama.ProducerMessage {
+		return &sarama.ProducerMessage{Key: sarama.ByteEncoder(key), Metadata: kafkaMessageMetadata{}}
+	}
+
+	// Every key goes to the partition its salted bucket hashes to, so no more
+	// than 4 partitions are used, and the message key isn't touched.
+	used := make(map[int32]struct{})
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf(`[%d]`, i)
+		m := keyed(key)
+		p := partition(transformed, m)
+		require.Equal(t, partition(plain, keyed(string(partitionKey([]byte(key), `s`, 4)))), p)
+		require.Equal(t, sarama.ByteEncoder(key), m.Key)
+		used[p] = struct{}{}
+	}
+	require.True(t, len(used) <= 4, `%d partitions used`, len(used))
+
+	// The partition key of a hint is transformed the same way.
+	hinted := &sarama.ProducerMessage{
+		Key:      sarama.ByteEncoder(`["a", 1]`),
+		Metadata: kafkaMessageMetadata{partitionHint: partitionHint{key: []byte(`["a"]`)}},
+	}
+	require.Equal(t, partition(transformed, keyed(`["a"]`)), partition(transformed, hinted))
+
+	// An explicit value isn't affected.
+	pinned := &sarama.ProducerMessage{
+		Metadata: kafkaMessageMetadata{partitionHint: partitionHint{value: 5, hasValue: true}},
+	}
+	require.Equal(t, int32(5), partition(transformed, pinned))
+}
+
+func TestKafkaSinkContentType(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	sink := &kafkaSink{
+		cfg:      kafkaSinkConfig{contentType: cloudEventsContentType},
+		producer: p,
+		topics:   map[string]struct{}{`t`: {}},
+	}
+	sink.start()
+	defer func() { require.NoError(t, sink.Close()) }()
+
+	table := &sqlbase.TableDescriptor{Name: `t`}
+	require.NoError(t, sink.EmitRow(ctx, table, []byte(`k`), []byte(`v`), zeroTS))
+	m := <-p.inputCh
+	require.Equal(t, []sarama.RecordHeader{
+		{Key: []byte(`content-type`), Value: []byte(`application/cloudevents+json`)},
+	}, m.Headers)
+}
+
+func TestKafkaSinkHighWater(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	k := &kafkaSink{
+		cfg:      kafkaSinkConfig{highWaterHeader: true},
+		producer: p,
+		topics:   map[string]struct{}{`t`: {}},
+	}
+	k.start()
+	defer func() { require.NoError(t, k.Close()) }()
+	sink := makeMetricsSink(MakeMetrics(time.Minute).(*Metrics), k)
+
+	// The high water is passed through wrapping sinks and only moves forward.
+	table := &sqlbase.TableDescriptor{Name: `t`}
+	for _, highWater := range []hlc.Timestamp{{WallTime: 2, Logical: 1}, {WallTime: 1}} {
+		setSinkHighWater(sink, highWater)
+		require.NoError(t, sink.EmitRow(ctx, table, []byte(`k`), []byte(`v`), zeroTS))
+		m := <-p.inputCh
+		require.Equal(t, []sarama.RecordHeader{
+			{Key: []byte(`high_water`), Value: []byte(`2.0000000001`)},
+		}, m.Headers)
+		p.successesCh <- m
+	}
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+}
+
+func TestKafkaSinkSchemaVersionHeader(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	q := url.Values{}
+	q.Set(sinkParamSchemaVersionHeader, `nope`)
+	_, err := consumeKafkaSinkConfig(q)
+	require.EqualError(t, err,
+		`parsing schema_version_header: strconv.ParseBool: parsing "nope": invalid syntax`)
+	q.Set(sinkParamSchemaVersionHeader, `true`)
+	cfg, err := consumeKafkaSinkConfig(q)
+	require.NoError(t, err)
+	require.Empty(t, q)
+
+	ctx := context.Background()
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	sink := &kafkaSink{
+		cfg:      cfg,
+		producer: p,
+		topics:   map[string]struct{}{`t`: {}},
+	}
+	sink.start()
+	defer func() { require.NoError(t, sink.Close()) }()
+
+	// Each row has the version of the descriptor it was encoded with.
+	for _, version := range []sqlbase.DescriptorVersion{1, 12} {
+		table := &sqlbase.TableDescriptor{Name: `t`, Version: version}
+		require.NoError(t, sink.EmitRow(ctx, table, []byte(`k`), []byte(`v`), zeroTS))
+		m := <-p.inputCh
+		require.Equal(t, []sarama.RecordHeader{
+			{Key: []byte(`schema_version`), Value: []byte(fmt.Sprint(version))},
+		}, m.Headers)
+		p.successesCh <- m
+	}
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+}
+
+func TestKafkaSinkSourceHeaders(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	newClientFn := func(_ []string, _ *sarama.Config) (sarama.Client, sarama.AsyncProducer, error) {
+		return &fakeKafkaClient{partitions: map[string][]int32{`t`: {0}}}, p, nil
+	}
+	targets := jobspb.ChangefeedTargets{
+		53: {StatementTimeName: `t`, StatementTimeDatabaseName: `d`},
+	}
+	sink, err := makeKafkaSink(
+		ctx, kafkaSinkConfig{sourceHeaders: true}, `a:9092`, targets, newClientFn)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, sink.Close()) }()
+
+	// The database's name is only there if it's known.
+	for _, table := range []*sqlbase.TableDescriptor{
+		{Name: `t`, ID: 53, ParentID: 52},
+		{Name: `t`, ID: 54, ParentID: 52},
+	} {
+		require.NoError(t, sink.EmitRow(ctx, table, []byte(`k`), []byte(`v`), zeroTS))
+		m := <-p.inputCh
+		expected := []sarama.RecordHeader{
+			{Key: []byte(`table_id`), Value: []byte(fmt.Sprint(table.ID))},
+			{Key: []byte(`database_id`), Value: []byte(`52`)},
+		}
+		if table.ID == 53 {
+			expected = append(expected, sarama.RecordHeader{Key: []byte(`database`), Value: []byte(`d`)})
+		}
+		require.Equal(t, expected, m.Headers)
+		p.successesCh <- m
+	}
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+}
+
+func TestKafkaSinkLifecycleMarkers(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	opts := map[string]string{optLifecycleMarkers: ``}
+	_, err := getSink(ctx, `kafka://nope/`, opts, &jsonEncoder{},
+		nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+	require.EqualError(t, err, `lifecycle_markers requires control_topic`)
+	_, err = getSink(ctx, ``, opts, &jsonEncoder{},
+		nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+	require.EqualError(t, err, `this sink is incompatible with lifecycle_markers`)
+
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	sink := &kafkaSink{
+		cfg:      kafkaSinkConfig{controlTopic: `control`},
+		producer: p,
+		topics:   map[string]struct{}{`t`: {}},
+	}
+	sink.start()
+	defer func() { require.NoError(t, sink.Close()) }()
+
+	// The markers go to the control topic, under the same key, and are
+	// flushed before EmitFeedLifecycle returns.
+	acked := make(chan *sarama.ProducerMessage, 1)
+	for _, phase := range []feedPhase{feedPhaseStart, feedPhaseEnd} {
+		go func() {
+			m := <-p.inputCh
+			p.successesCh <- m
+			acked <- m
+		}()
+		require.NoError(t, sink.EmitFeedLifecycle(ctx, phase, hlc.Timestamp{WallTime: 1}))
+		require.Equal(t, int64(0), sink.InflightCount())
+		m := <-acked
+		require.Equal(t, `control`, m.Topic)
+		require.Equal(t, sarama.StringEncoder(`__crdb__`), m.Key)
+		expected := `{"phase":"` + string(phase) + `","timestamp":"1.0000000000"}`
+		require.Equal(t, sarama.ByteEncoder(expected), m.Value)
+	}
+}
+
+func TestKafkaSinkFlushTable(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	table := func(name string) *sqlbase.TableDescriptor {
+		return &sqlbase.TableDescriptor{Name: name}
+	}
+
+	ctx := context.Background()
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	sink := &kafkaSink{
+		producer: p,
+		topics:   map[string]struct{}{`a`: {}, `b`: {}},
+	}
+	sink.start()
+	// The inflight messages of every open sink are added up by a gauge.
+	metrics := MakeMetrics(time.Minute).(*Metrics)
+	wrapped := makeMetricsSink(metrics, sink)
+	defer func() {
+		require.NoError(t, wrapped.Close())
+		require.Empty(t, metrics.mu.sinks)
+	}()
+
+	require.Equal(t, int64(0), sinkInflightCount(sink))
+	require.NoError(t, sink.EmitRow(ctx, table(`a`), []byte(`1`), nil, zeroTS))
+	m := <-p.inputCh
+	require.Equal(t, int64(1), sinkInflightCount(makeRateLimitedSink(sink, sinkRateLimits{})))
+	require.Equal(t, int64(1), metrics.SinkInflightMessages.Value())
+
+	// Nothing from b is inflight, so it doesn't wait for a.
+	require.NoError(t, flushTable(ctx, sink, `b`, zeroTS))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	require.Regexp(t, `context deadline exceeded`, flushTable(timeoutCtx, sink, `a`, zeroTS))
+
+	go func() { p.successesCh <- m }()
+	require.NoError(t, flushTable(ctx, sink, `a`, zeroTS))
+	require.Equal(t, int64(0), sinkInflightCount(sink))
+	require.Equal(t, int64(0), metrics.SinkInflightMessages.Value())
+	sink.mu.Lock()
+	require.Empty(t, sink.mu.inflightTables)
+	sink.mu.Unlock()
+}
+
+func TestKafkaSinkCloseAndDrain(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	sink := &kafkaSink{
+		producer: p,
+		topics:   map[string]struct{}{`t`: {}},
+	}
+	sink.start()
+
+	// One row is acknowledged, one is rejected and one is never acknowledged.
+	table := &sqlbase.TableDescriptor{Name: `t`}
+	var msgs []*sarama.ProducerMessage
+	for _, key := range []string{`1`, `2`, `3`} {
+		require.NoError(t, sink.EmitRow(ctx, table, []byte(key), nil, zeroTS))
+		msgs = append(msgs, <-p.inputCh)
+	}
+	p.successesCh <- msgs[0]
+	p.errorsCh <- &sarama.ProducerError{Msg: msgs[1], Err: errors.New(`boom`)}
+	testutils.SucceedsSoon(t, func() error {
+		if inflight := sink.InflightCount(); inflight != 1 {
+			return errors.Errorf(`expected 1 inflight message got %d`, inflight)
+		}
+		return nil
+	})
+
+	// It's drained through a wrapper, which passes it on.
+	drainCtx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	undelivered, err := closeAndDrainSink(drainCtx, makeRateLimitedSink(sink, sinkRateLimits{}))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []MessageRef{
+		{Topic: `t`, Key: []byte(`2`)},
+		{Topic: `t`, Key: []byte(`3`)},
+	}, undelivered)
+}
+
+// drainRecordingSink is a bufferSink that records what the context it was
+// drained with looked like at the time.
+type drainRecordingSink struct {
+	*bufferSink
+	drained     bool
+	drainErr    error
+	hasDeadline bool
+}
+
+func (s *drainRecordingSink) CloseAndDrain(ctx context.Context) ([]MessageRef, error) {
+	s.drained, s.drainErr = true, ctx.Err()
+	_, s.hasDeadline = ctx.Deadline()
+	return []MessageRef{{Topic: `t`}}, s.Close()
+}
+
+func TestCloseSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	// A processor's context is canceled by the time it closes its sink, but
+	// the sink still gets a while to drain.
+	procCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := &drainRecordingSink{bufferSink: &bufferSink{}}
+	closeSink(procCtx, makeMetricsSink(MakeMetrics(time.Minute).(*Metrics), s))
+	require.True(t, s.drained)
+	require.NoError(t, s.drainErr)
+	require.True(t, s.hasDeadline)
+	require.True(t, s.closed)
+}
+
+// forwardRecordingSink records the calls made to it through the optional
+// interfaces that sink wrappers forward.
+type forwardRecordingSink struct {
+	*bufferSink
+	calls []string
+}
+
+func (s *forwardRecordingSink) record(call string) {
+	s.calls = append(s.calls, call)
+}
+
+func (s *forwardRecordingSink) Ping(context.Context) error {
+	s.record(`Ping`)
+	return nil
+}
+
+func (s *forwardRecordingSink) SetBackfillMode(bool) {
+	s.record(`SetBackfillMode`)
+}
+
+func (s *forwardRecordingSink) SetHighWater(hlc.Timestamp) {
+	s.record(`SetHighWater`)
+}
+
+func (s *forwardRecordingSink) EmitFeedLifecycle(context.Context, feedPhase, hlc.Timestamp) error {
+	s.record(`EmitFeedLifecycle`)
+	return nil
+}
+
+func (s *forwardRecordingSink) EmitRowWithPartitionHint(
+	context.Context, *sqlbase.TableDescriptor, []byte, []byte, partitionHint, hlc.Timestamp,
+) error {
+	s.record(`EmitRowWithPartitionHint`)
+	return nil
+}
+
+func (s *forwardRecordingSink) SetMetrics(*Metrics, roachpb.NodeID) {
+	s.record(`SetMetrics`)
+}
+
+func (s *forwardRecordingSink) ResumeFromState(context.Context, []roachpb.Span) error {
+	s.record(`ResumeFromState`)
+	return nil
+}
+
+func (s *forwardRecordingSink) TakeChangedTopics() []string {
+	s.record(`TakeChangedTopics`)
+	return nil
+}
+
+func (s *forwardRecordingSink) NoteChangedTopic(string) {
+	s.record(`NoteChangedTopic`)
+}
+
+func (s *forwardRecordingSink) TakeCompletedFiles() []string {
+	s.record(`TakeCompletedFiles`)
+	return nil
+}
+
+func (s *forwardRecordingSink) NoteCompletedFile(string) {
+	s.record(`NoteCompletedFile`)
+}
+
+func (s *forwardRecordingSink) CombinesTopicResolved() bool {
+	s.record(`CombinesTopicResolved`)
+	return true
+}
+
+func (s *forwardRecordingSink) SetCombinedTopicResolved(map[string]hlc.Timestamp) {
+	s.record(`SetCombinedTopicResolved`)
+}
+
+func (s *forwardRecordingSink) EmitsTopicResolved() bool {
+	s.record(`EmitsTopicResolved`)
+	return true
+}
+
+func (s *forwardRecordingSink) EmitTopicResolvedTimestamp(
+	context.Context, Encoder, string, hlc.Timestamp,
+) error {
+	s.record(`EmitTopicResolvedTimestamp`)
+	return nil
+}
+
+func TestSinkWrappersForward(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	debugDir, cleanup := testutils.TempDir(t)
+	defer cleanup()
+	breaker, err := acquireSinkBreaker(`kafka://nope?breaker_failures=1`, 1 /* jobID */)
+	require.NoError(t, err)
+	defer breaker.release()
+	metrics := MakeMetrics(time.Minute).(*Metrics)
+
+	wrappers := []struct {
+		name string
+		wrap func(Sink) Sink
+	}{
+		{`debug mirror`, func(s Sink) Sink {
+			m, err := makeDebugMirrorSink(ctx, s, debugMirrorConfig{dir: debugDir}, 1 /* jobID */)
+			require.NoError(t, err)
+			return m
+		}},
+		{`debug tap`, func(s Sink) Sink { return makeDebugTapSink(s, 0 /* sampleRate */) }},
+		{`value limit`, func(s Sink) Sink {
+			return makeValueLimitSink(s, sinkValueLimit{maxBytes: 1 << 10})
+		}},
+		{`dead letter`, func(s Sink) Sink { return makeDeadLetterSink(s, &bufferSink{}) }},
+		{`rate limit`, func(s Sink) Sink { return makeRateLimitedSink(s, sinkRateLimits{}) }},
+		{`breaker`, func(s Sink) Sink { return makeBreakerSink(s, breaker) }},
+		{`sla`, func(s Sink) Sink { return makeSLASink(s, metrics, 0 /* sla */) }},
+		{`metrics`, func(s Sink) Sink { return makeMetricsSink(metrics, s) }},
+	}
+	table := &sqlbase.TableDescriptor{Name: `foo`}
+	ts := hlc.Timestamp{WallTime: 1}
+	for _, w := range wrappers {
+		t.Run(w.name, func(t *testing.T) {
+			rec := &forwardRecordingSink{bufferSink: &bufferSink{}}
+			s := w.wrap(rec)
+			defer func() { require.NoError(t, s.Close()) }()
+
+			require.NoError(t, pingSink(ctx, s))
+			setSinkBackfillMode(ctx, s, true)
+			setSinkHighWater(s, ts)
+			require.NoError(t, emitFeedLifecycle(ctx, s, feedPhaseStart, ts))
+			require.NoError(t, emitRowWithPartitionHint(
+				ctx, s, table, []byte(`k`), []byte(`v`), partitionHint{}, ts))
+			setSinkMetrics(s, metrics, 1 /* nodeID */)
+			require.NoError(t, resumeSinkFromState(ctx, s, nil /* spans */))
+			takeSinkChangedTopics(s)
+			noteSinkChangedTopic(s, `foo`)
+			takeSinkCompletedFiles(s)
+			noteSinkCompletedFile(s, `foo.ndjson`)
+			require.True(t, sinkCombinesTopicResolved(s))
+			setSinkCombinedTopicResolved(s, map[string]hlc.Timestamp{`foo`: ts})
+			require.True(t, sinkEmitsTopicResolved(s))
+			require.NoError(t, emitSinkTopicResolvedTimestamp(
+				ctx, s, makeJSONEncoder(nil /* opts */), `foo`, ts))
+			require.Equal(t, []string{
+				`Ping`, `SetBackfillMode`, `SetHighWater`, `EmitFeedLifecycle`,
+				`EmitRowWithPartitionHint`, `SetMetrics`, `ResumeFromState`,
+				`TakeChangedTopics`, `NoteChangedTopic`, `TakeCompletedFiles`,
+				`NoteCompletedFile`, `CombinesTopicResolved`, `SetCombinedTopicResolved`,
+				`EmitsTopicResolved`, `EmitTopicResolvedTimestamp`,
+			}, rec.calls)
+		})
+	}
+}
+
+func TestKafkaSinkInflightPartitions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	sink := &kafkaSink{
+		producer: p,
+		topics:   map[string]struct{}{`t`: {}},
+	}
+	sink.start()
+	defer func() { require.NoError(t, sink.Close()) }()
+
+	// The mock producer doesn't partition, so do what sarama would, with a
+	// partitioner that reports to the sink.
+	partitioner := makeChangefeedPartitionerConstructor(kafkaSinkConfig{})(`t`)
+	partitioner.(*changefeedPartitioner).onPartition = sink.notePartition
+	table := &sqlbase.TableDescriptor{Name: `t`}
+	var msgs []*sarama.ProducerMessage
+	for _, key := range []string{`a`, `b`, `c`, `d`} {
+		require.NoError(t, sink.EmitRow(ctx, table, []byte(key), nil, zeroTS))
+		msgs = append(msgs, <-p.inputCh)
+	}
+	for _, msg := range msgs[:3] {
+		var err error
+		msg.Partition, err = partitioner.Partition(msg, 2)
+		require.NoError(t, err)
+	}
+	// The last message hasn't been partitioned yet.
+	require.Equal(t, `t/0: 2, t/1: 1, t/?: 1`, sink.describeInflightPartitions(10))
+	require.Equal(t, `t/0: 2, and 2 more`, sink.describeInflightPartitions(1))
+
+	// Acknowledged messages aren't inflight anymore, whether or not they were
+	// partitioned.
+	p.successesCh <- msgs[0]
+	p.successesCh <- msgs[3]
+	testutils.SucceedsSoon(t, func() error {
+		if inflight := sink.InflightCount(); inflight != 2 {
+			return errors.Errorf(`expected 2 inflight messages got %d`, inflight)
+		}
+		return nil
+	})
+	require.Equal(t, `t/0: 1, t/1: 1`, sink.describeInflightPartitions(10))
+	p.successesCh <- msgs[1]
+	p.successesCh <- msgs[2]
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+	require.Equal(t, ``, sink.describeInflightPartitions(10))
+}
+
+func TestKafkaSinkBackpressure(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	table := func(name string) *sqlbase.TableDescriptor {
+		return &sqlbase.TableDescriptor{Name: name}
+	}
+
+	ctx := context.Background()
+	// An unbuffered input channel that nothing reads from simulates a full
+	// producer queue.
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	sink := &kafkaSink{
+		cfg:      kafkaSinkConfig{backpressureTimeout: time.Millisecond},
+		producer: p,
+		topics:   map[string]struct{}{`t`: {}},
+	}
+	sink.start()
+	defer func() { require.NoError(t, sink.Close()) }()
+
+	err := sink.EmitRow(ctx, table(`t`), []byte(`1`), nil, zeroTS)
+	require.True(t, isBackpressureSinkError(err), `expected backpressure error got: %+v`, err)
+	require.True(t, isRetryableSinkError(err), `expected retryable error got: %+v`, err)
+
+	// The message that timed out isn't inflight anymore, so it doesn't hold up
+	// the next flush.
+	sink.mu.Lock()
+	require.Equal(t, int64(0), sink.mu.inflight)
+	require.Empty(t, sink.mu.inflightMsgs)
+	require.Empty(t, sink.mu.inflightPartitions)
+	require.Empty(t, sink.mu.inflightTables)
+	sink.mu.Unlock()
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+}
+
+func TestKafkaSinkChangedTopics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	table := func(name string) *sqlbase.TableDescriptor {
+		return &sqlbase.TableDescriptor{Name: name}
+	}
+
+	ctx := context.Background()
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 3),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	sink := &kafkaSink{
+		cfg:      kafkaSinkConfig{resolvedChangedTopicsOnly: true},
+		producer: p,
+		topics:   map[string]struct{}{`a`: {}, `b`: {}, `c`: {}},
+	}
+	sink.start()
+	defer func() { require.NoError(t, sink.Close()) }()
+
+	require.Empty(t, sink.TakeChangedTopics())
+	require.NoError(t, sink.EmitRow(ctx, table(`c`), []byte(`1`), nil, zeroTS))
+	require.NoError(t, sink.EmitRow(ctx, table(`a`), []byte(`2`), nil, zeroTS))
+	require.Equal(t, []string{`a`, `c`}, sink.TakeChangedTopics())
+	require.Empty(t, sink.TakeChangedTopics())
+
+	// The topics are tracked through the wrappers added by sink params, but
+	// only by sinks configured to.
+	wrapped := makeRateLimitedSink(makeDebugTapSink(sink, 0 /* sampleRate */), sinkRateLimits{})
+	require.NoError(t, wrapped.EmitRow(ctx, table(`b`), []byte(`3`), nil, zeroTS))
+	require.Equal(t, []string{`b`}, takeSinkChangedTopics(wrapped))
+	untracked := makeRateLimitedSink(&kafkaSink{}, sinkRateLimits{})
+	noteSinkChangedTopic(untracked, `a`)
+	require.Empty(t, takeSinkChangedTopics(untracked))
+	require.Empty(t, takeSinkChangedTopics(&bufferSink{}))
+}
+
+func TestKafkaSinkResolvedTopic(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 2),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	cfg, err := consumeKafkaSinkConfig(url.Values{
+		sinkParamTopicPrefix:   {`p_`},
+		sinkParamResolvedTopic: {`progress`},
+	})
+	require.NoError(t, err)
+	// There's no client, because the partitions of the data topics aren't
+	// needed.
+	sink := &kafkaSink{
+		cfg:      cfg,
+		producer: p,
+		topics:   map[string]struct{}{`p_a`: {}, `p_b`: {}},
+	}
+	sink.start()
+	defer func() { require.NoError(t, sink.Close()) }()
+
+	// Every data topic gets one resolved timestamp in the resolved topic, keyed
+	// by the data topic.
+	var e testEncoder
+	require.NoError(t, sink.EmitResolvedTimestamp(ctx, e, hlc.Timestamp{WallTime: 1}))
+	keys := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		m := <-p.inputCh
+		require.Equal(t, `progress`, m.Topic)
+		key, err := m.Key.Encode()
+		require.NoError(t, err)
+		value, err := m.Value.Encode()
+		require.NoError(t, err)
+		keys[string(key)] = string(value)
+		p.successesCh <- m
+	}
+	require.Equal(t, map[string]string{
+		`p_a`: `0.000000001,0`,
+		`p_b`: `0.000000001,0`,
+	}, keys)
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+}
+
+func TestKafkaSinkRejectsLargeRows(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	config := sarama.NewConfig()
+	config.Producer.MaxMessageBytes = 10
+	sink := &kafkaSink{
+		producer: p,
+		config:   config,
+		topics:   map[string]struct{}{`t`: {}},
+	}
+	sink.start()
+	defer func() { require.NoError(t, sink.Close()) }()
+
+	table := &sqlbase.TableDescriptor{Name: `t`}
+	err := sink.EmitRow(ctx, table, []byte(`[1]`), []byte(`{"a": 1234}`), zeroTS)
+	require.True(t, isRowSinkError(err), `%+v`, err)
+	require.Equal(t, int64(0), sink.InflightCount())
+	require.NoError(t, sink.EmitRow(ctx, table, []byte(`[1]`), []byte(`{}`), zeroTS))
+	p.successesCh <- <-p.inputCh
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+}
+
+// fakeKafkaClient is a sarama.Client that serves partitions from a map
+// instead of a broker. Methods that a kafkaSink doesn't use panic.
+type fakeKafkaClient struct {
+	sarama.Client
+	partitions    map[string][]int32
+	partitionsErr error
+	refreshes     int
+	refreshErr    error
+	closed        bool
+}
+
+func (c *fakeKafkaClient) Partitions(topic string) ([]int32, error) {
+	if c.partitionsErr != nil {
+		return nil, c.partitionsErr
+	}
+	return c.partitions[topic], nil
+}
+
+func (c *fakeKafkaClient) RefreshMetadata(...string) error {
+	c.refreshes++
+	return c.refreshErr
+}
+
+func (c *fakeKafkaClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestKafkaSinkFakeClient(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	table := func(name string) *sqlbase.TableDescriptor {
+		return &sqlbase.TableDescriptor{Name: name}
+	}
+	inflight := func(s *kafkaSink) int64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.mu.inflight
+	}
+
+	ctx := context.Background()
+	client := &fakeKafkaClient{partitions: map[string][]int32{`t`: {0, 1, 2}}}
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 6),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	var brokers []string
+	var config *sarama.Config
+	newClientFn := func(b []string, c *sarama.Config) (sarama.Client, sarama.AsyncProducer, error) {
+		brokers, config = b, c
+		return client, p, nil
+	}
+
+	targets := jobspb.ChangefeedTargets{
+		0: jobspb.ChangefeedTarget{StatementTimeName: `t`},
+	}
+	_, err := makeKafkaSink(ctx, kafkaSinkConfig{}, `a:9092,b:9092`, targets,
+		func([]string, *sarama.Config) (sarama.Client, sarama.AsyncProducer, error) {
+			return nil, nil, errors.New(`no brokers`)
+		})
+	require.True(t, isRetryableSinkError(err), `expected retryable error got: %+v`, err)
+	require.Regexp(t, `connecting to kafka: a:9092,b:9092: no brokers`, err)
+
+	sink, err := makeKafkaSink(ctx, kafkaSinkConfig{}, `a:9092,b:9092`, targets, newClientFn)
+	require.NoError(t, err)
+	s := sink.(*kafkaSink)
+	require.Equal(t, []string{`a:9092`, `b:9092`}, brokers)
+	require.Equal(t, 1, config.Producer.Flush.Messages)
+	require.True(t, config.Producer.Return.Successes)
+	require.Equal(t, []int32{0, 1, 2}, s.partitions[`t`])
+
+	// A resolved timestamp goes to every partition and each message is
+	// inflight until it's acknowledged. Metadata is only refreshed once a
+	// minute.
+	var e testEncoder
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, e, zeroTS))
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, e, zeroTS))
+	require.Equal(t, 1, client.refreshes)
+	require.Equal(t, int64(6), inflight(s))
+	for i := int32(0); i < 3; i++ {
+		m := <-p.inputCh
+		require.Equal(t, `t`, m.Topic)
+		require.Equal(t, i, m.Partition)
+		p.successesCh <- m
+	}
+	testutils.SucceedsSoon(t, func() error {
+		if i := inflight(s); i != 3 {
+			return errors.Errorf(`expected 3 inflight got %d`, i)
+		}
+		return nil
+	})
+
+	// Flush waits for all of them, then is signaled by the worker.
+	flushErrCh := make(chan error, 1)
+	go func() { flushErrCh <- s.Flush(ctx, zeroTS) }()
+	testutils.SucceedsSoon(t, func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.mu.flushCh == nil {
+			return errors.New(`flush is not waiting`)
+		}
+		return nil
+	})
+	for i := 0; i < 2; i++ {
+		p.successesCh <- <-p.inputCh
+	}
+	select {
+	case err := <-flushErrCh:
+		t.Fatalf(`flush returned with 1 message inflight: %v`, err)
+	default:
+	}
+	p.errorsCh <- &sarama.ProducerError{Msg: <-p.inputCh, Err: errors.New(`m`)}
+	err = <-flushErrCh
+	require.True(t, isRetryableSinkError(err), `expected retryable error got: %+v`, err)
+	require.Equal(t, int64(0), inflight(s))
+	s.mu.Lock()
+	require.Nil(t, s.mu.flushCh)
+	s.mu.Unlock()
+
+	// The error is only returned once.
+	require.NoError(t, s.Flush(ctx, zeroTS))
+
+	// If the partitions can't be looked up, the cached ones are used.
+	client.partitionsErr = errors.New(`metadata hiccup`)
+	require.NoError(t, s.EmitRow(ctx, table(`t`), []byte(`k`), []byte(`v`), zeroTS))
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, e, zeroTS))
+	require.Equal(t, int64(4), inflight(s))
+	for i := 0; i < 4; i++ {
+		p.successesCh <- <-p.inputCh
+	}
+	require.NoError(t, s.Flush(ctx, zeroTS))
+
+	// A ping refreshes the metadata of the topics.
+	client.refreshes = 0
+	require.NoError(t, pingSink(ctx, s))
+	require.Equal(t, 1, client.refreshes)
+	client.refreshErr = errors.New(`no leader`)
+	require.EqualError(t, pingSink(ctx, s), `refreshing kafka metadata: no leader`)
+
+	require.NoError(t, s.Close())
+	require.True(t, client.closed)
+}
+
+func TestKafkaSinkTopicPartitions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	client := &fakeKafkaClient{partitions: map[string][]int32{`t`: {0, 1}}}
+	s := &kafkaSink{client: client, partitions: make(map[string][]int32)}
+
+	// Without cached partitions, a failed lookup is an error.
+	client.partitionsErr = sarama.ErrOutOfBrokers
+	_, err := s.topicPartitions(ctx, `t`)
+	require.Equal(t, sarama.ErrOutOfBrokers, err)
+	require.Empty(t, s.partitions)
+
+	// A successful lookup is cached and used when a later one fails because
+	// the brokers are briefly unavailable.
+	client.partitionsErr = nil
+	partitions, err := s.topicPartitions(ctx, `t`)
+	require.NoError(t, err)
+	require.Equal(t, []int32{0, 1}, partitions)
+	client.partitionsErr = sarama.ErrOutOfBrokers
+	partitions, err = s.topicPartitions(ctx, `t`)
+	require.NoError(t, err)
+	require.Equal(t, []int32{0, 1}, partitions)
+	client.partitionsErr = &retryableSinkError{cause: errors.New(`metadata hiccup`)}
+	partitions, err = s.topicPartitions(ctx, `t`)
+	require.NoError(t, err)
+	require.Equal(t, []int32{0, 1}, partitions)
+
+	// Other errors aren't masked by the cache.
+	client.partitionsErr = sarama.ErrUnknownTopicOrPartition
+	_, err = s.topicPartitions(ctx, `t`)
+	require.Equal(t, sarama.ErrUnknownTopicOrPartition, err)
+
+	// The cache of one topic isn't used for another.
+	client.partitionsErr = sarama.ErrOutOfBrokers
+	_, err = s.topicPartitions(ctx, `u`)
+	require.Equal(t, sarama.ErrOutOfBrokers, err)
+
+	// Once the lookup works again, partitions added in the meantime replace
+	// the stale cached ones, which aren't used again.
+	client.partitionsErr = nil
+	client.partitions[`t`] = []int32{0, 1, 2}
+	partitions, err = s.topicPartitions(ctx, `t`)
+	require.NoError(t, err)
+	require.Equal(t, []int32{0, 1, 2}, partitions)
+	client.partitionsErr = sarama.ErrOutOfBrokers
+	partitions, err = s.topicPartitions(ctx, `t`)
+	require.NoError(t, err)
+	require.Equal(t, []int32{0, 1, 2}, partitions)
+}
+
+func TestKafkaSinkConfigHook(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	var config *sarama.Config
+	newClientFn := func(_ []string, c *sarama.Config) (sarama.Client, sarama.AsyncProducer, error) {
+		config = c
+		return &fakeKafkaClient{}, p, nil
+	}
+	targets := jobspb.ChangefeedTargets{
+		0: jobspb.ChangefeedTarget{StatementTimeName: `t`},
+	}
+
+	// The hook sees the sink's settings and its changes are kept.
+	cfg := kafkaSinkConfig{configHook: func(c *sarama.Config) error {
+		require.Equal(t, 1, c.Producer.Flush.Messages)
+		c.ClientID = `custom-client`
+		return nil
+	}}
+	sink, err := makeKafkaSink(ctx, cfg, `k:9092`, targets, newClientFn)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	require.Equal(t, `custom-client`, config.ClientID)
+	require.Equal(t, 1, config.Producer.Flush.Messages)
+
+	cfg.configHook = func(*sarama.Config) error { return errors.New(`nope`) }
+	_, err = makeKafkaSink(ctx, cfg, `k:9092`, targets, newClientFn)
+	require.EqualError(t, err, `applying kafka config hook: nope`)
+
+	cfg.configHook = func(c *sarama.Config) error {
+		c.ClientID = `invalid client id!`
+		return nil
+	}
+	_, err = makeKafkaSink(ctx, cfg, `k:9092`, targets, newClientFn)
+	require.Regexp(t, `invalid kafka config after hook: .*ClientID`, err)
+
+	// getSink takes the hook from the testing knobs.
+	knobs := TestingKnobs{KafkaConfigHook: func(*sarama.Config) error { return errors.New(`nope`) }}
+	_, err = getSink(context.Background(), `kafka://nope/`, map[string]string{}, &jsonEncoder{},
+		targets, 0 /* jobID */, nil /* settings */, knobs)
+	require.EqualError(t, err, `applying kafka config hook: nope`)
+}
+
+func TestKafkaSinkIdleFlushInterval(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	_, err := consumeKafkaSinkConfig(url.Values{sinkParamIdleFlushInterval: {`0s`}})
+	require.EqualError(t, err, `idle_flush_interval must be positive: 0s`)
+
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	var config *sarama.Config
+	newClientFn := func(_ []string, c *sarama.Config) (sarama.Client, sarama.AsyncProducer, error) {
+		config = c
+		return &fakeKafkaClient{}, p, nil
+	}
+	targets := jobspb.ChangefeedTargets{
+		0: jobspb.ChangefeedTarget{StatementTimeName: `t`},
+	}
+
+	// The interval is sarama's flush frequency, on top of flushing every
+	// message.
+	cfg, err := consumeKafkaSinkConfig(url.Values{sinkParamIdleFlushInterval: {`250ms`}})
+	require.NoError(t, err)
+	sink, err := makeKafkaSink(ctx, cfg, `k:9092`, targets, newClientFn)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	require.Equal(t, 250*time.Millisecond, config.Producer.Flush.Frequency)
+	require.Equal(t, 1, config.Producer.Flush.Messages)
+}
+
+func TestKafkaSinkReconnect(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	defer func(opts retry.Options) { kafkaReconnectRetryOpts = opts }(kafkaReconnectRetryOpts)
+	kafkaReconnectRetryOpts = retry.Options{InitialBackoff: time.Microsecond, MaxRetries: 1}
+
+	table := &sqlbase.TableDescriptor{Name: `t`}
+	targets := jobspb.ChangefeedTargets{
+		0: jobspb.ChangefeedTarget{StatementTimeName: `t`},
+	}
+	makeProducer := func() asyncProducerMock {
+		return asyncProducerMock{
+			inputCh:     make(chan *sarama.ProducerMessage, 2),
+			successesCh: make(chan *sarama.ProducerMessage, 1),
+			errorsCh:    make(chan *sarama.ProducerError, 1),
+		}
+	}
+	// Each client gets the next producer. Once they run out, connecting fails.
+	producers := make(chan asyncProducerMock, 2)
+	var clients []*fakeKafkaClient
+	newClientFn := func([]string, *sarama.Config) (sarama.Client, sarama.AsyncProducer, error) {
+		select {
+		case p := <-producers:
+			client := &fakeKafkaClient{}
+			clients = append(clients, client)
+			return client, p, nil
+		default:
+			return nil, nil, errors.New(`no brokers`)
+		}
+	}
+
+	ctx := context.Background()
+	p1, p2 := makeProducer(), makeProducer()
+	producers <- p1
+	producers <- p2
+	sink, err := makeKafkaSink(ctx, kafkaSinkConfig{}, `k:9092`, targets, newClientFn)
+	require.NoError(t, err)
+	s := sink.(*kafkaSink)
+
+	// A message that fails because the connection was lost is resent on a new
+	// producer, and the flush succeeds once that one is acknowledged.
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`1`), []byte(`a`), zeroTS))
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`2`), []byte(`b`), zeroTS))
+	p1.successesCh <- <-p1.inputCh
+	p1.errorsCh <- &sarama.ProducerError{Msg: <-p1.inputCh, Err: sarama.ErrOutOfBrokers}
+	flushErrCh := make(chan error, 1)
+	go func() { flushErrCh <- s.Flush(ctx, zeroTS) }()
+	m := <-p2.inputCh
+	require.Equal(t, sarama.ByteEncoder(`2`), m.Key)
+	require.Equal(t, sarama.ByteEncoder(`b`), m.Value)
+	p2.successesCh <- m
+	require.NoError(t, <-flushErrCh)
+	require.Len(t, clients, 2)
+	require.True(t, clients[0].closed)
+	require.False(t, clients[1].closed)
+
+	// Other errors are returned without reconnecting.
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`3`), []byte(`c`), zeroTS))
+	p2.errorsCh <- &sarama.ProducerError{Msg: <-p2.inputCh, Err: sarama.ErrMessageSizeTooLarge}
+	err = s.Flush(ctx, zeroTS)
+	require.True(t, isRetryableSinkError(err), `expected retryable error got: %+v`, err)
+	require.Len(t, clients, 2)
+
+	// If the producer can't be rebuilt, the flush fails with a retryable error
+	// and the old producer is kept, so the sink can still be used and closed.
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`4`), []byte(`d`), zeroTS))
+	p2.errorsCh <- &sarama.ProducerError{Msg: <-p2.inputCh, Err: sarama.ErrOutOfBrokers}
+	err = s.Flush(ctx, zeroTS)
+	require.True(t, isRetryableSinkError(err), `expected retryable error got: %+v`, err)
+	require.Regexp(t, `reconnecting to kafka: k:9092: no brokers`, err)
+	require.Len(t, clients, 2)
+	require.False(t, clients[1].closed)
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`5`), []byte(`e`), zeroTS))
+	require.Equal(t, sarama.ByteEncoder(`5`), (<-p2.inputCh).Key)
+	require.NoError(t, s.Close())
+	require.True(t, clients[1].closed)
+}
+
+func TestKafkaSinkTopicGranularity(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	q := url.Values{}
+	q.Set(sinkParamTopicGranularity, `schema`)
+	_, err := consumeKafkaSinkConfig(q)
+	require.EqualError(t, err, `unknown topic_granularity: schema`)
+	q.Set(sinkParamTopicGranularity, kafkaTopicGranularityDatabase)
+	cfg, err := consumeKafkaSinkConfig(q)
+	require.NoError(t, err)
+	require.Empty(t, q)
+
+	ctx := context.Background()
+	client := &fakeKafkaClient{partitions: map[string][]int32{`d`: {0, 1}}}
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 2),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	var config *sarama.Config
+	newClientFn := func(_ []string, c *sarama.Config) (sarama.Client, sarama.AsyncProducer, error) {
+		config = c
+		return client, p, nil
+	}
+
+	_, err = makeKafkaSink(ctx, cfg, `k:9092`, jobspb.ChangefeedTargets{
+		1: jobspb.ChangefeedTarget{StatementTimeName: `foo`},
+	}, newClientFn)
+	require.EqualError(t, err, `topic_granularity=database is not supported by changefeeds `+
+		`created before it was introduced`)
+
+	targets := jobspb.ChangefeedTargets{
+		1: jobspb.ChangefeedTarget{StatementTimeName: `foo`, StatementTimeDatabaseName: `d`},
+		2: jobspb.ChangefeedTarget{StatementTimeName: `bar`, StatementTimeDatabaseName: `d`},
+	}
+	sink, err := makeKafkaSink(ctx, cfg, `k:9092`, targets, newClientFn)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, sink.Close()) }()
+	s := sink.(*kafkaSink)
+	require.Equal(t, map[string]struct{}{`d`: {}}, s.topics)
+	require.True(t, config.Version.IsAtLeast(sarama.V0_11_0_0))
+
+	// Rows from every table go to the database's topic, with the table in a
+	// header.
+	foo := &sqlbase.TableDescriptor{ID: 1, Name: `foo`}
+	bar := &sqlbase.TableDescriptor{ID: 2, Name: `bar`}
+	require.NoError(t, s.EmitRow(ctx, foo, []byte(`1`), []byte(`f`), zeroTS))
+	require.NoError(t, s.EmitRow(ctx, bar, []byte(`1`), []byte(`b`), zeroTS))
+	for _, table := range []string{`foo`, `bar`} {
+		m := <-p.inputCh
+		require.Equal(t, `d`, m.Topic)
+		require.Equal(t, []sarama.RecordHeader{
+			{Key: []byte(`table`), Value: []byte(table)},
+		}, m.Headers)
+		p.successesCh <- m
+	}
+	require.NoError(t, s.Flush(ctx, zeroTS))
+	require.EqualError(t, s.EmitRow(ctx, &sqlbase.TableDescriptor{ID: 3, Name: `baz`},
+		nil, nil, zeroTS), `cannot emit undeclared table: baz`)
+
+	// Resolved timestamps go to each partition of the database's topic once.
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, testEncoder{}, zeroTS))
+	for i := int32(0); i < 2; i++ {
+		m := <-p.inputCh
+		require.Equal(t, `d`, m.Topic)
+		require.Equal(t, i, m.Partition)
+		p.successesCh <- m
+	}
+	require.NoError(t, s.Flush(ctx, zeroTS))
+}
+
+func TestKafkaSinkRelaxedOrdering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	q := url.Values{}
+	q.Set(sinkParamMaxInflightRequests, `0`)
+	_, err := consumeKafkaSinkConfig(q)
+	require.EqualError(t, err, `max_inflight_requests must be positive: 0`)
+	q.Set(sinkParamMaxInflightRequests, `20`)
+	q.Set(sinkParamRelaxedOrderingTopics, `foo,bar`)
+	cfg, err := consumeKafkaSinkConfig(q)
+	require.NoError(t, err)
+	require.Empty(t, q)
+	require.Equal(t, 20, cfg.maxInflightRequests)
+
+	client := &fakeKafkaClient{partitions: map[string][]int32{}}
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	var config *sarama.Config
+	newClientFn := func(_ []string, c *sarama.Config) (sarama.Client, sarama.AsyncProducer, error) {
+		config = c
+		return client, p, nil
+	}
+
+	_, err = makeKafkaSink(ctx, cfg, `k:9092`, jobspb.ChangefeedTargets{
+		1: jobspb.ChangefeedTarget{StatementTimeName: `foo`},
+	}, newClientFn)
+	require.EqualError(t, err,
+		`relaxed_ordering_topics names a topic that isn't emitted to: bar`)
+
+	sink, err := makeKafkaSink(ctx, cfg, `k:9092`, jobspb.ChangefeedTargets{
+		1: jobspb.ChangefeedTarget{StatementTimeName: `foo`},
+		2: jobspb.ChangefeedTarget{StatementTimeName: `bar`},
+		3: jobspb.ChangefeedTarget{StatementTimeName: `baz`},
+	}, newClientFn)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, sink.Close()) }()
+	require.Equal(t, 20, config.Net.MaxOpenRequests)
+	require.False(t, config.Producer.Partitioner(`foo`).RequiresConsistency())
+	require.False(t, config.Producer.Partitioner(`bar`).RequiresConsistency())
+	require.True(t, config.Producer.Partitioner(`baz`).RequiresConsistency())
+}
+
+func TestKafkaSinkNetTimeouts(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	for value, expectedErr := range map[string]string{
+		`nope`: `parsing dial_timeout: time: invalid duration`,
+		`0s`:   `dial_timeout must be positive: 0s`,
+		`-1s`:  `dial_timeout must be positive: -1s`,
+	} {
+		_, err := consumeKafkaSinkConfig(url.Values{sinkParamDialTimeout: {value}})
+		require.Regexp(t, expectedErr, err)
+	}
+
+	newClientFn := func(_ []string, c *sarama.Config) (sarama.Client, sarama.AsyncProducer, error) {
+		p := asyncProducerMock{
+			inputCh:     make(chan *sarama.ProducerMessage, 1),
+			successesCh: make(chan *sarama.ProducerMessage, 1),
+			errorsCh:    make(chan *sarama.ProducerError, 1),
+		}
+		return &fakeKafkaClient{partitions: map[string][]int32{}}, p, nil
+	}
+	targets := jobspb.ChangefeedTargets{1: jobspb.ChangefeedTarget{StatementTimeName: `t`}}
+
+	// Unset timeouts keep sarama's defaults.
+	defaults := sarama.NewConfig().Net
+	sink, err := makeKafkaSink(ctx, kafkaSinkConfig{}, `k:9092`, targets, newClientFn)
+	require.NoError(t, err)
+	config := sink.(*kafkaSink).config
+	require.NoError(t, sink.Close())
+	require.Equal(t, defaults.DialTimeout, config.Net.DialTimeout)
+	require.Equal(t, defaults.ReadTimeout, config.Net.ReadTimeout)
+	require.Equal(t, defaults.WriteTimeout, config.Net.WriteTimeout)
+
+	q := url.Values{
+		sinkParamDialTimeout:  {`1s`},
+		sinkParamReadTimeout:  {`2s`},
+		sinkParamWriteTimeout: {`3s`},
+	}
+	cfg, err := consumeKafkaSinkConfig(q)
+	require.NoError(t, err)
+	require.Empty(t, q)
+	sink, err = makeKafkaSink(ctx, cfg, `k:9092`, targets, newClientFn)
+	require.NoError(t, err)
+	config = sink.(*kafkaSink).config
+	require.NoError(t, sink.Close())
+	require.Equal(t, time.Second, config.Net.DialTimeout)
+	require.Equal(t, 2*time.Second, config.Net.ReadTimeout)
+	require.Equal(t, 3*time.Second, config.Net.WriteTimeout)
+}
+
+func TestKafkaSinkAcksTimeout(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	_, err := consumeKafkaSinkConfig(url.Values{sinkParamAcksTimeout: {`0s`}})
+	require.EqualError(t, err, `acks_timeout must be positive: 0s`)
+	q := url.Values{sinkParamAcksTimeout: {`1s`}}
+	cfg, err := consumeKafkaSinkConfig(q)
+	require.NoError(t, err)
+	require.Empty(t, q)
+
+	// It's the producer's timeout, and the deadline is how long all of its
+	// attempts could take.
+	newClientFn := func(_ []string, c *sarama.Config) (sarama.Client, sarama.AsyncProducer, error) {
+		p := asyncProducerMock{
+			inputCh:     make(chan *sarama.ProducerMessage, 1),
+			successesCh: make(chan *sarama.ProducerMessage, 1),
+			errorsCh:    make(chan *sarama.ProducerError, 1),
+		}
+		return &fakeKafkaClient{partitions: map[string][]int32{}}, p, nil
+	}
+	targets := jobspb.ChangefeedTargets{1: jobspb.ChangefeedTarget{StatementTimeName: `t`}}
+	sink, err := makeKafkaSink(ctx, cfg, `k:9092`, targets, newClientFn)
+	require.NoError(t, err)
+	k := sink.(*kafkaSink)
+	require.NoError(t, sink.Close())
+	require.Equal(t, time.Second, k.config.Producer.Timeout)
+	require.Equal(t, 4*(time.Second+100*time.Millisecond), k.ackDeadline)
+
+	p := asyncProducerMock{
+		inputCh:     make(chan *sarama.ProducerMessage, 1),
+		successesCh: make(chan *sarama.ProducerMessage, 1),
+		errorsCh:    make(chan *sarama.ProducerError, 1),
+	}
+	k = &kafkaSink{
+		producer:    p,
+		topics:      map[string]struct{}{`t`: {}},
+		ackDeadline: time.Hour,
+		logCtx:      ctx,
+	}
+	k.start()
+	defer func() { require.NoError(t, k.Close()) }()
+
+	// A message that's stuck past the deadline fails the flush with a
+	// retryable error instead of hanging it.
+	table := &sqlbase.TableDescriptor{Name: `t`}
+	require.NoError(t, k.EmitRow(ctx, table, []byte(`1`), nil, zeroTS))
+	stuck := <-p.inputCh
+	k.notePartition(stuck, 0)
+	k.expireInflight(timeutil.Now().Add(time.Minute))
+	require.Equal(t, int64(1), k.InflightCount())
+	k.expireInflight(timeutil.Now().Add(2 * time.Hour))
+	require.Equal(t, int64(0), k.InflightCount())
+	err = k.Flush(ctx, zeroTS)
+	require.Regexp(t, `kafka message not acknowledged after 1h0m0s`, err)
+	require.True(t, isRetryableSinkError(err), `expected retryable error got: %+v`, err)
+
+	// The deadline starts when sarama sends a message, not while it's queued
+	// behind others, but a message can't stay queued past it either.
+	require.NoError(t, k.EmitRow(ctx, table, []byte(`3`), nil, zeroTS))
+	queued := <-p.inputCh
+	k.mu.Lock()
+	m := k.mu.inflightMsgs[queued]
+	m.emitted = m.emitted.Add(-90 * time.Minute)
+	k.mu.inflightMsgs[queued] = m
+	k.mu.Unlock()
+	k.notePartition(queued, 0)
+	k.expireInflight(timeutil.Now().Add(time.Minute))
+	require.Equal(t, int64(1), k.inflightCount())
+	p.successesCh <- queued
+	require.NoError(t, k.Flush(ctx, zeroTS))
+	require.NoError(t, k.EmitRow(ctx, table, []byte(`4`), nil, zeroTS))
+	queued = <-p.inputCh
+	k.expireInflight(timeutil.Now().Add(2 * time.Hour))
+	require.Equal(t, int64(0), k.inflightCount())
+	err = k.Flush(ctx, zeroTS)
+	require.Regexp(t, `kafka message not sent after 1h0m0s`, err)
+	p.successesCh <- queued
+
+	// If sarama gets to it after all, that's ignored.
+	p.successesCh <- stuck
+	require.NoError(t, k.EmitRow(ctx, table, []byte(`2`), nil, zeroTS))
+	p.successesCh <- <-p.inputCh
+	require.NoError(t, k.Flush(ctx, zeroTS))
+	require.Equal(t, int64(0), k.InflightCount())
+}
+
 type testEncoder struct{}
 
-func (testEncoder) EncodeKey(t *sqlbase.TableDescriptor, _ sqlbase.EncDatumRow) ([]byte, error) {
-	panic(`unimplemented`)
+func (testEncoder) EncodeKey(t *sqlbase.TableDescriptor, _ sqlbase.EncDatumRow) ([]byte, error) {
+	panic(`unimplemented`)
+}
+func (testEncoder) EncodeValue(
+	t *sqlbase.TableDescriptor, _, _ sqlbase.EncDatumRow, _ hlc.Timestamp,
+) ([]byte, error) {
+	panic(`unimplemented`)
+}
+func (testEncoder) EncodeResolvedTimestamp(_ string, ts hlc.Timestamp) ([]byte, error) {
+	return []byte(ts.String()), nil
+}
+
+func TestBufferSinkMaxRows(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	table := &sqlbase.TableDescriptor{Name: `t`}
+	values := func(s *bufferSink) []string {
+		var ret []string
+		for _, row := range s.buf {
+			ret = append(ret, string(*row[3].Datum.(*tree.DBytes)))
+		}
+		return ret
+	}
+
+	unbounded := &bufferSink{}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, unbounded.EmitRow(ctx, table, nil, []byte(strconv.Itoa(i)), zeroTS))
+	}
+	require.Equal(t, []string{`0`, `1`, `2`}, values(unbounded))
+
+	full := &bufferSink{maxRows: 2}
+	require.NoError(t, full.EmitRow(ctx, table, nil, []byte(`0`), zeroTS))
+	require.NoError(t, full.EmitRow(ctx, table, nil, []byte(`1`), zeroTS))
+	require.EqualError(t, full.EmitRow(ctx, table, nil, []byte(`2`), zeroTS),
+		`buffer sink is full: 2 rows`)
+	require.EqualError(t, full.EmitResolvedTimestamp(ctx, testEncoder{}, zeroTS),
+		`buffer sink is full: 2 rows`)
+	require.Equal(t, []string{`0`, `1`}, values(full))
+
+	rotating := &bufferSink{maxRows: 2, dropOldest: true}
+	require.NoError(t, rotating.EmitRow(ctx, table, nil, []byte(`0`), zeroTS))
+	require.NoError(t, rotating.EmitRow(ctx, table, nil, []byte(`1`), zeroTS))
+	require.NoError(t, rotating.EmitRow(ctx, table, nil, []byte(`2`), zeroTS))
+	require.NoError(t, rotating.EmitResolvedTimestamp(ctx, testEncoder{}, zeroTS))
+	require.Equal(t, []string{`2`, `0.000000000,0`}, values(rotating))
+	require.Equal(t, int64(2), rotating.dropped)
+}
+
+func TestSinksResolvedFormat(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	resolved := hlc.Timestamp{WallTime: int64(time.Hour), Logical: 1}
+	encoder := makeJSONEncoder(map[string]string{
+		optResolvedFormat: string(optResolvedFormatISO8601),
+	})
+	const expected = `1970-01-01T01:00:00Z`
+
+	t.Run(`kafka`, func(t *testing.T) {
+		p := asyncProducerMock{
+			inputCh:     make(chan *sarama.ProducerMessage, 1),
+			successesCh: make(chan *sarama.ProducerMessage, 1),
+			errorsCh:    make(chan *sarama.ProducerError, 1),
+		}
+		cfg, err := consumeKafkaSinkConfig(url.Values{sinkParamResolvedTopic: {`progress`}})
+		require.NoError(t, err)
+		sink := &kafkaSink{cfg: cfg, producer: p, topics: map[string]struct{}{`t`: {}}}
+		sink.start()
+		defer func() { require.NoError(t, sink.Close()) }()
+
+		require.NoError(t, sink.EmitResolvedTimestamp(ctx, encoder, resolved))
+		m := <-p.inputCh
+		value, err := m.Value.Encode()
+		require.NoError(t, err)
+		require.Equal(t, expected, string(value))
+		p.successesCh <- m
+		require.NoError(t, sink.Flush(ctx, zeroTS))
+	})
+
+	t.Run(`cloudstorage`, func(t *testing.T) {
+		dir, dirCleanupFn := testutils.TempDir(t)
+		defer dirCleanupFn()
+
+		cfg := cloudStorageSinkConfig{bucketSize: time.Hour}
+		sink, err := makeCloudStorageSink(
+			ctx, `nodelocal://`+dir, cfg, encoder, nil /* settings */)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, sink.Close()) }()
+
+		require.NoError(t, sink.EmitResolvedTimestamp(ctx, encoder, resolved))
+		infos, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		body, err := ioutil.ReadFile(filepath.Join(dir, infos[0].Name()))
+		require.NoError(t, err)
+		require.Equal(t, expected, string(body))
+	})
+
+	t.Run(`buffer`, func(t *testing.T) {
+		sink := &bufferSink{}
+		require.NoError(t, sink.EmitResolvedTimestamp(ctx, encoder, resolved))
+		require.Len(t, sink.buf, 1)
+		require.Equal(t, expected, string(*sink.buf[0][3].Datum.(*tree.DBytes)))
+	})
+}
+
+func TestSQLSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	table := func(name string) *sqlbase.TableDescriptor {
+		return &sqlbase.TableDescriptor{Name: name}
+	}
+
+	ctx := context.Background()
+	s, sqlDBRaw, _ := serverutils.StartServer(t, base.TestServerArgs{UseDatabase: "d"})
+	defer s.Stopper().Stop(ctx)
+	sqlDB := sqlutils.MakeSQLRunner(sqlDBRaw)
+	sqlDB.Exec(t, `CREATE DATABASE d`)
+
+	sinkURL, cleanup := sqlutils.PGUrl(t, s.ServingAddr(), t.Name(), url.User(security.RootUser))
+	defer cleanup()
+	sinkURL.Path = `d`
+
+	targets := jobspb.ChangefeedTargets{
+		0: jobspb.ChangefeedTarget{StatementTimeName: `foo`},
+		1: jobspb.ChangefeedTarget{StatementTimeName: `bar`},
+	}
+	sink, err := makeSQLSink(sinkURL.String(), `sink`, false /* skipCreate */, targets)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, sink.Close()) }()
+	require.NoError(t, pingSink(ctx, sink))
+
+	// Empty
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+
+	// Undeclared topic
+	require.EqualError(t,
+		sink.EmitRow(ctx, table(`nope`), nil, nil, zeroTS), `cannot emit to undeclared topic: nope`)
+
+	// With one row, nothing flushes until Flush is called.
+	require.NoError(t, sink.EmitRow(ctx, table(`foo`), []byte(`k1`), []byte(`v0`), zeroTS))
+	sqlDB.CheckQueryResults(t, `SELECT key, value FROM sink ORDER BY PRIMARY KEY sink`,
+		[][]string{},
+	)
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+	sqlDB.CheckQueryResults(t, `SELECT key, value FROM sink ORDER BY PRIMARY KEY sink`,
+		[][]string{{`k1`, `v0`}},
+	)
+	sqlDB.Exec(t, `TRUNCATE sink`)
+
+	// Verify the implicit flushing
+	sqlDB.CheckQueryResults(t, `SELECT count(*) FROM sink`, [][]string{{`0`}})
+	for i := 0; i < sqlSinkRowBatchSize+1; i++ {
+		require.NoError(t,
+			sink.EmitRow(ctx, table(`foo`), []byte(`k1`), []byte(`v`+strconv.Itoa(i)), zeroTS))
+	}
+	// Should have auto flushed after sqlSinkRowBatchSize
+	sqlDB.CheckQueryResults(t, `SELECT count(*) FROM sink`, [][]string{{`3`}})
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+	sqlDB.CheckQueryResults(t, `SELECT count(*) FROM sink`, [][]string{{`4`}})
+	sqlDB.Exec(t, `TRUNCATE sink`)
+
+	// Two tables interleaved in time
+	require.NoError(t, sink.EmitRow(ctx, table(`foo`), []byte(`kfoo`), []byte(`v0`), zeroTS))
+	require.NoError(t, sink.EmitRow(ctx, table(`bar`), []byte(`kbar`), []byte(`v0`), zeroTS))
+	require.NoError(t, sink.EmitRow(ctx, table(`foo`), []byte(`kfoo`), []byte(`v1`), zeroTS))
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+	sqlDB.CheckQueryResults(t, `SELECT topic, key, value FROM sink ORDER BY PRIMARY KEY sink`,
+		[][]string{{`bar`, `kbar`, `v0`}, {`foo`, `kfoo`, `v0`}, {`foo`, `kfoo`, `v1`}},
+	)
+	sqlDB.Exec(t, `TRUNCATE sink`)
+
+	// Multiple keys interleaved in time. Use sqlSinkNumPartitions+1 keys to
+	// guarantee that at lease two of them end up in the same partition.
+	for i := 0; i < sqlSinkNumPartitions+1; i++ {
+		require.NoError(t,
+			sink.EmitRow(ctx, table(`foo`), []byte(`v`+strconv.Itoa(i)), []byte(`v0`), zeroTS))
+	}
+	for i := 0; i < sqlSinkNumPartitions+1; i++ {
+		require.NoError(t,
+			sink.EmitRow(ctx, table(`foo`), []byte(`v`+strconv.Itoa(i)), []byte(`v1`), zeroTS))
+	}
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+	sqlDB.CheckQueryResults(t, `SELECT partition, key, value FROM sink ORDER BY PRIMARY KEY sink`,
+		[][]string{
+			{`0`, `v3`, `v0`},
+			{`0`, `v3`, `v1`},
+			{`1`, `v1`, `v0`},
+			{`1`, `v2`, `v0`},
+			{`1`, `v1`, `v1`},
+			{`1`, `v2`, `v1`},
+			{`2`, `v0`, `v0`},
+			{`2`, `v0`, `v1`},
+		},
+	)
+	sqlDB.Exec(t, `TRUNCATE sink`)
+
+	// Emit resolved
+	var e testEncoder
+	require.NoError(t, sink.EmitResolvedTimestamp(ctx, e, zeroTS))
+	// It's more than a batch, but all of the partitions of every topic are
+	// inserted together.
+	sqlDB.CheckQueryResults(t, `SELECT count(*) FROM sink WHERE resolved IS NOT NULL`,
+		[][]string{{strconv.Itoa(2 * sqlSinkNumPartitions)}},
+	)
+	require.NoError(t, sink.EmitRow(ctx, table(`foo`), []byte(`foo0`), []byte(`v0`), zeroTS))
+	require.NoError(t, sink.EmitResolvedTimestamp(ctx, e, hlc.Timestamp{WallTime: 1}))
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+	sqlDB.CheckQueryResults(t,
+		`SELECT topic, partition, key, value, resolved FROM sink ORDER BY PRIMARY KEY sink`,
+		[][]string{
+			{`bar`, `0`, ``, ``, `0.000000000,0`},
+			{`bar`, `0`, ``, ``, `0.000000001,0`},
+			{`bar`, `1`, ``, ``, `0.000000000,0`},
+			{`bar`, `1`, ``, ``, `0.000000001,0`},
+			{`bar`, `2`, ``, ``, `0.000000000,0`},
+			{`bar`, `2`, ``, ``, `0.000000001,0`},
+			{`foo`, `0`, ``, ``, `0.000000000,0`},
+			{`foo`, `0`, `foo0`, `v0`, ``},
+			{`foo`, `0`, ``, ``, `0.000000001,0`},
+			{`foo`, `1`, ``, ``, `0.000000000,0`},
+			{`foo`, `1`, ``, ``, `0.000000001,0`},
+			{`foo`, `2`, ``, ``, `0.000000000,0`},
+			{`foo`, `2`, ``, ``, `0.000000001,0`},
+		},
+	)
+}
+
+func TestSQLSinkCompression(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	table := &sqlbase.TableDescriptor{Name: `foo`}
+	targets := jobspb.ChangefeedTargets{
+		0: jobspb.ChangefeedTarget{StatementTimeName: `foo`},
+	}
+
+	ctx := context.Background()
+	s, sqlDBRaw, _ := serverutils.StartServer(t, base.TestServerArgs{UseDatabase: "d"})
+	defer s.Stopper().Stop(ctx)
+	sqlDB := sqlutils.MakeSQLRunner(sqlDBRaw)
+	sqlDB.Exec(t, `CREATE DATABASE d`)
+
+	sinkURL, cleanup := sqlutils.PGUrl(t, s.ServingAddr(), t.Name(), url.User(security.RootUser))
+	defer cleanup()
+	sinkURL.Path = `d`
+
+	_, err := consumeSQLSinkCodec(url.Values{sinkParamCompression: {`snappy`}})
+	require.EqualError(t, err, `unknown compression: snappy`)
+
+	// A table created before the codec column existed gets it added.
+	sqlDB.Exec(t, `CREATE TABLE sink (
+		topic STRING, partition INT, message_id INT, key BYTES, value BYTES, resolved BYTES,
+		PRIMARY KEY (topic, partition, message_id)
+	)`)
+	plain, err := makeSQLSink(sinkURL.String(), `sink`, false /* skipCreate */, targets)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, plain.Close()) }()
+	gzipped, err := makeSQLSink(sinkURL.String(), `sink`, false /* skipCreate */, targets)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, gzipped.Close()) }()
+	gzipped.codec, err = consumeSQLSinkCodec(url.Values{sinkParamCompression: {`gzip`}})
+	require.NoError(t, err)
+
+	// Both sinks write to the same table, and every row is decoded by its own
+	// codec.
+	var e testEncoder
+	for _, sink := range []*sqlSink{plain, gzipped} {
+		require.NoError(t, sink.EmitRow(ctx, table, []byte(`k`), []byte(`v`), zeroTS))
+		require.NoError(t, sink.EmitRow(ctx, table, []byte(`k`), nil /* value */, zeroTS))
+		require.NoError(t, sink.EmitResolvedTimestamp(ctx, e, hlc.Timestamp{WallTime: 1}))
+		require.NoError(t, sink.Flush(ctx, zeroTS))
+	}
+
+	rows := sqlDB.Query(t, `SELECT key, value, resolved, codec FROM sink`)
+	defer rows.Close()
+	counts := make(map[string]map[string]int)
+	for rows.Next() {
+		var key, value, resolved []byte
+		var codec string
+		require.NoError(t, rows.Scan(&key, &value, &resolved, &codec))
+		if codec == sqlSinkCodecGzip && len(value) > 0 {
+			require.NotEqual(t, `v`, string(value))
+		}
+		value, err = decodeSQLSinkPayload(codec, value)
+		require.NoError(t, err)
+		resolved, err = decodeSQLSinkPayload(codec, resolved)
+		require.NoError(t, err)
+		if counts[codec] == nil {
+			counts[codec] = make(map[string]int)
+		}
+		counts[codec][string(key)+`/`+string(value)+`/`+string(resolved)]++
+	}
+	require.NoError(t, rows.Err())
+	expected := map[string]int{
+		`k/v/`:            1,
+		`k//`:             1,
+		`//0.000000001,0`: sqlSinkNumPartitions,
+	}
+	require.Equal(t, map[string]map[string]int{
+		sqlSinkCodecNone: expected,
+		sqlSinkCodecGzip: expected,
+	}, counts)
+}
+
+func TestSQLSinkMaxStatementBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	_, err := consumeSQLSinkMaxStatementBytes(url.Values{sinkParamMaxStatementBytes: {`0`}})
+	require.EqualError(t, err, `max_statement_bytes must be positive: 0`)
+	q := url.Values{sinkParamMaxStatementBytes: {`30B`}}
+	maxStatementBytes, err := consumeSQLSinkMaxStatementBytes(q)
+	require.NoError(t, err)
+	require.Empty(t, q)
+
+	targets := jobspb.ChangefeedTargets{
+		0: jobspb.ChangefeedTarget{StatementTimeName: `foo`},
+	}
+
+	ctx := context.Background()
+	s, sqlDBRaw, _ := serverutils.StartServer(t, base.TestServerArgs{UseDatabase: "d"})
+	defer s.Stopper().Stop(ctx)
+	sqlDB := sqlutils.MakeSQLRunner(sqlDBRaw)
+	sqlDB.Exec(t, `CREATE DATABASE d`)
+
+	sinkURL, cleanup := sqlutils.PGUrl(t, s.ServingAddr(), t.Name(), url.User(security.RootUser))
+	defer cleanup()
+	sinkURL.Path = `d`
+
+	sink, err := makeSQLSink(sinkURL.String(), `sink`, false /* skipCreate */, targets)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, sink.Close()) }()
+	sink.maxStatementBytes = maxStatementBytes
+
+	// Each row is 27 bytes: the topic, two integers, the key, the value and
+	// the codec. Only one fits in a statement, and a row that doesn't fit at
+	// all gets a statement of its own.
+	table := &sqlbase.TableDescriptor{Name: `foo`}
+	require.NoError(t, sink.EmitRow(ctx, table, []byte(`k1`), []byte(`v1`), zeroTS))
+	require.NoError(t, sink.EmitRow(ctx, table, []byte(`k2`), []byte(`much too large`), zeroTS))
+	require.Equal(t, sqlSinkEmitCols, sink.statementLen(sink.rowBuf))
+	require.Equal(t, sqlSinkEmitCols, sink.statementLen(sink.rowBuf[sqlSinkEmitCols:]))
+	sink.maxStatementBytes = 0
+	require.Equal(t, 2*sqlSinkEmitCols, sink.statementLen(sink.rowBuf))
+	sink.maxStatementBytes = maxStatementBytes
+
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+	require.Empty(t, sink.rowBuf)
+	sqlDB.CheckQueryResults(t, `SELECT key FROM sink ORDER BY message_id`,
+		[][]string{{`k1`}, {`k2`}},
+	)
+
+	// A resolved timestamp is far too large too, but its rows for every
+	// partition are inserted by the same statement, apart from the rows
+	// around them.
+	sink.bufferRow(`foo`, 0, []byte(`k3`), []byte(`v3`), nil /* resolved */)
+	for partition := int32(0); partition < sqlSinkNumPartitions; partition++ {
+		sink.bufferRow(`foo`, partition, nil /* key */, nil /* value */, []byte(`resolved`))
+	}
+	sink.bufferRow(`foo`, 0, []byte(`k4`), []byte(`v4`), nil /* resolved */)
+	require.Equal(t, sqlSinkEmitCols, sink.statementLen(sink.rowBuf))
+	resolvedRows := sink.rowBuf[sqlSinkEmitCols:]
+	require.Equal(t, sqlSinkNumPartitions*sqlSinkEmitCols, sink.statementLen(resolvedRows))
+	require.Equal(t, sqlSinkEmitCols,
+		sink.statementLen(resolvedRows[sqlSinkNumPartitions*sqlSinkEmitCols:]))
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+	sqlDB.CheckQueryResults(t, `SELECT count(*) FROM sink WHERE resolved IS NOT NULL`,
+		[][]string{{strconv.Itoa(sqlSinkNumPartitions)}},
+	)
+}
+
+func TestSQLSinkMessageIDsIncrease(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var noDB *gosql.DB
+	sink := newSQLSink(noDB, `sink`, jobspb.ChangefeedTargets{})
+
+	// Buffer many rows to the same partition faster than the clock that the
+	// message ids are derived from ticks.
+	const numRows = 10000
+	const partition = 1
+	for i := 0; i < numRows; i++ {
+		sink.bufferRow(`foo`, partition, []byte(`k`), []byte(`v`), nil /* resolved */)
+	}
+	require.Len(t, sink.rowBuf, numRows*sqlSinkEmitCols)
+	var last int64
+	for i := 0; i < numRows; i++ {
+		messageID := sink.rowBuf[i*sqlSinkEmitCols+2].(int64)
+		require.True(t, messageID > last, `row %d: message id %d after %d`, i, messageID, last)
+		last = messageID
+	}
+}
+
+func TestSQLSinkKeylessPartitions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var noDB *gosql.DB
+	sink := newSQLSink(noDB, `sink`, jobspb.ChangefeedTargets{})
+
+	// Keyless rows are spread evenly instead of all hashing to one partition.
+	const rowsPerPartition = 100
+	var counts [sqlSinkNumPartitions]int
+	for i := 0; i < rowsPerPartition*sqlSinkNumPartitions; i++ {
+		partition, err := sink.partition(nil /* key */, partitionHint{})
+		require.NoError(t, err)
+		counts[partition]++
+	}
+	for partition, count := range counts {
+		require.Equal(t, rowsPerPartition, count, `partition %d`, partition)
+	}
+
+	// Keyed rows, and rows with a partition hint, are unaffected.
+	keyed, err := sink.partition([]byte(`v0`), partitionHint{})
+	require.NoError(t, err)
+	for i := 0; i < sqlSinkNumPartitions; i++ {
+		partition, err := sink.partition([]byte(`v0`), partitionHint{})
+		require.NoError(t, err)
+		require.Equal(t, keyed, partition)
+	}
+	hinted, err := sink.partition(nil /* key */, partitionHint{value: 4, hasValue: true})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), hinted)
+}
+
+func TestSQLSinkPartitionBy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		params      string
+		opts        map[string]string
+		encoder     Encoder
+		expectedErr string
+	}{
+		{`partition_by=a`, map[string]string{}, &rawEncoder{},
+			`partition_by with a column is only supported with format=json`},
+		{`partition_by=value`, map[string]string{optPartitionKey: `a`}, &jsonEncoder{},
+			`partition_by=value is not supported with partition_key`},
+	} {
+		_, err := getSink(ctx, `experimental-sql://root@localhost/d?`+tc.params, tc.opts, tc.encoder,
+			nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+		require.EqualError(t, err, tc.expectedErr)
+	}
+
+	var noDB *gosql.DB
+	sink := newSQLSink(noDB, `sink`, jobspb.ChangefeedTargets{})
+	table := &sqlbase.TableDescriptor{
+		Name: `foo`,
+		Columns: []sqlbase.ColumnDescriptor{
+			{Name: `id`}, {Name: `region`}, {Name: `v`},
+		},
+		PrimaryIndex: sqlbase.IndexDescriptor{ColumnNames: []string{`id`}},
+	}
+	key := []byte(`[1]`)
+	value := []byte(`{"id": 1, "region": "us-east", "v": 2}`)
+	for _, tc := range []struct {
+		partitionBy string
+		key, value  []byte
+		expected    string
+	}{
+		{sqlSinkPartitionByKey, key, value, `[1]`},
+		{sqlSinkPartitionByValue, key, value, string(value)},
+		{`region`, key, value, `"us-east"`},
+		// A deleted row only has the columns of its key.
+		{`id`, key, []byte(`{}`), `1`},
+		{`region`, key, []byte(`{}`), `null`},
+		// The metadata isn't a column.
+		{`region`, key, []byte(`{"__crdb__": {"updated": "1.0"}, "region": "eu"}`), `"eu"`},
+	} {
+		sink.partitionBy = tc.partitionBy
+		partitionKey, err := sink.partitionKey(table, tc.key, tc.value)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, string(partitionKey), tc.partitionBy)
+	}
+
+	sink.partitionBy = `nope`
+	_, err := sink.partitionKey(table, key, value)
+	require.EqualError(t, err, `table foo has no column nope for partition_by`)
+}
+
+func TestSQLSinkExecWithRetry(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	opts := retry.Options{InitialBackoff: time.Microsecond, MaxRetries: 2}
+	serializationErr := &pq.Error{Code: pgerror.CodeSerializationFailureError}
+	failN := func(n int, err error) (func() error, *int) {
+		var calls int
+		return func() error {
+			calls++
+			if calls <= n {
+				return err
+			}
+			return nil
+		}, &calls
+	}
+
+	// Retryable errors are retried until they succeed.
+	fn, calls := failN(2, serializationErr)
+	require.NoError(t, sqlSinkExecWithRetry(ctx, opts, fn))
+	require.Equal(t, 3, *calls)
+
+	// Until the retries run out, after which they're retryable sink errors.
+	fn, calls = failN(3, serializationErr)
+	err := sqlSinkExecWithRetry(ctx, opts, fn)
+	require.True(t, isRetryableSinkError(err), `expected retryable error got: %+v`, err)
+	require.Equal(t, 3, *calls)
+
+	// Other errors are returned immediately.
+	fn, calls = failN(1, &pq.Error{Code: pgerror.CodeUndefinedColumnError})
+	err = sqlSinkExecWithRetry(ctx, opts, fn)
+	require.False(t, isRetryableSinkError(err), `expected non-retryable error got: %+v`, err)
+	require.Equal(t, 1, *calls)
+}
+
+func TestSQLSinkSkipCreate(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	table := &sqlbase.TableDescriptor{Name: `foo`}
+	targets := jobspb.ChangefeedTargets{
+		0: jobspb.ChangefeedTarget{StatementTimeName: `foo`},
+	}
+
+	ctx := context.Background()
+	s, sqlDBRaw, _ := serverutils.StartServer(t, base.TestServerArgs{UseDatabase: "d"})
+	defer s.Stopper().Stop(ctx)
+	sqlDB := sqlutils.MakeSQLRunner(sqlDBRaw)
+	sqlDB.Exec(t, `CREATE DATABASE d`)
+
+	sinkURL, cleanup := sqlutils.PGUrl(t, s.ServingAddr(), t.Name(), url.User(security.RootUser))
+	defer cleanup()
+	sinkURL.Path = `d`
+
+	// A pre-created table with an extra column is used as is.
+	sqlDB.Exec(t, `CREATE TABLE extra (
+		topic STRING, partition INT, message_id INT, key BYTES, value BYTES, resolved BYTES,
+		codec STRING,
+		note STRING DEFAULT 'precreated',
+		PRIMARY KEY (topic, partition, message_id)
+	)`)
+	sink, err := makeSQLSink(sinkURL.String(), `extra`, true /* skipCreate */, targets)
+	require.NoError(t, err)
+	require.NoError(t, sink.EmitRow(ctx, table, []byte(`k`), []byte(`v`), zeroTS))
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+	require.NoError(t, sink.Close())
+	sqlDB.CheckQueryResults(t, `SELECT key, value, codec, note FROM extra`,
+		[][]string{{`k`, `v`, sqlSinkCodecNone, `precreated`}},
+	)
+
+	// A pre-created table from before the codec column is written to without
+	// it, but only uncompressed.
+	sqlDB.Exec(t, `CREATE TABLE sqlsink (
+		topic STRING, partition INT, message_id INT, key BYTES, value BYTES, resolved BYTES,
+		PRIMARY KEY (topic, partition, message_id)
+	)`)
+	sink, err = makeSQLSink(sinkURL.String(), `sqlsink`, true /* skipCreate */, targets)
+	require.NoError(t, err)
+	require.NoError(t, sink.EmitRow(ctx, table, []byte(`k`), []byte(`v`), zeroTS))
+	require.NoError(t, sink.EmitResolvedTimestamp(ctx, testEncoder{}, zeroTS))
+	require.NoError(t, sink.Flush(ctx, zeroTS))
+	require.NoError(t, sink.Close())
+	sqlDB.CheckQueryResults(t, `SELECT count(*) FROM sqlsink`,
+		[][]string{{strconv.Itoa(1 + sqlSinkNumPartitions)}},
+	)
+	gzipURL := sinkURL
+	gzipURL.Scheme = sinkSchemeExperimentalSQL
+	q := gzipURL.Query()
+	q.Set(sinkParamSkipCreate, `true`)
+	q.Set(sinkParamCompression, sqlSinkCodecGzip)
+	gzipURL.RawQuery = q.Encode()
+	_, err = getSink(ctx, gzipURL.String(), map[string]string{}, &jsonEncoder{}, targets,
+		0 /* jobID */, nil /* settings */, TestingKnobs{})
+	require.EqualError(t, err, `compression=gzip needs a codec column in existing table sqlsink`)
+
+	// A table that's missing columns fails the first insert.
+	sqlDB.Exec(t, `CREATE TABLE missing (topic STRING PRIMARY KEY)`)
+	sink, err = makeSQLSink(sinkURL.String(), `missing`, true /* skipCreate */, targets)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, sink.Close()) }()
+	require.NoError(t, sink.EmitRow(ctx, table, []byte(`k`), []byte(`v`), zeroTS))
+	require.Regexp(t, `inserting into existing table missing, which must have columns`,
+		sink.Flush(ctx, zeroTS))
+}
+
+func TestSQLSinkDiagnoseErrors(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	table := &sqlbase.TableDescriptor{Name: `foo`}
+	targets := jobspb.ChangefeedTargets{
+		0: jobspb.ChangefeedTarget{StatementTimeName: `foo`},
+	}
+
+	ctx := context.Background()
+	s, sqlDBRaw, _ := serverutils.StartServer(t, base.TestServerArgs{UseDatabase: "d"})
+	defer s.Stopper().Stop(ctx)
+	sqlDB := sqlutils.MakeSQLRunner(sqlDBRaw)
+	sqlDB.Exec(t, `CREATE DATABASE d`)
+
+	sinkURL, cleanup := sqlutils.PGUrl(t, s.ServingAddr(), t.Name(), url.User(security.RootUser))
+	defer cleanup()
+	sinkURL.Path = `d`
+
+	_, err := consumeSQLSinkDiagnoseErrors(url.Values{sinkParamDiagnoseErrors: {`nope`}})
+	require.Regexp(t, `parsing diagnose_errors`, err)
+
+	// The table rejects values that are too large.
+	sqlDB.Exec(t, `CREATE TABLE sink (
+		topic STRING, partition INT, message_id INT, key BYTES, value BYTES, resolved BYTES,
+		codec STRING,
+		PRIMARY KEY (topic, partition, message_id),
+		CHECK (length(value) <= 8)
+	)`)
+	emit := func(sink *sqlSink) {
+		require.NoError(t, sink.EmitRow(ctx, table, []byte(`k1`), []byte(`small`), zeroTS))
+		require.NoError(t, sink.EmitRow(ctx, table, []byte(`k2`), []byte(`much too large`), zeroTS))
+	}
+
+	// By default, one bad row fails the whole batch without saying which.
+	sink, err := makeSQLSink(sinkURL.String(), `sink`, true /* skipCreate */, targets)
+	require.NoError(t, err)
+	emit(sink)
+	err = sink.Flush(ctx, zeroTS)
+	require.Regexp(t, `CHECK`, err)
+	require.NotRegexp(t, `message_id`, err)
+	require.NoError(t, sink.Close())
+	sqlDB.CheckQueryResults(t, `SELECT count(*) FROM sink`, [][]string{{`0`}})
+
+	// When diagnosing errors, the good rows are inserted and the bad ones are
+	// reported and left in the buffer.
+	sink, err = makeSQLSink(sinkURL.String(), `sink`, true /* skipCreate */, targets)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, sink.Close()) }()
+	sink.diagnoseErrors = true
+	emit(sink)
+	err = sink.Flush(ctx, zeroTS)
+	require.Regexp(t,
+		`1 of 2 rows failed to insert: topic foo partition \d message_id \d+: .*CHECK`, err)
+	sqlDB.CheckQueryResults(t, `SELECT key, value FROM sink`, [][]string{{`k1`, `small`}})
+	require.Len(t, sink.rowBuf, sqlSinkEmitCols)
+	require.Equal(t, []byte(`k2`), sink.rowBuf[3])
+}
+
+// forEachBufferedFile calls fn with the key, file_idx and contents of every
+// data file that s is buffering, in filename order. It's only for tests, which
+// can check how rows are grouped into files without writing them out and
+// reading them back. Files whose contents were all written out early, and
+// which are empty until more rows come in, are skipped.
+func (s *cloudStorageSink) forEachBufferedFile(
+	fn func(key cloudStorageSinkKey, fileIdx int, contents []byte) error,
+) error {
+	keys := make([]cloudStorageSinkKey, 0, len(s.files))
+	for key, file := range s.files {
+		if file.size > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Filename(s.files[keys[i]].idx) < keys[j].Filename(s.files[keys[j]].idx)
+	})
+	for _, key := range keys {
+		file := s.files[key]
+		r, err := file.Reader()
+		if err != nil {
+			return err
+		}
+		contents, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if err := fn(key, file.idx, contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestCloudStorageSinkBuffering(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	cfg := cloudStorageSinkConfig{bucketSize: time.Hour}
+	sink, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, sink.Close()) }()
+	s := sink.(*cloudStorageSink)
+
+	buffered := func() []string {
+		var files []string
+		require.NoError(t, s.forEachBufferedFile(
+			func(key cloudStorageSinkKey, fileIdx int, contents []byte) error {
+				files = append(files, fmt.Sprintf(`%s %s@%d #%d: %s`,
+					cloudStorageFormatBucket(key.Bucket), key.Topic, key.SchemaID, fileIdx, contents))
+				return nil
+			}))
+		return files
+	}
+	table := func(name string, version sqlbase.DescriptorVersion) *sqlbase.TableDescriptor {
+		return &sqlbase.TableDescriptor{Name: name, Version: version}
+	}
+	hour := int64(time.Hour)
+	emit := func(t *sqlbase.TableDescriptor, value string, wallTime int64) error {
+		return s.EmitRow(ctx, t, nil /* key */, []byte(value), hlc.Timestamp{WallTime: wallTime})
+	}
+
+	// Rows are grouped by bucket, then table, then schema version.
+	require.NoError(t, emit(table(`foo`, 1), `{"a":1}`, 1))
+	require.NoError(t, emit(table(`foo`, 1), `{"a":2}`, 2))
+	require.NoError(t, emit(table(`foo`, 2), `{"a":3}`, 3))
+	require.NoError(t, emit(table(`bar`, 1), `{"b":1}`, 4))
+	require.NoError(t, emit(table(`foo`, 1), `{"a":4}`, hour+1))
+	require.Equal(t, []string{
+		"19700101000000000000000 bar@1 #0: {\"b\":1}\n",
+		"19700101000000000000000 foo@1 #0: {\"a\":1}\n{\"a\":2}\n",
+		"19700101000000000000000 foo@2 #0: {\"a\":3}\n",
+		"19700101010000000000000 foo@1 #0: {\"a\":4}\n",
+	}, buffered())
+
+	// The first bucket is complete and written out. The second one is written
+	// out too, but it may still get rows, so it stays buffered.
+	require.NoError(t, s.Flush(ctx, hlc.Timestamp{WallTime: hour + 2}))
+	require.Equal(t, []string{
+		"19700101010000000000000 foo@1 #0: {\"a\":4}\n",
+	}, buffered())
+
+	// Rows at or below the flushed timestamp are duplicates and dropped, even
+	// in a bucket that's still buffered.
+	require.NoError(t, emit(table(`foo`, 1), `{"dup":1}`, 5))
+	require.NoError(t, emit(table(`foo`, 1), `{"dup":2}`, hour+2))
+	require.NoError(t, emit(table(`foo`, 1), `{"a":5}`, hour+3))
+	require.Equal(t, []string{
+		"19700101010000000000000 foo@1 #0: {\"a\":4}\n{\"a\":5}\n",
+	}, buffered())
+}
+
+// TODO(dan): More extensive cloudStorageSink testing.
+// - multi node cluster
+// - job restarts
+// - ValidationsTest (+ maybe chaos?)
+func TestCloudStorageSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	flushCh := make(chan struct{}, 1)
+	defer close(flushCh)
+	knobs := base.TestingKnobs{DistSQL: &distsqlrun.TestingKnobs{Changefeed: &TestingKnobs{
+		AfterSinkFlush: func() error {
+			select {
+			case flushCh <- struct{}{}:
+			default:
+			}
+			return nil
+		},
+	}}}
+
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{
+		UseDatabase:   "d",
+		ExternalIODir: dir,
+		Knobs:         knobs,
+	})
+	defer s.Stopper().Stop(ctx)
+	sqlDB := sqlutils.MakeSQLRunner(db)
+	sqlDB.Exec(t, `SET CLUSTER SETTING changefeed.experimental_poll_interval = '10ms'`)
+	sqlDB.Exec(t, `CREATE DATABASE d`)
+
+	f := makeCloud(s, db, dir, flushCh)
+
+	sqlDB.Exec(t, `CREATE TABLE foo (a INT PRIMARY KEY)`)
+	sqlDB.Exec(t, `INSERT INTO foo VALUES (1)`)
+
+	foo := f.Feed(t, `CREATE CHANGEFEED FOR foo WITH resolved, envelope=value_only`)
+
+	sqlDB.Exec(t, `ALTER TABLE foo ADD COLUMN b STRING`)
+	sqlDB.Exec(t, `INSERT INTO foo VALUES (2, 'b')`)
+
+	assertPayloads(t, foo, []string{
+		`foo: ->{"a": 1}`,
+		`foo: ->{"a": 2, "b": "b"}`,
+	})
+}
+
+func TestCloudStorageSinkLogicalTimestamps(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	cfg := cloudStorageSinkConfig{bucketSize: time.Second}
+	s, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+
+	ts := func(wallTime int64, logical int32) hlc.Timestamp {
+		return hlc.Timestamp{WallTime: wallTime, Logical: logical}
+	}
+	table := &sqlbase.TableDescriptor{Name: `foo`}
+	flushed := ts(int64(time.Second), 1)
+	require.NoError(t, s.Flush(ctx, flushed))
+
+	// Only rows at or below the flushed timestamp, including its logical part,
+	// are dropped as duplicates. The rest go in the bucket of their wall time.
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 1}`), ts(int64(time.Second), 0)))
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 2}`), flushed))
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 3}`), ts(int64(time.Second), 2)))
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 4}`), ts(int64(time.Second), 3)))
+	require.Len(t, s.(*cloudStorageSink).files, 1)
+	require.NoError(t, s.Flush(ctx, ts(int64(2*time.Second), 0)))
+
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	b, err := ioutil.ReadFile(filepath.Join(dir, infos[0].Name()))
+	require.NoError(t, err)
+	require.Equal(t, "{\"a\": 3}\n{\"a\": 4}\n", string(b))
 }
-func (testEncoder) EncodeValue(
-	t *sqlbase.TableDescriptor, _ sqlbase.EncDatumRow, _ hlc.Timestamp,
-) ([]byte, error) {
-	panic(`unimplemented`)
+
+func TestCloudStorageSinkRecordSeparator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var buf bytes.Buffer
+	require.NoError(t, makeDelimitedRecordWriter([]byte{'\n'})(&buf, []byte(`{"a": 1}`)))
+	require.NoError(t, makeDelimitedRecordWriter([]byte{'\r', '\n'})(&buf, []byte(`{"a": 2}`)))
+	require.Equal(t, "{\"a\": 1}\n{\"a\": 2}\r\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, writeLengthPrefixedRecord(&buf, []byte(`{"a": 3}`)))
+	require.Equal(t, append([]byte{0, 0, 0, 8}, `{"a": 3}`...), buf.Bytes())
+}
+
+func TestCloudStorageSinkFlushBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	cfg := cloudStorageSinkConfig{bucketSize: time.Hour, writeManifest: true, flushBytes: 10}
+	s, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+
+	written := func(suffix string) []string {
+		infos, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		var contents []string
+		for _, info := range infos {
+			if strings.HasSuffix(info.Name(), suffix) {
+				b, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+				require.NoError(t, err)
+				contents = append(contents, string(b))
+			}
+		}
+		return contents
+	}
+	ts := func(minutes int64) hlc.Timestamp {
+		return hlc.Timestamp{WallTime: minutes * int64(time.Minute)}
+	}
+	table := &sqlbase.TableDescriptor{Name: `foo`}
+
+	// Each record is 9 bytes, so the second one crosses flush_bytes and both
+	// are written out without a Flush.
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 1}`), ts(1)))
+	require.Empty(t, written(`.ndjson`))
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 2}`), ts(2)))
+	require.Equal(t, []string{"{\"a\": 1}\n{\"a\": 2}\n"}, written(`.ndjson`))
+	require.Equal(t, int64(0), s.(*cloudStorageSink).bufferedBytes)
+
+	// Later rows for the same bucket go to the next file, which is written by
+	// Flush, and the manifest lists both.
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 3}`), ts(3)))
+	require.NoError(t, s.Flush(ctx, ts(120)))
+	require.ElementsMatch(t, []string{
+		"{\"a\": 1}\n{\"a\": 2}\n",
+		"{\"a\": 3}\n",
+	}, written(`.ndjson`))
+	require.Empty(t, s.(*cloudStorageSink).files)
+	require.Equal(t, int64(0), s.(*cloudStorageSink).bufferedBytes)
+	require.Empty(t, s.(*cloudStorageSink).writtenEntries)
+
+	manifests := written(`.MANIFEST`)
+	require.Len(t, manifests, 1)
+	var entries []cloudStorageManifestEntry
+	require.NoError(t, gojson.Unmarshal([]byte(manifests[0]), &entries))
+	require.Len(t, entries, 2)
+	require.Equal(t, []int64{18, 9}, []int64{entries[0].Bytes, entries[1].Bytes})
+}
+
+func TestCloudStorageSinkMaxFileAge(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	cfg := cloudStorageSinkConfig{bucketSize: time.Hour, listFiles: true, maxFileAge: time.Minute}
+	sink, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, sink.Close()) }()
+	s := sink.(*cloudStorageSink)
+	now := timeutil.Unix(0, 0)
+	s.now = func() time.Time { return now }
+
+	written := func() []string {
+		infos, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		var contents []string
+		for _, info := range infos {
+			b, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+			require.NoError(t, err)
+			contents = append(contents, string(b))
+		}
+		return contents
+	}
+	ts := func(minutes int64) hlc.Timestamp {
+		return hlc.Timestamp{WallTime: minutes * int64(time.Minute)}
+	}
+	table := &sqlbase.TableDescriptor{Name: `foo`}
+
+	// The resolved timestamp lags behind the row's bucket, so its file is only
+	// written out once it's older than max_file_age.
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 1}`), ts(61)))
+	require.NoError(t, s.Flush(ctx, ts(1)))
+	require.Empty(t, written())
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 2}`), ts(62)))
+	require.NoError(t, s.Flush(ctx, ts(2)))
+	require.Equal(t, []string{"{\"a\": 1}\n{\"a\": 2}\n"}, written())
+
+	// The bucket isn't garbage collected and its file isn't complete, so later
+	// rows for it go to the next file, which is aged from its own first row.
+	require.Len(t, s.files, 1)
+	require.Empty(t, s.TakeCompletedFiles())
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 3}`), ts(63)))
+	require.NoError(t, s.Flush(ctx, ts(3)))
+	require.Len(t, written(), 1)
+
+	// Once the bucket is resolved, both of its files are complete.
+	require.NoError(t, s.Flush(ctx, ts(121)))
+	require.ElementsMatch(t, []string{
+		"{\"a\": 1}\n{\"a\": 2}\n",
+		"{\"a\": 3}\n",
+	}, written())
+	require.Empty(t, s.files)
+	require.Len(t, s.TakeCompletedFiles(), 2)
+}
+
+func TestCloudStorageSinkFlushTable(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	cfg := cloudStorageSinkConfig{bucketSize: time.Hour}
+	s, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+
+	written := func() []string {
+		infos, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		var contents []string
+		for _, info := range infos {
+			b, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+			require.NoError(t, err)
+			contents = append(contents, string(b))
+		}
+		return contents
+	}
+	ts := func(minutes int64) hlc.Timestamp {
+		return hlc.Timestamp{WallTime: minutes * int64(time.Minute)}
+	}
+	foo := &sqlbase.TableDescriptor{Name: `foo`}
+	bar := &sqlbase.TableDescriptor{Name: `bar`}
+
+	require.NoError(t, s.EmitRow(ctx, foo, nil, []byte(`{"foo": 1}`), ts(1)))
+	require.NoError(t, s.EmitRow(ctx, foo, nil, []byte(`{"foo": 2}`), ts(61)))
+	require.NoError(t, s.EmitRow(ctx, bar, nil, []byte(`{"bar": 1}`), ts(1)))
+
+	// Only foo's file in the bucket before the timestamp is written.
+	require.NoError(t, flushTable(ctx, s, `foo`, ts(60)))
+	require.Equal(t, []string{"{\"foo\": 1}\n"}, written())
+
+	// Nothing is garbage collected or skipped, so a later row for the flushed
+	// bucket still goes out with the next Flush.
+	require.NoError(t, s.EmitRow(ctx, foo, nil, []byte(`{"foo": 3}`), ts(2)))
+	require.NoError(t, s.Flush(ctx, ts(180)))
+	require.Len(t, written(), 4)
+	require.Empty(t, s.(*cloudStorageSink).files)
+}
+
+func TestCloudStorageSinkKeyOnly(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	cfg := cloudStorageSinkConfig{bucketSize: time.Hour, keyOnly: true}
+	s, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	// The changefeed doesn't encode values with key_only, so a deletion looks
+	// just like an upsert: only which keys changed is written.
+	foo := &sqlbase.TableDescriptor{Name: `foo`}
+	require.NoError(t, s.EmitRow(ctx, foo, []byte(`[1]`), nil, ts(1)))
+	require.NoError(t, s.EmitRow(ctx, foo, []byte(`[2]`), nil, ts(2)))
+	require.NoError(t, s.Flush(ctx, ts(3)))
+
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.True(t, strings.HasSuffix(infos[0].Name(), `.ndjson`), infos[0].Name())
+	b, err := ioutil.ReadFile(filepath.Join(dir, infos[0].Name()))
+	require.NoError(t, err)
+	require.Equal(t, "[1]\n[2]\n", string(b))
+}
+
+func TestCloudStorageSinkMetadata(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	diffOpts := map[string]string{optEnvelope: string(optEnvelopeDiff)}
+	for _, tc := range []struct {
+		opts        map[string]string
+		encoder     Encoder
+		expectedErr string
+	}{
+		{diffOpts, &rawEncoder{}, `metadata is only supported with format=json`},
+		{map[string]string{optEnvelope: string(optEnvelopeKeyOnly)}, &jsonEncoder{},
+			`metadata is not supported with envelope=key_only`},
+	} {
+		_, err := getSink(ctx, `experimental-nodelocal:///foo?bucket_size=1h&metadata=true`,
+			tc.opts, tc.encoder, nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+		require.EqualError(t, err, tc.expectedErr)
+	}
+
+	files, cleanup := useMemExportStorage()
+	defer cleanup()
+
+	cfg := cloudStorageSinkConfig{bucketSize: time.Hour, metadata: true}
+	sink, err := makeCloudStorageSink(
+		ctx, `mem://bucket`, cfg, makeJSONEncoder(diffOpts), nil /* settings */)
+	require.NoError(t, err)
+	s := sink.(*cloudStorageSink)
+	defer func() { require.NoError(t, s.Close()) }()
+	s.nodeID = 3
+
+	// The metadata joins the rest of the row's metadata, which is untouched.
+	foo := &sqlbase.TableDescriptor{Name: `foo`}
+	require.NoError(t, s.EmitRow(ctx, foo, []byte(`[1]`),
+		[]byte(`{"__crdb__": {"before": {"a": 9223372036854775807}}, "a": 1}`),
+		hlc.Timestamp{WallTime: 1, Logical: 2}))
+	require.NoError(t, s.EmitRow(ctx, foo, []byte(`[2]`), []byte(`{}`), hlc.Timestamp{WallTime: 2}))
+	err = s.EmitRow(ctx, foo, []byte(`[3]`), []byte(`[3]`), hlc.Timestamp{WallTime: 3})
+	require.Regexp(t, `decoding value for metadata: json: cannot unmarshal array`, err)
+	require.NoError(t, s.Flush(ctx, hlc.Timestamp{WallTime: 4}))
+
+	names := files.names()
+	require.Len(t, names, 1)
+	require.Equal(t, ``+
+		`{"__crdb__":{"before":{"a":9223372036854775807},`+
+		`"metadata":{"wall":1,"logical":2,"node_id":3}},"a":1}`+"\n"+
+		`{"__crdb__":{"metadata":{"wall":2,"logical":0,"node_id":3}}}`+"\n",
+		files.get(names[0]))
+}
+
+func TestCloudStorageSinkCloseAndDrain(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	files, cleanup := useMemExportStorage()
+	defer cleanup()
+
+	ts := hlc.Timestamp{WallTime: int64(90 * time.Minute)}
+	foo, bar := &sqlbase.TableDescriptor{Name: `foo`}, &sqlbase.TableDescriptor{Name: `bar`}
+	makeSink := func() Sink {
+		cfg := cloudStorageSinkConfig{bucketSize: time.Hour}
+		s, err := makeCloudStorageSink(
+			ctx, `mem://bucket`, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+		require.NoError(t, err)
+		require.NoError(t, s.EmitRow(ctx, foo, nil, []byte(`{"a": 1}`), ts))
+		require.NoError(t, s.EmitRow(ctx, bar, nil, []byte(`{"b": 1}`), ts))
+		return s
+	}
+
+	// The data files that can't be written out are reported by their bucket.
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	undelivered, err := closeAndDrainSink(canceledCtx, makeSink())
+	require.NoError(t, err)
+	bucket := ts.GoTime().Truncate(time.Hour)
+	require.ElementsMatch(t, []MessageRef{
+		{Topic: `foo`, Bucket: bucket},
+		{Topic: `bar`, Bucket: bucket},
+	}, undelivered)
+	require.Empty(t, files.names())
+
+	// Otherwise, they're written out, even though their bucket isn't resolved.
+	undelivered, err = closeAndDrainSink(ctx, makeSink())
+	require.NoError(t, err)
+	require.Empty(t, undelivered)
+	require.Len(t, files.names(), 2)
+}
+
+func TestCloudStorageSinkResolvedFileListing(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	// The data files are written by the sink of a change aggregator and the
+	// resolved timestamp files by the one of the change frontier.
+	cfg := cloudStorageSinkConfig{bucketSize: time.Hour, listFiles: true}
+	encoder := makeJSONEncoder(nil /* opts */)
+	makeSink := func() *cloudStorageSink {
+		s, err := makeCloudStorageSink(ctx, `nodelocal://`+dir, cfg, encoder, nil /* settings */)
+		require.NoError(t, err)
+		return s.(*cloudStorageSink)
+	}
+	aggregator, frontier := makeSink(), makeSink()
+	defer func() { require.NoError(t, aggregator.Close()) }()
+	defer func() { require.NoError(t, frontier.Close()) }()
+
+	// The files are passed on through the wrappers added by sink params, but
+	// only noted by sinks configured to list them.
+	wrapped := makeRateLimitedSink(makeValueLimitSink(frontier, sinkValueLimit{}), sinkRateLimits{})
+	unlisted := &cloudStorageSink{}
+	noteSinkCompletedFile(makeRateLimitedSink(unlisted, sinkRateLimits{}), `foo`)
+	require.Empty(t, unlisted.listedFiles)
+	require.Empty(t, takeSinkCompletedFiles(&bufferSink{}))
+
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	hour := int64(time.Hour)
+	resolve := func(resolved hlc.Timestamp, completed []string) string {
+		for _, filename := range completed {
+			noteSinkCompletedFile(wrapped, filename)
+		}
+		require.NoError(t, frontier.EmitResolvedTimestamp(ctx, encoder, resolved))
+		bucket := cloudStorageResolvedBucket(resolved, time.Hour, false /* bucketStart */)
+		name := cloudStorageFormatBucket(bucket) + cloudStorageDefaultResolvedSuffix
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	foo := &sqlbase.TableDescriptor{Name: `foo`}
+	require.NoError(t, aggregator.EmitRow(ctx, foo, nil, []byte(`v1`), ts(1)))
+	require.NoError(t, aggregator.EmitRow(ctx, foo, nil, []byte(`v2`), ts(hour+1)))
+
+	// The first bucket is complete as of its end, the second isn't.
+	require.NoError(t, aggregator.Flush(ctx, ts(hour)))
+	first := aggregator.TakeCompletedFiles()
+	require.Len(t, first, 1)
+	_, err := os.Stat(filepath.Join(dir, first[0]))
+	require.NoError(t, err)
+	require.Equal(t, `{"__crdb__":{"resolved":"3600000000000.0000000000"}}`+"\n"+first[0]+"\n",
+		resolve(ts(hour), first))
+
+	// The second bucket's file is written out, but it's only listed once the
+	// bucket is complete.
+	require.NoError(t, aggregator.Flush(ctx, ts(hour+2)))
+	require.Empty(t, aggregator.TakeCompletedFiles())
+	require.NoError(t, aggregator.Flush(ctx, ts(2*hour)))
+	second := aggregator.TakeCompletedFiles()
+	require.Len(t, second, 1)
+	require.NotEqual(t, first[0], second[0])
+	require.Equal(t, `{"__crdb__":{"resolved":"7200000000000.0000000000"}}`+"\n"+second[0]+"\n",
+		resolve(ts(2*hour), second))
+
+	// Nothing was completed since, so nothing is listed.
+	require.Equal(t, `{"__crdb__":{"resolved":"10800000000000.0000000000"}}`+"\n",
+		resolve(ts(3*hour), nil))
+}
+
+func TestCloudStorageSinkTrimTrailingSeparator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	foo := &sqlbase.TableDescriptor{Name: `foo`}
+	written := func(cfg cloudStorageSinkConfig) string {
+		dir, dirCleanupFn := testutils.TempDir(t)
+		defer dirCleanupFn()
+		cfg.bucketSize = time.Hour
+		s, err := makeCloudStorageSink(
+			ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, s.Close()) }()
+		require.NoError(t, s.EmitRow(ctx, foo, nil, []byte(`{"a": 1}`), ts(1)))
+		require.NoError(t, s.EmitRow(ctx, foo, nil, []byte(`{"a": 2}`), ts(2)))
+		require.NoError(t, s.Flush(ctx, ts(3)))
+		infos, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		b, err := ioutil.ReadFile(filepath.Join(dir, infos[0].Name()))
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	require.Equal(t, "{\"a\": 1}\n{\"a\": 2}\n", written(cloudStorageSinkConfig{}))
+	require.Equal(t, "{\"a\": 1}\n{\"a\": 2}",
+		written(cloudStorageSinkConfig{trimTrailingSeparator: true}))
+	require.Equal(t, "{\"a\": 1}\r\n{\"a\": 2}", written(cloudStorageSinkConfig{
+		recordSeparator: `crlf`, trimTrailingSeparator: true,
+	}))
+
+	cfg := cloudStorageSinkConfig{
+		bucketSize: time.Hour, recordSeparator: `length_prefixed`, trimTrailingSeparator: true,
+	}
+	_, err := makeCloudStorageSink(ctx, `nodelocal:///unused`, cfg,
+		makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.EqualError(t, err,
+		`trim_trailing_separator is not supported with record_separator=length_prefixed`)
+}
+
+func TestCloudStorageSinkRawRecordSeparator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	foo := &sqlbase.TableDescriptor{Name: `foo`}
+	written := func(recordSeparator string) (string, string) {
+		dir, dirCleanupFn := testutils.TempDir(t)
+		defer dirCleanupFn()
+		cfg := cloudStorageSinkConfig{bucketSize: time.Hour, recordSeparator: recordSeparator}
+		s, err := makeCloudStorageSink(
+			ctx, `nodelocal://`+dir, cfg, makeRawEncoder(nil /* opts */), nil /* settings */)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, s.Close()) }()
+		require.NoError(t, s.EmitRow(ctx, foo, nil, []byte("a\nb"), ts(1)))
+		require.NoError(t, s.Flush(ctx, ts(2)))
+		infos, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		b, err := ioutil.ReadFile(filepath.Join(dir, infos[0].Name()))
+		require.NoError(t, err)
+		return filepath.Ext(infos[0].Name()), string(b)
+	}
+
+	// A raw value can contain a newline, so by default it's length prefixed.
+	ext, b := written(``)
+	require.Equal(t, `.lpraw`, ext)
+	require.Equal(t, "\x00\x00\x00\x03a\nb", b)
+	ext, b = written(`lf`)
+	require.Equal(t, `.ndraw`, ext)
+	require.Equal(t, "a\nb\n", b)
+
+	cfg := cloudStorageSinkConfig{bucketSize: time.Hour, trimTrailingSeparator: true}
+	_, err := makeCloudStorageSink(ctx, `nodelocal:///unused`, cfg,
+		makeRawEncoder(nil /* opts */), nil /* settings */)
+	require.EqualError(t, err,
+		`trim_trailing_separator is not supported with record_separator=length_prefixed`)
+}
+
+func TestCloudStorageSinkPing(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	cfg := cloudStorageSinkConfig{bucketSize: time.Hour}
+	s, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+
+	// The file written by a ping is deleted again.
+	require.NoError(t, pingSink(ctx, makeMetricsSink(MakeMetrics(time.Minute).(*Metrics), s)))
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, infos)
+}
+
+func TestCloudStorageSinkAtomicWrites(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	cfg := cloudStorageSinkConfig{bucketSize: time.Hour, atomicWrites: true}
+	s, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+	require.True(t, s.(*cloudStorageSink).renameFiles)
+
+	table := &sqlbase.TableDescriptor{Name: `foo`}
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 1}`), hlc.Timestamp{WallTime: 1}))
+	require.NoError(t, s.Flush(ctx, hlc.Timestamp{WallTime: int64(2 * time.Hour)}))
+
+	// Only the renamed file is left behind.
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.True(t, strings.HasSuffix(infos[0].Name(), `.ndjson`), infos[0].Name())
+	b, err := ioutil.ReadFile(filepath.Join(dir, infos[0].Name()))
+	require.NoError(t, err)
+	require.Equal(t, "{\"a\": 1}\n", string(b))
+}
+
+func TestCloudStorageSinkUpload(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	for _, param := range []string{`upload_timeout=0s`, `upload_max_retries=-1`} {
+		_, err := getSink(ctx, `experimental-nodelocal:///foo?bucket_size=1h&`+param,
+			map[string]string{}, &jsonEncoder{},
+			nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+		require.Regexp(t, `must be (positive|non-negative)`, err)
+	}
+
+	defer func(opts retry.Options) { cloudStorageUploadRetryOpts = opts }(cloudStorageUploadRetryOpts)
+	cloudStorageUploadRetryOpts = retry.Options{InitialBackoff: time.Microsecond}
+
+	cfg := cloudStorageSinkConfig{
+		bucketSize: time.Hour, uploadTimeout: 10 * time.Millisecond, uploadMaxRetries: 2,
+	}
+	sink, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, sink.Close()) }()
+	s := sink.(*cloudStorageSink)
+
+	// Every attempt gets all of the contents.
+	var attempts []string
+	failures := 2
+	require.NoError(t, s.upload(ctx, `f`, bytes.NewReader([]byte(`abc`)), func(
+		_ context.Context, contents io.ReadSeeker,
+	) error {
+		b, err := ioutil.ReadAll(contents)
+		require.NoError(t, err)
+		attempts = append(attempts, string(b))
+		if failures--; failures >= 0 {
+			return errors.New(`flaky`)
+		}
+		return nil
+	}))
+	require.Equal(t, []string{`abc`, `abc`, `abc`}, attempts)
+
+	// Errors are returned as is once the retries run out.
+	attempts = nil
+	err = s.upload(ctx, `f`, bytes.NewReader([]byte(`abc`)), func(
+		_ context.Context, contents io.ReadSeeker,
+	) error {
+		attempts = append(attempts, ``)
+		return errors.New(`boom`)
+	})
+	require.EqualError(t, err, `boom`)
+	require.False(t, isRetryableSinkError(err))
+	require.Len(t, attempts, 3)
+
+	// An upload that's stuck until its context is canceled times out, and
+	// the changefeed is restarted.
+	err = s.upload(ctx, `f`, bytes.NewReader([]byte(`abc`)), func(
+		ctx context.Context, _ io.ReadSeeker,
+	) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	require.EqualError(t, err, `retryable sink error: writing f timed out after 10ms: `+
+		`context deadline exceeded`)
+	require.True(t, isRetryableSinkError(err))
+
+	// Files are still written out as usual.
+	table := &sqlbase.TableDescriptor{Name: `foo`}
+	require.NoError(t, s.EmitRow(ctx, table, nil, []byte(`{"a": 1}`), hlc.Timestamp{WallTime: 1}))
+	require.NoError(t, s.Flush(ctx, hlc.Timestamp{WallTime: int64(2 * time.Hour)}))
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+}
+
+func TestCloudStorageSinkResolvedSuffix(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	for suffix, expectedErr := range map[string]string{
+		`/RESOLVED`:        `resolved_suffix must not contain /`,
+		`-RESOLVED`:        `resolved_suffix must not start with a digit or -`,
+		`0RESOLVED`:        `resolved_suffix must not start with a digit or -`,
+		`.resolved.ndjson`: `resolved_suffix must not end with .ndjson`,
+		`.MANIFEST`:        `resolved_suffix must not end with .MANIFEST`,
+	} {
+		cfg := cloudStorageSinkConfig{bucketSize: time.Hour, resolvedSuffix: suffix}
+		_, err := makeCloudStorageSink(
+			ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+		require.Regexp(t, expectedErr, err)
+	}
+
+	// Named after the start of a bucket, the file must sort after its data
+	// files.
+	cfg := cloudStorageSinkConfig{
+		bucketSize: time.Hour, resolvedSuffix: `+RESOLVED`, resolvedBucketStart: true,
+	}
+	_, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.EqualError(t, err, `resolved_suffix must start with a character that sorts `+
+		`after - with resolved_bucket_start: +RESOLVED`)
+
+	cfg.resolvedSuffix, cfg.resolvedBucketStart = `_done.marker`, false
+	s, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+	resolved := hlc.Timestamp{WallTime: int64(time.Hour)}
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, makeJSONEncoder(nil), resolved))
+
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, `19700101005959999999999_done.marker`, infos[0].Name())
+}
+
+func TestCloudStorageSinkResolvedGranularity(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	opts := map[string]string{optEnvelope: string(optEnvelopeValueOnly)}
+	for params, expectedErr := range map[string]string{
+		`resolved_granularity=nope`: `unknown resolved_granularity: nope`,
+		`resolved_granularity=topic&resolved_file_listing=true`: `resolved_file_listing ` +
+			`is not supported with resolved_granularity=topic`,
+	} {
+		_, err := getSink(ctx, `experimental-nodelocal:///foo?bucket_size=1h&`+params, opts,
+			&jsonEncoder{}, nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+		require.EqualError(t, err, expectedErr)
+	}
+
+	files := func() []string {
+		infos, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+			require.NoError(t, os.Remove(filepath.Join(dir, info.Name())))
+		}
+		return names
+	}
+	resolved := hlc.Timestamp{WallTime: int64(time.Hour)}
+	for granularity, expected := range map[string][]string{
+		cloudStorageResolvedGranularityChangefeed: {`19700101005959999999999.RESOLVED`},
+		cloudStorageResolvedGranularityTopic:      {`foo-19700101005959999999999.RESOLVED`},
+		cloudStorageResolvedGranularityBoth: {
+			`19700101005959999999999.RESOLVED`, `foo-19700101005959999999999.RESOLVED`,
+		},
+	} {
+		cfg := cloudStorageSinkConfig{bucketSize: time.Hour, resolvedGranularity: granularity}
+		sink, err := makeCloudStorageSink(
+			ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+		require.NoError(t, err)
+		s := sink.(*cloudStorageSink)
+		// The change frontier only writes the files of each topic when the
+		// sink is set up to have them.
+		require.NoError(t, s.EmitResolvedTimestamp(ctx, makeJSONEncoder(nil), resolved))
+		if s.EmitsTopicResolved() {
+			require.NoError(t, s.EmitTopicResolvedTimestamp(ctx, makeJSONEncoder(nil), `foo`, resolved))
+		}
+		require.NoError(t, s.Close())
+		require.Equal(t, expected, files(), granularity)
+	}
+}
+
+func TestCloudStorageSinkBufferPool(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	opts := map[string]string{optEnvelope: string(optEnvelopeValueOnly)}
+	for params, expectedErr := range map[string]string{
+		`buffer_pool_max_bytes=nope`: `parsing buffer_pool_max_bytes: .*invalid syntax`,
+		`buffer_pool_max_bytes=0`:    `buffer_pool_max_bytes must be positive: 0`,
+	} {
+		_, err := getSink(ctx, `experimental-nodelocal:///foo?bucket_size=1h&`+params, opts,
+			&jsonEncoder{}, nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+		require.Regexp(t, expectedErr, err)
+	}
+
+	files, cleanup := useMemExportStorage()
+	defer cleanup()
+	cfg := cloudStorageSinkConfig{bucketSize: time.Second, bufferPoolMaxBytes: 1 << 20}
+	sink, err := makeCloudStorageSink(
+		ctx, `mem://bucket`, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	s := sink.(*cloudStorageSink)
+	defer func() { require.NoError(t, s.Close()) }()
+	require.NotNil(t, s.bufferPool)
+
+	// Each data file only has its own rows, even though they reuse the
+	// buffers of the ones written before them.
+	table := &sqlbase.TableDescriptor{Name: `foo`}
+	for i := 1; i <= 3; i++ {
+		ts := hlc.Timestamp{WallTime: int64(i) * int64(time.Second)}
+		value := []byte(strings.Repeat(strconv.Itoa(i), 1000))
+		require.NoError(t, s.EmitRow(ctx, table, nil, value, ts))
+		require.NoError(t, s.Flush(ctx, ts.Add(int64(500*time.Millisecond), 0)))
+		key := cloudStorageSinkKey{Bucket: ts.GoTime(), Topic: `foo`, SinkID: s.sinkID, Ext: s.ext}
+		require.Equal(t, string(value)+"\n", files.get(`bucket/`+key.Filename(0)))
+	}
+}
+
+func TestCloudStorageSinkLifecycleMarkers(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	files, cleanup := useMemExportStorage()
+	defer cleanup()
+	cfg := cloudStorageSinkConfig{bucketSize: time.Second}
+	sink, err := makeCloudStorageSink(
+		ctx, `mem://bucket`, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+
+	// The marker files are named like the resolved timestamp files for the
+	// same timestamps.
+	ts := hlc.Timestamp{WallTime: int64(3 * time.Second)}
+	require.NoError(t, emitFeedLifecycle(ctx, sink, feedPhaseStart, ts))
+	require.NoError(t, emitFeedLifecycle(ctx, sink, feedPhaseEnd, ts.Add(int64(time.Second), 0)))
+	bucket := func(d time.Duration) string {
+		return `bucket/` + cloudStorageFormatBucket(hlc.Timestamp{WallTime: int64(d)}.GoTime())
+	}
+	require.Equal(t, []string{
+		bucket(3*time.Second-time.Nanosecond) + `.FEEDSTART`,
+		bucket(4*time.Second-time.Nanosecond) + `.FEEDEND`,
+	}, files.names())
+	require.Equal(t, `{"phase":"start","timestamp":"3000000000.0000000000"}`,
+		files.get(bucket(3*time.Second-time.Nanosecond)+`.FEEDSTART`))
+
+	require.NoError(t, sink.Close())
+	require.EqualError(t, emitFeedLifecycle(ctx, sink, feedPhaseEnd, ts),
+		`cannot EmitFeedLifecycle on a closed sink`)
+}
+
+func TestCloudStorageSinkSchemaChange(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	files, cleanup := useMemExportStorage()
+	defer cleanup()
+	cfg := cloudStorageSinkConfig{bucketSize: time.Second}
+	sink, err := makeCloudStorageSink(
+		ctx, `mem://bucket`, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+
+	// The marker is named with the topic and schema id of the data files
+	// written with the new schema.
+	foo := &sqlbase.TableDescriptor{Name: `foo`, Version: 2}
+	require.NoError(t, sink.EmitRow(ctx, foo, nil, []byte(`v1`), hlc.Timestamp{WallTime: 1}))
+	require.NoError(t, sink.Flush(ctx, hlc.Timestamp{WallTime: 1}))
+	require.NoError(t, sink.EmitSchemaChange(ctx, foo, 1, 2))
+	names := files.names()
+	require.Len(t, names, 2)
+	require.Contains(t, names[0], `-foo-2-`)
+	require.Equal(t, `bucket/foo-2.SCHEMACHANGE`, names[1])
+	require.Equal(t, `{"table":"foo","old_version":1,"new_version":2}`,
+		files.get(`bucket/foo-2.SCHEMACHANGE`))
+
+	require.NoError(t, sink.Close())
+	require.EqualError(t, sink.EmitSchemaChange(ctx, foo, 1, 2),
+		`cannot EmitSchemaChange on a closed sink`)
+}
+
+// schemaChangeRecordingSink is a bufferSink that records the schema changes
+// emitted to it.
+type schemaChangeRecordingSink struct {
+	*bufferSink
+	changes []string
+}
+
+func (s *schemaChangeRecordingSink) EmitSchemaChange(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	oldVersion, newVersion sqlbase.DescriptorVersion,
+) error {
+	s.changes = append(s.changes, fmt.Sprintf(`%s:%d->%d`, table.Name, oldVersion, newVersion))
+	return s.bufferSink.EmitSchemaChange(ctx, table, oldVersion, newVersion)
 }
-func (testEncoder) EncodeResolvedTimestamp(_ string, ts hlc.Timestamp) ([]byte, error) {
-	return []byte(ts.String()), nil
+
+func TestChangeFrontierSchemaChanges(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	sink := &schemaChangeRecordingSink{bufferSink: &bufferSink{}}
+	cf := &changeFrontier{sink: sink}
+	note := func(name string, oldVersion, newVersion sqlbase.DescriptorVersion) {
+		table := &sqlbase.TableDescriptor{Name: name, Version: newVersion}
+		marker, err := encodeSchemaChangeMarker(table, oldVersion, newVersion)
+		require.NoError(t, err)
+		d := sqlbase.EncDatum{Datum: tree.NewDBytes(tree.DBytes(marker))}
+		require.NoError(t, cf.noteSchemaChange(ctx, d))
+	}
+
+	// Every aggregator forwards the same change, which is only emitted once,
+	// and a late forward of an older change is ignored.
+	note(`foo`, 1, 2)
+	note(`foo`, 1, 2)
+	note(`bar`, 1, 2)
+	note(`foo`, 2, 3)
+	note(`foo`, 1, 2)
+	require.Equal(t, []string{`foo:1->2`, `bar:1->2`, `foo:2->3`}, sink.changes)
+
+	d := sqlbase.EncDatum{Datum: tree.NewDBytes(`not json`)}
+	require.Error(t, cf.noteSchemaChange(ctx, d))
 }
 
-func TestSQLSink(t *testing.T) {
+func TestCloudStorageSinkMinResolvedInterval(t *testing.T) {
 	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
 
-	table := func(name string) *sqlbase.TableDescriptor {
-		return &sqlbase.TableDescriptor{Name: name}
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	opts := map[string]string{optEnvelope: string(optEnvelopeValueOnly)}
+	for params, expectedErr := range map[string]string{
+		`min_resolved_interval=nope`: `parsing min_resolved_interval: time: invalid duration nope`,
+		`min_resolved_interval=0s`:   `min_resolved_interval must be positive: 0s`,
+	} {
+		_, err := getSink(ctx, `experimental-nodelocal:///foo?bucket_size=1h&`+params, opts,
+			&jsonEncoder{}, nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+		require.EqualError(t, err, expectedErr)
+	}
+
+	cfg := cloudStorageSinkConfig{
+		bucketSize:          time.Minute,
+		resolvedGranularity: cloudStorageResolvedGranularityBoth,
+		minResolvedInterval: 2 * time.Minute,
+	}
+	sink, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	s := sink.(*cloudStorageSink)
+	defer func() { require.NoError(t, s.Close()) }()
+
+	var expected []string
+	for _, tc := range []struct {
+		resolved time.Duration
+		written  bool
+	}{
+		// The first one is always written.
+		{resolved: time.Minute, written: true},
+		{resolved: 2 * time.Minute, written: false},
+		{resolved: 3 * time.Minute, written: true},
+		{resolved: 4*time.Minute + 59*time.Second, written: false},
+		{resolved: 5 * time.Minute, written: true},
+	} {
+		resolved := hlc.Timestamp{WallTime: int64(tc.resolved)}
+		require.NoError(t, s.EmitResolvedTimestamp(ctx, makeJSONEncoder(nil), resolved))
+		require.NoError(t, s.EmitTopicResolvedTimestamp(ctx, makeJSONEncoder(nil), `foo`, resolved))
+		if tc.written {
+			bucket := cloudStorageFormatBucket(
+				cloudStorageResolvedBucket(resolved, time.Minute, false /* bucketStart */))
+			expected = append(expected, bucket+`.RESOLVED`, `foo-`+bucket+`.RESOLVED`)
+		}
+	}
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
 	}
+	sort.Strings(expected)
+	require.Equal(t, expected, names)
+}
 
+func TestCloudStorageSinkCombinedResolved(t *testing.T) {
+	defer leaktest.AfterTest(t)()
 	ctx := context.Background()
-	s, sqlDBRaw, _ := serverutils.StartServer(t, base.TestServerArgs{UseDatabase: "d"})
-	defer s.Stopper().Stop(ctx)
-	sqlDB := sqlutils.MakeSQLRunner(sqlDBRaw)
-	sqlDB.Exec(t, `CREATE DATABASE d`)
 
-	sinkURL, cleanup := sqlutils.PGUrl(t, s.ServingAddr(), t.Name(), url.User(security.RootUser))
+	files, cleanup := useMemExportStorage()
 	defer cleanup()
-	sinkURL.Path = `d`
 
-	targets := jobspb.ChangefeedTargets{
-		0: jobspb.ChangefeedTarget{StatementTimeName: `foo`},
-		1: jobspb.ChangefeedTarget{StatementTimeName: `bar`},
+	cfg := cloudStorageSinkConfig{
+		bucketSize:          time.Second,
+		resolvedGranularity: cloudStorageResolvedGranularityCombined,
+		listFiles:           true,
+	}
+	sink, err := makeCloudStorageSink(
+		ctx, `mem://bucket`, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	s := sink.(*cloudStorageSink)
+	defer func() { require.NoError(t, s.Close()) }()
+
+	ts := func(d time.Duration) hlc.Timestamp { return hlc.Timestamp{WallTime: int64(d)} }
+	require.NoError(t, s.EmitRow(
+		ctx, &sqlbase.TableDescriptor{Name: `foo`}, nil, []byte(`{"a": 1}`), ts(time.Second)))
+	require.NoError(t, s.Flush(ctx, ts(3*time.Second)))
+	for _, filename := range s.TakeCompletedFiles() {
+		s.NoteCompletedFile(filename)
+	}
+
+	// One file has every topic, and the listing of the data files still
+	// follows the first line.
+	require.True(t, sinkCombinesTopicResolved(s))
+	s.SetCombinedTopicResolved(map[string]hlc.Timestamp{
+		`foo`: ts(3 * time.Second),
+		`bar`: ts(5 * time.Second),
+	})
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, makeJSONEncoder(nil), ts(3*time.Second)))
+	resolvedName := `bucket/` +
+		cloudStorageFormatBucket(ts(3*time.Second-time.Nanosecond).GoTime()) + `.RESOLVED`
+	var dataName string
+	for _, name := range files.names() {
+		if name != resolvedName {
+			require.Empty(t, dataName, `unexpected %s`, name)
+			dataName = strings.TrimPrefix(name, `bucket/`)
+		}
+	}
+	require.Equal(t, `{"resolved":"3000000000.0000000000","topics":{`+
+		`"bar":"5000000000.0000000000","foo":"3000000000.0000000000"}}`+"\n"+
+		dataName+"\n", files.get(resolvedName))
+}
+
+func TestCloudStorageSinkProtobuf(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	cfg := cloudStorageSinkConfig{bucketSize: time.Hour, trimTrailingSeparator: true}
+	_, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeProtobufEncoder(nil /* opts */), nil /* settings */)
+	require.EqualError(t, err, `trim_trailing_separator is not supported with format=protobuf`)
+
+	cfg = cloudStorageSinkConfig{bucketSize: time.Hour}
+	s, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeProtobufEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+
+	// The descriptor of each table version is written once, before its rows
+	// are flushed.
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	for _, version := range []sqlbase.DescriptorVersion{1, 1, 2} {
+		table := &sqlbase.TableDescriptor{Name: `foo`, Version: version}
+		table.Columns = []sqlbase.ColumnDescriptor{
+			{Name: `a`, ID: 1, Type: sqlbase.ColumnType{SemanticType: sqlbase.ColumnType_INT}},
+		}
+		require.NoError(t, s.EmitRow(ctx, table, nil, []byte{0x08, byte(version)}, ts(1)))
 	}
-	sink, err := makeSQLSink(sinkURL.String(), `sink`, targets)
+	var names []string
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	require.Equal(t, []string{`foo-1.DESCRIPTOR`, `foo-2.DESCRIPTOR`}, names)
+
+	require.NoError(t, s.Flush(ctx, ts(int64(2*time.Hour))))
+	infos, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, infos, 4)
+	for _, info := range infos[:2] {
+		require.True(t, strings.HasSuffix(info.Name(), `.protodelim`), info.Name())
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, infos[0].Name()))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x02, 0x08, 0x01, 0x02, 0x08, 0x01}, b)
+}
+
+func TestCloudStorageSinkMetrics(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	cfg := cloudStorageSinkConfig{bucketSize: time.Hour}
+	s, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+	metrics := MakeMetrics(time.Minute).(*Metrics)
+	s.(*cloudStorageSink).metrics = metrics
+
+	ts := hlc.Timestamp{WallTime: 1}
+	require.NoError(t, s.EmitRow(ctx, &sqlbase.TableDescriptor{Name: `foo`}, nil, []byte(`{}`), ts))
+	require.NoError(t, s.EmitRow(ctx, &sqlbase.TableDescriptor{Name: `bar`}, nil, []byte(`{"a": 1}`), ts))
+	require.NoError(t, s.Flush(ctx, hlc.Timestamp{WallTime: int64(2 * time.Hour)}))
+
+	// One sample per data file, and flushing with nothing buffered records
+	// nothing.
+	require.NoError(t, s.Flush(ctx, hlc.Timestamp{WallTime: int64(3 * time.Hour)}))
+	fileBytes := metrics.CloudStorageFileBytesHist.Snapshot()
+	require.Equal(t, int64(2), fileBytes.TotalCount())
+	require.Equal(t, int64(3), fileBytes.Min())
+	require.Equal(t, int64(9), fileBytes.Max())
+	require.Equal(t, int64(2), metrics.CloudStorageFileWriteNanosHist.Snapshot().TotalCount())
+}
+
+func TestCloudStorageSinkIdempotentFlush(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	cfg := cloudStorageSinkConfig{bucketSize: time.Hour, idempotentFlush: true}
+	sink, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
 	require.NoError(t, err)
 	defer func() { require.NoError(t, sink.Close()) }()
+	s := sink.(*cloudStorageSink)
+	metrics := MakeMetrics(time.Minute).(*Metrics)
+	s.metrics = metrics
+	written := func() int64 { return metrics.CloudStorageFileBytesHist.Snapshot().TotalCount() }
 
-	// Empty
-	require.NoError(t, sink.Flush(ctx, zeroTS))
+	ts := hlc.Timestamp{WallTime: 1}
+	require.NoError(t, s.EmitRow(ctx, &sqlbase.TableDescriptor{Name: `foo`}, nil, []byte(`1`), ts))
+	require.NoError(t, s.EmitRow(ctx, &sqlbase.TableDescriptor{Name: `bar`}, nil, []byte(`2`), ts))
+	var filenames []string
+	for key, file := range s.files {
+		filenames = append(filenames, key.Filename(file.idx))
+	}
+	sort.Strings(filenames)
+	require.Len(t, filenames, 2)
 
-	// Undeclared topic
-	require.EqualError(t,
-		sink.EmitRow(ctx, table(`nope`), nil, nil, zeroTS), `cannot emit to undeclared topic: nope`)
+	// A directory in the way of the second file makes the flush fail after the
+	// first file has been written.
+	blocker := filepath.Join(dir, filenames[1])
+	require.NoError(t, os.Mkdir(blocker, 0755))
+	flushTs := hlc.Timestamp{WallTime: int64(2 * time.Hour)}
+	require.Error(t, s.Flush(ctx, flushTs))
+	require.Equal(t, int64(1), written())
+	_, err = os.Stat(filepath.Join(dir, filenames[0]))
+	require.NoError(t, err)
 
-	// With one row, nothing flushes until Flush is called.
-	require.NoError(t, sink.EmitRow(ctx, table(`foo`), []byte(`k1`), []byte(`v0`), zeroTS))
-	sqlDB.CheckQueryResults(t, `SELECT key, value FROM sink ORDER BY PRIMARY KEY sink`,
-		[][]string{},
-	)
-	require.NoError(t, sink.Flush(ctx, zeroTS))
-	sqlDB.CheckQueryResults(t, `SELECT key, value FROM sink ORDER BY PRIMARY KEY sink`,
-		[][]string{{`k1`, `v0`}},
-	)
-	sqlDB.Exec(t, `TRUNCATE sink`)
+	// The retry only writes the second file.
+	require.NoError(t, os.Remove(blocker))
+	require.NoError(t, s.Flush(ctx, flushTs))
+	require.Equal(t, int64(2), written())
+	b, err := ioutil.ReadFile(blocker)
+	require.NoError(t, err)
+	require.Equal(t, "1\n", string(b))
+}
 
-	// Verify the implicit flushing
-	sqlDB.CheckQueryResults(t, `SELECT count(*) FROM sink`, [][]string{{`0`}})
-	for i := 0; i < sqlSinkRowBatchSize+1; i++ {
-		require.NoError(t,
-			sink.EmitRow(ctx, table(`foo`), []byte(`k1`), []byte(`v`+strconv.Itoa(i)), zeroTS))
+func TestCloudStorageSinkBackfillMode(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	cfg := cloudStorageSinkConfig{
+		bucketSize: time.Hour, writeConcurrency: 1, backfillWriteConcurrency: 4,
 	}
-	// Should have auto flushed after sqlSinkRowBatchSize
-	sqlDB.CheckQueryResults(t, `SELECT count(*) FROM sink`, [][]string{{`3`}})
-	require.NoError(t, sink.Flush(ctx, zeroTS))
-	sqlDB.CheckQueryResults(t, `SELECT count(*) FROM sink`, [][]string{{`4`}})
-	sqlDB.Exec(t, `TRUNCATE sink`)
+	s, err := makeCloudStorageSink(
+		ctx, `nodelocal://`+dir, cfg, makeJSONEncoder(nil /* opts */), nil /* settings */)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+	metrics := MakeMetrics(time.Minute).(*Metrics)
+	s.(*cloudStorageSink).metrics = metrics
+	// The mode is forwarded through the sinks that wrap it.
+	wrapped := makeMetricsSink(metrics, s)
 
-	// Two tables interleaved in time
-	require.NoError(t, sink.EmitRow(ctx, table(`foo`), []byte(`kfoo`), []byte(`v0`), zeroTS))
-	require.NoError(t, sink.EmitRow(ctx, table(`bar`), []byte(`kbar`), []byte(`v0`), zeroTS))
-	require.NoError(t, sink.EmitRow(ctx, table(`foo`), []byte(`kfoo`), []byte(`v1`), zeroTS))
-	require.NoError(t, sink.Flush(ctx, zeroTS))
-	sqlDB.CheckQueryResults(t, `SELECT topic, key, value FROM sink ORDER BY PRIMARY KEY sink`,
-		[][]string{{`bar`, `kbar`, `v0`}, {`foo`, `kfoo`, `v0`}, {`foo`, `kfoo`, `v1`}},
-	)
-	sqlDB.Exec(t, `TRUNCATE sink`)
+	require.Equal(t, 1, s.(*cloudStorageSink).writeConcurrency())
+	setSinkBackfillMode(ctx, wrapped, true)
+	require.Equal(t, 4, s.(*cloudStorageSink).writeConcurrency())
 
-	// Multiple keys interleaved in time. Use sqlSinkNumPartitions+1 keys to
-	// guarantee that at lease two of them end up in the same partition.
-	for i := 0; i < sqlSinkNumPartitions+1; i++ {
-		require.NoError(t,
-			sink.EmitRow(ctx, table(`foo`), []byte(`v`+strconv.Itoa(i)), []byte(`v0`), zeroTS))
+	// Every file is written out, however many are written at once.
+	ts := hlc.Timestamp{WallTime: 1}
+	const numTables = 10
+	for i := 0; i < numTables; i++ {
+		table := &sqlbase.TableDescriptor{Name: `t` + strconv.Itoa(i)}
+		require.NoError(t, wrapped.EmitRow(ctx, table, nil, []byte(`{}`), ts))
 	}
-	for i := 0; i < sqlSinkNumPartitions+1; i++ {
-		require.NoError(t,
-			sink.EmitRow(ctx, table(`foo`), []byte(`v`+strconv.Itoa(i)), []byte(`v1`), zeroTS))
+	require.NoError(t, wrapped.Flush(ctx, hlc.Timestamp{WallTime: int64(2 * time.Hour)}))
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, infos, numTables)
+	require.Equal(t, int64(numTables), metrics.CloudStorageFileBytesHist.Snapshot().TotalCount())
+
+	setSinkBackfillMode(ctx, wrapped, false)
+	require.Equal(t, 1, s.(*cloudStorageSink).writeConcurrency())
+
+	_, err = parseWriteConcurrency(`0`, sinkParamWriteConcurrency, 1)
+	require.EqualError(t, err, `write_concurrency must be positive: 0`)
+	concurrency, err := parseWriteConcurrency(``, sinkParamBackfillWriteConcurrency, 3)
+	require.NoError(t, err)
+	require.Equal(t, 3, concurrency)
+}
+
+func TestCloudStorageResolvedBucket(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ts := func(d time.Duration, logical int32) hlc.Timestamp {
+		return hlc.Timestamp{WallTime: int64(d), Logical: logical}
 	}
-	require.NoError(t, sink.Flush(ctx, zeroTS))
-	sqlDB.CheckQueryResults(t, `SELECT partition, key, value FROM sink ORDER BY PRIMARY KEY sink`,
-		[][]string{
-			{`0`, `v3`, `v0`},
-			{`0`, `v3`, `v1`},
-			{`1`, `v1`, `v0`},
-			{`1`, `v2`, `v0`},
-			{`1`, `v1`, `v1`},
-			{`1`, `v2`, `v1`},
-			{`2`, `v0`, `v0`},
-			{`2`, `v0`, `v1`},
-		},
-	)
-	sqlDB.Exec(t, `TRUNCATE sink`)
+	tests := []struct {
+		resolved   hlc.Timestamp
+		bucketSize time.Duration
+		expected   time.Duration
+	}{
+		// On a bucket boundary, the bucket that just ended is complete.
+		{ts(5*time.Minute, 0), time.Minute, 4 * time.Minute},
+		{ts(2*time.Hour, 0), time.Hour, time.Hour},
+		// Off a boundary, the bucket containing the resolved timestamp isn't.
+		{ts(5*time.Minute+time.Nanosecond, 0), time.Minute, 4 * time.Minute},
+		{ts(5*time.Minute+30*time.Second, 0), time.Minute, 4 * time.Minute},
+		{ts(6*time.Minute-time.Nanosecond, 0), time.Minute, 4 * time.Minute},
+		{ts(6*time.Minute-time.Nanosecond, 7), time.Minute, 4 * time.Minute},
+		{ts(6*time.Minute, 7), time.Minute, 5 * time.Minute},
+	}
+	dataName := func(bucket time.Time) string {
+		return cloudStorageSinkKey{Bucket: bucket, Topic: `foo`, SinkID: `x`, Ext: `.ndjson`}.Filename(0)
+	}
+	for _, test := range tests {
+		complete := time.Unix(0, int64(test.expected)).UTC()
+		for _, bucketStart := range []bool{false, true} {
+			expected := complete.Add(test.bucketSize - time.Nanosecond)
+			if bucketStart {
+				expected = complete
+			}
+			actual := cloudStorageResolvedBucket(test.resolved, test.bucketSize, bucketStart)
+			require.Equal(t, expected, actual, `%s bucketStart=%t`, test.resolved, bucketStart)
 
-	// Emit resolved
-	var e testEncoder
-	require.NoError(t, sink.EmitResolvedTimestamp(ctx, e, zeroTS))
-	require.NoError(t, sink.EmitRow(ctx, table(`foo`), []byte(`foo0`), []byte(`v0`), zeroTS))
-	require.NoError(t, sink.EmitResolvedTimestamp(ctx, e, hlc.Timestamp{WallTime: 1}))
-	require.NoError(t, sink.Flush(ctx, zeroTS))
-	sqlDB.CheckQueryResults(t,
-		`SELECT topic, partition, key, value, resolved FROM sink ORDER BY PRIMARY KEY sink`,
-		[][]string{
-			{`bar`, `0`, ``, ``, `0.000000000,0`},
-			{`bar`, `0`, ``, ``, `0.000000001,0`},
-			{`bar`, `1`, ``, ``, `0.000000000,0`},
-			{`bar`, `1`, ``, ``, `0.000000001,0`},
-			{`bar`, `2`, ``, ``, `0.000000000,0`},
-			{`bar`, `2`, ``, ``, `0.000000001,0`},
-			{`foo`, `0`, ``, ``, `0.000000000,0`},
-			{`foo`, `0`, `foo0`, `v0`, ``},
-			{`foo`, `0`, ``, ``, `0.000000001,0`},
-			{`foo`, `1`, ``, ``, `0.000000000,0`},
-			{`foo`, `1`, ``, ``, `0.000000001,0`},
-			{`foo`, `2`, ``, ``, `0.000000000,0`},
-			{`foo`, `2`, ``, ``, `0.000000001,0`},
+			// The resolved timestamp file sorts after the data files of the
+			// complete bucket and before those of the next one.
+			resolvedName := cloudStorageFormatBucket(actual) + cloudStorageDefaultResolvedSuffix
+			require.True(t, dataName(complete) < resolvedName)
+			require.True(t, resolvedName < dataName(complete.Add(test.bucketSize)))
+		}
+	}
+}
+
+func TestCloudStoragePartition(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	table := &sqlbase.TableDescriptor{
+		Name: `foo`,
+		Columns: []sqlbase.ColumnDescriptor{
+			{Name: `a`}, {Name: `region`}, {Name: `b`},
 		},
-	)
+		PrimaryIndex: sqlbase.IndexDescriptor{ColumnNames: []string{`a`, `region`}},
+	}
+	tests := []struct {
+		column, key, value, partition string
+	}{
+		{`region`, `[1, "us-east"]`, `{"a": 1, "b": 2, "region": "us-east"}`, `us_u002d_east`},
+		{`b`, `[1, "us-east"]`, `{"a": 1, "b": 2, "region": "us-east"}`, `2`},
+		{`b`, `[1, "us-east"]`, `{"a": 1, "b": null, "region": "us-east"}`, `null`},
+		{`b`, `[1, "us-east"]`, `{"a": 1, "b": true, "region": "us-east"}`, `true`},
+		// Deleted rows only have the primary key.
+		{`region`, `[1, "us-east"]`, ``, `us_u002d_east`},
+		{`region`, `[1, "us-east"]`, `{"__crdb__": {"before": null}}`, `us_u002d_east`},
+		{`b`, `[1, "us-east"]`, ``, `null`},
+	}
+	for _, test := range tests {
+		partition, err := cloudStoragePartition(
+			table, test.column, []byte(test.key), []byte(test.value))
+		require.NoError(t, err)
+		require.Equal(t, test.partition, partition, `%s of %s %s`, test.column, test.key, test.value)
+	}
+	_, err := cloudStoragePartition(table, `nope`, []byte(`[1, "us-east"]`), nil)
+	require.EqualError(t, err, `table foo has no column nope for partition_column`)
+
+	key := cloudStorageSinkKey{Topic: `foo`, SchemaID: 2, SinkID: `s`, Ext: `.ndjson`}
+	require.Equal(t, `00010101000000000000000-foo-2-s.ndjson`, key.Filename(0))
+	require.Equal(t, `00010101000000000000000-foo-2-s-3.ndjson`, key.Filename(3))
+	key.Partition = `us_u002d_east`
+	require.Equal(t, `00010101000000000000000-foo-2-us_u002d_east-s-3.ndjson`, key.Filename(3))
 }
 
-// TODO(dan): More extensive cloudStorageSink testing.
-// - multi node cluster
-// - job restarts
-// - ValidationsTest (+ maybe chaos?)
-func TestCloudStorageSink(t *testing.T) {
+func TestCloudStorageSinkJobPrefix(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	ctx := context.Background()
 
 	dir, dirCleanupFn := testutils.TempDir(t)
 	defer dirCleanupFn()
 
-	flushCh := make(chan struct{}, 1)
-	defer close(flushCh)
-	knobs := base.TestingKnobs{DistSQL: &distsqlrun.TestingKnobs{Changefeed: &TestingKnobs{
-		AfterSinkFlush: func() error {
-			select {
-			case flushCh <- struct{}{}:
-			default:
-			}
-			return nil
-		},
-	}}}
+	opts := map[string]string{
+		optFormat:   string(optFormatJSON),
+		optEnvelope: string(optEnvelopeValueOnly),
+	}
+	targets := jobspb.ChangefeedTargets{0: jobspb.ChangefeedTarget{StatementTimeName: `foo`}}
+	s, err := getSink(ctx, `experimental-nodelocal://`+dir+`?bucket_size=1h&job_prefix=true`,
+		opts, &jsonEncoder{}, targets, 7 /* jobID */, nil /* settings */, TestingKnobs{})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
 
-	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{
-		UseDatabase:   "d",
-		ExternalIODir: dir,
-		Knobs:         knobs,
-	})
-	defer s.Stopper().Stop(ctx)
-	sqlDB := sqlutils.MakeSQLRunner(db)
-	sqlDB.Exec(t, `SET CLUSTER SETTING changefeed.experimental_poll_interval = '10ms'`)
-	sqlDB.Exec(t, `CREATE DATABASE d`)
+	foo := &sqlbase.TableDescriptor{Name: `foo`}
+	require.NoError(t, s.EmitRow(ctx, foo, nil, []byte(`{}`), hlc.Timestamp{WallTime: 1}))
+	require.NoError(t, s.Flush(ctx, hlc.Timestamp{WallTime: int64(2 * time.Hour)}))
+	infos, err := ioutil.ReadDir(filepath.Join(dir, `job_7`))
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
 
-	f := makeCloud(s, db, dir, flushCh)
+	// Other params of the sink URI are kept.
+	jobURI, err := cloudStorageJobURI(`s3://bucket/base?AUTH=implicit`, 7)
+	require.NoError(t, err)
+	require.Equal(t, `s3://bucket/base/job_7?AUTH=implicit`, jobURI)
+}
 
-	sqlDB.Exec(t, `CREATE TABLE foo (a INT PRIMARY KEY)`)
-	sqlDB.Exec(t, `INSERT INTO foo VALUES (1)`)
+func TestSinkRetryBudget(t *testing.T) {
+	defer leaktest.AfterTest(t)()
 
-	foo := f.Feed(t, `CREATE CHANGEFEED FOR foo WITH resolved, envelope=value_only`)
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	sinkErr := &retryableSinkError{cause: errors.New(`boom`)}
 
-	sqlDB.Exec(t, `ALTER TABLE foo ADD COLUMN b STRING`)
-	sqlDB.Exec(t, `INSERT INTO foo VALUES (2, 'b')`)
+	// Without the param, there's no limit.
+	b, err := makeSinkRetryBudget(`kafka://nope`, ts(1))
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, b.onRetryableError(sinkErr, ts(1)))
+	}
 
-	assertPayloads(t, foo, []string{
-		`foo: ->{"a": 1}`,
-		`foo: ->{"a": 2, "b": "b"}`,
-	})
+	b, err = makeSinkRetryBudget(`kafka://nope?retry_budget=2`, ts(1))
+	require.NoError(t, err)
+	require.NoError(t, b.onRetryableError(sinkErr, ts(1)))
+	require.NoError(t, b.onRetryableError(sinkErr, ts(1)))
+	// Progress in between resets the count.
+	require.NoError(t, b.onRetryableError(sinkErr, ts(2)))
+	require.NoError(t, b.onRetryableError(sinkErr, ts(2)))
+	err = b.onRetryableError(sinkErr, ts(2))
+	require.EqualError(t, err, `giving up after 3 consecutive sink failures without progress `+
+		`(retry_budget=2): retryable sink error: boom`)
+	require.False(t, isRetryableSinkError(err))
+
+	_, err = makeSinkRetryBudget(`kafka://nope?retry_budget=-1`, ts(1))
+	require.EqualError(t, err, `retry_budget must be non-negative: -1`)
+}
+
+func TestGetSinkValidatesCapabilities(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	opts := map[string]string{optFormat: string(optFormatAvro)}
+	_, err := getSink(ctx, `experimental-nodelocal:///foo?bucket_size=1s`, opts,
+		&confluentAvroEncoder{}, nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+	require.EqualError(t, err, `this sink is incompatible with format=experimental_avro`)
+
+	opts = map[string]string{optFormat: string(optFormatJSON), optEnvelope: string(optEnvelopeRow)}
+	_, err = getSink(ctx, `experimental-nodelocal:///foo?bucket_size=1s`, opts,
+		&jsonEncoder{}, nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+	require.EqualError(t, err, `this sink is incompatible with envelope=row`)
+
+	opts = map[string]string{optFormat: string(optFormatAvro)}
+	sink, err := getSink(ctx, ``, opts, &confluentAvroEncoder{},
+		nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+	require.NoError(t, err)
+	require.Equal(t, bufferSinkCapabilities, sink.Capabilities())
+	require.NoError(t, sink.Close())
+
+	noResolved := SinkCapabilities{Formats: []formatType{optFormatJSON}, Envelopes: allEnvelopes}
+	require.NoError(t, noResolved.validate(optFormatJSON, map[string]string{}))
+	require.EqualError(t, noResolved.validate(optFormatJSON, map[string]string{optResolvedTimestamps: ``}),
+		`this sink is incompatible with resolved`)
+}
+
+func TestLocalSinkPath(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+
+	// Outside of a server, any path is allowed.
+	path, err := localSinkPath(`/feed`, nil /* settings */)
+	require.NoError(t, err)
+	require.Equal(t, `/feed`, path)
+
+	// On a server, the path has to be in the external IO dir.
+	settings := cluster.MakeTestingClusterSettings()
+	_, err = localSinkPath(`/feed`, settings)
+	require.EqualError(t, err, `local file access is disabled`)
+	settings.ExternalIODir = dir
+	path, err = localSinkPath(`/feed`, settings)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, `feed`), path)
+	_, err = localSinkPath(`/../feed`, settings)
+	require.EqualError(t, err,
+		`local file access to paths outside of external-io-dir is not allowed`)
 }
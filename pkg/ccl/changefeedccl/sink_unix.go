@@ -0,0 +1,203 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/pkg/errors"
+)
+
+// unixSinkEnabled gates the unix sink, which connects to whatever socket is
+// at the given path on every node.
+var unixSinkEnabled = settings.RegisterBoolSetting(
+	"changefeed.unix_sink.enabled",
+	"if set, changefeeds can emit to Unix domain sockets in the external IO dir",
+	false,
+)
+
+const (
+	unixDialTimeout = 10 * time.Second
+	// unixWriteTimeout bounds every write to the socket, so that a consumer
+	// that stops reading can't block the changefeed forever.
+	unixWriteTimeout = 10 * time.Second
+)
+
+// The first byte of every unix sink frame is its kind.
+const (
+	unixFrameRow      byte = 'r'
+	unixFrameResolved byte = 't'
+)
+
+var unixSinkCapabilities = SinkCapabilities{
+	Formats:   []formatType{optFormatJSON, optFormatAvro, optFormatCloudEvents, optFormatRaw},
+	Envelopes: allEnvelopes,
+	Resolved:  true,
+	KeyFormat: true,
+}
+
+// unixSink streams to a co-located consumer over a Unix domain socket. Every
+// message is a frame, written as a 4-byte big-endian length followed by that
+// many bytes. A frame is its kind followed by its fields, each also preceded
+// by a 4-byte big-endian length:
+//
+//   - a row frame (`r`) has the topic (the table name), the key, the value and
+//     the updated timestamp as a decimal
+//   - a resolved frame (`t`) has the resolved timestamp as a decimal and the
+//     payload from the encoder
+//
+// Frames are buffered and Flush writes them to the socket. Nothing is read
+// back, so once Flush returns the frames are in the consumer's receive buffer,
+// not necessarily processed. A write that takes longer than unixWriteTimeout
+// fails. Any error on the socket is retryable, which makes the changefeed
+// reconnect. It is not concurrency-safe; all calls to Emit and
+// Flush should be from the same goroutine.
+type unixSink struct {
+	conn   net.Conn
+	w      *bufio.Writer
+	topics map[string]struct{}
+
+	scratch bytes.Buffer
+}
+
+// makeUnixSink connects to the socket at the given path, which, like the path
+// of any other node-local sink, is confined to the external IO dir. On a
+// server, the changefeed.unix_sink.enabled cluster setting has to be set.
+func makeUnixSink(
+	ctx context.Context, path string, targets jobspb.ChangefeedTargets, settings *cluster.Settings,
+) (Sink, error) {
+	if path == `` {
+		return nil, errors.New(`unix sink requires the path of a socket`)
+	}
+	if settings != nil && !unixSinkEnabled.Get(&settings.SV) {
+		return nil, errors.New(`unix sink is disabled (changefeed.unix_sink.enabled)`)
+	}
+	path, err := localSinkPath(path, settings)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{Timeout: unixDialTimeout}
+	conn, err := dialer.DialContext(ctx, `unix`, path)
+	if err != nil {
+		err = errors.Wrapf(err, `connecting to unix socket: %s`, path)
+		return nil, &retryableSinkError{cause: err}
+	}
+	return newUnixSink(conn, targets), nil
+}
+
+func newUnixSink(conn net.Conn, targets jobspb.ChangefeedTargets) *unixSink {
+	s := &unixSink{
+		conn:   conn,
+		w:      bufio.NewWriter(conn),
+		topics: make(map[string]struct{}),
+	}
+	for _, t := range targets {
+		s.topics[t.StatementTimeName] = struct{}{}
+	}
+	return s
+}
+
+// EmitRow implements the Sink interface.
+func (s *unixSink) EmitRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, updated hlc.Timestamp,
+) error {
+	if _, ok := s.topics[table.Name]; !ok {
+		return errors.Errorf(`cannot emit to undeclared topic: %s`, table.Name)
+	}
+	return s.writeFrame(ctx, unixFrameRow,
+		[]byte(table.Name), key, value, []byte(tree.TimestampToDecimal(updated).Decimal.String()))
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *unixSink) EmitResolvedTimestamp(
+	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
+) error {
+	var noTopic string
+	payload, err := encoder.EncodeResolvedTimestamp(noTopic, resolved)
+	if err != nil {
+		return err
+	}
+	return s.writeFrame(ctx, unixFrameResolved,
+		[]byte(tree.TimestampToDecimal(resolved).Decimal.String()), payload)
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *unixSink) EmitSchemaChange(
+	context.Context, *sqlbase.TableDescriptor, sqlbase.DescriptorVersion, sqlbase.DescriptorVersion,
+) error {
+	return nil
+}
+
+// writeFrame buffers a frame. It's not necessarily written to the socket until
+// the next Flush.
+func (s *unixSink) writeFrame(ctx context.Context, kind byte, fields ...[]byte) error {
+	s.scratch.Reset()
+	s.scratch.WriteByte(kind)
+	for _, field := range fields {
+		// Writes to a bytes.Buffer don't fail.
+		_ = writeLengthPrefixedRecord(&s.scratch, field)
+	}
+	// The frame may not fit in what's left of the buffer, in which case the
+	// buffer is written to the socket.
+	if err := s.setWriteDeadline(ctx); err != nil {
+		return err
+	}
+	if err := writeLengthPrefixedRecord(s.w, s.scratch.Bytes()); err != nil {
+		return &retryableSinkError{cause: err}
+	}
+	return nil
+}
+
+// Flush implements the Sink interface.
+func (s *unixSink) Flush(ctx context.Context, _ hlc.Timestamp) error {
+	// Ignore the timestamp and flush everything, which necessarily means that
+	// we've flushed everything >= the timestamp.
+
+	if err := s.setWriteDeadline(ctx); err != nil {
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		return &retryableSinkError{cause: err}
+	}
+	return nil
+}
+
+// setWriteDeadline sets the deadline of the next write to the socket to
+// unixWriteTimeout from now, or the deadline of ctx if that's sooner.
+func (s *unixSink) setWriteDeadline(ctx context.Context) error {
+	deadline := timeutil.Now().Add(unixWriteTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := s.conn.SetWriteDeadline(deadline); err != nil {
+		return &retryableSinkError{cause: err}
+	}
+	return nil
+}
+
+// Capabilities implements the Sink interface.
+func (s *unixSink) Capabilities() SinkCapabilities {
+	return unixSinkCapabilities
+}
+
+// Close implements the Sink interface.
+func (s *unixSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+// readUnixFrame reads one frame written by a unixSink and returns its kind and
+// fields.
+func readUnixFrame(r io.Reader) (byte, []string, error) {
+	readPrefixed := func(r io.Reader) ([]byte, error) {
+		var prefix [4]byte
+		if _, err := io.ReadFull(r, prefix[:]); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, binary.BigEndian.Uint32(prefix[:]))
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	frame, err := readPrefixed(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	var fields []string
+	for rest := bytes.NewReader(frame[1:]); rest.Len() > 0; {
+		field, err := readPrefixed(rest)
+		if err != nil {
+			return 0, nil, err
+		}
+		fields = append(fields, string(field))
+	}
+	return frame[0], fields, nil
+}
+
+func TestUnixSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	dir, dirCleanupFn := testutils.TempDir(t)
+	defer dirCleanupFn()
+	socket := filepath.Join(dir, `cdc.sock`)
+	targets := jobspb.ChangefeedTargets{1: {StatementTimeName: `t`}}
+
+	// On a server, the sink has to be enabled and the socket has to be in the
+	// external IO dir.
+	settings := cluster.MakeTestingClusterSettings()
+	settings.ExternalIODir = dir
+	_, err := makeUnixSink(ctx, `/cdc.sock`, targets, settings)
+	require.EqualError(t, err, `unix sink is disabled (changefeed.unix_sink.enabled)`)
+	unixSinkEnabled.Override(&settings.SV, true)
+	_, err = makeUnixSink(ctx, `/../cdc.sock`, targets, settings)
+	require.EqualError(t, err,
+		`local file access to paths outside of external-io-dir is not allowed`)
+
+	// Nothing is listening yet.
+	_, err = makeUnixSink(ctx, `/cdc.sock`, targets, settings)
+	require.True(t, isRetryableSinkError(err), `%+v`, err)
+
+	l, err := net.Listen(`unix`, socket)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	s, err := makeUnixSink(ctx, `/cdc.sock`, targets, settings)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+	server := <-accepted
+	defer func() { _ = server.Close() }()
+	r := bufio.NewReader(server)
+
+	table := func(name string) *sqlbase.TableDescriptor {
+		return &sqlbase.TableDescriptor{Name: name}
+	}
+	require.EqualError(t, s.EmitRow(ctx, table(`nope`), nil, nil, zeroTS),
+		`cannot emit to undeclared topic: nope`)
+
+	updated := hlc.Timestamp{WallTime: 1, Logical: 2}
+	require.NoError(t, s.EmitRow(ctx, table(`t`), []byte(`k`), []byte(`v`), updated))
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, testEncoder{}, hlc.Timestamp{WallTime: 3}))
+	require.NoError(t, s.Flush(ctx, zeroTS))
+
+	kind, fields, err := readUnixFrame(r)
+	require.NoError(t, err)
+	require.Equal(t, unixFrameRow, kind)
+	require.Equal(t, []string{`t`, `k`, `v`, `1.0000000002`}, fields)
+	kind, fields, err = readUnixFrame(r)
+	require.NoError(t, err)
+	require.Equal(t, unixFrameResolved, kind)
+	require.Equal(t, []string{`3.0000000000`, `0.000000003,0`}, fields)
+
+	// Once the consumer goes away, the sink fails with a retryable error.
+	require.NoError(t, server.Close())
+	require.NoError(t, s.EmitRow(ctx, table(`t`), []byte(`k`), []byte(`v`), updated))
+	err = s.Flush(ctx, zeroTS)
+	require.True(t, isRetryableSinkError(err), `%+v`, err)
+
+	// A consumer that stops reading can't block the sink past the deadline.
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	stuck, err := makeUnixSink(ctx, `/cdc.sock`, targets, settings)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, stuck.Close()) }()
+	stuckServer := <-accepted
+	defer func() { _ = stuckServer.Close() }()
+	writeCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	big := make([]byte, 4<<20)
+	err = stuck.EmitRow(writeCtx, table(`t`), []byte(`k`), big, updated)
+	if err == nil {
+		err = stuck.Flush(writeCtx, zeroTS)
+	}
+	require.True(t, isRetryableSinkError(err), `%+v`, err)
+}
@@ -0,0 +1,265 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	gojson "encoding/json"
+	"net/url"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/humanizeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// sinkValueLimitPolicyReject fails to emit a row whose value is too large
+	// with a rowSinkError.
+	sinkValueLimitPolicyReject = `reject`
+	// sinkValueLimitPolicyTruncate emits a marker in place of a value that's
+	// too large, see valueLimitSink.
+	sinkValueLimitPolicyTruncate = `truncate`
+)
+
+// sinkValueLimit holds the `max_value_bytes` and `max_value_policy` sink
+// params. Zero maxBytes means no limit.
+type sinkValueLimit struct {
+	maxBytes int64
+	truncate bool
+}
+
+// consumeSinkValueLimit parses and removes the `max_value_bytes` and
+// `max_value_policy` sink params from q.
+func consumeSinkValueLimit(q url.Values) (sinkValueLimit, error) {
+	var l sinkValueLimit
+	if str := q.Get(sinkParamMaxValueBytes); str != `` {
+		var err error
+		if l.maxBytes, err = humanizeutil.ParseBytes(str); err != nil {
+			return sinkValueLimit{}, errors.Wrapf(err, `parsing %s`, sinkParamMaxValueBytes)
+		}
+		if l.maxBytes <= 0 {
+			return sinkValueLimit{}, errors.Errorf(`%s must be positive: %s`,
+				sinkParamMaxValueBytes, str)
+		}
+	}
+	q.Del(sinkParamMaxValueBytes)
+	switch policy := q.Get(sinkParamMaxValuePolicy); policy {
+	case ``, sinkValueLimitPolicyReject, sinkValueLimitPolicyTruncate:
+		if policy != `` && l.maxBytes == 0 {
+			return sinkValueLimit{}, errors.Errorf(`%s requires %s`,
+				sinkParamMaxValuePolicy, sinkParamMaxValueBytes)
+		}
+		l.truncate = policy == sinkValueLimitPolicyTruncate
+	default:
+		return sinkValueLimit{}, errors.Errorf(`unknown %s: %s`, sinkParamMaxValuePolicy, policy)
+	}
+	q.Del(sinkParamMaxValuePolicy)
+	return l, nil
+}
+
+// valueLimitSink wraps a Sink and keeps the values of the rows emitted to it
+// under the `max_value_bytes` sink param, so that one pathological row, like
+// one with a huge JSONB column, can't exceed what's downstream can take and
+// fail the changefeed over and over. It's checked before the row gets to the
+// sink, for every sink, so it's also stricter than the kafka producer's own
+// max message bytes, which counts the key too.
+//
+// With the default `max_value_policy` of `reject`, a row with a larger value
+// fails with a rowSinkError, so it goes to the `dead_letter_sink` if there is
+// one and otherwise fails the changefeed. With `truncate`, which needs
+// `format=json`, the value is replaced with a marker like
+// `{"__crdb__":{"truncated":true,"bytes":<size of the value>}}`, which keeps
+// the key, so a consumer still learns that the row changed and can look it up.
+type valueLimitSink struct {
+	wrapped Sink
+	limit   sinkValueLimit
+}
+
+func makeValueLimitSink(s Sink, limit sinkValueLimit) *valueLimitSink {
+	return &valueLimitSink{wrapped: s, limit: limit}
+}
+
+// truncatedValue is the marker that replaces a value that's too large with
+// `max_value_policy=truncate`.
+type truncatedValue struct {
+	Truncated bool `json:"truncated"`
+	Bytes     int  `json:"bytes"`
+}
+
+// limitValue returns the value to emit for a row, or an error if the row
+// can't be emitted.
+func (s *valueLimitSink) limitValue(
+	ctx context.Context, table *sqlbase.TableDescriptor, value []byte,
+) ([]byte, error) {
+	if int64(len(value)) <= s.limit.maxBytes {
+		return value, nil
+	}
+	if !s.limit.truncate {
+		return nil, &rowSinkError{cause: errors.Errorf(
+			`value of %d bytes is larger than %s of %d`,
+			len(value), sinkParamMaxValueBytes, s.limit.maxBytes)}
+	}
+	log.Warningf(ctx, `truncating value of %d bytes of a row of %s`, len(value), table.Name)
+	return gojson.Marshal(map[string]truncatedValue{
+		jsonMetaSentinel: {Truncated: true, Bytes: len(value)},
+	})
+}
+
+// EmitRow implements the Sink interface.
+func (s *valueLimitSink) EmitRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, updated hlc.Timestamp,
+) error {
+	value, err := s.limitValue(ctx, table, value)
+	if err != nil {
+		return err
+	}
+	return s.wrapped.EmitRow(ctx, table, key, value, updated)
+}
+
+// EmitRowWithPartitionHint implements the PartitionHintEmitter interface.
+func (s *valueLimitSink) EmitRowWithPartitionHint(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	key, value []byte,
+	hint partitionHint,
+	updated hlc.Timestamp,
+) error {
+	value, err := s.limitValue(ctx, table, value)
+	if err != nil {
+		return err
+	}
+	return emitRowWithPartitionHint(ctx, s.wrapped, table, key, value, hint, updated)
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *valueLimitSink) EmitResolvedTimestamp(
+	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
+) error {
+	return s.wrapped.EmitResolvedTimestamp(ctx, encoder, resolved)
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *valueLimitSink) EmitSchemaChange(
+	ctx context.Context,
+	table *sqlbase.TableDescriptor,
+	oldVersion, newVersion sqlbase.DescriptorVersion,
+) error {
+	return s.wrapped.EmitSchemaChange(ctx, table, oldVersion, newVersion)
+}
+
+// Flush implements the Sink interface.
+func (s *valueLimitSink) Flush(ctx context.Context, ts hlc.Timestamp) error {
+	return s.wrapped.Flush(ctx, ts)
+}
+
+// FlushTable implements the TableFlusher interface.
+func (s *valueLimitSink) FlushTable(
+	ctx context.Context, tableName string, ts hlc.Timestamp,
+) error {
+	return flushTable(ctx, s.wrapped, tableName, ts)
+}
+
+// Ping implements the Pinger interface.
+func (s *valueLimitSink) Ping(ctx context.Context) error {
+	return pingSink(ctx, s.wrapped)
+}
+
+// SetHighWater implements the HighWaterSetter interface.
+func (s *valueLimitSink) SetHighWater(highWater hlc.Timestamp) {
+	setSinkHighWater(s.wrapped, highWater)
+}
+
+// EmitFeedLifecycle implements the LifecycleEmitter interface.
+func (s *valueLimitSink) EmitFeedLifecycle(
+	ctx context.Context, phase feedPhase, ts hlc.Timestamp,
+) error {
+	return emitFeedLifecycle(ctx, s.wrapped, phase, ts)
+}
+
+// InflightCount implements the InflightCounter interface.
+func (s *valueLimitSink) InflightCount() int64 {
+	return sinkInflightCount(s.wrapped)
+}
+
+// SetBackfillMode implements the BackfillModeSetter interface.
+func (s *valueLimitSink) SetBackfillMode(backfill bool) {
+	if b, ok := s.wrapped.(BackfillModeSetter); ok {
+		b.SetBackfillMode(backfill)
+	}
+}
+
+// SetMetrics implements the MetricsSetter interface.
+func (s *valueLimitSink) SetMetrics(metrics *Metrics, nodeID roachpb.NodeID) {
+	setSinkMetrics(s.wrapped, metrics, nodeID)
+}
+
+// ResumeFromState implements the StateResumer interface.
+func (s *valueLimitSink) ResumeFromState(ctx context.Context, spans []roachpb.Span) error {
+	return resumeSinkFromState(ctx, s.wrapped, spans)
+}
+
+// TakeChangedTopics implements the ChangedTopicsTracker interface.
+func (s *valueLimitSink) TakeChangedTopics() []string {
+	return takeSinkChangedTopics(s.wrapped)
+}
+
+// NoteChangedTopic implements the ChangedTopicsTracker interface.
+func (s *valueLimitSink) NoteChangedTopic(topic string) {
+	noteSinkChangedTopic(s.wrapped, topic)
+}
+
+// TakeCompletedFiles implements the CompletedFilesTracker interface.
+func (s *valueLimitSink) TakeCompletedFiles() []string {
+	return takeSinkCompletedFiles(s.wrapped)
+}
+
+// NoteCompletedFile implements the CompletedFilesTracker interface.
+func (s *valueLimitSink) NoteCompletedFile(filename string) {
+	noteSinkCompletedFile(s.wrapped, filename)
+}
+
+// CombinesTopicResolved implements the TopicResolvedCombiner interface.
+func (s *valueLimitSink) CombinesTopicResolved() bool {
+	return sinkCombinesTopicResolved(s.wrapped)
+}
+
+// SetCombinedTopicResolved implements the TopicResolvedCombiner interface.
+func (s *valueLimitSink) SetCombinedTopicResolved(topicResolved map[string]hlc.Timestamp) {
+	setSinkCombinedTopicResolved(s.wrapped, topicResolved)
+}
+
+// EmitsTopicResolved implements the TopicResolvedEmitter interface.
+func (s *valueLimitSink) EmitsTopicResolved() bool {
+	return sinkEmitsTopicResolved(s.wrapped)
+}
+
+// EmitTopicResolvedTimestamp implements the TopicResolvedEmitter interface.
+func (s *valueLimitSink) EmitTopicResolvedTimestamp(
+	ctx context.Context, encoder Encoder, topic string, resolved hlc.Timestamp,
+) error {
+	return emitSinkTopicResolvedTimestamp(ctx, s.wrapped, encoder, topic, resolved)
+}
+
+// Capabilities implements the Sink interface.
+func (s *valueLimitSink) Capabilities() SinkCapabilities {
+	return s.wrapped.Capabilities()
+}
+
+// Close implements the Sink interface.
+func (s *valueLimitSink) Close() error {
+	return s.wrapped.Close()
+}
+
+// CloseAndDrain implements the Drainer interface.
+func (s *valueLimitSink) CloseAndDrain(ctx context.Context) ([]MessageRef, error) {
+	return closeAndDrainSink(ctx, s.wrapped)
+}
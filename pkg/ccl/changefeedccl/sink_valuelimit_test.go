@@ -0,0 +1,74 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueLimitSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	for params, expectedErr := range map[string]string{
+		`max_value_bytes=0`:                       `max_value_bytes must be positive: 0`,
+		`max_value_policy=truncate`:               `max_value_policy requires max_value_bytes`,
+		`max_value_bytes=1KiB&max_value_policy=x`: `unknown max_value_policy: x`,
+	} {
+		q, err := url.ParseQuery(params)
+		require.NoError(t, err)
+		_, err = consumeSinkValueLimit(q)
+		require.EqualError(t, err, expectedErr)
+	}
+	q, err := url.ParseQuery(`max_value_bytes=1KiB&max_value_policy=truncate`)
+	require.NoError(t, err)
+	limit, err := consumeSinkValueLimit(q)
+	require.NoError(t, err)
+	require.Empty(t, q)
+	require.Equal(t, sinkValueLimit{maxBytes: 1024, truncate: true}, limit)
+
+	_, err = getSink(ctx, `experimental-metrics://?max_value_bytes=1KiB&max_value_policy=truncate`,
+		map[string]string{}, &rawEncoder{},
+		nil /* targets */, 0 /* jobID */, nil /* settings */, TestingKnobs{})
+	require.EqualError(t, err, `max_value_policy=truncate is only supported with format=json`)
+
+	table := &sqlbase.TableDescriptor{Name: `t`}
+	values := func(b *bufferSink) []string {
+		var values []string
+		for _, row := range b.buf {
+			values = append(values, string(*row[3].Datum.(*tree.DBytes)))
+		}
+		return values
+	}
+
+	// Values up to the limit are left alone. A larger one is rejected as a
+	// row error, which a dead letter sink picks up.
+	buf := &bufferSink{}
+	s := makeValueLimitSink(buf, sinkValueLimit{maxBytes: 4})
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`[1]`), []byte(`1234`), zeroTS))
+	err = s.EmitRow(ctx, table, []byte(`[2]`), []byte(`12345`), zeroTS)
+	require.EqualError(t, err, `value of 5 bytes is larger than max_value_bytes of 4`)
+	require.True(t, isRowSinkError(err))
+	require.Equal(t, []string{`1234`}, values(buf))
+
+	// With truncate, the value is replaced with a marker under the same key.
+	buf = &bufferSink{}
+	s = makeValueLimitSink(buf, sinkValueLimit{maxBytes: 4, truncate: true})
+	require.NoError(t, s.EmitRow(ctx, table, []byte(`[2]`), []byte(`12345`), zeroTS))
+	require.Equal(t, `[2]`, string(*buf.buf[0][2].Datum.(*tree.DBytes)))
+	require.Equal(t, []string{`{"__crdb__":{"truncated":true,"bytes":5}}`}, values(buf))
+	require.NoError(t, s.Close())
+}
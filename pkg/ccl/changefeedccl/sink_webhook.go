@@ -0,0 +1,433 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	gojson "encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/pkg/errors"
+)
+
+const (
+	webhookDefaultHMACHeader = `X-Signature`
+	webhookRequestTimeout    = 30 * time.Second
+	// webhookMaxBatchMessages bounds the number of messages buffered between
+	// Flushes. When it's reached, the batch is sent early.
+	webhookMaxBatchMessages = 1000
+	// webhookTokenRefreshMargin is how long before its expiry an OAuth token is
+	// refreshed, so that it doesn't expire while a request is in flight.
+	webhookTokenRefreshMargin = time.Minute
+)
+
+// webhookSinkConfig holds the sink params of a webhookSink.
+type webhookSinkConfig struct {
+	// hmacSecret, if non-empty, is the key used to sign every request body
+	// with HMAC-SHA256.
+	hmacSecret string
+	// hmacHeader is the request header that holds the signature.
+	hmacHeader string
+	// headers are sent with every request, from the `header.<name>` params.
+	headers http.Header
+	// oauth, if its tokenURL is non-empty, is how the bearer token sent with
+	// every request is fetched.
+	oauth webhookOAuthConfig
+}
+
+// webhookOAuthConfig holds the sink params of the OAuth2 client credentials
+// grant that a webhookSink uses to get a bearer token.
+type webhookOAuthConfig struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	// scope, if non-empty, is the space-separated scopes to request.
+	scope string
+}
+
+// consumeWebhookSinkConfig parses and removes the webhook sink params from q.
+func consumeWebhookSinkConfig(q url.Values) (webhookSinkConfig, error) {
+	var cfg webhookSinkConfig
+	cfg.hmacSecret = q.Get(sinkParamHMACSecret)
+	q.Del(sinkParamHMACSecret)
+	cfg.hmacHeader = q.Get(sinkParamHMACHeader)
+	q.Del(sinkParamHMACHeader)
+	if cfg.hmacHeader == `` {
+		cfg.hmacHeader = webhookDefaultHMACHeader
+	} else if cfg.hmacSecret == `` {
+		return webhookSinkConfig{}, errors.Errorf(`%s requires %s`,
+			sinkParamHMACHeader, sinkParamHMACSecret)
+	}
+
+	cfg.headers = make(http.Header)
+	for param, values := range q {
+		if !strings.HasPrefix(param, sinkParamHeaderPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(param, sinkParamHeaderPrefix)
+		if name == `` {
+			return webhookSinkConfig{}, errors.Errorf(`%s param is missing a header name`,
+				sinkParamHeaderPrefix)
+		}
+		for _, v := range values {
+			cfg.headers.Add(name, v)
+		}
+		q.Del(param)
+	}
+
+	for param, dest := range map[string]*string{
+		sinkParamOAuthTokenURL:     &cfg.oauth.tokenURL,
+		sinkParamOAuthClientID:     &cfg.oauth.clientID,
+		sinkParamOAuthClientSecret: &cfg.oauth.clientSecret,
+		sinkParamOAuthScope:        &cfg.oauth.scope,
+	} {
+		*dest = q.Get(param)
+		q.Del(param)
+	}
+	if cfg.oauth.tokenURL == `` {
+		for param, v := range map[string]string{
+			sinkParamOAuthClientID:     cfg.oauth.clientID,
+			sinkParamOAuthClientSecret: cfg.oauth.clientSecret,
+			sinkParamOAuthScope:        cfg.oauth.scope,
+		} {
+			if v != `` {
+				return webhookSinkConfig{}, errors.Errorf(`%s requires %s`,
+					param, sinkParamOAuthTokenURL)
+			}
+		}
+	} else {
+		if cfg.oauth.clientID == `` || cfg.oauth.clientSecret == `` {
+			return webhookSinkConfig{}, errors.Errorf(`%s requires %s and %s`,
+				sinkParamOAuthTokenURL, sinkParamOAuthClientID, sinkParamOAuthClientSecret)
+		}
+		if _, ok := cfg.headers[`Authorization`]; ok {
+			return webhookSinkConfig{}, errors.Errorf(`%sAuthorization conflicts with %s`,
+				sinkParamHeaderPrefix, sinkParamOAuthTokenURL)
+		}
+	}
+	return cfg, nil
+}
+
+var webhookSinkCapabilities = SinkCapabilities{
+	Formats:   []formatType{optFormatJSON},
+	Envelopes: allEnvelopes,
+	Resolved:  true,
+}
+
+// webhookMessage is one element of the payload of a webhook request. Rows have
+// a topic, a key unless `envelope=value_only` and a value unless they were
+// deleted. Resolved timestamps only have the resolved payload.
+type webhookMessage struct {
+	Topic    string            `json:"topic,omitempty"`
+	Key      gojson.RawMessage `json:"key,omitempty"`
+	Value    gojson.RawMessage `json:"value,omitempty"`
+	Resolved gojson.RawMessage `json:"resolved,omitempty"`
+}
+
+// webhookRequest is the body of a webhook request.
+type webhookRequest struct {
+	Payload []webhookMessage `json:"payload"`
+	Length  int              `json:"length"`
+}
+
+// webhookSink POSTs batches of messages as JSON to an HTTP(S) endpoint. The
+// sink URI is the endpoint with the scheme prefixed by `webhook-`, for example
+// `webhook-https://example.com/changefeed`.
+//
+// EmitRow and EmitResolvedTimestamp only buffer messages, and Flush sends them
+// in one request, which must be answered with a 2xx status. If the
+// `hmac_secret` sink param is set, the hex-encoded HMAC-SHA256 of the request
+// body is sent in the `X-Signature` header, or the one named by the
+// `hmac_header` sink param, so that the endpoint can authenticate the sender.
+// Each `header.<name>=<value>` sink param adds a header to every request.
+//
+// If the `oauth_token_url` sink param is set, every request carries a bearer
+// token fetched from it with the OAuth2 client credentials grant, using the
+// `oauth_client_id`, `oauth_client_secret` and optional `oauth_scope` params.
+// The token is refreshed shortly before it expires, and a request that's
+// rejected with a 401 is retried once with a freshly fetched token. The token
+// is never logged or included in errors.
+//
+// It is not concurrency-safe; all calls to Emit and Flush should be from the
+// same goroutine.
+type webhookSink struct {
+	cfg       webhookSinkConfig
+	endpoint  string
+	transport *http.Transport
+	client    *http.Client
+	topics    map[string]struct{}
+	// tokens is nil unless the sink uses OAuth.
+	tokens *webhookTokenSource
+
+	messages []webhookMessage
+	buf      bytes.Buffer
+}
+
+func makeWebhookSink(
+	u *url.URL, cfg webhookSinkConfig, targets jobspb.ChangefeedTargets,
+) (Sink, error) {
+	endpoint := *u
+	endpoint.Scheme = strings.TrimPrefix(endpoint.Scheme, `webhook-`)
+	// Every query param was a sink param, and the hmac secret in particular
+	// mustn't be sent to the endpoint or show up in errors.
+	endpoint.RawQuery = ``
+	// The sink has its own transport so that Close can release its idle
+	// connections.
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	s := &webhookSink{
+		cfg:       cfg,
+		endpoint:  endpoint.String(),
+		transport: transport,
+		client:    &http.Client{Transport: transport, Timeout: webhookRequestTimeout},
+		topics:    make(map[string]struct{}),
+	}
+	for _, t := range targets {
+		s.topics[t.StatementTimeName] = struct{}{}
+	}
+	if cfg.oauth.tokenURL != `` {
+		s.tokens = &webhookTokenSource{cfg: cfg.oauth, client: s.client}
+	}
+	return s, nil
+}
+
+// EmitRow implements the Sink interface.
+func (s *webhookSink) EmitRow(
+	ctx context.Context, table *sqlbase.TableDescriptor, key, value []byte, _ hlc.Timestamp,
+) error {
+	if _, ok := s.topics[table.Name]; !ok {
+		return errors.Errorf(`cannot emit to undeclared topic: %s`, table.Name)
+	}
+	// The key and value are only valid until the next call to the encoder.
+	return s.buffer(ctx, webhookMessage{
+		Topic: table.Name,
+		Key:   append(gojson.RawMessage(nil), key...),
+		Value: append(gojson.RawMessage(nil), value...),
+	})
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *webhookSink) EmitResolvedTimestamp(
+	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
+) error {
+	var noTopic string
+	payload, err := encoder.EncodeResolvedTimestamp(noTopic, resolved)
+	if err != nil {
+		return err
+	}
+	return s.buffer(ctx, webhookMessage{
+		Resolved: append(gojson.RawMessage(nil), payload...),
+	})
+}
+
+// EmitSchemaChange implements the Sink interface.
+func (s *webhookSink) EmitSchemaChange(
+	context.Context, *sqlbase.TableDescriptor, sqlbase.DescriptorVersion, sqlbase.DescriptorVersion,
+) error {
+	return nil
+}
+
+func (s *webhookSink) buffer(ctx context.Context, msg webhookMessage) error {
+	s.messages = append(s.messages, msg)
+	if len(s.messages) >= webhookMaxBatchMessages {
+		return s.Flush(ctx, hlc.Timestamp{})
+	}
+	return nil
+}
+
+// Flush implements the Sink interface.
+func (s *webhookSink) Flush(ctx context.Context, _ hlc.Timestamp) error {
+	// Ignore the timestamp and flush everything, which necessarily means that
+	// we've flushed everything >= the timestamp.
+	if len(s.messages) == 0 {
+		return nil
+	}
+
+	s.buf.Reset()
+	if err := gojson.NewEncoder(&s.buf).Encode(webhookRequest{
+		Payload: s.messages,
+		Length:  len(s.messages),
+	}); err != nil {
+		return err
+	}
+
+	resp, err := s.post(ctx, false /* refreshToken */)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && s.tokens != nil {
+		// The token may have been revoked or expired early. Retry once with a
+		// new one.
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp, err = s.post(ctx, true /* refreshToken */); err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := errors.Errorf(`POST to %s: %s: %s`, s.endpoint, resp.Status, body)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return &retryableSinkError{cause: err}
+		}
+		return err
+	}
+	// Drain the body so the connection can be reused.
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	s.messages = s.messages[:0]
+	return nil
+}
+
+// post sends the encoded batch in s.buf. If refreshToken is true, a new OAuth
+// token is fetched even if the current one hasn't expired.
+func (s *webhookSink) post(ctx context.Context, refreshToken bool) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(s.buf.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range s.cfg.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set(`Content-Type`, `application/json`)
+	if s.cfg.hmacSecret != `` {
+		req.Header.Set(s.cfg.hmacHeader, webhookSignature(s.cfg.hmacSecret, s.buf.Bytes()))
+	}
+	if s.tokens != nil {
+		token, err := s.tokens.token(ctx, refreshToken)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(`Authorization`, `Bearer `+token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, &retryableSinkError{cause: err}
+	}
+	return resp, nil
+}
+
+// webhookTokenResponse is the body of a successful OAuth2 token response.
+type webhookTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	// ExpiresIn is the lifetime of the token in seconds. It's optional, and
+	// zero means the token doesn't expire as far as the client knows.
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// webhookTokenSource fetches and caches the bearer token of a webhookSink with
+// the OAuth2 client credentials grant. Like the sink, it is not
+// concurrency-safe.
+type webhookTokenSource struct {
+	cfg    webhookOAuthConfig
+	client *http.Client
+
+	accessToken string
+	// expiry, if non-zero, is when accessToken should be refreshed.
+	expiry time.Time
+}
+
+// token returns a bearer token, fetching a new one if there's none yet, the
+// current one is about to expire, or refresh is true.
+func (t *webhookTokenSource) token(ctx context.Context, refresh bool) (string, error) {
+	if !refresh && t.accessToken != `` &&
+		(t.expiry.IsZero() || timeutil.Now().Before(t.expiry)) {
+		return t.accessToken, nil
+	}
+	form := url.Values{`grant_type`: {`client_credentials`}}
+	if t.cfg.scope != `` {
+		form.Set(`scope`, t.cfg.scope)
+	}
+	req, err := http.NewRequest(
+		http.MethodPost, t.cfg.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return ``, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+	req.SetBasicAuth(url.QueryEscape(t.cfg.clientID), url.QueryEscape(t.cfg.clientSecret))
+
+	start := timeutil.Now()
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return ``, &retryableSinkError{cause: errors.Wrap(err, `fetching oauth token`)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// An error response doesn't contain a token, so it's safe to include.
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := errors.Errorf(`fetching oauth token from %s: %s: %s`,
+			t.cfg.tokenURL, resp.Status, body)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return ``, &retryableSinkError{cause: err}
+		}
+		return ``, err
+	}
+	var tokenResp webhookTokenResponse
+	if err := gojson.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		// Don't wrap the decoding error, which could quote the token.
+		return ``, errors.Errorf(`fetching oauth token from %s: malformed response`,
+			t.cfg.tokenURL)
+	}
+	if tokenResp.AccessToken == `` {
+		return ``, errors.Errorf(`fetching oauth token from %s: no access_token in response`,
+			t.cfg.tokenURL)
+	}
+	if tokenResp.TokenType != `` && !strings.EqualFold(tokenResp.TokenType, `bearer`) {
+		return ``, errors.Errorf(`fetching oauth token from %s: unsupported token_type %s`,
+			t.cfg.tokenURL, tokenResp.TokenType)
+	}
+	t.accessToken = tokenResp.AccessToken
+	t.expiry = time.Time{}
+	if tokenResp.ExpiresIn > 0 {
+		// Count the lifetime from when the request was sent, and refresh a bit
+		// early, but never so early that the token is refetched every time.
+		lifetime := time.Duration(tokenResp.ExpiresIn) * time.Second
+		margin := webhookTokenRefreshMargin
+		if margin > lifetime/2 {
+			margin = lifetime / 2
+		}
+		t.expiry = start.Add(lifetime - margin)
+	}
+	return t.accessToken, nil
+}
+
+// webhookSignature returns the hex-encoded HMAC-SHA256 of body.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Capabilities implements the Sink interface.
+func (s *webhookSink) Capabilities() SinkCapabilities {
+	return webhookSinkCapabilities
+}
+
+// Close implements the Sink interface.
+func (s *webhookSink) Close() error {
+	s.messages = nil
+	s.transport.CloseIdleConnections()
+	return nil
+}
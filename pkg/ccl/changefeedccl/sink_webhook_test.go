@@ -0,0 +1,242 @@
+// Copyright 2018 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/licenses/CCL.txt
+
+package changefeedccl
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	type request struct {
+		path, signature, body string
+	}
+	requests := make(chan request, 1)
+	status := int32(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		requests <- request{path: r.URL.String(), signature: r.Header.Get(`X-Sig`), body: string(body)}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	sinkURI := `webhook-` + server.URL + `/feed?hmac_secret=s3cret&hmac_header=X-Sig`
+	u, err := url.Parse(sinkURI)
+	require.NoError(t, err)
+	cfg, err := consumeWebhookSinkConfig(u.Query())
+	require.NoError(t, err)
+	targets := jobspb.ChangefeedTargets{1: {StatementTimeName: `foo`}}
+	s, err := makeWebhookSink(u, cfg, targets)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+
+	// Nothing buffered, nothing sent.
+	require.NoError(t, s.Flush(ctx, hlc.Timestamp{}))
+
+	foo := &sqlbase.TableDescriptor{Name: `foo`}
+	require.NoError(t, s.EmitRow(ctx, foo, []byte(`[1]`), []byte(`{"a": 1}`), hlc.Timestamp{}))
+	require.NoError(t, s.EmitRow(ctx, foo, []byte(`[2]`), nil, hlc.Timestamp{}))
+	require.NoError(t, s.EmitResolvedTimestamp(ctx, makeJSONEncoder(nil), hlc.Timestamp{WallTime: 1}))
+	require.EqualError(t, s.EmitRow(ctx, &sqlbase.TableDescriptor{Name: `bar`}, nil, nil, hlc.Timestamp{}),
+		`cannot emit to undeclared topic: bar`)
+	require.NoError(t, s.Flush(ctx, hlc.Timestamp{}))
+
+	// The whole batch is one request, signed as a whole, and the secret isn't
+	// sent to the endpoint.
+	req := <-requests
+	require.Equal(t, `/feed`, req.path)
+	require.Equal(t, `{"payload":[`+
+		`{"topic":"foo","key":[1],"value":{"a":1}},`+
+		`{"topic":"foo","key":[2]},`+
+		`{"resolved":{"__crdb__":{"resolved":"1.0000000000"}}}`+
+		`],"length":3}`+"\n", req.body)
+	mac := hmac.New(sha256.New, []byte(`s3cret`))
+	_, _ = mac.Write([]byte(req.body))
+	require.Equal(t, hex.EncodeToString(mac.Sum(nil)), req.signature)
+
+	// A failed request is retried with the same batch by the next Flush.
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	require.NoError(t, s.EmitRow(ctx, foo, []byte(`[3]`), []byte(`{"a": 3}`), hlc.Timestamp{}))
+	err = s.Flush(ctx, hlc.Timestamp{})
+	require.True(t, isRetryableSinkError(err), `%+v`, err)
+	failed := <-requests
+	atomic.StoreInt32(&status, http.StatusOK)
+	require.NoError(t, s.Flush(ctx, hlc.Timestamp{}))
+	require.Equal(t, failed, <-requests)
+}
+
+func TestWebhookSinkConfig(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	_, err := consumeWebhookSinkConfig(url.Values{sinkParamHMACHeader: {`X-Sig`}})
+	require.EqualError(t, err, `hmac_header requires hmac_secret`)
+
+	redacted, err := redactSinkURI(`webhook-https://example.com/feed?hmac_secret=s3cret`)
+	require.NoError(t, err)
+	require.False(t, strings.Contains(redacted, `s3cret`), redacted)
+
+	cfg, err := consumeWebhookSinkConfig(url.Values{
+		`header.x-api-key`: {`k`},
+		`header.X-Tag`:     {`a`, `b`},
+	})
+	require.NoError(t, err)
+	require.Equal(t, http.Header{`X-Api-Key`: {`k`}, `X-Tag`: {`a`, `b`}}, cfg.headers)
+	_, err = consumeWebhookSinkConfig(url.Values{`header.`: {`k`}})
+	require.EqualError(t, err, `header. param is missing a header name`)
+
+	_, err = consumeWebhookSinkConfig(url.Values{sinkParamOAuthClientID: {`id`}})
+	require.EqualError(t, err, `oauth_client_id requires oauth_token_url`)
+	_, err = consumeWebhookSinkConfig(url.Values{
+		sinkParamOAuthTokenURL: {`https://example.com/token`},
+		sinkParamOAuthClientID: {`id`},
+	})
+	require.EqualError(t, err, `oauth_token_url requires oauth_client_id and oauth_client_secret`)
+	_, err = consumeWebhookSinkConfig(url.Values{
+		sinkParamOAuthTokenURL:     {`https://example.com/token`},
+		sinkParamOAuthClientID:     {`id`},
+		sinkParamOAuthClientSecret: {`s3cret`},
+		`header.Authorization`:     {`Basic Zm9vOmJhcg==`},
+	})
+	require.EqualError(t, err, `header.Authorization conflicts with oauth_token_url`)
+
+	redacted, err = redactSinkURI(`webhook-https://example.com/feed?` +
+		`oauth_client_secret=s3cret&header.X-Api-Key=k3y`)
+	require.NoError(t, err)
+	require.False(t, strings.Contains(redacted, `s3cret`), redacted)
+	require.False(t, strings.Contains(redacted, `k3y`), redacted)
+}
+
+func TestWebhookSinkOAuth(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	// The token server issues tok1, tok2, ... with a lifetime of expiresIn.
+	var tokensIssued, expiresIn int32
+	expiresIn = 3600
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		require.Equal(t, `client_credentials`, r.PostForm.Get(`grant_type`))
+		require.Equal(t, `feeds`, r.PostForm.Get(`scope`))
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != `id` || secret != `s3cret` {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		n := atomic.AddInt32(&tokensIssued, 1)
+		_, _ = fmt.Fprintf(w, `{"access_token":"tok%d","token_type":"Bearer","expires_in":%d}`,
+			n, atomic.LoadInt32(&expiresIn))
+	}))
+	defer tokenServer.Close()
+
+	// The endpoint only accepts the token in validToken.
+	var validToken atomic.Value
+	validToken.Store(`tok1`)
+	type request struct {
+		authorization, apiKey string
+	}
+	requests := make(chan request, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		auth := r.Header.Get(`Authorization`)
+		requests <- request{authorization: auth, apiKey: r.Header.Get(`X-Api-Key`)}
+		if auth != `Bearer `+validToken.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	makeSink := func(clientSecret string) Sink {
+		q := url.Values{
+			sinkParamOAuthTokenURL:     {tokenServer.URL},
+			sinkParamOAuthClientID:     {`id`},
+			sinkParamOAuthClientSecret: {clientSecret},
+			sinkParamOAuthScope:        {`feeds`},
+			`header.X-Api-Key`:         {`k3y`},
+		}
+		u, err := url.Parse(`webhook-` + server.URL + `?` + q.Encode())
+		require.NoError(t, err)
+		cfg, err := consumeWebhookSinkConfig(u.Query())
+		require.NoError(t, err)
+		s, err := makeWebhookSink(u, cfg, jobspb.ChangefeedTargets{1: {StatementTimeName: `foo`}})
+		require.NoError(t, err)
+		return s
+	}
+	s := makeSink(`s3cret`)
+	defer func() { require.NoError(t, s.Close()) }()
+	foo := &sqlbase.TableDescriptor{Name: `foo`}
+	emitAndFlush := func() error {
+		require.NoError(t, s.EmitRow(ctx, foo, []byte(`[1]`), []byte(`{}`), hlc.Timestamp{}))
+		return s.Flush(ctx, hlc.Timestamp{})
+	}
+
+	// The token is fetched once and reused while it's valid.
+	require.NoError(t, emitAndFlush())
+	require.NoError(t, emitAndFlush())
+	require.Equal(t, request{authorization: `Bearer tok1`, apiKey: `k3y`}, <-requests)
+	require.Equal(t, request{authorization: `Bearer tok1`, apiKey: `k3y`}, <-requests)
+	require.Equal(t, int32(1), atomic.LoadInt32(&tokensIssued))
+
+	// A revoked token is refreshed after a 401, and the request retried once.
+	validToken.Store(`tok2`)
+	require.NoError(t, emitAndFlush())
+	require.Equal(t, `Bearer tok1`, (<-requests).authorization)
+	require.Equal(t, `Bearer tok2`, (<-requests).authorization)
+	require.Equal(t, int32(2), atomic.LoadInt32(&tokensIssued))
+
+	// If the retry is rejected as well, the flush fails without the token.
+	validToken.Store(`nope`)
+	err := emitAndFlush()
+	require.Regexp(t, `401 Unauthorized`, err)
+	require.False(t, strings.Contains(err.Error(), `tok`), err.Error())
+	<-requests
+	<-requests
+
+	// A short-lived token is refreshed before it expires, without a 401.
+	atomic.StoreInt32(&expiresIn, 1)
+	validToken.Store(`tok4`)
+	require.NoError(t, emitAndFlush())
+	require.Equal(t, `Bearer tok3`, (<-requests).authorization)
+	require.Equal(t, `Bearer tok4`, (<-requests).authorization)
+	validToken.Store(`tok5`)
+	time.Sleep(time.Second)
+	require.NoError(t, emitAndFlush())
+	require.Equal(t, `Bearer tok5`, (<-requests).authorization)
+	require.Equal(t, int32(5), atomic.LoadInt32(&tokensIssued))
+
+	// Bad credentials fail the flush.
+	bad := makeSink(`wrong`)
+	defer func() { require.NoError(t, bad.Close()) }()
+	require.NoError(t, bad.EmitRow(ctx, foo, []byte(`[1]`), []byte(`{}`), hlc.Timestamp{}))
+	err = bad.Flush(ctx, hlc.Timestamp{})
+	require.Regexp(t,
+		`fetching oauth token from .*: 401 Unauthorized: {"error":"invalid_client"}`, err)
+	require.False(t, isRetryableSinkError(err), `%+v`, err)
+}
@@ -10,11 +10,15 @@ package changefeedccl
 
 import (
 	"container/heap"
+	"context"
 	"fmt"
 	"strings"
 	"testing"
 
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/keys"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlbase"
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/stretchr/testify/require"
@@ -224,3 +228,93 @@ func TestSpanFrontierHeap(t *testing.T) {
 	require.Equal(t, eBC1, heap.Pop(&sfh))
 	require.Equal(t, eAB2, heap.Pop(&sfh))
 }
+
+func TestTableFrontiers(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	tableSpan := func(tableID uint32, start, end string) roachpb.Span {
+		prefix := roachpb.Key(keys.MakeTablePrefix(tableID))
+		return roachpb.Span{
+			Key:    append(prefix[:len(prefix):len(prefix)], start...),
+			EndKey: append(prefix[:len(prefix):len(prefix)], end...),
+		}
+	}
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	keyA, keyB := roachpb.Key("a"), roachpb.Key("b")
+
+	sf := makeSpanFrontier(
+		tableSpan(52, `a`, `b`), tableSpan(52, `b`, `c`), tableSpan(53, `a`, `b`))
+	sf.Forward(tableSpan(52, `a`, `b`), ts(3))
+	sf.Forward(tableSpan(52, `b`, `c`), ts(2))
+	sf.Forward(tableSpan(53, `a`, `b`), ts(5))
+
+	// Each table is only as resolved as its least resolved span, and one
+	// table can be ahead of the changefeed as a whole.
+	frontiers, err := tableFrontiers(sf)
+	require.NoError(t, err)
+	require.Equal(t, map[sqlbase.ID]hlc.Timestamp{52: ts(2), 53: ts(5)}, frontiers)
+	require.Equal(t, ts(2), sf.Frontier())
+
+	_, err = tableFrontiers(makeSpanFrontier(roachpb.Span{Key: keyA, EndKey: keyB}))
+	require.Regexp(t, `invalid key prefix`, err)
+}
+
+// tableFlushRecordingSink is a bufferSink that records the tables flushed by
+// FlushTable, and the timestamps they were flushed to.
+type tableFlushRecordingSink struct {
+	*bufferSink
+	flushed []string
+}
+
+func (s *tableFlushRecordingSink) FlushTable(
+	_ context.Context, tableName string, ts hlc.Timestamp,
+) error {
+	s.flushed = append(s.flushed, fmt.Sprintf(`%s@%d`, tableName, ts.WallTime))
+	return nil
+}
+
+func TestFlushPriorityTables(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	details := jobspb.ChangefeedDetails{
+		Targets: jobspb.ChangefeedTargets{
+			52: {StatementTimeName: `foo`},
+			53: {StatementTimeName: `bar`},
+		},
+		Opts: map[string]string{optPriorityTables: `foo`},
+	}
+	require.EqualError(t, validatePriorityTables(details.Targets, `foo, nope`),
+		`priority_tables table "nope" is not watched by the changefeed`)
+	priorityTables := makePriorityTables(details)
+	require.Equal(t, map[sqlbase.ID]string{52: `foo`}, priorityTables)
+
+	tableSpan := func(tableID uint32) roachpb.Span {
+		prefix := roachpb.Key(keys.MakeTablePrefix(tableID))
+		return roachpb.Span{Key: prefix, EndKey: prefix.PrefixEnd()}
+	}
+	ts := func(wallTime int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wallTime} }
+	sf := makeSpanFrontier(tableSpan(52), tableSpan(53))
+	sf.Forward(tableSpan(52), ts(3))
+	sf.Forward(tableSpan(53), ts(5))
+	resolvedSpans := []jobspb.ResolvedSpan{
+		{Span: tableSpan(53), Timestamp: ts(5)},
+		{Span: tableSpan(52), Timestamp: ts(3)},
+	}
+
+	// Only foo is flushed, to its own frontier, and only its resolved span is
+	// forwarded. bar's waits for the next full flush.
+	sink := &tableFlushRecordingSink{bufferSink: &bufferSink{}}
+	ret, err := flushPriorityTables(ctx, sink, priorityTables, sf, &resolvedSpans)
+	require.NoError(t, err)
+	require.Equal(t, []jobspb.ResolvedSpan{{Span: tableSpan(52), Timestamp: ts(3)}}, ret)
+	require.Equal(t, []jobspb.ResolvedSpan{{Span: tableSpan(53), Timestamp: ts(5)}}, resolvedSpans)
+	require.Equal(t, []string{`foo@3`}, sink.flushed)
+
+	// With nothing of foo's left, nothing is flushed.
+	ret, err = flushPriorityTables(ctx, sink, priorityTables, sf, &resolvedSpans)
+	require.NoError(t, err)
+	require.Empty(t, ret)
+	require.Len(t, resolvedSpans, 1)
+	require.Equal(t, []string{`foo@3`}, sink.flushed)
+}
@@ -8,6 +8,8 @@
 
 package changefeedccl
 
+import "github.com/cockroachdb/cockroach/pkg/sql/distsqlrun"
+
 // TestingKnobs are the testing knobs for changefeed.
 type TestingKnobs struct {
 	// BeforeEmitRow is called before every sink emit row operation.
@@ -15,7 +17,21 @@ type TestingKnobs struct {
 	// AfterSinkFlush is called after a sink flush operation has returned without
 	// error.
 	AfterSinkFlush func() error
+	// KafkaConfigHook, if non-nil, is applied to the sarama.Config of every
+	// kafka sink.
+	KafkaConfigHook KafkaConfigHook
 }
 
 // ModuleTestingKnobs is part of the base.ModuleTestingKnobs interface.
 func (*TestingKnobs) ModuleTestingKnobs() {}
+
+// changefeedTestingKnobs returns the changefeed knobs among the given DistSQL
+// ones, which may be nil, or zero knobs if there are none.
+func changefeedTestingKnobs(knobs *distsqlrun.TestingKnobs) TestingKnobs {
+	if knobs != nil {
+		if cfKnobs, ok := knobs.Changefeed.(*TestingKnobs); ok {
+			return *cfKnobs
+		}
+	}
+	return TestingKnobs{}
+}
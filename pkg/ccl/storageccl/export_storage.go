@@ -257,6 +257,14 @@ type ExportStorage interface {
 	Size(ctx context.Context, basename string) (int64, error)
 }
 
+// ExportStorageRenamer is implemented by the ExportStorages that can atomically
+// rename a file. Writing a file under a temporary name and then renaming it
+// guarantees that it never appears under its final name partially written.
+type ExportStorageRenamer interface {
+	// Rename moves the named file to newBasename, replacing anything there.
+	Rename(ctx context.Context, oldBasename, newBasename string) error
+}
+
 var (
 	gcsDefault = settings.RegisterStringSetting(
 		cloudstorageGSDefaultKey,
@@ -280,6 +288,7 @@ type localFileStorage struct {
 }
 
 var _ ExportStorage = &localFileStorage{}
+var _ ExportStorageRenamer = &localFileStorage{}
 
 // MakeLocalStorageURI converts a local path (absolute or relative) to a
 // valid nodelocal URI.
@@ -348,6 +357,14 @@ func (l *localFileStorage) Delete(_ context.Context, basename string) error {
 	return os.Remove(filepath.Join(l.base, basename))
 }
 
+func (l *localFileStorage) Rename(_ context.Context, oldBasename, newBasename string) error {
+	oldPath, newPath := filepath.Join(l.base, oldBasename), filepath.Join(l.base, newBasename)
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return errors.Wrapf(err, "renaming local export file %q to %q", oldPath, newPath)
+	}
+	return nil
+}
+
 func (l *localFileStorage) Size(_ context.Context, basename string) (int64, error) {
 	fi, err := os.Stat(filepath.Join(l.base, basename))
 	if err != nil {
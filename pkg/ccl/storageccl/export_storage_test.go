@@ -228,6 +228,36 @@ func TestPutLocal(t *testing.T) {
 	testExportStore(t, dest, false)
 }
 
+func TestLocalRename(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.TODO()
+	p, cleanupFn := testutils.TempDir(t)
+	defer cleanupFn()
+
+	testSettings.ExternalIODir = p
+	dest, err := MakeLocalStorageURI(p)
+	require.NoError(t, err)
+	s, err := ExportStorageFromURI(ctx, dest, testSettings)
+	require.NoError(t, err)
+	defer s.Close()
+
+	renamer, ok := s.(ExportStorageRenamer)
+	require.True(t, ok)
+	require.NoError(t, s.WriteFile(ctx, "a.tmp", bytes.NewReader([]byte("aaa"))))
+	require.NoError(t, s.WriteFile(ctx, "a", bytes.NewReader([]byte("old"))))
+	require.NoError(t, renamer.Rename(ctx, "a.tmp", "a"))
+
+	r, err := s.ReadFile(ctx, "a")
+	require.NoError(t, err)
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "aaa", string(content))
+	_, err = s.Size(ctx, "a.tmp")
+	require.True(t, os.IsNotExist(err))
+}
+
 func TestLocalIOLimits(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 
@@ -539,6 +539,8 @@ func extractValue(mtr interface{}) (float64, error) {
 		return mtr, nil
 	case *metric.Counter:
 		return float64(mtr.Count()), nil
+	case *metric.CounterVec:
+		return float64(mtr.Count()), nil
 	case *metric.Gauge:
 		return float64(mtr.Value()), nil
 	case *metric.GaugeFloat64:
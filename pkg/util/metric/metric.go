@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"sort"
 	"sync/atomic"
 	"time"
 
@@ -79,6 +80,14 @@ type PrometheusExportable interface {
 	ToPrometheusMetric() *prometheusgo.Metric
 }
 
+// PrometheusIterable is a PrometheusExportable that also has children to be
+// exported in the same family, which are told apart by their labels.
+type PrometheusIterable interface {
+	PrometheusExportable
+	// EachChild calls the given closure with each child.
+	EachChild(func(PrometheusExportable))
+}
+
 // GetName returns the metric's name.
 func (m *Metadata) GetName() string {
 	return m.Name
@@ -124,6 +133,7 @@ func (m *Metadata) AddLabel(name, value string) {
 var _ Iterable = &Gauge{}
 var _ Iterable = &GaugeFloat64{}
 var _ Iterable = &Counter{}
+var _ Iterable = &CounterVec{}
 var _ Iterable = &Histogram{}
 
 var _ json.Marshaler = &Gauge{}
@@ -136,6 +146,8 @@ var _ PrometheusExportable = &GaugeFloat64{}
 var _ PrometheusExportable = &Counter{}
 var _ PrometheusExportable = &Histogram{}
 
+var _ PrometheusIterable = &CounterVec{}
+
 type periodic interface {
 	nextTick() time.Time
 	tick()
@@ -361,6 +373,74 @@ func (c *Counter) GetMetadata() Metadata {
 	return baseMetadata
 }
 
+// A CounterVec is a Counter that also counts its increments in a child Counter
+// for each value of a label. The total is recorded like any other Counter, but
+// the children are only exported to Prometheus, as the CounterVec's metric
+// with the label added, so that a label with many values doesn't add a time
+// series for each of them.
+type CounterVec struct {
+	*Counter
+	label string
+
+	mu struct {
+		syncutil.Mutex
+		children map[string]*Counter
+	}
+}
+
+// NewCounterVec creates a CounterVec whose children are told apart by the
+// label with the given name.
+func NewCounterVec(metadata Metadata, label string) *CounterVec {
+	v := &CounterVec{Counter: NewCounter(metadata), label: label}
+	v.mu.children = make(map[string]*Counter)
+	return v
+}
+
+// IncWithLabel increments the total and the child for the given value of the
+// label.
+func (v *CounterVec) IncWithLabel(value string, n int64) {
+	v.Inc(n)
+	v.mu.Lock()
+	child, ok := v.mu.children[value]
+	if !ok {
+		metadata := v.Metadata
+		metadata.Labels = append([]*LabelPair(nil), v.Labels...)
+		metadata.AddLabel(v.label, value)
+		child = NewCounter(metadata)
+		v.mu.children[value] = child
+	}
+	v.mu.Unlock()
+	child.Inc(n)
+}
+
+// Child returns the count of the child for the given value of the label.
+func (v *CounterVec) Child(value string) int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if child, ok := v.mu.children[value]; ok {
+		return child.Count()
+	}
+	return 0
+}
+
+// Inspect calls the given closure with itself.
+func (v *CounterVec) Inspect(f func(interface{})) { f(v) }
+
+// EachChild implements the PrometheusIterable interface. The children are
+// visited in the order of their label values.
+func (v *CounterVec) EachChild(f func(PrometheusExportable)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	values := make([]string, 0, len(v.mu.children))
+	for value := range v.mu.children {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		f(v.mu.children[value])
+	}
+}
+
 // A Gauge atomically stores a single integer value.
 type Gauge struct {
 	Metadata
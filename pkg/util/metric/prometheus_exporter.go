@@ -77,6 +77,15 @@ func (pm *PrometheusExporter) ScrapeRegistry(registry *Registry) {
 
 			family := pm.findOrCreateFamily(prom)
 			family.Metric = append(family.Metric, m)
+
+			if iter, ok := v.(PrometheusIterable); ok {
+				iter.EachChild(func(child PrometheusExportable) {
+					m := child.ToPrometheusMetric()
+					m.Label = append(append([]*prometheusgo.LabelPair(nil), labels...),
+						child.GetLabels()...)
+					family.Metric = append(family.Metric, m)
+				})
+			}
 		}
 	})
 }
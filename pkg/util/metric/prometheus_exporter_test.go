@@ -116,3 +116,55 @@ func TestPrometheusExporter(t *testing.T) {
 		}
 	}
 }
+
+func TestPrometheusExporterCounterVec(t *testing.T) {
+	r := NewRegistry()
+	r.AddLabel("registry", "one")
+	meta := Metadata{Name: "vec.counter"}
+	meta.AddLabel("counter", "vec")
+	v := NewCounterVec(meta, "table")
+	r.AddMetric(v)
+	v.IncWithLabel("foo", 1)
+	v.IncWithLabel("bar", 2)
+	v.IncWithLabel("foo", 3)
+
+	if total := v.Count(); total != 6 {
+		t.Errorf("expected a total of 6, got %d", total)
+	}
+	if foo, baz := v.Child("foo"), v.Child("baz"); foo != 4 || baz != 0 {
+		t.Errorf("expected children of 4 and 0, got %d and %d", foo, baz)
+	}
+
+	pe := MakePrometheusExporter()
+	pe.ScrapeRegistry(r)
+	fam, ok := pe.families["vec_counter"]
+	if !ok {
+		t.Fatal("exporter does not have metric family named vec_counter")
+	}
+	// The total comes first, followed by the children in the order of their
+	// label values.
+	type exported struct {
+		labels string
+		value  float64
+	}
+	expected := []exported{
+		{"registry=one,counter=vec", 6},
+		{"registry=one,counter=vec,table=bar", 2},
+		{"registry=one,counter=vec,table=foo", 4},
+	}
+	if len(fam.Metric) != len(expected) {
+		t.Fatalf("expected %d metrics, got %d", len(expected), len(fam.Metric))
+	}
+	for i, m := range fam.Metric {
+		var labels string
+		for j, l := range m.Label {
+			if j > 0 {
+				labels += ","
+			}
+			labels += l.GetName() + "=" + l.GetValue()
+		}
+		if actual := (exported{labels, m.GetCounter().GetValue()}); actual != expected[i] {
+			t.Errorf("expected metric %d to be %v, got %v", i, expected[i], actual)
+		}
+	}
+}